@@ -28,6 +28,8 @@ final class AppState: ObservableObject {
     private var shouldAutoConnect = true
     /// Startup race guard: replay resize until PTY is fully ready.
     private var resizeReplayTask: Task<Void, Never>?
+    /// Highest output seq rendered for the selected session; reconnects ask only for what follows.
+    private var lastSeq: UInt64 = 0
 
     var pendingApprovals: [SessionEvent] {
         approvals.values.filter { !$0.resolved }.sorted { $0.tsMS > $1.tsMS }
@@ -44,9 +46,7 @@ final class AppState: ObservableObject {
             guard let self else { return }
             self.wsConnected = connected
             if connected, let sid = self.selectedSessionID {
-                self.terminalBridge.clear()
-                self.terminalBridge.prepareForAttach()
-                self.wsClient.sendAttach(sessionID: sid)
+                self.wsClient.sendAttach(sessionID: sid, sinceSeq: self.lastSeq)
                 self.sendResize(cols: self.terminalBridge.currentCols, rows: self.terminalBridge.currentRows)
                 self.scheduleResizeReplay(sessionID: sid)
             }
@@ -238,6 +238,7 @@ final class AppState: ObservableObject {
 
     func attachSession(_ sessionID: String) {
         selectedSessionID = sessionID
+        lastSeq = 0
         terminalBridge.clear()
         terminalBridge.prepareForAttach()
         wsClient.sendAttach(sessionID: sessionID)
@@ -259,6 +260,14 @@ final class AppState: ObservableObject {
         wsClient.sendAction(sessionID: sessionID, kind: kind)
     }
 
+    func sendRejectWithMessage(sessionID: String, message: String) {
+        wsClient.sendRejectWithMessage(sessionID: sessionID, message: message)
+    }
+
+    func sendChoice(sessionID: String, choice: Int) {
+        wsClient.sendChoice(sessionID: sessionID, choice: choice)
+    }
+
     private func scheduleResizeReplay(sessionID: String) {
         resizeReplayTask?.cancel()
         let retryDelaysNS: [UInt64] = [
@@ -285,8 +294,9 @@ final class AppState: ObservableObject {
 
     private func handleWSMessage(_ msg: WSMessage) {
         switch msg {
-        case .termOut(let sessionID, let data, _):
+        case .termOut(let sessionID, let data, let seq):
             if sessionID == selectedSessionID {
+                lastSeq = max(lastSeq, seq)
                 terminalBridge.feed(data)
             }
 
@@ -321,8 +331,14 @@ final class AppState: ObservableObject {
             // Debounce: coalesce rapid updates into a single REST fetch
             debouncedFetchSessions()
 
-        case .attachOK(let sessionID):
+        case .attachOK(let sessionID, let resync):
             if sessionID == selectedSessionID {
+                if resync {
+                    // The requested seq was evicted; a full replay follows.
+                    lastSeq = 0
+                    terminalBridge.clear()
+                    terminalBridge.prepareForAttach()
+                }
                 scheduleResizeReplay(sessionID: sessionID)
             }
 
@@ -63,12 +63,20 @@ struct Session: Codable, Identifiable {
     }
 }
 
+struct ApprovalOption: Identifiable {
+    let index: Int
+    let label: String
+
+    var id: Int { index }
+}
+
 struct SessionEvent: Identifiable {
     let eventID: String
     let sessionID: String
     let serverID: String
     let kind: String
     let promptExcerpt: String?
+    let options: [ApprovalOption]
     let actor: String?
     let tsMS: Int64
     var resolved: Bool
@@ -87,7 +95,7 @@ enum WSMessage {
     case termOut(sessionID: String, data: Data, seq: UInt64)
     case event(SessionEvent)
     case sessionUpdate(SessionUpdatePayload)
-    case attachOK(sessionID: String)
+    case attachOK(sessionID: String, resync: Bool)
     case error(sessionID: String, message: String)
 }
 
@@ -125,7 +133,7 @@ enum WSMessageParser {
             guard let d = dataDict else { return nil }
             return .sessionUpdate(parseSessionUpdate(d, fallbackID: sessionID))
         case "attach_ok":
-            return .attachOK(sessionID: sessionID)
+            return .attachOK(sessionID: sessionID, resync: dataDict?["resync"] as? Bool ?? false)
         case "error":
             let msg = dataDict?["message"] as? String ?? "unknown error"
             return .error(sessionID: sessionID, message: msg)
@@ -145,11 +153,21 @@ enum WSMessageParser {
         return SessionEvent(
             eventID: eventID, sessionID: sessionID, serverID: serverID,
             kind: kind, promptExcerpt: d["prompt_excerpt"] as? String,
+            options: parseApprovalOptions(d["options"]),
             actor: d["actor"] as? String, tsMS: tsMS,
             resolved: d["resolved"] as? Bool ?? false
         )
     }
 
+    private static func parseApprovalOptions(_ raw: Any?) -> [ApprovalOption] {
+        guard let items = raw as? [[String: Any]] else { return [] }
+        return items.compactMap { item in
+            guard let index = (item["index"] as? NSNumber)?.intValue,
+                  let label = item["label"] as? String else { return nil }
+            return ApprovalOption(index: index, label: label)
+        }
+    }
+
     private static func parseSessionUpdate(_ d: [String: Any], fallbackID: String) -> SessionUpdatePayload {
         SessionUpdatePayload(
             sessionID: d["session_id"] as? String ?? fallbackID,
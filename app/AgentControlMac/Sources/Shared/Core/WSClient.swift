@@ -57,8 +57,8 @@ final class WSClient: NSObject, URLSessionWebSocketDelegate, URLSessionDelegate
         }
     }
 
-    func sendAttach(sessionID: String) {
-        sendJSON(["type": "attach", "data": ["session_id": sessionID, "since_seq": 0]])
+    func sendAttach(sessionID: String, sinceSeq: UInt64 = 0) {
+        sendJSON(["type": "attach", "data": ["session_id": sessionID, "since_seq": sinceSeq]])
     }
 
     func sendTermIn(sessionID: String, dataB64: String) {
@@ -73,6 +73,14 @@ final class WSClient: NSObject, URLSessionWebSocketDelegate, URLSessionDelegate
         sendJSON(["type": "action", "session_id": sessionID, "data": ["kind": kind]])
     }
 
+    func sendRejectWithMessage(sessionID: String, message: String) {
+        sendJSON(["type": "action", "session_id": sessionID, "data": ["kind": "reject_with_message", "message": message]])
+    }
+
+    func sendChoice(sessionID: String, choice: Int) {
+        sendJSON(["type": "action", "session_id": sessionID, "data": ["kind": "choose", "choice": choice]])
+    }
+
     private func sendJSON(_ obj: [String: Any]) {
         guard let data = try? JSONSerialization.data(withJSONObject: obj) else { return }
         send(data)
@@ -36,6 +36,8 @@ struct ApprovalPanelView: View {
 struct ApprovalRow: View {
     @EnvironmentObject var appState: AppState
     let event: SessionEvent
+    @State private var showFeedback = false
+    @State private var feedback = ""
 
     var body: some View {
         HStack(spacing: 10) {
@@ -60,6 +62,19 @@ struct ApprovalRow: View {
 
             Spacer()
 
+            if !event.options.isEmpty {
+                Menu("Options") {
+                    ForEach(event.options) { option in
+                        Button("\(option.index). \(option.label)") {
+                            appState.attachSession(event.sessionID)
+                            appState.sendChoice(sessionID: event.sessionID, choice: option.index)
+                        }
+                    }
+                }
+                .controlSize(.small)
+                .fixedSize()
+            }
+
             Button("Approve") {
                 appState.attachSession(event.sessionID)
                 appState.sendAction(sessionID: event.sessionID, kind: "approve")
@@ -75,6 +90,22 @@ struct ApprovalRow: View {
             .buttonStyle(.bordered)
             .tint(.red)
             .controlSize(.small)
+            .contextMenu {
+                Button("Reject with Message…") {
+                    feedback = ""
+                    showFeedback = true
+                }
+            }
+        }
+        .alert("Reject with Message", isPresented: $showFeedback) {
+            TextField("Tell the agent what to do instead", text: $feedback)
+            Button("Cancel", role: .cancel) {}
+            Button("Send") {
+                let message = feedback.trimmingCharacters(in: .whitespacesAndNewlines)
+                guard !message.isEmpty else { return }
+                appState.attachSession(event.sessionID)
+                appState.sendRejectWithMessage(sessionID: event.sessionID, message: message)
+            }
         }
         .padding(8)
         .background(
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"cc-agent/internal/agent"
+)
+
+// runEnroll implements `cc-agent enroll`: it trades a join code for a
+// per-host agent token and saves it under -config-dir for later runs.
+func runEnroll(args []string) int {
+	hostname, _ := os.Hostname()
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	var (
+		controlURL    = fs.String("control-url", getenv("CONTROL_URL", "ws://127.0.0.1:18080/ws/agent"), "control-plane ws url")
+		code          = fs.String("code", getenv("JOIN_CODE", ""), "one-time join code from the tenant owner")
+		serverID      = fs.String("server-id", getenv("SERVER_ID", hostname), "stable server id; the issued token only registers with this id")
+		configDir     = fs.String("config-dir", getenv("CONFIG_DIR", agent.DefaultConfigDir()), "where the credential and host key are stored")
+		tlsSkipVerify = fs.Bool("tls-skip-verify", getenvBool("TLS_SKIP_VERIFY", false), "skip TLS cert verification (e.g. self-signed)")
+		tlsCA         = fs.String("tls-ca", getenv("TLS_CA", ""), "PEM CA bundle to verify the control plane with instead of the system roots")
+		force         = fs.Bool("force", false, "replace an existing enrollment")
+	)
+	_ = fs.Parse(args)
+	if *code == "" || *serverID == "" {
+		slog.Error("enroll needs -code and -server-id")
+		return 2
+	}
+	if _, err := agent.LoadCredentials(*configDir); err == nil && !*force {
+		slog.Error("already enrolled; pass -force to replace", "config_dir", *configDir)
+		return 1
+	}
+	url, err := agent.NormalizeWSURL(*controlURL)
+	if err != nil {
+		slog.Error("bad control-url", "err", err)
+		return 1
+	}
+	key, err := agent.LoadOrCreateHostKey(filepath.Join(*configDir, agent.HostKeyFile))
+	if err != nil {
+		slog.Error("host key", "err", err)
+		return 1
+	}
+	creds, err := agent.Enroll(url, *code, *serverID, key, agent.TLSOptions{SkipVerify: *tlsSkipVerify, CAFile: *tlsCA})
+	if err != nil {
+		slog.Error("enroll failed", "err", err)
+		return 1
+	}
+	if err := agent.SaveCredentials(*configDir, creds); err != nil {
+		slog.Error("save credentials failed", "err", err)
+		return 1
+	}
+	slog.Info("enrolled", "server_id", creds.ServerID, "tenant_id", creds.TenantID, "token_id", creds.TokenID, "config_dir", *configDir)
+	return 0
+}
+
+// applyCredentials fills in the token, server id, control url and host key
+// saved by enroll for every setting not given by flag or env.
+func applyCredentials(dir string, agentToken, serverID, controlURL, hostKeyPath *string) error {
+	creds, err := agent.LoadCredentials(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	given := func(name, env string) bool { return set[name] || os.Getenv(env) != "" }
+	if given("agent-token", "AGENT_TOKEN") {
+		return nil
+	}
+	*agentToken = creds.Token
+	if !given("server-id", "SERVER_ID") {
+		*serverID = creds.ServerID
+	}
+	if !given("control-url", "CONTROL_URL") && creds.ControlURL != "" {
+		*controlURL = creds.ControlURL
+	}
+	if !given("host-key", "HOST_KEY") {
+		*hostKeyPath = filepath.Join(dir, agent.HostKeyFile)
+	}
+	return nil
+}
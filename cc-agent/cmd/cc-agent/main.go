@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
 	"log/slog"
 	"os"
@@ -15,6 +16,9 @@ import (
 
 func main() {
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{})))
+	if len(os.Args) > 1 && os.Args[1] == "enroll" {
+		os.Exit(runEnroll(os.Args[2:]))
+	}
 	hostname, _ := os.Hostname()
 	var (
 		controlURL     = flag.String("control-url", getenv("CONTROL_URL", "ws://127.0.0.1:18080/ws/agent"), "control-plane ws url")
@@ -23,12 +27,23 @@ func main() {
 		tagsCSV        = flag.String("tags", getenv("TAGS", ""), "comma-separated tags")
 		allowRootsCSV  = flag.String("allow-root", getenv("ALLOW_ROOT", ""), "comma-separated allowed repo roots")
 		claudePath     = flag.String("claude-path", getenv("CLAUDE_PATH", "claude-code"), "claude-code executable path")
-		agentToken       = flag.String("agent-token", getenv("AGENT_TOKEN", "agent-dev-token"), "agent bearer token")
-		tlsSkipVerify    = flag.Bool("tls-skip-verify", getenvBool("TLS_SKIP_VERIFY", false), "skip TLS cert verification (e.g. self-signed)")
-		envAllowKeys     = flag.String("env-allow-keys", getenv("ENV_ALLOW_KEYS", ""), "comma-separated allowed env keys")
+		agentToken     = flag.String("agent-token", getenv("AGENT_TOKEN", "agent-dev-token"), "agent bearer token")
+		tlsSkipVerify  = flag.Bool("tls-skip-verify", getenvBool("TLS_SKIP_VERIFY", false), "skip TLS cert verification (e.g. self-signed)")
+		tlsCA          = flag.String("tls-ca", getenv("TLS_CA", ""), "PEM CA bundle to verify the control plane with instead of the system roots")
+		tlsCert        = flag.String("tls-cert", getenv("TLS_CERT", ""), "PEM client certificate for mTLS; cc-control then takes tenant and server id from it")
+		tlsKey         = flag.String("tls-key", getenv("TLS_KEY", ""), "PEM private key for -tls-cert")
+		envAllowKeys   = flag.String("env-allow-keys", getenv("ENV_ALLOW_KEYS", ""), "comma-separated allowed env keys")
 		envAllowPrefix = flag.String("env-allow-prefix", getenv("ENV_ALLOW_PREFIX", "CC_"), "allowed env key prefix")
+		spoolBytes     = flag.Int("spool-bytes", 1<<20, "per-session output kept for replay after reconnect")
+		runtimesPath   = flag.String("runtimes", getenv("RUNTIMES", ""), "runtime profiles json file (overrides -claude-path)")
+		hostKeyPath    = flag.String("host-key", getenv("HOST_KEY", ""), "ed25519 host key file (PEM), created if missing; signs register so tokens can be pinned to this host")
+		configDir      = flag.String("config-dir", getenv("CONFIG_DIR", agent.DefaultConfigDir()), "credentials saved by cc-agent enroll, used unless -agent-token is given")
 	)
 	flag.Parse()
+	if err := applyCredentials(*configDir, agentToken, serverID, controlURL, hostKeyPath); err != nil {
+		slog.Error("invalid enrolled credentials", "err", err)
+		os.Exit(1)
+	}
 
 	roots, err := security.NormalizeRoots(security.ParseCSV(*allowRootsCSV))
 	if err != nil {
@@ -39,6 +54,25 @@ func main() {
 	for _, k := range security.ParseCSV(*envAllowKeys) {
 		allowedKeys[k] = struct{}{}
 	}
+	var (
+		runtimes       []agent.RuntimeProfile
+		defaultRuntime string
+	)
+	if *runtimesPath != "" {
+		runtimes, defaultRuntime, err = agent.LoadRuntimeProfiles(*runtimesPath)
+		if err != nil {
+			slog.Error("invalid runtimes", "err", err)
+			os.Exit(1)
+		}
+	}
+	var hostKey ed25519.PrivateKey
+	if *hostKeyPath != "" {
+		hostKey, err = agent.LoadOrCreateHostKey(*hostKeyPath)
+		if err != nil {
+			slog.Error("invalid host-key", "err", err)
+			os.Exit(1)
+		}
+	}
 
 	mgr := agent.NewSessionManager(agent.Config{
 		ServerID:       *serverID,
@@ -48,6 +82,10 @@ func main() {
 		ClaudePath:     *claudePath,
 		EnvAllowKeys:   allowedKeys,
 		EnvAllowPrefix: *envAllowPrefix,
+		SpoolBytes:     *spoolBytes,
+		Runtimes:       runtimes,
+		DefaultRuntime: defaultRuntime,
+		HostKey:        hostKey,
 	})
 
 	url, err := agent.NormalizeWSURL(*controlURL)
@@ -61,7 +99,12 @@ func main() {
 		Token:          *agentToken,
 		HeartbeatEvery: 5 * time.Second,
 		Manager:        mgr,
-		TLSSkipVerify:  *tlsSkipVerify,
+		TLS: agent.TLSOptions{
+			SkipVerify: *tlsSkipVerify,
+			CAFile:     *tlsCA,
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+		},
 	}
 
 	stop := make(chan struct{})
@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"log/slog"
@@ -10,8 +9,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 type Client struct {
@@ -19,7 +16,7 @@ type Client struct {
 	Token             string
 	HeartbeatEvery    time.Duration
 	Manager           *SessionManager
-	TLSSkipVerify     bool // 自签名证书时设为 true
+	TLS               TLSOptions
 }
 
 func (c *Client) Run(stop <-chan struct{}) error {
@@ -58,12 +55,12 @@ func (c *Client) Run(stop <-chan struct{}) error {
 func (c *Client) runOnce(stop <-chan struct{}) (bool, error) {
 	slog.Info("agent connecting", "control_url", c.URL, "server_id", c.Manager.cfg.ServerID)
 	header := http.Header{}
-	header.Set("Authorization", "Bearer "+c.Token)
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
 	}
-	if c.TLSSkipVerify {
-		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	dialer, err := c.TLS.Dialer()
+	if err != nil {
+		return false, err
 	}
 	conn, _, err := dialer.Dial(c.URL, header)
 	if err != nil {
@@ -84,6 +81,7 @@ func (c *Client) runOnce(stop <-chan struct{}) (bool, error) {
 		}
 	}
 	c.Manager.SetSendFunc(sendFunc)
+	defer c.Manager.Disconnected()
 
 	writerDone := make(chan struct{})
 	go func() {
@@ -127,6 +125,7 @@ func (c *Client) runOnce(stop <-chan struct{}) (bool, error) {
 				return
 			case <-ticker.C:
 				hb := NewEnvelope("heartbeat", c.Manager.cfg.ServerID, "")
+				hb.Data, _ = json.Marshal(c.Manager.HeartbeatPayload())
 				_ = sendFunc(hb)
 			}
 		}
@@ -142,6 +141,13 @@ func (c *Client) runOnce(stop <-chan struct{}) (bool, error) {
 		switch msg.Type {
 		case "register_ok":
 			slog.Info("agent register_ok received", "server_id", c.Manager.cfg.ServerID)
+			var ack RegisterOKPayload
+			_ = json.Unmarshal(msg.Data, &ack)
+			acked := make(map[string]uint64, len(ack.Sessions))
+			for _, s := range ack.Sessions {
+				acked[s.SessionID] = s.LatestSeq
+			}
+			go c.Manager.ResumeOutput(acked)
 		case "session_update", "event":
 		default:
 			if err := c.Manager.Handle(msg); err != nil {
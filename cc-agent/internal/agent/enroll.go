@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// CredentialsFile and HostKeyFile are the names `cc-agent enroll` uses
+	// inside the config dir.
+	CredentialsFile = "agent.json"
+	HostKeyFile     = "host.pem"
+)
+
+// Credentials is the per-host agent token obtained by enrolling.
+type Credentials struct {
+	ControlURL string `json:"control_url"`
+	TenantID   string `json:"tenant_id"`
+	ServerID   string `json:"server_id"`
+	TokenID    string `json:"token_id"`
+	Token      string `json:"token"`
+}
+
+// DefaultConfigDir is where enroll stores credentials unless told otherwise.
+func DefaultConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".cc-agent"
+	}
+	return filepath.Join(dir, "cc-agent")
+}
+
+// Enroll exchanges a one-time join code for an agent token bound to serverID
+// and key. wsURL is the agent ws url; enrollment goes to /api/enroll on the
+// same host.
+func Enroll(wsURL, code, serverID string, key ed25519.PrivateKey, tlsOpts TLSOptions) (Credentials, error) {
+	endpoint, err := enrollURL(wsURL)
+	if err != nil {
+		return Credentials{}, err
+	}
+	p := RegisterPayload{ServerID: serverID}
+	signRegister(&p, key, time.Now())
+	body, _ := json.Marshal(map[string]any{
+		"code":           code,
+		"server_id":      serverID,
+		"host_key":       p.HostKey,
+		"host_key_sig":   p.HostKeySig,
+		"host_key_ts_ms": p.HostKeyTsMS,
+	})
+	client, err := tlsOpts.HTTPClient(15 * time.Second)
+	if err != nil {
+		return Credentials{}, err
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("enroll failed: %s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+	var issued struct {
+		Token    string `json:"token"`
+		TokenID  string `json:"token_id"`
+		TenantID string `json:"tenant_id"`
+	}
+	if err := json.Unmarshal(raw, &issued); err != nil || issued.Token == "" {
+		return Credentials{}, fmt.Errorf("enroll failed: unexpected response %q", raw)
+	}
+	return Credentials{
+		ControlURL: wsURL,
+		TenantID:   issued.TenantID,
+		ServerID:   serverID,
+		TokenID:    issued.TokenID,
+		Token:      issued.Token,
+	}, nil
+}
+
+func enrollURL(wsURL string) (string, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return "", fmt.Errorf("unsupported control url scheme %q", u.Scheme)
+	}
+	u.Path = "/api/enroll"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// SaveCredentials writes c to dir, readable by the owner only.
+func SaveCredentials(dir string, c Credentials) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, CredentialsFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, CredentialsFile))
+}
+
+// LoadCredentials reads the credentials saved in dir. The error wraps
+// os.ErrNotExist when the host has not been enrolled.
+func LoadCredentials(dir string) (Credentials, error) {
+	var c Credentials
+	data, err := os.ReadFile(filepath.Join(dir, CredentialsFile))
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("invalid %s: %w", CredentialsFile, err)
+	}
+	if c.Token == "" {
+		return c, fmt.Errorf("invalid %s: missing token", CredentialsFile)
+	}
+	return c, nil
+}
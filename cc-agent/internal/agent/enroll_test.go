@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnroll_ExchangesCodeAndSavesCredentials(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/enroll" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": "secret", "token_id": "tok-1", "tenant_id": "t1"})
+	}))
+	defer srv.Close()
+
+	dir := filepath.Join(t.TempDir(), "cfg")
+	key, err := LoadOrCreateHostKey(filepath.Join(dir, HostKeyFile))
+	if err != nil {
+		t.Fatalf("host key: %v", err)
+	}
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/agent"
+	creds, err := Enroll(wsURL, "ABCDE-FGHJK", "build-7", key, TLSOptions{})
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if got["code"] != "ABCDE-FGHJK" || got["server_id"] != "build-7" || got["host_key"] == "" || got["host_key_sig"] == "" {
+		t.Fatalf("unexpected enroll request: %#v", got)
+	}
+	if err := SaveCredentials(dir, creds); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, CredentialsFile))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("credentials should be owner-only: %v %v", info.Mode(), err)
+	}
+	loaded, err := LoadCredentials(dir)
+	if err != nil || loaded != creds || loaded.ControlURL != wsURL || loaded.Token != "secret" {
+		t.Fatalf("reload mismatch: %#v err=%v", loaded, err)
+	}
+}
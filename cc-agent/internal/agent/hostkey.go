@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// LoadOrCreateHostKey reads the Ed25519 host key at path, generating and
+// saving one on first start. The control plane can pin an agent token to the
+// key, so keep the file when reinstalling the agent on the same host.
+func LoadOrCreateHostKey(path string) (ed25519.PrivateKey, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createHostKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("host key: expected a PEM PRIVATE KEY block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("host key: not an ed25519 key")
+	}
+	return priv, nil
+}
+
+func createHostKey(path string) (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	// O_EXCL keeps two agents started at once from overwriting each other.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return priv, f.Close()
+}
+
+// signRegister fills in the host key proof of p. The message must match
+// core.HostKeyMessage on the control plane.
+func signRegister(p *RegisterPayload, key ed25519.PrivateKey, now time.Time) {
+	p.HostKeyTsMS = now.UnixMilli()
+	msg := "cc-agent-register\n" + p.ServerID + "\n" + strconv.FormatInt(p.HostKeyTsMS, 10)
+	p.HostKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	p.HostKeySig = base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(msg)))
+}
@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHostKey_PersistsAndSignsRegister(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "host.pem")
+	key, err := LoadOrCreateHostKey(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	again, err := LoadOrCreateHostKey(path)
+	if err != nil || !key.Equal(again) {
+		t.Fatalf("reload should return the same key: err=%v", err)
+	}
+
+	p := RegisterPayload{ServerID: "build"}
+	signRegister(&p, key, time.UnixMilli(1700000000000))
+	pub, _ := base64.StdEncoding.DecodeString(p.HostKey)
+	sig, _ := base64.StdEncoding.DecodeString(p.HostKeySig)
+	msg := "cc-agent-register\nbuild\n" + strconv.FormatInt(p.HostKeyTsMS, 10)
+	if !ed25519.Verify(pub, []byte(msg), sig) {
+		t.Fatal("register signature does not verify")
+	}
+}
@@ -1,19 +1,26 @@
 package agent
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"log"
+	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"cc-agent/internal/pty"
 	"cc-agent/internal/security"
 )
 
+const replayRetryDelay = 50 * time.Millisecond
+
 type Config struct {
 	ServerID       string
 	Hostname       string
@@ -22,6 +29,17 @@ type Config struct {
 	ClaudePath     string
 	EnvAllowKeys   map[string]struct{}
 	EnvAllowPrefix string
+	// Runtimes are the CLIs sessions can be started with. When empty a single
+	// "claude" profile running ClaudePath is used. DefaultRuntime names the
+	// profile used when a start request does not pick one.
+	Runtimes       []RuntimeProfile
+	DefaultRuntime string
+	// SpoolBytes bounds the per-session output kept for replay after a
+	// reconnect. Defaults to 1 MiB.
+	SpoolBytes int
+	// HostKey, when set, signs every register so the control plane can pin
+	// the agent token to this host.
+	HostKey ed25519.PrivateKey
 }
 
 type SessionManager struct {
@@ -29,17 +47,32 @@ type SessionManager struct {
 
 	sendMu   sync.RWMutex
 	sendFunc func(msg Envelope) error
+	// online is set once the control plane acknowledged the registration and
+	// spooled output may be streamed again.
+	online bool
 
 	mu       sync.RWMutex
 	sessions map[string]*pty.Session
 	pending  map[string]struct{}
+	spools   map[string]*outputSpool
+
+	telemetry *telemetrySampler
 }
 
 func NewSessionManager(cfg Config) *SessionManager {
+	if len(cfg.Runtimes) == 0 {
+		cfg.Runtimes = []RuntimeProfile{DefaultRuntimeProfile(cfg.ClaudePath)}
+	}
+	if _, ok := findRuntime(cfg.Runtimes, cfg.DefaultRuntime); !ok {
+		cfg.DefaultRuntime = cfg.Runtimes[0].Name
+	}
 	return &SessionManager{
 		cfg:      cfg,
 		sessions: make(map[string]*pty.Session),
 		pending:  make(map[string]struct{}),
+		spools:   make(map[string]*outputSpool),
+
+		telemetry: newTelemetrySampler(),
 	}
 }
 
@@ -49,6 +82,80 @@ func (m *SessionManager) SetSendFunc(f func(msg Envelope) error) {
 	m.sendFunc = f
 }
 
+// Disconnected drops the send function of a closed connection. Output keeps
+// accumulating in the session spools until ResumeOutput is called.
+func (m *SessionManager) Disconnected() {
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	m.sendFunc = nil
+	m.online = false
+}
+
+// ResumeOutput replays spooled output after a (re)connect. acked maps session
+// IDs to the last seq the control plane already holds; sessions it does not
+// know are replayed from the start of their spool.
+func (m *SessionManager) ResumeOutput(acked map[string]uint64) {
+	m.mu.RLock()
+	spools := make(map[string]*outputSpool, len(m.spools))
+	for id, sp := range m.spools {
+		spools[id] = sp
+	}
+	m.mu.RUnlock()
+
+	for id, sp := range spools {
+		seq := acked[id]
+		if oldest := sp.oldestSeq(); oldest > seq+1 {
+			log.Printf("spool gap session=%s: control plane has seq=%d, oldest spooled seq=%d", id, seq, oldest)
+		}
+		sp.rewind(seq)
+	}
+	m.sendMu.Lock()
+	m.online = true
+	m.sendMu.Unlock()
+
+	for id, sp := range spools {
+		m.drainSpool(id, sp)
+		if !m.isOnline() {
+			log.Printf("replay pty_out interrupted session=%s: disconnected", id)
+			return
+		}
+	}
+}
+
+// drainSpool sends the spooled output of a session and then its pending
+// exit, if any, dropping the spool once the exit is out. The send queue is
+// bounded; back off until it drains rather than leaving the tail of an idle
+// session unsent. It gives up when disconnected, and ResumeOutput picks up
+// the rest after the reconnect.
+func (m *SessionManager) drainSpool(sessionID string, sp *outputSpool) {
+	sp.drainMu.Lock()
+	defer sp.drainMu.Unlock()
+	for m.isOnline() {
+		if sp.flush(m.cfg.ServerID, sessionID, m.send) != nil {
+			time.Sleep(replayRetryDelay)
+			continue
+		}
+		exit := sp.pendingExit()
+		if exit == nil {
+			return
+		}
+		if m.sendExit(sessionID, *exit) == nil {
+			sp.setPendingExit(nil)
+			m.mu.Lock()
+			delete(m.spools, sessionID)
+			m.mu.Unlock()
+			return
+		}
+		time.Sleep(replayRetryDelay)
+	}
+}
+
+func (m *SessionManager) isOnline() bool {
+	m.sendMu.RLock()
+	defer m.sendMu.RUnlock()
+	return m.online && m.sendFunc != nil
+}
+
 func (m *SessionManager) send(msg Envelope) error {
 	m.sendMu.RLock()
 	f := m.sendFunc
@@ -60,7 +167,12 @@ func (m *SessionManager) send(msg Envelope) error {
 }
 
 func (m *SessionManager) RegisterPayload() RegisterPayload {
-	return RegisterPayload{
+	def, _ := findRuntime(m.cfg.Runtimes, m.cfg.DefaultRuntime)
+	runtimes := make([]RuntimeInfo, 0, len(m.cfg.Runtimes))
+	for _, p := range m.cfg.Runtimes {
+		runtimes = append(runtimes, p.info(p.Name == m.cfg.DefaultRuntime))
+	}
+	p := RegisterPayload{
 		ServerID:     m.cfg.ServerID,
 		Hostname:     m.cfg.Hostname,
 		Tags:         append([]string(nil), m.cfg.Tags...),
@@ -68,8 +180,55 @@ func (m *SessionManager) RegisterPayload() RegisterPayload {
 		Arch:         runtime.GOARCH,
 		AgentVersion: "0.1.0",
 		AllowRoots:   append([]string(nil), m.cfg.AllowRoots...),
-		ClaudePath:   m.cfg.ClaudePath,
+		ClaudePath:   def.Command,
+		Runtimes:     runtimes,
+		Sessions:     m.Inventory(),
+	}
+	if m.cfg.HostKey != nil {
+		signRegister(&p, m.cfg.HostKey, time.Now())
+	}
+	return p
+}
+
+// HeartbeatPayload samples host load, memory, disk space under the allow
+// roots and the resource usage of each live session's process tree.
+func (m *SessionManager) HeartbeatPayload() HeartbeatPayload {
+	m.mu.RLock()
+	pids := make(map[string]int, len(m.sessions))
+	for id, sess := range m.sessions {
+		pids[id] = sess.Pid()
 	}
+	m.mu.RUnlock()
+	hb := readHostTelemetry(m.cfg.AllowRoots)
+	hb.PTYs = len(pids)
+	hb.Sessions = m.telemetry.sessionUsage(readProcesses(), os.Getpagesize(), pids, time.Now())
+	return hb
+}
+
+// Inventory reports the live PTY sessions so the control plane can re-adopt
+// them after a reconnect.
+func (m *SessionManager) Inventory() []SessionInventory {
+	m.mu.RLock()
+	out := make([]SessionInventory, 0, len(m.sessions))
+	for id, sess := range m.sessions {
+		out = append(out, SessionInventory{
+			SessionID: id,
+			Seq:       sess.Seq(),
+			Pid:       sess.Pid(),
+			Cwd:       sess.Cwd,
+		})
+	}
+	for id, sp := range m.spools {
+		if _, live := m.sessions[id]; live || sp.pendingExit() == nil {
+			continue
+		}
+		// Exited while disconnected: report it so the control plane waits for
+		// the replayed pty_exit instead of declaring the session lost.
+		out = append(out, SessionInventory{SessionID: id, Exited: true})
+	}
+	m.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].SessionID < out[j].SessionID })
+	return out
 }
 
 func (m *SessionManager) Handle(msg Envelope) error {
@@ -131,6 +290,16 @@ func (m *SessionManager) startSession(sessionID string, req StartSessionPayload)
 		return err
 	}
 
+	runtimeName := strings.TrimSpace(req.Runtime)
+	if runtimeName == "" {
+		runtimeName = m.cfg.DefaultRuntime
+	}
+	rt, ok := findRuntime(m.cfg.Runtimes, runtimeName)
+	if !ok {
+		m.sendError(sessionID, "reject_runtime:unknown runtime "+strconv.Quote(runtimeName))
+		return errors.New("unknown runtime")
+	}
+
 	resumeID := strings.TrimSpace(req.ResumeID)
 	if resumeID != "" {
 		if len(resumeID) > 128 {
@@ -145,47 +314,74 @@ func (m *SessionManager) startSession(sessionID string, req StartSessionPayload)
 				return err
 			}
 		}
+		if len(rt.ResumeArgs) == 0 {
+			m.sendError(sessionID, "reject_resume_id:unsupported_by_runtime")
+			return errors.New("runtime does not support resume")
+		}
 	}
 
-	args := make([]string, 0, 2)
-	if resumeID != "" {
-		args = append(args, "--resume", resumeID)
+	if err := rt.checkArgs(req.Args); err != nil {
+		m.sendError(sessionID, "reject_args:"+err.Error())
+		return err
 	}
 
-	env := security.FilterEnv(req.Env, m.cfg.EnvAllowKeys, m.cfg.EnvAllowPrefix)
-	sess, err := pty.Start(sessionID, req.Cwd, m.cfg.ClaudePath, args, env, req.Cols, req.Rows)
+	args := append(rt.argv(resumeID), req.Args...)
+	env := make(map[string]string, len(rt.Env)+len(req.Env))
+	for k, v := range rt.Env {
+		env[k] = v
+	}
+	for k, v := range security.FilterEnv(req.Env, m.cfg.EnvAllowKeys, m.cfg.EnvAllowPrefix) {
+		env[k] = v
+	}
+	sess, err := pty.Start(sessionID, req.Cwd, rt.Command, args, env, req.Cols, req.Rows)
 	if err != nil {
 		m.sendError(sessionID, "start_failed:"+err.Error())
 		return err
 	}
 
+	spool := newOutputSpool(m.cfg.SpoolBytes)
 	m.mu.Lock()
 	m.sessions[sessionID] = sess
+	m.spools[sessionID] = spool
 	m.mu.Unlock()
 
+	started, _ := json.Marshal(SessionStartedPayload{
+		Runtime: rt.Name,
+		Argv:    append([]string{rt.Command}, args...),
+		Pid:     sess.Pid(),
+	})
+	startedMsg := NewEnvelope("session_started", m.cfg.ServerID, sessionID)
+	startedMsg.Data = started
+	if err := m.send(startedMsg); err != nil {
+		log.Printf("send session_started failed session=%s: %v", sessionID, err)
+	}
+
 	go sess.ReadLoop(func(seq uint64, chunk []byte) {
-		msg := NewEnvelope("pty_out", m.cfg.ServerID, sessionID)
-		msg.Seq = seq
-		msg.DataB64 = base64.StdEncoding.EncodeToString(chunk)
-		if err := m.send(msg); err != nil {
-			log.Printf("send pty_out failed session=%s: %v", sessionID, err)
-		}
+		spool.append(seq, chunk)
+		m.drainSpool(sessionID, spool)
 	}, func(code *int, signal, reason string) {
 		m.mu.Lock()
 		delete(m.sessions, sessionID)
 		m.mu.Unlock()
-		payload, _ := json.Marshal(PTYExitPayload{
+		// The spool is kept until the exit is delivered, after a reconnect if
+		// need be.
+		spool.setPendingExit(&PTYExitPayload{
 			ExitCode: code,
 			Signal:   signal,
 			Reason:   reason,
 		})
-		msg := NewEnvelope("pty_exit", m.cfg.ServerID, sessionID)
-		msg.Data = payload
-		_ = m.send(msg)
+		m.drainSpool(sessionID, spool)
 	})
 	return nil
 }
 
+func (m *SessionManager) sendExit(sessionID string, exit PTYExitPayload) error {
+	payload, _ := json.Marshal(exit)
+	msg := NewEnvelope("pty_exit", m.cfg.ServerID, sessionID)
+	msg.Data = payload
+	return m.send(msg)
+}
+
 func (m *SessionManager) writeSession(sessionID, dataB64 string) error {
 	raw, err := base64.StdEncoding.DecodeString(dataB64)
 	if err != nil {
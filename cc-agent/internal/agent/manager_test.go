@@ -94,3 +94,41 @@ func TestStartSessionMissingSessionID(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+func TestRegisterPayloadReportsLiveSessions(t *testing.T) {
+	root := t.TempDir()
+	roots, err := security.NormalizeRoots([]string{root})
+	if err != nil {
+		t.Fatalf("normalize roots: %v", err)
+	}
+	mgr := NewSessionManager(Config{
+		ServerID:   "srv-test",
+		AllowRoots: roots,
+		ClaudePath: "/bin/cat",
+	})
+	mgr.SetSendFunc(func(msg Envelope) error { return nil })
+
+	if got := mgr.RegisterPayload().Sessions; got == nil || len(got) != 0 {
+		t.Fatalf("expected empty non-nil inventory, got %#v", got)
+	}
+
+	if err := mgr.startSession("s1", StartSessionPayload{Cwd: roots[0], Cols: 80, Rows: 24}); err != nil {
+		t.Fatalf("start session: %v", err)
+	}
+	t.Cleanup(func() {
+		mgr.mu.RLock()
+		sess := mgr.sessions["s1"]
+		mgr.mu.RUnlock()
+		if sess != nil {
+			sess.Stop(100, 200)
+		}
+	})
+
+	inv := mgr.RegisterPayload().Sessions
+	if len(inv) != 1 {
+		t.Fatalf("expected one live session, got %#v", inv)
+	}
+	if inv[0].SessionID != "s1" || inv[0].Pid <= 0 || inv[0].Cwd != roots[0] {
+		t.Fatalf("unexpected inventory entry: %#v", inv[0])
+	}
+}
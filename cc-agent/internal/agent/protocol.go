@@ -33,11 +33,48 @@ type RegisterPayload struct {
 	AgentVersion string   `json:"agent_version"`
 	AllowRoots   []string `json:"allow_roots"`
 	ClaudePath   string   `json:"claude_path"`
+	// Runtimes advertises the CLI profiles this agent can start.
+	Runtimes []RuntimeInfo `json:"runtimes"`
+	// Sessions lists the PTYs that are alive on this agent. It is always sent
+	// (possibly empty) so the control plane can tell it apart from older agents
+	// that do not report an inventory.
+	Sessions []SessionInventory `json:"sessions"`
+	// HostKey, HostKeySig and HostKeyTsMS prove this agent holds its host
+	// key; they are empty when no key is configured.
+	HostKey     string `json:"host_key,omitempty"`
+	HostKeySig  string `json:"host_key_sig,omitempty"`
+	HostKeyTsMS int64  `json:"host_key_ts_ms,omitempty"`
+}
+
+type SessionInventory struct {
+	SessionID string `json:"session_id"`
+	Seq       uint64 `json:"seq"`
+	Pid       int    `json:"pid,omitempty"`
+	Cwd       string `json:"cwd"`
+	// Exited marks a session whose process ended while disconnected; its
+	// spooled output and pty_exit are replayed after register_ok.
+	Exited bool `json:"exited,omitempty"`
+}
+
+// RegisterOKPayload is the control plane's reply to register. Sessions carries
+// the last pty_out seq it holds per session so spooled output can be replayed.
+type RegisterOKPayload struct {
+	HeartbeatIntervalMS int64              `json:"heartbeat_interval_ms"`
+	ServerTimeMS        int64              `json:"server_time_ms"`
+	Sessions            []SessionReplayAck `json:"sessions,omitempty"`
+}
+
+type SessionReplayAck struct {
+	SessionID string `json:"session_id"`
+	LatestSeq uint64 `json:"latest_seq"`
 }
 
 type StartSessionPayload struct {
-	Cwd      string            `json:"cwd"`
-	Cmd      []string          `json:"cmd"`
+	Runtime string   `json:"runtime,omitempty"`
+	Cwd     string   `json:"cwd"`
+	Cmd     []string `json:"cmd"`
+	// Args are extra CLI arguments checked against the runtime's AllowArgs.
+	Args     []string          `json:"args,omitempty"`
 	ResumeID string            `json:"resume_id,omitempty"`
 	Env      map[string]string `json:"env"`
 	Cols     uint16            `json:"cols"`
@@ -55,8 +92,46 @@ type StopSessionPayload struct {
 	Signal      string `json:"signal"`
 }
 
+// SessionStartedPayload reports the process actually started for a session.
+type SessionStartedPayload struct {
+	Runtime string   `json:"runtime"`
+	Argv    []string `json:"argv"`
+	Pid     int      `json:"pid"`
+}
+
 type PTYExitPayload struct {
 	ExitCode *int   `json:"exit_code,omitempty"`
 	Signal   string `json:"signal,omitempty"`
 	Reason   string `json:"reason,omitempty"`
 }
+
+// HeartbeatPayload is the host telemetry sent with every heartbeat. Fields
+// the platform cannot report are left zero.
+type HeartbeatPayload struct {
+	Load1         float64        `json:"load1"`
+	Load5         float64        `json:"load5"`
+	Load15        float64        `json:"load15"`
+	MemTotalBytes uint64         `json:"mem_total_bytes"`
+	MemAvailBytes uint64         `json:"mem_available_bytes"`
+	Disks         []DiskUsage    `json:"disks,omitempty"`
+	PTYs          int            `json:"ptys"`
+	Sessions      []SessionUsage `json:"sessions,omitempty"`
+}
+
+// DiskUsage is the filesystem space under one allow root.
+type DiskUsage struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+}
+
+// SessionUsage sums the resources of a session's process tree. CPUPercent is
+// averaged over the interval since the previous heartbeat.
+type SessionUsage struct {
+	SessionID  string  `json:"session_id"`
+	Pid        int     `json:"pid"`
+	Procs      int     `json:"procs"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+	CPUPercent float64 `json:"cpu_percent"`
+	RSSBytes   uint64  `json:"rss_bytes"`
+}
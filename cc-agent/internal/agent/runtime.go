@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// resumeIDPlaceholder is replaced by the session's resume ID in ResumeArgs.
+const resumeIDPlaceholder = "{resume_id}"
+
+const (
+	maxExtraArgs    = 32
+	maxExtraArgSize = 8 << 10
+)
+
+// RuntimeProfile describes one AI CLI the agent can start.
+type RuntimeProfile struct {
+	Name    string   `json:"name"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// ResumeArgs is appended when a resume ID is given, with every
+	// "{resume_id}" replaced by it, e.g. ["--resume", "{resume_id}"]. Empty
+	// means the runtime cannot resume sessions.
+	ResumeArgs []string `json:"resume_args,omitempty"`
+	// Env holds defaults set before the (filtered) request env is applied.
+	Env map[string]string `json:"env,omitempty"`
+	// AllowArgs lists the extra arguments a start request may add. Anything
+	// not matched is rejected; an empty list allows none.
+	AllowArgs []ArgRule `json:"allow_args,omitempty"`
+}
+
+// ArgRule allows one flag, or positional arguments when Flag is empty. Value
+// is a regexp the whole value must match; a flag without Value takes none.
+type ArgRule struct {
+	Flag  string `json:"flag,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// RuntimeInfo is what the agent advertises for a profile. Env values stay on
+// the host; only their keys are reported.
+type RuntimeInfo struct {
+	Name       string    `json:"name"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args,omitempty"`
+	ResumeArgs []string  `json:"resume_args,omitempty"`
+	EnvKeys    []string  `json:"env_keys,omitempty"`
+	AllowArgs  []ArgRule `json:"allow_args,omitempty"`
+	Default    bool      `json:"default,omitempty"`
+}
+
+type runtimesFile struct {
+	Default  string           `json:"default"`
+	Runtimes []RuntimeProfile `json:"runtimes"`
+}
+
+// DefaultRuntimeProfile is the single profile used when no runtimes file is
+// configured, preserving the -claude-path behaviour.
+func DefaultRuntimeProfile(claudePath string) RuntimeProfile {
+	return RuntimeProfile{
+		Name:       "claude",
+		Command:    claudePath,
+		ResumeArgs: []string{"--resume", resumeIDPlaceholder},
+	}
+}
+
+// LoadRuntimeProfiles reads a runtimes JSON file and returns its profiles and
+// the name of the default one (the first profile unless "default" is set).
+func LoadRuntimeProfiles(path string) ([]RuntimeProfile, string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var f runtimesFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, "", fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := ValidateRuntimeProfiles(f.Runtimes); err != nil {
+		return nil, "", err
+	}
+	def := strings.TrimSpace(f.Default)
+	if def == "" {
+		def = f.Runtimes[0].Name
+	}
+	if _, ok := findRuntime(f.Runtimes, def); !ok {
+		return nil, "", fmt.Errorf("default runtime %q is not defined", def)
+	}
+	return f.Runtimes, def, nil
+}
+
+func ValidateRuntimeProfiles(profiles []RuntimeProfile) error {
+	if len(profiles) == 0 {
+		return errors.New("no runtimes defined")
+	}
+	seen := make(map[string]struct{}, len(profiles))
+	for _, p := range profiles {
+		if strings.TrimSpace(p.Name) == "" || strings.ContainsAny(p.Name, " \t/") {
+			return fmt.Errorf("invalid runtime name %q", p.Name)
+		}
+		if _, dup := seen[p.Name]; dup {
+			return fmt.Errorf("duplicate runtime %q", p.Name)
+		}
+		seen[p.Name] = struct{}{}
+		if strings.TrimSpace(p.Command) == "" {
+			return fmt.Errorf("runtime %q: command is required", p.Name)
+		}
+		if len(p.ResumeArgs) > 0 && !strings.Contains(strings.Join(p.ResumeArgs, " "), resumeIDPlaceholder) {
+			return fmt.Errorf("runtime %q: resume_args must contain %s", p.Name, resumeIDPlaceholder)
+		}
+		for _, rule := range p.AllowArgs {
+			if rule.Flag != "" && !strings.HasPrefix(rule.Flag, "-") {
+				return fmt.Errorf("runtime %q: allow_args flag %q must start with -", p.Name, rule.Flag)
+			}
+			if rule.Flag == "" && rule.Value == "" {
+				return fmt.Errorf("runtime %q: positional allow_args rule needs a value pattern", p.Name)
+			}
+			if _, err := rule.compile(); err != nil {
+				return fmt.Errorf("runtime %q: allow_args %s: %w", p.Name, rule.Flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r ArgRule) compile() (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?:` + r.Value + `)$`)
+}
+
+// matches reports whether value fits the rule. Values with a ".." path
+// segment never match, so a path pattern cannot be walked out of its root.
+func (r ArgRule) matches(value string) bool {
+	for _, seg := range strings.Split(value, "/") {
+		if seg == ".." {
+			return false
+		}
+	}
+	re, err := r.compile()
+	return err == nil && re.MatchString(value)
+}
+
+// checkArgs validates extra start arguments against the allow-list. Flags may
+// be given as "--flag value" or "--flag=value".
+func (p RuntimeProfile) checkArgs(args []string) error {
+	if len(args) > maxExtraArgs {
+		return fmt.Errorf("too many args (max %d)", maxExtraArgs)
+	}
+	rule := func(flag string) (ArgRule, bool) {
+		for _, r := range p.AllowArgs {
+			if r.Flag == flag {
+				return r, true
+			}
+		}
+		return ArgRule{}, false
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) > maxExtraArgSize || strings.ContainsRune(arg, 0) {
+			return fmt.Errorf("arg %d too long or contains NUL", i)
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			r, ok := rule("")
+			if !ok || !r.matches(arg) {
+				return errors.New("positional argument not allowed")
+			}
+			continue
+		}
+		flag, value, hasValue := strings.Cut(arg, "=")
+		r, ok := rule(flag)
+		if !ok {
+			return fmt.Errorf("flag %s not allowed", flag)
+		}
+		if r.Value == "" {
+			if hasValue {
+				return fmt.Errorf("flag %s takes no value", flag)
+			}
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return fmt.Errorf("flag %s requires a value", flag)
+			}
+			i++
+			value = args[i]
+		}
+		if !r.matches(value) {
+			return fmt.Errorf("value for %s not allowed", flag)
+		}
+	}
+	return nil
+}
+
+func findRuntime(profiles []RuntimeProfile, name string) (RuntimeProfile, bool) {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return RuntimeProfile{}, false
+}
+
+// argv returns the arguments for a new process of this runtime.
+func (p RuntimeProfile) argv(resumeID string) []string {
+	args := append([]string(nil), p.Args...)
+	if resumeID == "" {
+		return args
+	}
+	for _, a := range p.ResumeArgs {
+		args = append(args, strings.ReplaceAll(a, resumeIDPlaceholder, resumeID))
+	}
+	return args
+}
+
+func (p RuntimeProfile) info(isDefault bool) RuntimeInfo {
+	keys := make([]string, 0, len(p.Env))
+	for k := range p.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return RuntimeInfo{
+		Name:       p.Name,
+		Command:    p.Command,
+		Args:       append([]string(nil), p.Args...),
+		ResumeArgs: append([]string(nil), p.ResumeArgs...),
+		EnvKeys:    keys,
+		AllowArgs:  append([]ArgRule(nil), p.AllowArgs...),
+		Default:    isDefault,
+	}
+}
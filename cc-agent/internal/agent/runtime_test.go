@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadRuntimeProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtimes.json")
+	body := `{
+  "default": "codex",
+  "runtimes": [
+    {"name": "claude", "command": "claude", "resume_args": ["--resume", "{resume_id}"]},
+    {"name": "codex", "command": "codex", "args": ["--no-alt-screen"], "resume_args": ["resume", "{resume_id}"], "env": {"CODEX_HOME": "/opt/codex"}}
+  ]
+}`
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	profiles, def, err := LoadRuntimeProfiles(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if def != "codex" || len(profiles) != 2 {
+		t.Fatalf("unexpected profiles: default=%q %#v", def, profiles)
+	}
+	if got := profiles[1].argv("abc"); !reflect.DeepEqual(got, []string{"--no-alt-screen", "resume", "abc"}) {
+		t.Fatalf("argv = %#v", got)
+	}
+	if got := profiles[1].argv(""); !reflect.DeepEqual(got, []string{"--no-alt-screen"}) {
+		t.Fatalf("argv without resume = %#v", got)
+	}
+}
+
+func TestValidateRuntimeProfilesRejectsBadProfiles(t *testing.T) {
+	cases := map[string][]RuntimeProfile{
+		"empty":      nil,
+		"no command": {{Name: "x"}},
+		"duplicate":  {{Name: "x", Command: "a"}, {Name: "x", Command: "b"}},
+		"bad resume": {{Name: "x", Command: "a", ResumeArgs: []string{"--resume"}}},
+		"bad name":   {{Name: "a/b", Command: "a"}},
+		"blank name": {{Name: " ", Command: "a"}},
+	}
+	for name, profiles := range cases {
+		if err := ValidateRuntimeProfiles(profiles); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestRegisterPayloadAdvertisesRuntimesWithoutEnvValues(t *testing.T) {
+	mgr := NewSessionManager(Config{
+		ServerID: "srv-test",
+		Runtimes: []RuntimeProfile{
+			{Name: "claude", Command: "/usr/bin/claude", ResumeArgs: []string{"--resume", "{resume_id}"}},
+			{Name: "gemini", Command: "/usr/bin/gemini", Env: map[string]string{"GEMINI_API_KEY": "secret"}},
+		},
+		DefaultRuntime: "gemini",
+	})
+	p := mgr.RegisterPayload()
+	if len(p.Runtimes) != 2 || p.ClaudePath != "/usr/bin/gemini" {
+		t.Fatalf("unexpected payload: %#v", p)
+	}
+	if !p.Runtimes[1].Default || p.Runtimes[0].Default {
+		t.Fatalf("default flag wrong: %#v", p.Runtimes)
+	}
+	raw, _ := json.Marshal(p)
+	if strings.Contains(string(raw), "secret") {
+		t.Fatalf("env values must not be advertised: %s", raw)
+	}
+	if !reflect.DeepEqual(p.Runtimes[1].EnvKeys, []string{"GEMINI_API_KEY"}) {
+		t.Fatalf("env keys = %#v", p.Runtimes[1].EnvKeys)
+	}
+}
+
+func TestDefaultRuntimeUsesClaudePath(t *testing.T) {
+	mgr := NewSessionManager(Config{ServerID: "srv-test", ClaudePath: "/bin/sh"})
+	p := mgr.RegisterPayload()
+	if len(p.Runtimes) != 1 || p.Runtimes[0].Name != "claude" || p.Runtimes[0].Command != "/bin/sh" || !p.Runtimes[0].Default {
+		t.Fatalf("unexpected default runtime: %#v", p.Runtimes)
+	}
+}
+
+func TestStartSessionRejectsUnknownRuntimeAndUnsupportedResume(t *testing.T) {
+	root := t.TempDir()
+	mgr := NewSessionManager(Config{
+		ServerID:   "srv-test",
+		AllowRoots: []string{root},
+		Runtimes:   []RuntimeProfile{{Name: "plain", Command: "/bin/sh"}},
+	})
+	var sent []string
+	mgr.SetSendFunc(func(msg Envelope) error {
+		var payload struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(msg.Data, &payload)
+		sent = append(sent, payload.Message)
+		return nil
+	})
+
+	if err := mgr.startSession("s1", StartSessionPayload{Cwd: root, Runtime: "codex"}); err == nil {
+		t.Fatal("expected unknown runtime to be rejected")
+	}
+	if err := mgr.startSession("s2", StartSessionPayload{Cwd: root, ResumeID: "abc"}); err == nil {
+		t.Fatal("expected resume on a runtime without resume_args to be rejected")
+	}
+	want := []string{`reject_runtime:unknown runtime "codex"`, "reject_resume_id:unsupported_by_runtime"}
+	if !reflect.DeepEqual(sent, want) {
+		t.Fatalf("sent errors = %#v, want %#v", sent, want)
+	}
+}
+
+func TestCheckArgsEnforcesAllowList(t *testing.T) {
+	p := RuntimeProfile{Name: "claude", Command: "claude", AllowArgs: []ArgRule{
+		{Flag: "--model", Value: "opus|sonnet"},
+		{Flag: "--add-dir", Value: "/srv/[a-z0-9/_-]+"},
+		{Flag: "--verbose"},
+		{Value: ".+"},
+	}}
+	ok := [][]string{
+		nil,
+		{"--model", "opus"},
+		{"--model=sonnet", "--verbose"},
+		{"--add-dir", "/srv/repo/sub", "fix the tests"},
+	}
+	for _, args := range ok {
+		if err := p.checkArgs(args); err != nil {
+			t.Errorf("%q: unexpected error: %v", args, err)
+		}
+	}
+	bad := map[string][]string{
+		"unknown flag":    {"--dangerously-skip-permissions"},
+		"bad value":       {"--model", "gpt"},
+		"partial match":   {"--model", "opus; rm -rf /"},
+		"missing value":   {"--model"},
+		"value on switch": {"--verbose=true"},
+		"path escape":     {"--add-dir", "/etc"},
+		"dot-dot escape":  {"--add-dir", "/srv/repo/../../etc"},
+		"dot-dot=value":   {"--add-dir=/srv/../etc"},
+	}
+	for name, args := range bad {
+		if err := p.checkArgs(args); err == nil {
+			t.Errorf("%s: expected %q to be rejected", name, args)
+		}
+	}
+	if err := (RuntimeProfile{Name: "x", Command: "x"}).checkArgs([]string{"hello"}); err == nil {
+		t.Error("profiles without allow_args must reject any extra args")
+	}
+}
+
+func TestStartSessionAppliesAllowedArgsAndReportsArgv(t *testing.T) {
+	root := t.TempDir()
+	mgr := NewSessionManager(Config{
+		ServerID:   "srv-test",
+		AllowRoots: []string{root},
+		Runtimes: []RuntimeProfile{{Name: "sh", Command: "/bin/sh", AllowArgs: []ArgRule{
+			{Flag: "-c", Value: "exit [0-9]"},
+		}}},
+	})
+	msgs := make(chan Envelope, 16)
+	mgr.SetSendFunc(func(msg Envelope) error {
+		msgs <- msg
+		return nil
+	})
+
+	if err := mgr.startSession("s1", StartSessionPayload{Cwd: root, Args: []string{"-c", "cat /etc/passwd"}}); err == nil {
+		t.Fatal("expected disallowed value to be rejected")
+	}
+	msg := <-msgs
+	if msg.Type != "error" || !strings.Contains(string(msg.Data), "reject_args:value for -c not allowed") {
+		t.Fatalf("unexpected rejection: %s %s", msg.Type, msg.Data)
+	}
+
+	if err := mgr.startSession("s2", StartSessionPayload{Cwd: root, Args: []string{"-c", "exit 0"}, Cols: 80, Rows: 24}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	msg = <-msgs
+	var started SessionStartedPayload
+	if err := json.Unmarshal(msg.Data, &started); err != nil || msg.Type != "session_started" {
+		t.Fatalf("expected session_started, got %s %s", msg.Type, msg.Data)
+	}
+	if !reflect.DeepEqual(started.Argv, []string{"/bin/sh", "-c", "exit 0"}) || started.Runtime != "sh" || started.Pid == 0 {
+		t.Fatalf("unexpected session_started payload: %#v", started)
+	}
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"encoding/base64"
+	"sync"
+)
+
+const defaultSpoolBytes = 1 << 20
+
+type spoolChunk struct {
+	seq  uint64
+	data []byte
+}
+
+// outputSpool keeps the most recent PTY chunks of a session, bounded by size,
+// so output produced while the control plane is unreachable can be replayed by
+// seq once the agent reconnects.
+type outputSpool struct {
+	mu       sync.Mutex
+	chunks   []spoolChunk
+	size     int
+	limit    int
+	lastSent uint64
+
+	exit *PTYExitPayload // set when pty_exit could not be delivered
+
+	// drainMu lets one sender at a time deliver the spool, so the exit is
+	// sent once.
+	drainMu sync.Mutex
+}
+
+func newOutputSpool(limit int) *outputSpool {
+	if limit <= 0 {
+		limit = defaultSpoolBytes
+	}
+	return &outputSpool{limit: limit}
+}
+
+func (s *outputSpool) append(seq uint64, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks = append(s.chunks, spoolChunk{seq: seq, data: data})
+	s.size += len(data)
+	drop := 0
+	for s.size > s.limit && drop < len(s.chunks)-1 {
+		s.size -= len(s.chunks[drop].data)
+		drop++
+	}
+	if drop > 0 {
+		s.chunks = append([]spoolChunk(nil), s.chunks[drop:]...)
+	}
+}
+
+// rewind makes the next flush start right after seq, the last chunk the
+// control plane confirmed it holds.
+func (s *outputSpool) rewind(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSent = seq
+}
+
+// flush sends every spooled chunk newer than the last sent one, in order. It
+// stops at the first send failure so the remainder is retried later.
+func (s *outputSpool) flush(serverID, sessionID string, send func(Envelope) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.chunks {
+		if c.seq <= s.lastSent {
+			continue
+		}
+		msg := NewEnvelope("pty_out", serverID, sessionID)
+		msg.Seq = c.seq
+		msg.DataB64 = base64.StdEncoding.EncodeToString(c.data)
+		if err := send(msg); err != nil {
+			return err
+		}
+		s.lastSent = c.seq
+	}
+	return nil
+}
+
+// oldestSeq returns the first seq still held, or 0 when the spool is empty.
+func (s *outputSpool) oldestSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.chunks) == 0 {
+		return 0
+	}
+	return s.chunks[0].seq
+}
+
+func (s *outputSpool) setPendingExit(exit *PTYExitPayload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exit = exit
+}
+
+func (s *outputSpool) pendingExit() *PTYExitPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exit
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var errSendTest = errors.New("send failed")
+
+func TestOutputSpoolEvictsOldestChunksBeyondLimit(t *testing.T) {
+	sp := newOutputSpool(10)
+	sp.append(1, []byte("aaaa"))
+	sp.append(2, []byte("bbbb"))
+	sp.append(3, []byte("cccc"))
+	if got := sp.oldestSeq(); got != 2 {
+		t.Fatalf("expected seq 1 to be evicted, oldest=%d", got)
+	}
+
+	// A single oversized chunk is still kept so the latest output is never lost.
+	sp.append(4, []byte("0123456789abc"))
+	if got := sp.oldestSeq(); got != 4 {
+		t.Fatalf("expected only the oversized chunk to remain, oldest=%d", got)
+	}
+}
+
+func TestOutputSpoolFlushResumesAfterRewindAndFailure(t *testing.T) {
+	sp := newOutputSpool(1024)
+	for seq := uint64(1); seq <= 5; seq++ {
+		sp.append(seq, []byte{byte('0' + seq)})
+	}
+
+	var sent []uint64
+	failAt := uint64(4)
+	send := func(msg Envelope) error {
+		if msg.Seq == failAt {
+			return errSendTest
+		}
+		sent = append(sent, msg.Seq)
+		return nil
+	}
+	sp.rewind(2)
+	if err := sp.flush("srv", "s1", send); err == nil {
+		t.Fatal("expected flush to stop at failing send")
+	}
+	failAt = 0
+	if err := sp.flush("srv", "s1", send); err != nil {
+		t.Fatalf("flush retry: %v", err)
+	}
+	want := []uint64{3, 4, 5}
+	if len(sent) != len(want) {
+		t.Fatalf("sent seqs = %v, want %v", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Fatalf("sent seqs = %v, want %v", sent, want)
+		}
+	}
+}
+
+func TestResumeOutputReplaysGapAndPendingExit(t *testing.T) {
+	mgr := NewSessionManager(Config{ServerID: "srv-test"})
+	sp := newOutputSpool(0)
+	sp.append(1, []byte("one"))
+	sp.append(2, []byte("two"))
+	sp.append(3, []byte("three"))
+	code := 0
+	sp.setPendingExit(&PTYExitPayload{ExitCode: &code, Reason: "exited"})
+	mgr.spools["s1"] = sp
+
+	if inv := mgr.Inventory(); len(inv) != 1 || inv[0].SessionID != "s1" || !inv[0].Exited {
+		t.Fatalf("exited session with undelivered exit should be in inventory, got %#v", inv)
+	}
+
+	var sent []Envelope
+	mgr.SetSendFunc(func(msg Envelope) error {
+		sent = append(sent, msg)
+		return nil
+	})
+	mgr.ResumeOutput(map[string]uint64{"s1": 1})
+
+	if len(sent) != 3 {
+		t.Fatalf("expected 2 pty_out + 1 pty_exit, got %#v", sent)
+	}
+	for i, wantSeq := range []uint64{2, 3} {
+		raw, _ := base64.StdEncoding.DecodeString(sent[i].DataB64)
+		if sent[i].Type != "pty_out" || sent[i].Seq != wantSeq {
+			t.Fatalf("unexpected replay envelope %d: %#v (%q)", i, sent[i], raw)
+		}
+	}
+	if sent[2].Type != "pty_exit" {
+		t.Fatalf("expected pty_exit after replay, got %q", sent[2].Type)
+	}
+	var exit PTYExitPayload
+	if err := json.Unmarshal(sent[2].Data, &exit); err != nil || exit.ExitCode == nil || *exit.ExitCode != 0 {
+		t.Fatalf("unexpected exit payload: %s (%v)", sent[2].Data, err)
+	}
+	if _, ok := mgr.spools["s1"]; ok {
+		t.Fatal("spool should be dropped once the exit is delivered")
+	}
+}
+
+func TestDisconnectedStopsLiveStreaming(t *testing.T) {
+	mgr := NewSessionManager(Config{ServerID: "srv-test"})
+	mgr.SetSendFunc(func(msg Envelope) error { return nil })
+	mgr.ResumeOutput(nil)
+	if !mgr.isOnline() {
+		t.Fatal("expected manager to be online after ResumeOutput")
+	}
+	mgr.Disconnected()
+	if mgr.isOnline() {
+		t.Fatal("expected manager to be offline after Disconnected")
+	}
+}
+
+func TestDrainSpoolRetriesWhileOnline(t *testing.T) {
+	mgr := NewSessionManager(Config{ServerID: "srv-test"})
+	var sent []Envelope
+	calls := 0
+	mgr.SetSendFunc(func(msg Envelope) error {
+		// Every other send hits a full queue.
+		calls++
+		if calls%2 == 1 {
+			return errSendTest
+		}
+		sent = append(sent, msg)
+		return nil
+	})
+	mgr.ResumeOutput(nil)
+
+	// Output and exit arriving after ResumeOutput went past the spool.
+	sp := newOutputSpool(0)
+	mgr.spools["s1"] = sp
+	sp.append(1, []byte("one"))
+	sp.append(2, []byte("two"))
+	code := 1
+	sp.setPendingExit(&PTYExitPayload{ExitCode: &code, Reason: "exited"})
+	mgr.drainSpool("s1", sp)
+
+	if len(sent) != 3 || sent[0].Seq != 1 || sent[1].Seq != 2 || sent[2].Type != "pty_exit" {
+		t.Fatalf("expected both chunks and the exit despite failed sends, got %#v", sent)
+	}
+	if _, ok := mgr.spools["s1"]; ok {
+		t.Fatal("spool should be dropped once the exit is delivered")
+	}
+
+	// Offline, the exit stays pending for the next ResumeOutput.
+	sp = newOutputSpool(0)
+	mgr.spools["s2"] = sp
+	sp.setPendingExit(&PTYExitPayload{ExitCode: &code})
+	mgr.Disconnected()
+	mgr.drainSpool("s2", sp)
+	if sp.pendingExit() == nil {
+		t.Fatal("exit should stay pending while disconnected")
+	}
+}
@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of utime and stime in /proc/<pid>/stat. It
+// is 100 on every mainstream Linux build.
+const clockTicks = 100
+
+// procStat is the part of /proc/<pid>/stat the telemetry needs.
+type procStat struct {
+	Pid      int
+	PPid     int
+	CPUTicks uint64
+	RSSPages uint64
+}
+
+// parseProcStat parses a /proc/<pid>/stat line. The command name may contain
+// spaces and parentheses, so fields are counted from the last ')'.
+func parseProcStat(line string) (procStat, bool) {
+	open := strings.IndexByte(line, '(')
+	closing := strings.LastIndexByte(line, ')')
+	if open <= 0 || closing < open {
+		return procStat{}, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line[:open]))
+	if err != nil {
+		return procStat{}, false
+	}
+	// fields[0] is the state (field 3 in proc(5)).
+	fields := strings.Fields(line[closing+1:])
+	if len(fields) < 22 {
+		return procStat{}, false
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	if rss < 0 {
+		rss = 0
+	}
+	return procStat{Pid: pid, PPid: ppid, CPUTicks: utime + stime, RSSPages: uint64(rss)}, true
+}
+
+// parseLoadAvg parses /proc/loadavg.
+func parseLoadAvg(data string) (load1, load5, load15 float64, ok bool) {
+	fields := strings.Fields(data)
+	if len(fields) < 3 {
+		return 0, 0, 0, false
+	}
+	var err1, err5, err15 error
+	load1, err1 = strconv.ParseFloat(fields[0], 64)
+	load5, err5 = strconv.ParseFloat(fields[1], 64)
+	load15, err15 = strconv.ParseFloat(fields[2], 64)
+	return load1, load5, load15, err1 == nil && err5 == nil && err15 == nil
+}
+
+// parseMemInfo returns MemTotal and MemAvailable from /proc/meminfo in bytes.
+func parseMemInfo(data string) (total, avail uint64) {
+	for _, line := range strings.Split(data, "\n") {
+		key, rest, ok := strings.Cut(line, ":")
+		if !ok || (key != "MemTotal" && key != "MemAvailable") {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if key == "MemTotal" {
+			total = kb * 1024
+		} else {
+			avail = kb * 1024
+		}
+	}
+	return total, avail
+}
+
+// sumProcessTree adds up root and all of its descendants.
+func sumProcessTree(procs map[int]procStat, root int) (n int, cpuTicks, rssPages uint64) {
+	children := make(map[int][]int, len(procs))
+	for pid, p := range procs {
+		children[p.PPid] = append(children[p.PPid], pid)
+	}
+	seen := make(map[int]bool)
+	queue := []int{root}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		p, ok := procs[pid]
+		if !ok || seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		n++
+		cpuTicks += p.CPUTicks
+		rssPages += p.RSSPages
+		queue = append(queue, children[pid]...)
+	}
+	return n, cpuTicks, rssPages
+}
+
+type cpuSample struct {
+	seconds float64
+	at      time.Time
+}
+
+// telemetrySampler remembers each session's CPU time at the previous
+// heartbeat to turn cumulative CPU seconds into a utilization.
+type telemetrySampler struct {
+	mu   sync.Mutex
+	prev map[string]cpuSample
+}
+
+func newTelemetrySampler() *telemetrySampler {
+	return &telemetrySampler{prev: make(map[string]cpuSample)}
+}
+
+// sessionUsage measures the process tree of every session in pids. It
+// returns nil where the process table cannot be read.
+func (t *telemetrySampler) sessionUsage(procs map[int]procStat, pageSize int, pids map[string]int, now time.Time) []SessionUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id := range t.prev {
+		if _, ok := pids[id]; !ok {
+			delete(t.prev, id)
+		}
+	}
+	if procs == nil {
+		return nil
+	}
+	out := make([]SessionUsage, 0, len(pids))
+	for id, pid := range pids {
+		if pid <= 0 {
+			continue
+		}
+		n, ticks, pages := sumProcessTree(procs, pid)
+		if n == 0 {
+			continue
+		}
+		usage := SessionUsage{
+			SessionID:  id,
+			Pid:        pid,
+			Procs:      n,
+			CPUSeconds: float64(ticks) / clockTicks,
+			RSSBytes:   pages * uint64(pageSize),
+		}
+		if prev, ok := t.prev[id]; ok {
+			// Children that exit take their CPU time with them, so the sum
+			// can shrink; report 0 rather than a negative utilization.
+			if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 && usage.CPUSeconds > prev.seconds {
+				usage.CPUPercent = (usage.CPUSeconds - prev.seconds) / elapsed * 100
+			}
+		}
+		t.prev[id] = cpuSample{seconds: usage.CPUSeconds, at: now}
+		out = append(out, usage)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SessionID < out[j].SessionID })
+	return out
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// readHostTelemetry reads load, memory and free disk space under each allow
+// root. Unreadable values are left zero.
+func readHostTelemetry(roots []string) HeartbeatPayload {
+	var hb HeartbeatPayload
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		hb.Load1, hb.Load5, hb.Load15, _ = parseLoadAvg(string(data))
+	}
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		hb.MemTotalBytes, hb.MemAvailBytes = parseMemInfo(string(data))
+	}
+	for _, root := range roots {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(root, &st); err != nil {
+			continue
+		}
+		hb.Disks = append(hb.Disks, DiskUsage{
+			Path:       root,
+			FreeBytes:  st.Bavail * uint64(st.Bsize),
+			TotalBytes: st.Blocks * uint64(st.Bsize),
+		})
+	}
+	return hb
+}
+
+// readProcesses snapshots the process table from /proc.
+func readProcesses() map[int]procStat {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	procs := make(map[int]procStat, len(entries))
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			// The process exited since the directory was listed.
+			continue
+		}
+		if p, ok := parseProcStat(string(data)); ok {
+			procs[p.Pid] = p
+		}
+	}
+	return procs
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package agent
+
+// Host telemetry is read from /proc and only reported on Linux; other
+// platforms still report the number of live PTYs.
+
+func readHostTelemetry(roots []string) HeartbeatPayload {
+	return HeartbeatPayload{}
+}
+
+func readProcesses() map[int]procStat {
+	return nil
+}
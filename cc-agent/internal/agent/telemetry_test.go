@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProcStatHandlesCommandWithSpaces(t *testing.T) {
+	line := "4242 (node (worker) 1) S 4200 4242 4200 34816 4242 4194560 1200 0 0 0 150 50 0 0 20 0 11 0 123456 1099511627776 2560 18446744073709551615 1 1 0 0 0 0 0 16781312 17410 0 0 0 17 3 0 0 0 0 0\n"
+	p, ok := parseProcStat(line)
+	if !ok {
+		t.Fatal("expected stat line to parse")
+	}
+	if p.Pid != 4242 || p.PPid != 4200 || p.CPUTicks != 200 || p.RSSPages != 2560 {
+		t.Fatalf("unexpected stat %#v", p)
+	}
+	if _, ok := parseProcStat("garbage"); ok {
+		t.Fatal("expected garbage to be rejected")
+	}
+}
+
+func TestParseHostFiles(t *testing.T) {
+	l1, l5, l15, ok := parseLoadAvg("0.52 0.58 0.59 2/1200 4242\n")
+	if !ok || l1 != 0.52 || l5 != 0.58 || l15 != 0.59 {
+		t.Fatalf("unexpected loadavg %v %v %v %v", l1, l5, l15, ok)
+	}
+	total, avail := parseMemInfo("MemTotal:       16318480 kB\nMemFree:         1021396 kB\nMemAvailable:    8345172 kB\n")
+	if total != 16318480*1024 || avail != 8345172*1024 {
+		t.Fatalf("unexpected meminfo %d %d", total, avail)
+	}
+}
+
+func TestSessionUsageSumsProcessTreeAndCPUPercent(t *testing.T) {
+	procs := map[int]procStat{
+		1:  {Pid: 1, PPid: 0, CPUTicks: 1000, RSSPages: 100},
+		10: {Pid: 10, PPid: 1, CPUTicks: 100, RSSPages: 10},
+		11: {Pid: 11, PPid: 10, CPUTicks: 50, RSSPages: 5},
+		12: {Pid: 12, PPid: 11, CPUTicks: 50, RSSPages: 5},
+		20: {Pid: 20, PPid: 1, CPUTicks: 700, RSSPages: 70},
+	}
+	sampler := newTelemetrySampler()
+	start := time.Unix(1000, 0)
+	got := sampler.sessionUsage(procs, 4096, map[string]int{"s1": 10, "gone": 99}, start)
+	if len(got) != 1 {
+		t.Fatalf("expected only the live tree, got %#v", got)
+	}
+	if u := got[0]; u.SessionID != "s1" || u.Procs != 3 || u.CPUSeconds != 2 || u.RSSBytes != 20*4096 || u.CPUPercent != 0 {
+		t.Fatalf("unexpected usage %#v", u)
+	}
+
+	procs[12] = procStat{Pid: 12, PPid: 11, CPUTicks: 550, RSSPages: 5}
+	got = sampler.sessionUsage(procs, 4096, map[string]int{"s1": 10}, start.Add(10*time.Second))
+	if got[0].CPUPercent != 50 {
+		t.Fatalf("expected 5s of cpu over 10s = 50%%, got %v", got[0].CPUPercent)
+	}
+	if got := sampler.sessionUsage(nil, 4096, map[string]int{}, start); got != nil || len(sampler.prev) != 0 {
+		t.Fatalf("expected nil usage and forgotten samples, got %#v %#v", got, sampler.prev)
+	}
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TLSOptions controls how the agent reaches the control plane. Files are
+// read on every connect, so renewed certificates apply on the next
+// reconnect.
+type TLSOptions struct {
+	SkipVerify bool // 自签名证书时设为 true
+	// CAFile replaces the system roots with a PEM bundle.
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mTLS.
+	CertFile string
+	KeyFile  string
+}
+
+// Config builds the client TLS config, or nil when the defaults apply.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if !o.SkipVerify && o.CAFile == "" && o.CertFile == "" && o.KeyFile == "" {
+		return nil, nil
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("tls client certificate needs both cert and key")
+	}
+	cfg := &tls.Config{InsecureSkipVerify: o.SkipVerify}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Dialer returns the websocket dialer for the agent connection. Like the
+// enroll client it honors HTTPS_PROXY / NO_PROXY.
+func (o TLSOptions) Dialer() (*websocket.Dialer, error) {
+	cfg, err := o.Config()
+	if err != nil {
+		return nil, err
+	}
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:  cfg,
+	}, nil
+}
+
+// HTTPClient returns an http client with the same TLS and proxy settings.
+func (o TLSOptions) HTTPClient(timeout time.Duration) (*http.Client, error) {
+	cfg, err := o.Config()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.TLSClientConfig = cfg
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
@@ -179,6 +179,23 @@ func (s *Session) IsRunning() bool {
 	return s.cmd != nil && s.cmd.ProcessState == nil
 }
 
+// Pid returns the process id of the session's command, or 0 if unknown.
+func (s *Session) Pid() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cmd == nil || s.cmd.Process == nil {
+		return 0
+	}
+	return s.cmd.Process.Pid
+}
+
+// Seq returns the sequence number of the last chunk read from the PTY.
+func (s *Session) Seq() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seq
+}
+
 func (s *Session) nextSeq() uint64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+
+	"cc-control/internal/core"
+)
+
+// runAudit implements `cc-control audit verify [-pubkey key.pem] <dir>`.
+func runAudit(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: cc-control audit verify [-pubkey key.pem] <dir>")
+		return 2
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	pubPath := fs.String("pubkey", getenv("AUDIT_PUBLIC_KEY", ""), "ed25519 PEM key to check checkpoint signatures with (optional)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cc-control audit verify [-pubkey key.pem] <dir>")
+		return 2
+	}
+	var pub ed25519.PublicKey
+	if *pubPath != "" {
+		key, err := core.LoadAuditPublicKey(*pubPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "load public key:", err)
+			return 2
+		}
+		pub = key
+	}
+	rep, err := core.VerifyAuditDir(fs.Arg(0), pub)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify:", err)
+		return 2
+	}
+	fmt.Printf("files=%d records=%d legacy=%d last_seq=%d checkpoints=%d verified=%d unsigned=%d\n",
+		rep.Files, rep.Records, rep.Legacy, rep.LastSeq, rep.Checkpoints, rep.VerifiedCheckpoints, rep.Unsigned)
+	if pub == nil && rep.Checkpoints > 0 {
+		fmt.Println("checkpoint signatures not checked (no -pubkey)")
+	}
+	for _, p := range rep.Problems {
+		fmt.Println("FAIL", p)
+	}
+	if len(rep.Problems) > 0 {
+		return 1
+	}
+	fmt.Println("OK")
+	return 0
+}
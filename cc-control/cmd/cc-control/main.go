@@ -17,32 +17,109 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{})))
 	var (
 		addr                  = flag.String("addr", ":18080", "http listen address")
+		tlsCert               = flag.String("tls-cert", getenv("TLS_CERT", ""), "PEM certificate to serve HTTPS/WSS on -addr, reloaded on SIGHUP (optional)")
+		tlsKey                = flag.String("tls-key", getenv("TLS_KEY", ""), "PEM private key for -tls-cert")
+		tlsClientCA           = flag.String("tls-client-ca", getenv("TLS_CLIENT_CA", ""), "PEM CA bundle for agent client certificates; enables mTLS agent auth (requires -tls-cert)")
+		tlsDenyList           = flag.String("tls-deny-list", getenv("TLS_DENY_LIST", ""), "file of revoked agent certificate SHA-256 public key fingerprints, reloaded on SIGHUP (requires -tls-client-ca)")
 		uiDir                 = flag.String("ui-dir", "../cc-web", "static ui directory")
 		agentToken            = flag.String("agent-token", getenv("AGENT_TOKEN", "agent-dev-token"), "agent bearer token")
 		uiToken               = flag.String("ui-token", getenv("UI_TOKEN", "admin-dev-token"), "ui bearer token")
 		adminToken            = flag.String("admin-token", getenv("ADMIN_TOKEN", ""), "admin bearer token (optional)")
 		tokenDBPath           = flag.String("token-db", getenv("TOKEN_DB", ""), "sqlite db path for token persistence (optional)")
+		stateDBPath           = flag.String("state-db", getenv("STATE_DB", ""), "sqlite db path for server/session persistence (optional, defaults to -token-db)")
 		auditPath             = flag.String("audit-path", "./audit.jsonl", "audit jsonl path")
 		ringBufferBytes       = flag.Int("ring-buffer-bytes", 128*1024, "session ring buffer size")
 		offlineAfterSec       = flag.Int("offline-after-sec", 20, "mark server offline if no heartbeat")
 		enablePromptDetection = flag.Bool("enable-prompt-detection", false, "enable heuristic prompt detection to emit approval_needed events (default: off)")
+		detectionProfiles     = flag.String("detection-profiles", getenv("DETECTION_PROFILES", ""), "prompt detection profiles json file, reloaded on SIGHUP (optional)")
+		recordingDir          = flag.String("recording-dir", getenv("RECORDING_DIR", ""), "directory for asciicast session recordings (optional)")
+		recordSessions        = flag.Bool("record-sessions", false, "record sessions of tenants without explicit settings (requires -recording-dir)")
+		recordingRetention    = flag.Int("recording-retention-days", 30, "delete finished recordings after this many days (0 = keep forever)")
+		callbackSecret        = flag.String("callback-secret", getenv("CALLBACK_SECRET", ""), "hmac key for approval callback tokens (optional, random per process if empty)")
+		callbackTTLSec        = flag.Int("callback-token-ttl-sec", 900, "lifetime of approval callback tokens")
+		webhookAllowPrivate   = flag.Bool("webhook-allow-private", false, "let tenant webhooks reach loopback, private and link-local addresses")
+		auditRotateMB         = flag.Int("audit-rotate-mb", 0, "rotate the audit log at this size (0 = off)")
+		auditRotateHours      = flag.Int("audit-rotate-hours", 0, "rotate the audit log after this many hours (0 = off)")
+		auditCompress         = flag.Bool("audit-compress", false, "gzip rotated audit logs")
+		auditSigningKey       = flag.String("audit-signing-key", getenv("AUDIT_SIGNING_KEY", ""), "ed25519 PEM private key for signed audit checkpoints (optional)")
+		auditCheckpointMin    = flag.Int("audit-checkpoint-min", 60, "minutes between signed audit checkpoints")
+		tokenRotateOverlapSec = flag.Int("token-rotate-overlap-sec", 3600, "default time a rotated token keeps working")
+		metricsAddr           = flag.String("metrics-addr", getenv("METRICS_ADDR", ""), "separate listen address for /metrics, e.g. 127.0.0.1:9180 (optional)")
+		trustedProxies        = flag.String("trusted-proxies", getenv("TRUSTED_PROXIES", ""), "comma-separated proxy IPs/CIDRs whose X-Forwarded-For / X-Real-IP name the client, e.g. 127.0.0.1 (optional)")
+		metricsToken          = flag.String("metrics-token", getenv("METRICS_TOKEN", ""), "bearer token for /metrics; also serves it on -addr when set (optional)")
 	)
 	flag.Parse()
+	if (*tlsCert == "") != (*tlsKey == "") || (*tlsClientCA != "" && *tlsCert == "") || (*tlsDenyList != "" && *tlsClientCA == "") {
+		slog.Error("-tls-cert and -tls-key go together; -tls-client-ca needs both; -tls-deny-list needs -tls-client-ca")
+		os.Exit(1)
+	}
+	var tlsFiles *tlsReloader
+	if *tlsCert != "" {
+		var err error
+		tlsFiles, err = newTLSReloader(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			slog.Error("load tls certificate failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	proxies, err := auth.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		slog.Error("parse -trusted-proxies failed", "err", err)
+		os.Exit(1)
+	}
+	var deniedCerts *auth.CertDenyList
+	if *tlsDenyList != "" {
+		var err error
+		deniedCerts, err = auth.NewCertDenyList(*tlsDenyList)
+		if err != nil {
+			slog.Error("load tls deny list failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if *stateDBPath == "" {
+		*stateDBPath = *tokenDBPath
+	}
+	auditOpts := core.AuditOptions{
+		RotateBytes:        int64(*auditRotateMB) << 20,
+		RotateInterval:     time.Duration(*auditRotateHours) * time.Hour,
+		Compress:           *auditCompress,
+		CheckpointInterval: time.Duration(*auditCheckpointMin) * time.Minute,
+	}
+	if *auditSigningKey != "" {
+		key, err := core.LoadAuditSigningKey(*auditSigningKey)
+		if err != nil {
+			slog.Error("load audit signing key failed", "err", err)
+			os.Exit(1)
+		}
+		auditOpts.SigningKey = key
+	}
 
 	cp, err := core.NewControlPlane(core.Config{
 		RingBufferBytes:       *ringBufferBytes,
 		OfflineAfter:          time.Duration(*offlineAfterSec) * time.Second,
 		HeartbeatMS:           5000,
 		AuditPath:             *auditPath,
+		StateDBPath:           *stateDBPath,
 		RateLimitPerMin:       1200,
 		RateWindow:            time.Minute,
 		DefaultGraceMS:        4000,
 		DefaultKillMS:         9000,
 		ApprovalBroadcast:     "all",
 		EnablePromptDetection: *enablePromptDetection,
+		RecordingDir:          *recordingDir,
+		RecordSessions:        *recordSessions,
+		RecordingRetention:    time.Duration(*recordingRetention) * 24 * time.Hour,
+		DetectionProfilesPath: *detectionProfiles,
+		CallbackSecret:        *callbackSecret,
+		CallbackTokenTTL:      time.Duration(*callbackTTLSec) * time.Second,
+		WebhookAllowPrivate:   *webhookAllowPrivate,
+		Audit:                 auditOpts,
 	})
 	if err != nil {
 		slog.Error("init control plane failed", "err", err)
@@ -61,6 +138,7 @@ func main() {
 	} else {
 		tokenStore = auth.NewStore()
 	}
+	tokenStore.SetAuditSink(cp.AuditSink())
 	defer func() {
 		if err := tokenStore.Close(); err != nil {
 			slog.Error("close token store failed", "err", err)
@@ -90,10 +168,14 @@ func main() {
 	}
 
 	api := &httpapi.Server{
-		CP:          cp,
-		Tokens:      tokenStore,
-		UIDir:       *uiDir,
-		CheckOrigin: false,
+		CP:                 cp,
+		Tokens:             tokenStore,
+		UIDir:              *uiDir,
+		CheckOrigin:        false,
+		MetricsToken:       *metricsToken,
+		TokenRotateOverlap: time.Duration(*tokenRotateOverlapSec) * time.Second,
+		DeniedCerts:        deniedCerts,
+		TrustedProxies:     proxies,
 	}
 
 	srv := &http.Server{
@@ -102,14 +184,73 @@ func main() {
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
+	if tlsFiles != nil {
+		srv.TLSConfig = tlsFiles.Config()
+	}
+
 	go func() {
-		slog.Info("cc-control listening", "addr", *addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Info("cc-control listening", "addr", *addr, "tls", tlsFiles != nil, "client_ca", *tlsClientCA != "")
+		var err error
+		if tlsFiles != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			slog.Error("listen error", "err", err)
 			os.Exit(1)
 		}
 	}()
 
+	var metricsSrv *http.Server
+	if *metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", api.MetricsHandler())
+		metricsSrv = &http.Server{
+			Addr:              *metricsAddr,
+			Handler:           metricsMux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("cc-control metrics listening", "addr", *metricsAddr)
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("metrics listen error", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if *detectionProfiles != "" || tlsFiles != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if tlsFiles != nil {
+					if err := tlsFiles.Reload(); err != nil {
+						slog.Error("reload tls certificate failed", "cert", *tlsCert, "err", err)
+					} else {
+						slog.Info("tls certificate reloaded", "cert", *tlsCert)
+					}
+				}
+				if deniedCerts != nil {
+					if err := deniedCerts.Reload(); err != nil {
+						slog.Error("reload tls deny list failed", "path", *tlsDenyList, "err", err)
+					} else {
+						slog.Info("tls deny list reloaded", "path", *tlsDenyList, "count", deniedCerts.Len())
+					}
+				}
+				if *detectionProfiles == "" {
+					continue
+				}
+				if err := cp.ReloadDetectionProfiles(); err != nil {
+					slog.Error("reload detection profiles failed", "path", *detectionProfiles, "err", err)
+					continue
+				}
+				slog.Info("detection profiles reloaded", "path", *detectionProfiles)
+			}
+		}()
+	}
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
@@ -117,6 +258,9 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
 	defer cancel()
 	_ = srv.Shutdown(ctx)
+	if metricsSrv != nil {
+		_ = metricsSrv.Shutdown(ctx)
+	}
 }
 
 func getenv(k, fallback string) string {
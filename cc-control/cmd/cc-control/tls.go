@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+)
+
+// tlsReloader serves -tls-cert/-tls-key (and -tls-client-ca) and re-reads
+// them on SIGHUP, so renewed certificates apply without a restart.
+type tlsReloader struct {
+	certPath     string
+	keyPath      string
+	clientCAPath string
+
+	mu  sync.RWMutex
+	cfg *tls.Config
+}
+
+func newTLSReloader(certPath, keyPath, clientCAPath string) (*tlsReloader, error) {
+	t := &tlsReloader{certPath: certPath, keyPath: keyPath, clientCAPath: clientCAPath}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload re-reads the files. On error the previous config stays in use.
+func (t *tlsReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(t.certPath, t.keyPath)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		// Websocket upgrades need HTTP/1.1.
+		NextProtos: []string{"http/1.1"},
+	}
+	if t.clientCAPath != "" {
+		pem, err := os.ReadFile(t.clientCAPath)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates in " + t.clientCAPath)
+		}
+		// Browsers and token-auth agents connect without a certificate;
+		// one that is sent must chain to the client CA.
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	t.mu.Lock()
+	t.cfg = cfg
+	t.mu.Unlock()
+	return nil
+}
+
+// Config is the listener config; each handshake picks up the latest files.
+func (t *tlsReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			return t.cfg, nil
+		},
+	}
+}
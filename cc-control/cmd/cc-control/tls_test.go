@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a fresh self-signed certificate and key and returns
+// the certificate DER.
+func writeSelfSigned(t *testing.T, certPath, keyPath, cn string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func currentConfig(t *testing.T, r *tlsReloader) *tls.Config {
+	t.Helper()
+	cfg, err := r.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestTLSReloader_BadFilesKeepPreviousConfig(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	caPath := filepath.Join(dir, "ca.pem")
+	first := writeSelfSigned(t, certPath, keyPath, "first")
+	writeSelfSigned(t, caPath, filepath.Join(dir, "ca.key"), "agent ca")
+
+	r, err := newTLSReloader(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	cfg := currentConfig(t, r)
+	if !bytes.Equal(cfg.Certificates[0].Certificate[0], first) || cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatal("initial config should serve the first certificate and accept client certs")
+	}
+
+	if err := os.WriteFile(certPath, []byte("truncated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("reload of a broken certificate should fail")
+	}
+	if currentConfig(t, r) != cfg {
+		t.Fatal("failed reload should keep serving the previous config")
+	}
+
+	second := writeSelfSigned(t, certPath, keyPath, "second")
+	if err := os.WriteFile(caPath, []byte("no pem here"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("reload with an empty client CA bundle should fail")
+	}
+	if currentConfig(t, r) != cfg {
+		t.Fatal("a bad client CA should not swap in the new certificate either")
+	}
+
+	writeSelfSigned(t, caPath, filepath.Join(dir, "ca.key"), "agent ca")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := currentConfig(t, r); !bytes.Equal(got.Certificates[0].Certificate[0], second) {
+		t.Fatal("successful reload should serve the renewed certificate")
+	}
+}
@@ -0,0 +1,71 @@
+package auth
+
+// Actor identifies who asked for a token operation. The zero value is the
+// control plane itself, e.g. seeding tokens from flags at startup.
+type Actor struct {
+	TokenID    string
+	Type       TokenType
+	TenantID   string
+	RemoteAddr string
+	UserAgent  string
+}
+
+// ActorFor describes the holder of rec calling from remoteAddr.
+func ActorFor(rec *TokenRecord, remoteAddr, userAgent string) Actor {
+	a := Actor{RemoteAddr: remoteAddr, UserAgent: userAgent}
+	if rec != nil {
+		a.TokenID = rec.TokenID
+		a.Type = rec.Type
+		a.TenantID = rec.TenantID
+	}
+	return a
+}
+
+// String is the audit actor, in the same "<type>:<token id>" form the
+// control plane uses for session events.
+func (a Actor) String() string {
+	if a.TokenID == "" {
+		return "system"
+	}
+	return string(a.Type) + ":" + a.TokenID
+}
+
+// AuditMeta returns the request details worth keeping next to the actor.
+func (a Actor) AuditMeta() map[string]any {
+	meta := map[string]any{}
+	if a.TokenID != "" {
+		meta["actor_token_id"] = a.TokenID
+	}
+	if a.TenantID != "" {
+		meta["actor_tenant_id"] = a.TenantID
+	}
+	if a.RemoteAddr != "" {
+		meta["remote_addr"] = a.RemoteAddr
+	}
+	if a.UserAgent != "" {
+		meta["user_agent"] = a.UserAgent
+	}
+	return meta
+}
+
+// AuditSink records token lifecycle events. The control plane's audit log
+// implements it so token and session events share one hash chain.
+type AuditSink interface {
+	LogAuthEvent(kind string, actor Actor, tenantID string, meta map[string]any)
+}
+
+// SetAuditSink makes the store report token issuance and revocation.
+func (s *Store) SetAuditSink(sink AuditSink) {
+	s.mu.Lock()
+	s.audit = sink
+	s.mu.Unlock()
+}
+
+func (s *Store) logEvent(kind string, actor Actor, tenantID string, meta map[string]any) {
+	s.mu.RLock()
+	sink := s.audit
+	s.mu.RUnlock()
+	if sink != nil {
+		sink.LogAuthEvent(kind, actor, tenantID, meta)
+	}
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AgentCertScheme is the URI SAN scheme naming an agent's tenant and server
+// id: cc-agent://<tenant_id>/<server_id>.
+const AgentCertScheme = "cc-agent"
+
+// AgentCertIdentity maps a verified agent client certificate to the tenant
+// and server id it may register as, taken from its cc-agent:// URI SAN. A
+// certificate without one is refused, so a CA that also signs other client
+// certificates cannot mint agent identities by accident. Verifying the chain
+// is up to the TLS stack.
+func AgentCertIdentity(cert *x509.Certificate) (tenantID, serverID string, err error) {
+	if cert == nil {
+		return "", "", errors.New("no client certificate")
+	}
+	for _, u := range cert.URIs {
+		if u.Scheme != AgentCertScheme {
+			continue
+		}
+		tenantID = u.Host
+		serverID = strings.Trim(u.Path, "/")
+		if tenantID == "" || serverID == "" || strings.Contains(serverID, "/") {
+			return "", "", errors.New("invalid client certificate: bad cc-agent uri")
+		}
+		return tenantID, serverID, nil
+	}
+	return "", "", errors.New("invalid client certificate: no cc-agent uri")
+}
+
+// CertFingerprint is the hex SHA-256 of the certificate's public key
+// (SubjectPublicKeyInfo), so one entry covers every certificate issued for
+// the same key.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertDenyList holds revoked agent certificates by CertFingerprint, read
+// from a file with one fingerprint per line ('#' starts a comment, colons
+// are ignored). A nil list denies nothing.
+type CertDenyList struct {
+	path string
+
+	mu     sync.RWMutex
+	denied map[string]bool
+}
+
+func NewCertDenyList(path string) (*CertDenyList, error) {
+	l := &CertDenyList{path: path}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload re-reads the file. On error the previous list stays in use.
+func (l *CertDenyList) Reload() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	denied := map[string]bool{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fp := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(line), ":", ""))
+		if fp == "" {
+			continue
+		}
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+			return errors.New(l.path + ":" + strconv.Itoa(n) + ": not a sha256 fingerprint")
+		}
+		denied[fp] = true
+	}
+	l.mu.Lock()
+	l.denied = denied
+	l.mu.Unlock()
+	return nil
+}
+
+// Revoked reports whether fingerprint is on the list.
+func (l *CertDenyList) Revoked(fingerprint string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.denied[fingerprint]
+}
+
+// Len is the number of denied fingerprints.
+func (l *CertDenyList) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.denied)
+}
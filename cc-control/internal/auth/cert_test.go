@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAgentCertIdentity(t *testing.T) {
+	cases := []struct {
+		name           string
+		cert           x509.Certificate
+		tenant, server string
+		ok             bool
+	}{
+		{"uri san", x509.Certificate{
+			Subject: pkix.Name{Organization: []string{"other"}, CommonName: "other"},
+			URIs:    []*url.URL{{Scheme: "https", Host: "example.com"}, {Scheme: AgentCertScheme, Host: "acme", Path: "/build-7"}},
+		}, "acme", "build-7", true},
+		{"subject only", x509.Certificate{Subject: pkix.Name{Organization: []string{"acme"}, CommonName: "build-7"}}, "", "", false},
+		{"no server", x509.Certificate{URIs: []*url.URL{{Scheme: AgentCertScheme, Host: "acme"}}}, "", "", false},
+		{"bad uri", x509.Certificate{URIs: []*url.URL{{Scheme: AgentCertScheme, Host: "acme", Path: "/a/b"}}}, "", "", false},
+	}
+	for _, tc := range cases {
+		tenant, server, err := AgentCertIdentity(&tc.cert)
+		if (err == nil) != tc.ok || tenant != tc.tenant || server != tc.server {
+			t.Errorf("%s: got %q %q %v", tc.name, tenant, server, err)
+		}
+	}
+}
+
+func TestCertDenyList_ReloadKeepsOldListOnError(t *testing.T) {
+	cert := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("agent key")}
+	fp := CertFingerprint(cert)
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	// openssl prints fingerprints upper-case with colons.
+	var colons []string
+	for i := 0; i < len(fp); i += 2 {
+		colons = append(colons, strings.ToUpper(fp[i:i+2]))
+	}
+	if err := os.WriteFile(path, []byte("# lost laptop\n"+strings.Join(colons, ":")+"  # build-7\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewCertDenyList(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !l.Revoked(fp) || l.Revoked(CertFingerprint(&x509.Certificate{RawSubjectPublicKeyInfo: []byte("other")})) {
+		t.Fatal("deny list should match only the listed key")
+	}
+
+	if err := os.WriteFile(path, []byte(fp+"\nnot-a-fingerprint\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("reload should name the bad line, got %v", err)
+	}
+	if !l.Revoked(fp) || l.Len() != 1 {
+		t.Fatal("failed reload should keep the previous list")
+	}
+
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err != nil || l.Revoked(fp) {
+		t.Fatalf("emptied list should deny nothing, err=%v", err)
+	}
+	var none *CertDenyList
+	if none.Revoked(fp) {
+		t.Fatal("nil deny list should deny nothing")
+	}
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultJoinCodeTTL applies when a join code request does not set one.
+	DefaultJoinCodeTTL = 15 * time.Minute
+	// MaxJoinCodeTTL caps join code lifetime; codes are meant to be used
+	// right after they are handed out.
+	MaxJoinCodeTTL = 24 * time.Hour
+
+	// joinCodeAlphabet leaves out 0/O and 1/I so codes survive being read
+	// out or typed by hand.
+	joinCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	joinCodeLen      = 10
+)
+
+// JoinCode is a short-lived, single-use code a tenant hands to a new host.
+// The host exchanges it for its own agent token with RedeemJoinCode.
+type JoinCode struct {
+	CodeID      string `json:"code_id"`
+	CodeHash    string `json:"-"`
+	TenantID    string `json:"tenant_id"`
+	Name        string `json:"name,omitempty"`
+	CreatedBy   string `json:"created_by"`
+	CreatedAtMS int64  `json:"created_at_ms"`
+	ExpiresAtMS int64  `json:"expires_at_ms"`
+	// UsedAtMS, TokenID and ServerID are set once a host enrolls.
+	UsedAtMS int64  `json:"used_at_ms,omitempty"`
+	TokenID  string `json:"token_id,omitempty"`
+	ServerID string `json:"server_id,omitempty"`
+}
+
+// CreateJoinCode issues a join code for tenantID that expires after ttl
+// (DefaultJoinCodeTTL when zero). name becomes the enrolled token's name.
+func (s *Store) CreateJoinCode(actor Actor, tenantID, name string, ttl time.Duration) (string, JoinCode, error) {
+	if tenantID == "" {
+		return "", JoinCode{}, errors.New("tenant_id required")
+	}
+	if ttl == 0 {
+		ttl = DefaultJoinCodeTTL
+	}
+	if ttl < 0 || ttl > MaxJoinCodeTTL {
+		return "", JoinCode{}, errors.New("invalid join code ttl")
+	}
+	plain, err := randomJoinCode()
+	if err != nil {
+		return "", JoinCode{}, err
+	}
+	now := time.Now()
+	jc := JoinCode{
+		CodeID:      uuid.NewString(),
+		CodeHash:    HashToken(normalizeJoinCode(plain)),
+		TenantID:    tenantID,
+		Name:        strings.TrimSpace(name),
+		CreatedBy:   actor.String(),
+		CreatedAtMS: now.UnixMilli(),
+		ExpiresAtMS: now.Add(ttl).UnixMilli(),
+	}
+	s.mu.Lock()
+	if _, ok := s.joinCodes[jc.CodeHash]; ok {
+		s.mu.Unlock()
+		return "", JoinCode{}, errors.New("join code already exists")
+	}
+	if err := s.persistJoinCode(jc); err != nil {
+		s.mu.Unlock()
+		return "", JoinCode{}, err
+	}
+	copyJC := jc
+	s.joinCodes[jc.CodeHash] = &copyJC
+	s.mu.Unlock()
+	s.logEvent("join_code_created", actor, tenantID, map[string]any{
+		"code_id":       jc.CodeID,
+		"name":          jc.Name,
+		"expires_at_ms": jc.ExpiresAtMS,
+	})
+	return plain, jc, nil
+}
+
+// ListJoinCodes returns the tenant's join codes, newest first.
+func (s *Store) ListJoinCodes(tenantID string) []JoinCode {
+	s.mu.RLock()
+	out := make([]JoinCode, 0)
+	for _, jc := range s.joinCodes {
+		if tenantID != "" && jc.TenantID != tenantID {
+			continue
+		}
+		out = append(out, *jc)
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAtMS > out[j].CreatedAtMS })
+	return out
+}
+
+// RedeemJoinCode uses up code and issues an agent token for the enrolling
+// host, pinned to serverID and, when given, its verified hostKey. Unknown,
+// used and expired codes all fail with the same error.
+func (s *Store) RedeemJoinCode(code, serverID, hostKey, remoteAddr string) (string, TokenRecord, error) {
+	serverID = strings.TrimSpace(serverID)
+	if serverID == "" {
+		return "", TokenRecord{}, errors.New("server_id required")
+	}
+	plain, err := randomToken()
+	if err != nil {
+		return "", TokenRecord{}, err
+	}
+	now := time.Now().UnixMilli()
+	s.mu.Lock()
+	jc := s.joinCodes[HashToken(normalizeJoinCode(code))]
+	if jc == nil || jc.UsedAtMS != 0 || now >= jc.ExpiresAtMS {
+		s.mu.Unlock()
+		return "", TokenRecord{}, errors.New("invalid join code")
+	}
+	rec := TokenRecord{
+		TokenID:        uuid.NewString(),
+		TokenHash:      HashToken(plain),
+		TenantID:       jc.TenantID,
+		Type:           TokenTypeAgent,
+		CreatedAtMS:    now,
+		Name:           jc.Name,
+		Pin:            PinServerID,
+		PinnedServerID: serverID,
+		PinnedHostKey:  hostKey,
+		JoinCodeID:     jc.CodeID,
+	}
+	if rec.Name == "" {
+		rec.Name = serverID
+	}
+	if hostKey != "" {
+		rec.Pin = PinHostKey
+	}
+	used := *jc
+	used.UsedAtMS = now
+	used.TokenID = rec.TokenID
+	used.ServerID = serverID
+	// The token and the used code are stored together: a code that stays
+	// unused on disk next to a live token could enroll a second host after a
+	// restart.
+	if err := s.insertWithLocked(&rec, func(db execer) error { return upsertJoinCode(db, used) }); err != nil {
+		s.mu.Unlock()
+		return "", TokenRecord{}, err
+	}
+	*jc = used
+	s.mu.Unlock()
+	meta := tokenMeta(rec)
+	meta["server_id"] = serverID
+	if hostKey != "" {
+		meta["host_key"] = hostKey
+	}
+	s.logEvent("agent_enrolled", ActorFor(&rec, remoteAddr, ""), rec.TenantID, meta)
+	return plain, rec, nil
+}
+
+// persistJoinCode upserts jc. Callers must hold s.mu.
+func (s *Store) persistJoinCode(jc JoinCode) error {
+	if s.db == nil {
+		return nil
+	}
+	return upsertJoinCode(s.db, jc)
+}
+
+func upsertJoinCode(db execer, jc JoinCode) error {
+	data, err := json.Marshal(jc)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+INSERT INTO join_codes (code_id, code_hash, tenant_id, data) VALUES (?, ?, ?, ?)
+ON CONFLICT(code_id) DO UPDATE SET data = excluded.data`,
+		jc.CodeID, jc.CodeHash, jc.TenantID, string(data),
+	)
+	return err
+}
+
+func (s *Store) loadJoinCodes(db *sql.DB) error {
+	rows, err := db.Query(`SELECT code_hash, data FROM join_codes`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for rows.Next() {
+		var hash, data string
+		if err := rows.Scan(&hash, &data); err != nil {
+			return err
+		}
+		var jc JoinCode
+		if err := json.Unmarshal([]byte(data), &jc); err != nil {
+			return fmt.Errorf("invalid join code in db: %w", err)
+		}
+		jc.CodeHash = hash
+		s.joinCodes[hash] = &jc
+	}
+	return rows.Err()
+}
+
+// normalizeJoinCode lets users type codes in any case, with or without the
+// dash.
+func normalizeJoinCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// randomJoinCode returns a code like "ABCDE-FGH23".
+func randomJoinCode() (string, error) {
+	buf := make([]byte, joinCodeLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i, v := range buf {
+		if i == joinCodeLen/2 {
+			b.WriteByte('-')
+		}
+		// 256 is a multiple of 32, so this is unbiased.
+		b.WriteByte(joinCodeAlphabet[int(v)%len(joinCodeAlphabet)])
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// AgentPin selects what an agent token is bound to on first register.
+type AgentPin string
+
+const (
+	PinNone AgentPin = ""
+	// PinServerID binds the token to the first server_id it registers.
+	PinServerID AgentPin = "server_id"
+	// PinHostKey binds the token to the first Ed25519 host key (and
+	// server_id) it registers with; the agent must prove it holds the key.
+	PinHostKey AgentPin = "host_key"
+)
+
+func ParsePin(v string) (AgentPin, bool) {
+	switch AgentPin(v) {
+	case PinNone, PinServerID, PinHostKey:
+		return AgentPin(v), true
+	default:
+		return "", false
+	}
+}
+
+// BindAgent checks an agent register against the token's pin. The first
+// register of a pinned token records the identity; later ones must match it.
+// hostKey is the agent's verified public key, or empty if it sent none;
+// remoteAddr is only used for the audit entry.
+func (s *Store) BindAgent(tokenID, serverID, hostKey, remoteAddr string) error {
+	s.mu.Lock()
+	rec := s.byID[tokenID]
+	if rec == nil {
+		s.mu.Unlock()
+		return errors.New("token not found")
+	}
+	switch rec.Pin {
+	case PinNone:
+		s.mu.Unlock()
+		return nil
+	case PinHostKey:
+		if hostKey == "" {
+			s.mu.Unlock()
+			return errors.New("token requires a host key")
+		}
+		if rec.PinnedHostKey != "" && rec.PinnedHostKey != hostKey {
+			s.mu.Unlock()
+			return errors.New("token is pinned to another host key")
+		}
+	}
+	if rec.PinnedServerID != "" {
+		s.mu.Unlock()
+		if rec.PinnedServerID != serverID {
+			return errors.New("token is pinned to another server_id")
+		}
+		return nil
+	}
+	rec.PinnedServerID = serverID
+	if rec.Pin == PinHostKey {
+		rec.PinnedHostKey = hostKey
+	}
+	pinned := *rec
+	s.mu.Unlock()
+	if s.db != nil {
+		if _, err := s.db.Exec(`UPDATE tokens SET pinned_server_id = ?, pinned_host_key = ? WHERE token_id = ?`, pinned.PinnedServerID, pinned.PinnedHostKey, tokenID); err != nil {
+			slog.Error("persist token pin failed", "token_id", tokenID, "err", err)
+		}
+	}
+	meta := tokenMeta(pinned)
+	meta["server_id"] = pinned.PinnedServerID
+	if pinned.PinnedHostKey != "" {
+		meta["host_key"] = pinned.PinnedHostKey
+	}
+	s.logEvent("token_pinned", ActorFor(&pinned, remoteAddr, ""), pinned.TenantID, meta)
+	return nil
+}
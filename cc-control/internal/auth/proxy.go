@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// TrustedProxies are the reverse proxies whose X-Forwarded-For and
+// X-Real-IP headers name the real client. Requests from anywhere else keep
+// their socket address, so clients cannot spoof their IP.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies reads a comma-separated list of CIDRs or single IPs.
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	var out TrustedProxies
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("invalid trusted proxy: " + item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy: " + item)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (tp TrustedProxies) trusts(ip net.IP) bool {
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address to record for a request. When the peer at
+// remoteAddr is a trusted proxy, X-Forwarded-For is walked from the right,
+// skipping further trusted hops, and X-Real-IP is the fallback; otherwise the
+// headers are ignored.
+func (tp TrustedProxies) ClientIP(remoteAddr, forwardedFor, realIP string) string {
+	peer := net.ParseIP(RemoteIP(remoteAddr))
+	if peer == nil || !tp.trusts(peer) {
+		return RemoteIP(remoteAddr)
+	}
+	if forwardedFor != "" {
+		hops := strings.Split(forwardedFor, ",")
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			client = ip.String()
+			if !tp.trusts(ip) {
+				break
+			}
+		}
+		if client != "" {
+			return client
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(realIP)); ip != nil {
+		return ip.String()
+	}
+	return peer.String()
+}
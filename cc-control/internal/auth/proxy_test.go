@@ -0,0 +1,33 @@
+package auth
+
+import "testing"
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	tp, err := ParseTrustedProxies("127.0.0.1, 10.0.0.0/8,::1")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	cases := []struct {
+		name, remote, xff, xri, want string
+	}{
+		{"direct client ignores headers", "203.0.113.9:4000", "198.51.100.1", "198.51.100.2", "203.0.113.9"},
+		{"x-real-ip from proxy", "127.0.0.1:5000", "", "198.51.100.2", "198.51.100.2"},
+		{"forwarded-for wins", "127.0.0.1:5000", "198.51.100.1", "198.51.100.2", "198.51.100.1"},
+		{"skips trusted hops", "127.0.0.1:5000", "198.51.100.7, 198.51.100.1, 10.1.2.3", "", "198.51.100.1"},
+		{"spoofed left entry is not trusted", "10.0.0.5:80", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"garbage hop stops the walk", "[::1]:80", "198.51.100.1, junk", "198.51.100.2", "198.51.100.2"},
+		{"proxy without headers", "127.0.0.1:5000", "", "", "127.0.0.1"},
+	}
+	for _, tc := range cases {
+		if got := tp.ClientIP(tc.remote, tc.xff, tc.xri); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	var none TrustedProxies
+	if got := none.ClientIP("127.0.0.1:5000", "198.51.100.1", ""); got != "127.0.0.1" {
+		t.Fatalf("no trusted proxies should ignore headers, got %q", got)
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatal("bad cidr should be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// Scope narrows a UI token to part of its tenant. Every non-empty list must
+// match: the server id is listed, the server carries all of ServerTags, and
+// the session cwd lies under one of CwdPrefixes. A nil scope allows
+// everything in the tenant.
+type Scope struct {
+	ServerIDs   []string `json:"server_ids,omitempty"`
+	ServerTags  []string `json:"server_tags,omitempty"`
+	CwdPrefixes []string `json:"cwd_prefixes,omitempty"`
+}
+
+// NormalizeScope trims and validates sc. It returns nil when sc restricts
+// nothing, so callers can store the result as is.
+func NormalizeScope(sc *Scope) (*Scope, error) {
+	if sc == nil {
+		return nil, nil
+	}
+	out := &Scope{
+		ServerIDs:  trimNonEmpty(sc.ServerIDs),
+		ServerTags: trimNonEmpty(sc.ServerTags),
+	}
+	for _, prefix := range trimNonEmpty(sc.CwdPrefixes) {
+		if !filepath.IsAbs(prefix) {
+			return nil, errors.New("invalid scope: cwd prefix must be absolute")
+		}
+		out.CwdPrefixes = append(out.CwdPrefixes, filepath.Clean(prefix))
+	}
+	if len(out.ServerIDs) == 0 && len(out.ServerTags) == 0 && len(out.CwdPrefixes) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// AllowsServer reports whether a server with the given id and tags is in
+// scope.
+func (sc *Scope) AllowsServer(serverID string, tags []string) bool {
+	if sc == nil {
+		return true
+	}
+	if len(sc.ServerIDs) > 0 && !contains(sc.ServerIDs, serverID) {
+		return false
+	}
+	for _, need := range sc.ServerTags {
+		if !contains(tags, need) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsCwd reports whether cwd is one of the prefixes or below one.
+func (sc *Scope) AllowsCwd(cwd string) bool {
+	if sc == nil || len(sc.CwdPrefixes) == 0 {
+		return true
+	}
+	if cwd == "" || !filepath.IsAbs(cwd) {
+		return false
+	}
+	cwd = filepath.Clean(cwd)
+	for _, prefix := range sc.CwdPrefixes {
+		if cwd == prefix || strings.HasPrefix(cwd, strings.TrimSuffix(prefix, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func trimNonEmpty(in []string) []string {
+	var out []string
+	for _, v := range in {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -7,6 +7,8 @@ import (
 	"encoding/hex"
 	"errors"
 	"log/slog"
+	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -39,6 +41,38 @@ type TokenRecord struct {
 	CreatedAtMS int64     `json:"created_at_ms"`
 	Revoked     bool      `json:"revoked"`
 	Name        string    `json:"name,omitempty"`
+	// ExpiresAtMS is zero for tokens that never expire. Rotation shortens
+	// it to the end of the overlap window.
+	ExpiresAtMS  int64  `json:"expires_at_ms,omitempty"`
+	LastUsedAtMS int64  `json:"last_used_at_ms,omitempty"`
+	LastUsedIP   string `json:"last_used_ip,omitempty"`
+	// RotatedTo is the id of the successor issued by RotateToken.
+	RotatedTo string `json:"rotated_to,omitempty"`
+	// Scope limits a UI token to some of the tenant's servers.
+	Scope *Scope `json:"scope,omitempty"`
+	// Pin binds an agent token to the identity of the first agent that
+	// registers with it; PinnedServerID and PinnedHostKey record it.
+	Pin            AgentPin `json:"pin,omitempty"`
+	PinnedServerID string   `json:"pinned_server_id,omitempty"`
+	PinnedHostKey  string   `json:"pinned_host_key,omitempty"`
+	// JoinCodeID is set on agent tokens issued by enrolling a host with a
+	// join code.
+	JoinCodeID string `json:"join_code_id,omitempty"`
+}
+
+// TokenOptions are the optional settings of a new token.
+type TokenOptions struct {
+	// ExpiresAtMS is zero for a token that does not expire.
+	ExpiresAtMS int64
+	// Scope is only accepted for UI tokens.
+	Scope *Scope
+	// Pin is only accepted for agent tokens.
+	Pin AgentPin
+}
+
+// Expired reports whether the token is past its expiry.
+func (r *TokenRecord) Expired(now time.Time) bool {
+	return r.ExpiresAtMS > 0 && now.UnixMilli() >= r.ExpiresAtMS
 }
 
 type Store struct {
@@ -46,12 +80,22 @@ type Store struct {
 	byHash map[string]*TokenRecord
 	byID   map[string]*TokenRecord
 	db     *sql.DB
+	audit  AuditSink
+	// joinCodes is keyed by code hash, like byHash.
+	joinCodes map[string]*JoinCode
+
+	// used holds token ids whose last-used fields changed since the last
+	// flush to SQLite.
+	used      map[string]struct{}
+	flushStop chan struct{}
+	flushDone chan struct{}
 }
 
 func NewStore() *Store {
 	return &Store{
-		byHash: make(map[string]*TokenRecord),
-		byID:   make(map[string]*TokenRecord),
+		byHash:    make(map[string]*TokenRecord),
+		byID:      make(map[string]*TokenRecord),
+		joinCodes: make(map[string]*JoinCode),
 	}
 }
 
@@ -59,6 +103,12 @@ func (s *Store) Close() error {
 	if s == nil || s.db == nil {
 		return nil
 	}
+	if s.flushStop != nil {
+		close(s.flushStop)
+		<-s.flushDone
+		s.flushStop = nil
+	}
+	s.flushUsage()
 	return s.db.Close()
 }
 
@@ -97,10 +147,25 @@ func roleRank(r TokenRole) int {
 	}
 }
 
-func (s *Store) CreateToken(tt TokenType, role TokenRole, tenantID, name string) (string, TokenRecord, error) {
+// CreateToken issues a new token.
+func (s *Store) CreateToken(actor Actor, tt TokenType, role TokenRole, tenantID, name string, opts TokenOptions) (string, TokenRecord, error) {
 	if !validType(tt) {
 		return "", TokenRecord{}, errors.New("invalid token type")
 	}
+	scope, err := NormalizeScope(opts.Scope)
+	if err != nil {
+		return "", TokenRecord{}, err
+	}
+	if scope != nil && tt != TokenTypeUI {
+		return "", TokenRecord{}, errors.New("invalid scope: only ui tokens can be scoped")
+	}
+	if _, ok := ParsePin(string(opts.Pin)); !ok {
+		return "", TokenRecord{}, errors.New("invalid pin")
+	}
+	if opts.Pin != PinNone && tt != TokenTypeAgent {
+		return "", TokenRecord{}, errors.New("invalid pin: only agent tokens can be pinned")
+	}
+	expiresAtMS := opts.ExpiresAtMS
 	if tt == TokenTypeUI {
 		if !validRole(role) {
 			return "", TokenRecord{}, errors.New("invalid token role")
@@ -108,6 +173,10 @@ func (s *Store) CreateToken(tt TokenType, role TokenRole, tenantID, name string)
 	} else {
 		role = ""
 	}
+	now := time.Now().UnixMilli()
+	if expiresAtMS < 0 || (expiresAtMS > 0 && expiresAtMS <= now) {
+		return "", TokenRecord{}, errors.New("invalid token expiry")
+	}
 	plain, err := randomToken()
 	if err != nil {
 		return "", TokenRecord{}, err
@@ -118,13 +187,17 @@ func (s *Store) CreateToken(tt TokenType, role TokenRole, tenantID, name string)
 		TenantID:    tenantID,
 		Type:        tt,
 		Role:        role,
-		CreatedAtMS: time.Now().UnixMilli(),
+		CreatedAtMS: now,
 		Revoked:     false,
 		Name:        name,
+		ExpiresAtMS: expiresAtMS,
+		Scope:       scope,
+		Pin:         opts.Pin,
 	}
 	if err := s.insert(&rec); err != nil {
 		return "", TokenRecord{}, err
 	}
+	s.logEvent("token_created", actor, rec.TenantID, tokenMeta(rec))
 	return plain, rec, nil
 }
 
@@ -158,12 +231,23 @@ func (s *Store) SeedToken(token string, tt TokenType, role TokenRole, tenantID,
 	if err := s.insert(&rec); err != nil {
 		return TokenRecord{}, err
 	}
+	s.logEvent("token_seeded", Actor{}, rec.TenantID, tokenMeta(rec))
 	return rec, nil
 }
 
 func (s *Store) insert(rec *TokenRecord) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.insertLocked(rec)
+}
+
+func (s *Store) insertLocked(rec *TokenRecord) error {
+	return s.insertWithLocked(rec, nil)
+}
+
+// insertWithLocked is insertLocked that also runs extra in the transaction
+// that stores the token, so both rows are written or neither is.
+func (s *Store) insertWithLocked(rec *TokenRecord, extra func(execer) error) error {
 	if rec.TokenHash == "" || rec.TokenID == "" {
 		return errors.New("missing token hash or id")
 	}
@@ -174,7 +258,7 @@ func (s *Store) insert(rec *TokenRecord) error {
 		return errors.New("token id already exists")
 	}
 	if s.db != nil {
-		if err := s.persistInsertLocked(rec); err != nil {
+		if err := s.persistInsertLocked(rec, extra); err != nil {
 			return err
 		}
 	}
@@ -184,6 +268,17 @@ func (s *Store) insert(rec *TokenRecord) error {
 	return nil
 }
 
+// GetToken returns the token with the given id.
+func (s *Store) GetToken(tokenID string) (TokenRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec := s.byID[tokenID]
+	if rec == nil {
+		return TokenRecord{}, false
+	}
+	return *rec, true
+}
+
 func (s *Store) Lookup(token string) (*TokenRecord, bool) {
 	hash := HashToken(token)
 	s.mu.RLock()
@@ -196,7 +291,95 @@ func (s *Store) Lookup(token string) (*TokenRecord, bool) {
 	return &copyRec, true
 }
 
-func (s *Store) RevokeToken(tokenID string) bool {
+// MarkUsed records a successful authentication with the token. It is cheap
+// enough to call on every request; SQLite is updated in batches.
+func (s *Store) MarkUsed(tokenID, ip string) {
+	now := time.Now().UnixMilli()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.byID[tokenID]
+	if rec == nil {
+		return
+	}
+	rec.LastUsedAtMS = now
+	rec.LastUsedIP = ip
+	if s.db != nil {
+		if s.used == nil {
+			s.used = make(map[string]struct{})
+		}
+		s.used[tokenID] = struct{}{}
+	}
+}
+
+// RotateToken issues a successor with the same tenant, type, role, name,
+// scope and pin, and lets the old token keep working for overlap. A token
+// expiring sooner than that keeps its expiry. The successor gets the old
+// token's lifetime, counted from now.
+func (s *Store) RotateToken(actor Actor, tokenID string, overlap time.Duration) (string, TokenRecord, error) {
+	if overlap < 0 {
+		return "", TokenRecord{}, errors.New("invalid overlap")
+	}
+	plain, err := randomToken()
+	if err != nil {
+		return "", TokenRecord{}, err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	old := s.byID[tokenID]
+	switch {
+	case old == nil:
+		s.mu.Unlock()
+		return "", TokenRecord{}, errors.New("token not found")
+	case old.Revoked:
+		s.mu.Unlock()
+		return "", TokenRecord{}, errors.New("token revoked")
+	case old.Expired(now):
+		s.mu.Unlock()
+		return "", TokenRecord{}, errors.New("token expired")
+	case old.RotatedTo != "":
+		s.mu.Unlock()
+		return "", TokenRecord{}, errors.New("token already rotated")
+	}
+	next := TokenRecord{
+		TokenID:     uuid.NewString(),
+		TokenHash:   HashToken(plain),
+		TenantID:    old.TenantID,
+		Type:        old.Type,
+		Role:        old.Role,
+		CreatedAtMS: now.UnixMilli(),
+		Name:        old.Name,
+		Scope:       old.Scope,
+		// The successor is meant for the same host, so it keeps the binding.
+		Pin:            old.Pin,
+		PinnedServerID: old.PinnedServerID,
+		PinnedHostKey:  old.PinnedHostKey,
+		JoinCodeID:     old.JoinCodeID,
+	}
+	if old.ExpiresAtMS > 0 {
+		next.ExpiresAtMS = next.CreatedAtMS + (old.ExpiresAtMS - old.CreatedAtMS)
+	}
+	if err := s.insertLocked(&next); err != nil {
+		s.mu.Unlock()
+		return "", TokenRecord{}, err
+	}
+	old.RotatedTo = next.TokenID
+	if cutoff := now.Add(overlap).UnixMilli(); old.ExpiresAtMS == 0 || cutoff < old.ExpiresAtMS {
+		old.ExpiresAtMS = cutoff
+	}
+	rotated := *old
+	s.mu.Unlock()
+	if s.db != nil {
+		if _, err := s.db.Exec(`UPDATE tokens SET expires_at_ms = ?, rotated_to = ? WHERE token_id = ?`, rotated.ExpiresAtMS, rotated.RotatedTo, tokenID); err != nil {
+			slog.Error("persist rotate token failed", "token_id", tokenID, "err", err)
+		}
+	}
+	meta := tokenMeta(rotated)
+	meta["successor_id"] = next.TokenID
+	s.logEvent("token_rotated", actor, rotated.TenantID, meta)
+	return plain, next, nil
+}
+
+func (s *Store) RevokeToken(actor Actor, tokenID string) bool {
 	s.mu.Lock()
 	rec := s.byID[tokenID]
 	if rec == nil {
@@ -208,7 +391,9 @@ func (s *Store) RevokeToken(tokenID string) bool {
 		return true
 	}
 	rec.Revoked = true
+	revoked := *rec
 	s.mu.Unlock()
+	s.logEvent("token_revoked", actor, revoked.TenantID, tokenMeta(revoked))
 	if s.db != nil {
 		if _, err := s.db.Exec(`UPDATE tokens SET revoked = 1 WHERE token_id = ?`, tokenID); err != nil {
 			slog.Error("persist revoke token failed", "token_id", tokenID, "err", err)
@@ -217,7 +402,7 @@ func (s *Store) RevokeToken(tokenID string) bool {
 	return true
 }
 
-func (s *Store) RevokeTokensByTenant(tenantID string, types ...TokenType) int {
+func (s *Store) RevokeTokensByTenant(actor Actor, tenantID string, types ...TokenType) int {
 	if tenantID == "" || len(types) == 0 {
 		return 0
 	}
@@ -225,7 +410,7 @@ func (s *Store) RevokeTokensByTenant(tenantID string, types ...TokenType) int {
 	for _, tt := range types {
 		typeSet[tt] = struct{}{}
 	}
-	count := 0
+	var tokenIDs []string
 	s.mu.Lock()
 	for _, rec := range s.byID {
 		if rec.TenantID != tenantID {
@@ -234,19 +419,26 @@ func (s *Store) RevokeTokensByTenant(tenantID string, types ...TokenType) int {
 		if _, ok := typeSet[rec.Type]; !ok {
 			continue
 		}
-		if rec.Revoked {
+		// Enrolled hosts hold their own tokens; they are revoked one by one.
+		if rec.Revoked || rec.JoinCodeID != "" {
 			continue
 		}
 		rec.Revoked = true
-		count++
+		tokenIDs = append(tokenIDs, rec.TokenID)
 	}
 	s.mu.Unlock()
+	sort.Strings(tokenIDs)
+	s.logEvent("tenant_tokens_revoked", actor, tenantID, map[string]any{
+		"types":     types,
+		"count":     len(tokenIDs),
+		"token_ids": tokenIDs,
+	})
 	if s.db != nil {
 		if err := s.persistRevokeByTenant(tenantID, types); err != nil {
 			slog.Error("persist revoke tenant tokens failed", "tenant_id", tenantID, "err", err)
 		}
 	}
-	return count
+	return len(tokenIDs)
 }
 
 func (s *Store) ListTokens(tenantID string) []TokenRecord {
@@ -263,6 +455,41 @@ func (s *Store) ListTokens(tenantID string) []TokenRecord {
 	return out
 }
 
+func tokenMeta(rec TokenRecord) map[string]any {
+	meta := map[string]any{
+		"token_id": rec.TokenID,
+		"type":     rec.Type,
+	}
+	if rec.Role != "" {
+		meta["role"] = rec.Role
+	}
+	if rec.Name != "" {
+		meta["name"] = rec.Name
+	}
+	if rec.ExpiresAtMS > 0 {
+		meta["expires_at_ms"] = rec.ExpiresAtMS
+	}
+	if rec.Scope != nil {
+		meta["scope"] = rec.Scope
+	}
+	if rec.Pin != PinNone {
+		meta["pin"] = rec.Pin
+	}
+	if rec.JoinCodeID != "" {
+		meta["join_code_id"] = rec.JoinCodeID
+	}
+	return meta
+}
+
+// RemoteIP strips the port from an http.Request RemoteAddr.
+func RemoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
 func HashToken(token string) string {
 	sum := sha256.Sum256([]byte(token))
 	return hex.EncodeToString(sum[:])
@@ -2,15 +2,21 @@ package auth
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
 
+// usageFlushInterval is how often last-used fields are written to SQLite.
+const usageFlushInterval = 30 * time.Second
+
 func NewStoreWithSQLite(path string) (*Store, error) {
 	if strings.TrimSpace(path) == "" {
 		return nil, errors.New("sqlite path required")
@@ -29,6 +35,13 @@ func NewStoreWithSQLite(path string) (*Store, error) {
 		_ = db.Close()
 		return nil, err
 	}
+	if err := store.loadJoinCodes(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	store.flushStop = make(chan struct{})
+	store.flushDone = make(chan struct{})
+	go store.runUsageFlusher(usageFlushInterval)
 	return store, nil
 }
 
@@ -73,7 +86,61 @@ CREATE TABLE IF NOT EXISTS tokens (
 );
 CREATE INDEX IF NOT EXISTS idx_tokens_tenant ON tokens(tenant_id);
 CREATE INDEX IF NOT EXISTS idx_tokens_hash ON tokens(token_hash);
+CREATE TABLE IF NOT EXISTS join_codes (
+  code_id TEXT PRIMARY KEY,
+  code_hash TEXT NOT NULL UNIQUE,
+  tenant_id TEXT NOT NULL,
+  data TEXT NOT NULL
+);
 `)
+	if err != nil {
+		return err
+	}
+	for _, col := range []struct{ name, decl string }{
+		{"expires_at_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"last_used_at_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"last_used_ip", "TEXT NOT NULL DEFAULT ''"},
+		{"rotated_to", "TEXT NOT NULL DEFAULT ''"},
+		{"scope", "TEXT NOT NULL DEFAULT ''"},
+		{"pin", "TEXT NOT NULL DEFAULT ''"},
+		{"pinned_server_id", "TEXT NOT NULL DEFAULT ''"},
+		{"pinned_host_key", "TEXT NOT NULL DEFAULT ''"},
+		{"join_code_id", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := ensureColumn(db, "tokens", col.name, col.decl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds a column that databases created by older releases lack.
+func ensureColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			colType string
+			notNull int
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
 	return err
 }
 
@@ -82,7 +149,9 @@ func (s *Store) loadFromSQLite(db *sql.DB) error {
 		return errors.New("nil db")
 	}
 	rows, err := db.Query(`
-SELECT token_id, token_hash, tenant_id, type, role, created_at_ms, revoked, name
+SELECT token_id, token_hash, tenant_id, type, role, created_at_ms, revoked, name,
+  expires_at_ms, last_used_at_ms, last_used_ip, rotated_to, scope,
+  pin, pinned_server_id, pinned_host_key, join_code_id
 FROM tokens
 `)
 	if err != nil {
@@ -97,11 +166,22 @@ FROM tokens
 		var tt string
 		var role string
 		var revokedInt int
-		if err := rows.Scan(&rec.TokenID, &rec.TokenHash, &rec.TenantID, &tt, &role, &rec.CreatedAtMS, &revokedInt, &rec.Name); err != nil {
+		var scope string
+		var pin string
+		if err := rows.Scan(&rec.TokenID, &rec.TokenHash, &rec.TenantID, &tt, &role, &rec.CreatedAtMS, &revokedInt, &rec.Name,
+			&rec.ExpiresAtMS, &rec.LastUsedAtMS, &rec.LastUsedIP, &rec.RotatedTo, &scope,
+			&pin, &rec.PinnedServerID, &rec.PinnedHostKey, &rec.JoinCodeID); err != nil {
 			return err
 		}
+		if scope != "" {
+			rec.Scope = &Scope{}
+			if err := json.Unmarshal([]byte(scope), rec.Scope); err != nil {
+				return fmt.Errorf("invalid scope for token %s: %w", rec.TokenID, err)
+			}
+		}
 		rec.Type = TokenType(tt)
 		rec.Role = TokenRole(role)
+		rec.Pin = AgentPin(pin)
 		rec.Revoked = revokedInt != 0
 		if rec.TokenHash == "" || rec.TokenID == "" {
 			return errors.New("invalid token record in db")
@@ -119,17 +199,49 @@ FROM tokens
 	return rows.Err()
 }
 
-func (s *Store) persistInsertLocked(rec *TokenRecord) error {
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (s *Store) persistInsertLocked(rec *TokenRecord, extra func(execer) error) error {
 	if s.db == nil || rec == nil {
 		return nil
 	}
+	if extra == nil {
+		return insertTokenRow(s.db, rec)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertTokenRow(tx, rec); err != nil {
+		return err
+	}
+	if err := extra(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertTokenRow(db execer, rec *TokenRecord) error {
 	revoked := 0
 	if rec.Revoked {
 		revoked = 1
 	}
-	_, err := s.db.Exec(
-		`INSERT INTO tokens (token_id, token_hash, tenant_id, type, role, created_at_ms, revoked, name)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	scope := ""
+	if rec.Scope != nil {
+		raw, err := json.Marshal(rec.Scope)
+		if err != nil {
+			return err
+		}
+		scope = string(raw)
+	}
+	_, err := db.Exec(
+		`INSERT INTO tokens (token_id, token_hash, tenant_id, type, role, created_at_ms, revoked, name, expires_at_ms, rotated_to, scope,
+  pin, pinned_server_id, pinned_host_key, join_code_id)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		rec.TokenID,
 		rec.TokenHash,
 		rec.TenantID,
@@ -138,17 +250,78 @@ VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
 		rec.CreatedAtMS,
 		revoked,
 		rec.Name,
+		rec.ExpiresAtMS,
+		rec.RotatedTo,
+		scope,
+		string(rec.Pin),
+		rec.PinnedServerID,
+		rec.PinnedHostKey,
+		rec.JoinCodeID,
 	)
 	return err
 }
 
+func (s *Store) runUsageFlusher(interval time.Duration) {
+	defer close(s.flushDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.flushStop:
+			return
+		case <-ticker.C:
+			s.flushUsage()
+		}
+	}
+}
+
+// flushUsage writes the last-used fields of every token marked since the
+// previous flush in one transaction.
+func (s *Store) flushUsage() {
+	s.mu.Lock()
+	if len(s.used) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	batch := make([]TokenRecord, 0, len(s.used))
+	for id := range s.used {
+		if rec := s.byID[id]; rec != nil {
+			batch = append(batch, *rec)
+		}
+	}
+	s.used = nil
+	s.mu.Unlock()
+
+	err := func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		stmt, err := tx.Prepare(`UPDATE tokens SET last_used_at_ms = ?, last_used_ip = ? WHERE token_id = ?`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, rec := range batch {
+			if _, err := stmt.Exec(rec.LastUsedAtMS, rec.LastUsedIP, rec.TokenID); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		slog.Error("persist token usage failed", "count", len(batch), "err", err)
+	}
+}
+
 func (s *Store) persistRevokeByTenant(tenantID string, types []TokenType) error {
 	if s.db == nil || tenantID == "" || len(types) == 0 {
 		return nil
 	}
 	placeholders := strings.Repeat("?,", len(types))
 	placeholders = strings.TrimSuffix(placeholders, ",")
-	query := fmt.Sprintf(`UPDATE tokens SET revoked = 1 WHERE tenant_id = ? AND type IN (%s) AND revoked = 0`, placeholders)
+	query := fmt.Sprintf(`UPDATE tokens SET revoked = 1 WHERE tenant_id = ? AND type IN (%s) AND revoked = 0 AND join_code_id = ''`, placeholders)
 	args := make([]any, 0, len(types)+1)
 	args = append(args, tenantID)
 	for _, tt := range types {
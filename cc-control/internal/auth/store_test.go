@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore_RotateKeepsOldTokenForOverlap(t *testing.T) {
+	s := NewStore()
+	expires := time.Now().Add(30 * 24 * time.Hour).UnixMilli()
+	oldPlain, old, err := s.CreateToken(Actor{}, TokenTypeAgent, "", "t1", "build-box", TokenOptions{ExpiresAtMS: expires})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	newPlain, next, err := s.RotateToken(Actor{}, old.TokenID, time.Hour)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if next.TenantID != "t1" || next.Type != TokenTypeAgent || next.Name != "build-box" || next.ExpiresAtMS <= expires-1000 {
+		t.Fatalf("successor should inherit the old token's settings and lifetime: %#v", next)
+	}
+	if rec, ok := s.Lookup(newPlain); !ok || rec.Expired(time.Now()) {
+		t.Fatal("successor should be usable")
+	}
+	rec, ok := s.Lookup(oldPlain)
+	if !ok || rec.RotatedTo != next.TokenID || rec.Expired(time.Now()) {
+		t.Fatalf("old token should still work during the overlap: %#v", rec)
+	}
+	if !rec.Expired(time.Now().Add(time.Hour + time.Second)) {
+		t.Fatal("old token should expire after the overlap")
+	}
+	if _, _, err := s.RotateToken(Actor{}, old.TokenID, time.Hour); err == nil {
+		t.Fatal("a rotated token must not be rotated twice")
+	}
+	if _, _, err := s.CreateToken(Actor{}, TokenTypeAgent, "", "t1", "", TokenOptions{ExpiresAtMS: time.Now().Add(-time.Minute).UnixMilli()}); err == nil {
+		t.Fatal("expiry in the past should be rejected")
+	}
+}
+
+func TestStore_PersistsUsageAndMigratesOldSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = db.Exec(`
+CREATE TABLE tokens (
+  token_id TEXT PRIMARY KEY,
+  token_hash TEXT NOT NULL UNIQUE,
+  tenant_id TEXT NOT NULL,
+  type TEXT NOT NULL,
+  role TEXT NOT NULL,
+  created_at_ms INTEGER NOT NULL,
+  revoked INTEGER NOT NULL,
+  name TEXT NOT NULL
+);
+INSERT INTO tokens VALUES ('legacy', '` + HashToken("legacy-secret") + `', 't1', 'agent', '', 1, 0, 'old');
+`)
+	_ = db.Close()
+	if err != nil {
+		t.Fatalf("seed old schema: %v", err)
+	}
+
+	s, err := NewStoreWithSQLite(path)
+	if err != nil {
+		t.Fatalf("open store on old schema: %v", err)
+	}
+	rec, ok := s.Lookup("legacy-secret")
+	if !ok || rec.ExpiresAtMS != 0 {
+		t.Fatalf("legacy token should load without expiry: %#v", rec)
+	}
+	s.MarkUsed(rec.TokenID, "10.1.2.3")
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s, err = NewStoreWithSQLite(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	rec, _ = s.Lookup("legacy-secret")
+	if rec.LastUsedAtMS == 0 || rec.LastUsedIP != "10.1.2.3" {
+		t.Fatalf("usage should be flushed on close: %#v", rec)
+	}
+}
+
+func TestStore_BindAgentPinsFirstIdentity(t *testing.T) {
+	s := NewStore()
+	if _, _, err := s.CreateToken(Actor{}, TokenTypeUI, RoleOwner, "t1", "", TokenOptions{Pin: PinServerID}); err == nil {
+		t.Fatal("only agent tokens can be pinned")
+	}
+	_, byID, err := s.CreateToken(Actor{}, TokenTypeAgent, "", "t1", "", TokenOptions{Pin: PinServerID})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.BindAgent(byID.TokenID, "build-1", "", ""); err != nil {
+		t.Fatalf("first register should pin: %v", err)
+	}
+	if err := s.BindAgent(byID.TokenID, "build-1", "", ""); err != nil {
+		t.Fatalf("same server_id should be accepted again: %v", err)
+	}
+	if err := s.BindAgent(byID.TokenID, "build-2", "", ""); err == nil {
+		t.Fatal("a pinned token must not register another server_id")
+	}
+	_, next, err := s.RotateToken(Actor{}, byID.TokenID, time.Hour)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if next.PinnedServerID != "build-1" {
+		t.Fatalf("successor should keep the pin: %#v", next)
+	}
+
+	_, byKey, err := s.CreateToken(Actor{}, TokenTypeAgent, "", "t1", "", TokenOptions{Pin: PinHostKey})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.BindAgent(byKey.TokenID, "build-3", "", ""); err == nil {
+		t.Fatal("a host key pin needs a host key")
+	}
+	if err := s.BindAgent(byKey.TokenID, "build-3", "key-a", ""); err != nil {
+		t.Fatalf("first register should pin: %v", err)
+	}
+	if err := s.BindAgent(byKey.TokenID, "build-3", "key-b", ""); err == nil {
+		t.Fatal("a different host key must be rejected")
+	}
+}
+
+func TestStore_JoinCodeEnrollsOneHost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	s, err := NewStoreWithSQLite(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	code, jc, err := s.CreateJoinCode(Actor{}, "t1", "", 0)
+	if err != nil {
+		t.Fatalf("create code: %v", err)
+	}
+	if _, _, err := s.CreateJoinCode(Actor{}, "t1", "", 48*time.Hour); err == nil {
+		t.Fatal("ttl above the cap should be rejected")
+	}
+
+	plain, rec, err := s.RedeemJoinCode(strings.ToLower(code), "build-7", "", "10.0.0.7:5000")
+	if err != nil {
+		t.Fatalf("redeem (case-insensitive): %v", err)
+	}
+	if rec.TenantID != "t1" || rec.Type != TokenTypeAgent || rec.JoinCodeID != jc.CodeID || rec.PinnedServerID != "build-7" {
+		t.Fatalf("enrolled token should be a pinned agent token of the tenant: %#v", rec)
+	}
+	if _, _, err := s.RedeemJoinCode(code, "build-8", "", ""); err == nil {
+		t.Fatal("a join code must only work once")
+	}
+	if n := s.RevokeTokensByTenant(Actor{}, "t1", TokenTypeAgent); n != 0 {
+		t.Fatalf("tenant-wide reissue should leave enrolled hosts alone, revoked %d", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s, err = NewStoreWithSQLite(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if got, ok := s.Lookup(plain); !ok || got.Revoked || got.JoinCodeID != jc.CodeID {
+		t.Fatalf("enrolled token should persist: %#v", got)
+	}
+	codes := s.ListJoinCodes("t1")
+	if len(codes) != 1 || codes[0].UsedAtMS == 0 || codes[0].ServerID != "build-7" {
+		t.Fatalf("used code should persist: %#v", codes)
+	}
+	if _, _, err := s.RedeemJoinCode(code, "build-8", "", ""); err == nil {
+		t.Fatal("a used code must stay used after restart")
+	}
+}
+
+func TestStore_RedeemJoinCodeRollsBackTokenWhenCodeNotStored(t *testing.T) {
+	s, err := NewStoreWithSQLite(filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+	code, _, err := s.CreateJoinCode(Actor{}, "t1", "", 0)
+	if err != nil {
+		t.Fatalf("create code: %v", err)
+	}
+	if _, err := s.db.Exec(`DROP TABLE join_codes`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.RedeemJoinCode(code, "build-7", "", ""); err == nil {
+		t.Fatal("redeem should fail when the used code cannot be stored")
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM tokens WHERE join_code_id != ''`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("enrolled token should be rolled back, rows=%d err=%v", n, err)
+	}
+	if toks := s.ListTokens("t1"); len(toks) != 0 {
+		t.Fatalf("enrolled token should not be kept in memory: %#v", toks)
+	}
+	if codes := s.ListJoinCodes("t1"); len(codes) != 1 || codes[0].UsedAtMS != 0 {
+		t.Fatalf("code should stay unused: %#v", codes)
+	}
+}
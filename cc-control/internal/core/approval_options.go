@@ -0,0 +1,109 @@
+package core
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// approvalOptionLine matches a numbered menu entry such as "❯ 1. Yes" or
+// "│   2) No, and tell Claude what to do differently │".
+var approvalOptionLine = regexp.MustCompile(`^[\s│|]*(?:[❯›>▶]\s*)?(\d{1,2})[.)]\s+(.+?)[\s│|]*$`)
+
+// parseApprovalOptions extracts the last numbered menu of an excerpt. Only a
+// run numbered 1, 2, ... with at least two entries counts as a menu.
+func parseApprovalOptions(excerpt string) []ApprovalOption {
+	var menu, cur []ApprovalOption
+	for _, line := range strings.Split(excerpt, "\n") {
+		m := approvalOptionLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		switch {
+		case n == 1:
+			cur = []ApprovalOption{{Index: 1, Label: m[2]}}
+		case cur != nil && n == len(cur)+1:
+			cur = append(cur, ApprovalOption{Index: n, Label: m[2]})
+		default:
+			cur = nil
+		}
+		if len(cur) >= 2 {
+			menu = cur
+		}
+	}
+	return menu
+}
+
+// selectApprovalOption resolves a choose action to one of the options. A
+// label matches case-insensitively, exactly or as a unique prefix.
+func selectApprovalOption(options []ApprovalOption, req ActionRequest) (ApprovalOption, error) {
+	if len(options) == 0 {
+		return ApprovalOption{}, errors.New("approval has no options")
+	}
+	if req.Choice > 0 {
+		for _, opt := range options {
+			if opt.Index == req.Choice {
+				return opt, nil
+			}
+		}
+		return ApprovalOption{}, errors.New("unknown approval option")
+	}
+	label := strings.ToLower(strings.TrimSpace(req.Label))
+	if label == "" {
+		return ApprovalOption{}, errors.New("choice or label is required")
+	}
+	var prefixed []ApprovalOption
+	for _, opt := range options {
+		have := strings.ToLower(opt.Label)
+		if have == label {
+			return opt, nil
+		}
+		if strings.HasPrefix(have, label) {
+			prefixed = append(prefixed, opt)
+		}
+	}
+	if len(prefixed) == 1 {
+		return prefixed[0], nil
+	}
+	if len(prefixed) > 1 {
+		return ApprovalOption{}, errors.New("ambiguous approval option")
+	}
+	return ApprovalOption{}, errors.New("unknown approval option")
+}
+
+const maxFeedbackMessageBytes = 8 * 1024
+
+// defaultFeedbackPasteDelay separates the keys that open a CLI's feedback
+// input from the pasted message, so the TUI has switched modes when it
+// arrives.
+const defaultFeedbackPasteDelay = 300 * time.Millisecond
+
+// feedbackOptionPattern matches menu entries such as "No, and tell Claude
+// what to do differently".
+var feedbackOptionPattern = regexp.MustCompile(`(?i)^no\b.*\b(tell|feedback|instead|differently)\b`)
+
+func feedbackOption(options []ApprovalOption) (ApprovalOption, bool) {
+	for _, opt := range options {
+		if feedbackOptionPattern.MatchString(opt.Label) {
+			return opt, true
+		}
+	}
+	return ApprovalOption{}, false
+}
+
+// sanitizePasteText drops control characters, including ESC, so a message
+// can't end the bracketed paste early or inject keys.
+func sanitizePasteText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+			return -1
+		}
+		return r
+	}, s)
+}
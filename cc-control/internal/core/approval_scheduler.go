@@ -0,0 +1,193 @@
+package core
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"cc-control/internal/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	approvalCheckInterval = 5 * time.Second
+	approvalDeadlineActor = "system:approval_deadline"
+)
+
+// approvalFollowUp is one scheduler step for a pending approval: the new
+// reminder, escalation or timeout event plus what is needed to deliver it.
+type approvalFollowUp struct {
+	ev        SessionEvent
+	ref       SessionEvent
+	createdBy string
+	role      auth.TokenRole
+	action    string
+}
+
+func (cp *ControlPlane) runApprovalScheduler() {
+	ticker := time.NewTicker(approvalCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cp.stop:
+			return
+		case now := <-ticker.C:
+			cp.checkApprovals(now)
+		}
+	}
+}
+
+// checkApprovals applies the tenant reminder, escalation and deadline
+// settings to approvals still pending at now. Each step runs at most once
+// per interval and is recorded as its own event referencing the prompt.
+func (cp *ControlPlane) checkApprovals(now time.Time) {
+	nowMS := now.UnixMilli()
+	var work []approvalFollowUp
+	cp.mu.Lock()
+	for sessionID, sess := range cp.sessions {
+		if !sess.AwaitingApproval || sess.PendingEventID == "" {
+			continue
+		}
+		settings := cp.tenantSettingsLocked(sess.TenantID)
+		if settings.ApprovalReminderSec <= 0 && settings.ApprovalEscalateAfterSec <= 0 && settings.ApprovalDeadlineSec <= 0 {
+			continue
+		}
+		events := cp.sessionEvents[sessionID]
+		idx := -1
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].EventID == sess.PendingEventID {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 || events[idx].Resolved {
+			continue
+		}
+		ev := &events[idx]
+		age := time.Duration(nowMS-ev.TsMS) * time.Millisecond
+		var steps []approvalFollowUp
+		switch {
+		case settings.ApprovalDeadlineSec > 0 && ev.DeadlineAtMS == 0 && age >= time.Duration(settings.ApprovalDeadlineSec)*time.Second:
+			ev.DeadlineAtMS = nowMS
+			steps = append(steps, approvalFollowUp{ev: SessionEvent{Kind: "approval_timeout"}, action: settings.ApprovalDeadlineAction})
+		case ev.DeadlineAtMS != 0:
+			// The deadline action could not be delivered; the prompt stays
+			// pending for a human.
+		default:
+			if settings.ApprovalEscalateAfterSec > 0 && ev.EscalatedAtMS == 0 && age >= time.Duration(settings.ApprovalEscalateAfterSec)*time.Second {
+				ev.EscalatedAtMS = nowMS
+				role, _ := auth.ParseRole(settings.ApprovalEscalateRole)
+				steps = append(steps, approvalFollowUp{ev: SessionEvent{Kind: "approval_escalated"}, role: role})
+			}
+			if settings.ApprovalReminderSec > 0 {
+				last := ev.TsMS
+				if ev.RemindedAtMS > last {
+					last = ev.RemindedAtMS
+				}
+				if nowMS-last >= int64(settings.ApprovalReminderSec)*1000 {
+					ev.RemindedAtMS = nowMS
+					steps = append(steps, approvalFollowUp{ev: SessionEvent{Kind: "approval_reminder"}})
+				}
+			}
+		}
+		ref := *ev
+		for _, step := range steps {
+			step.ev.EventID = uuid.NewString()
+			step.ev.SessionID = sessionID
+			step.ev.ServerID = ref.ServerID
+			step.ev.TenantID = ref.TenantID
+			step.ev.Profile = ref.Profile
+			step.ev.Actor = "system"
+			step.ev.TsMS = nowMS
+			step.ev.Resolved = true
+			step.ev.RefEventID = ref.EventID
+			step.ref = ref
+			step.createdBy = sess.CreatedBy
+			cp.sessionEvents[sessionID] = append(cp.sessionEvents[sessionID], step.ev)
+			work = append(work, step)
+		}
+	}
+	cp.mu.Unlock()
+
+	for _, step := range work {
+		cp.persistSessionEvent(step.ev.SessionID, step.ref.EventID)
+		cp.persistSessionEvent(step.ev.SessionID, step.ev.EventID)
+		meta := map[string]any{
+			"event_id":     step.ev.EventID,
+			"ref_event_id": step.ref.EventID,
+		}
+		if step.role != "" {
+			meta["role"] = step.role
+		}
+		if step.action != "" {
+			meta["action"] = step.action
+		}
+		cp.audit.Log(AuditEvent{
+			TenantID:  step.ev.TenantID,
+			Actor:     "system",
+			ServerID:  step.ev.ServerID,
+			SessionID: step.ev.SessionID,
+			Kind:      step.ev.Kind,
+			Meta:      meta,
+		})
+		switch step.ev.Kind {
+		case "approval_reminder":
+			cp.broadcastApprovalEvent(step.ev, step.createdBy)
+			cp.broadcastApprovalEvent(step.ref, step.createdBy)
+		case "approval_escalated":
+			cp.broadcastToRole(step.ev.TenantID, step.role, eventEnvelope(step.ev))
+			cp.broadcastToRole(step.ref.TenantID, step.role, eventEnvelope(step.ref))
+		case "approval_timeout":
+			cp.broadcastApprovalEvent(step.ev, step.createdBy)
+			if err := cp.applyDeadlineAction(step.ev.SessionID, step.ref.EventID, step.action); err != nil {
+				slog.Warn("approval deadline action failed", "session_id", step.ev.SessionID, "action", step.action, "err", err)
+			}
+		}
+	}
+}
+
+// applyDeadlineAction answers or stops a session whose approval timed out.
+func (cp *ControlPlane) applyDeadlineAction(sessionID, eventID, action string) error {
+	if action != "stop" {
+		return cp.HandleClientAction(approvalDeadlineActor, "", nil, sessionID, ActionRequest{Kind: action, EventID: eventID})
+	}
+	if err := cp.StopSession(approvalDeadlineActor, "", sessionID, cp.cfg.DefaultGraceMS, cp.cfg.DefaultKillMS); err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	if sess, ok := cp.sessions[sessionID]; ok && sess.PendingEventID == eventID {
+		sess.AwaitingApproval = false
+		sess.PendingEventID = ""
+	}
+	events := cp.sessionEvents[sessionID]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].EventID == eventID {
+			events[i].Resolved = true
+			events[i].Actor = approvalDeadlineActor
+			break
+		}
+	}
+	cp.mu.Unlock()
+	cp.persistSessionEvent(sessionID, eventID)
+	cp.persistSession(sessionID)
+	cp.broadcastSessionUpdate(sessionID)
+	return nil
+}
+
+func eventEnvelope(ev SessionEvent) Envelope {
+	body, _ := json.Marshal(ev)
+	msg := NewEnvelope("event", ev.ServerID, ev.SessionID)
+	msg.Data = body
+	return msg
+}
+
+// broadcastApprovalEvent delivers an approval related event the way
+// Config.ApprovalBroadcast asks for.
+func (cp *ControlPlane) broadcastApprovalEvent(ev SessionEvent, createdBy string) {
+	msg := eventEnvelope(ev)
+	if cp.cfg.ApprovalBroadcast == "attached" {
+		cp.broadcastToAttached(ev.SessionID, msg)
+		return
+	}
+	cp.broadcastToTenant(ev.TenantID, ev.ServerID, createdBy, msg)
+}
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cc-control/internal/auth"
+)
+
+func drainEventKinds(sub *Subscriber) []string {
+	var kinds []string
+	for {
+		select {
+		case msg := <-sub.Send:
+			if msg.Type != "event" {
+				continue
+			}
+			var ev SessionEvent
+			if err := json.Unmarshal(msg.Data, &ev); err == nil {
+				kinds = append(kinds, ev.Kind)
+			}
+		default:
+			return kinds
+		}
+	}
+}
+
+func eventsOfKind(cp *ControlPlane, sessionID, kind string) []SessionEvent {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	var out []SessionEvent
+	for _, ev := range cp.sessionEvents[sessionID] {
+		if ev.Kind == kind {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func TestCheckApprovals_ReminderRebroadcastsOncePerInterval(t *testing.T) {
+	cp, _, sessionID, eventID := setupActionTestControlPlane(t, "Continue? [y/N]")
+	if _, err := cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", ApprovalReminderSec: 60}); err != nil {
+		t.Fatalf("set settings: %v", err)
+	}
+	sub := &Subscriber{ID: "ui", Actor: "ui:a", TenantID: "t1", Send: make(chan Envelope, 16)}
+	cp.RegisterSubscriber(sub)
+
+	cp.checkApprovals(time.UnixMilli(30_000))
+	if got := drainEventKinds(sub); len(got) != 0 {
+		t.Fatalf("no reminder expected before the interval, got %v", got)
+	}
+	cp.checkApprovals(time.UnixMilli(61_000))
+	if got := drainEventKinds(sub); len(got) != 2 || got[0] != "approval_reminder" || got[1] != "approval_needed" {
+		t.Fatalf("expected reminder and original event, got %v", got)
+	}
+	cp.checkApprovals(time.UnixMilli(90_000))
+	if got := drainEventKinds(sub); len(got) != 0 {
+		t.Fatalf("reminder repeated within interval: %v", got)
+	}
+	cp.checkApprovals(time.UnixMilli(121_000))
+	reminders := eventsOfKind(cp, sessionID, "approval_reminder")
+	if len(reminders) != 2 || reminders[0].RefEventID != eventID || !reminders[0].Resolved {
+		t.Fatalf("unexpected reminder events: %#v", reminders)
+	}
+	if !sessionByID(t, cp, sessionID).AwaitingApproval {
+		t.Fatal("reminders must not resolve the approval")
+	}
+}
+
+func TestCheckApprovals_EscalationReachesRoleOnly(t *testing.T) {
+	cp, _, sessionID, _ := setupActionTestControlPlane(t, "Continue? [y/N]")
+	if _, err := cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", ApprovalEscalateAfterSec: 120}); err != nil {
+		t.Fatalf("set settings: %v", err)
+	}
+	viewer := &Subscriber{ID: "v", Actor: "ui:v", TenantID: "t1", Role: auth.RoleViewer, Send: make(chan Envelope, 16)}
+	owner := &Subscriber{ID: "o", Actor: "ui:o", TenantID: "t1", Role: auth.RoleOwner, Scope: ScopeOwn, Send: make(chan Envelope, 16)}
+	other := &Subscriber{ID: "x", Actor: "ui:x", TenantID: "t2", Role: auth.RoleOwner, Send: make(chan Envelope, 16)}
+	admin := &Subscriber{ID: "a", Actor: "ui:a", Role: auth.RoleOwner, Send: make(chan Envelope, 16)}
+	for _, sub := range []*Subscriber{viewer, owner, other, admin} {
+		cp.RegisterSubscriber(sub)
+	}
+
+	cp.checkApprovals(time.UnixMilli(121_000))
+	cp.checkApprovals(time.UnixMilli(300_000))
+	if got := drainEventKinds(owner); len(got) != 2 || got[0] != "approval_escalated" {
+		t.Fatalf("owner should get one escalation despite own scope, got %v", got)
+	}
+	if got := drainEventKinds(viewer); len(got) != 0 {
+		t.Fatalf("viewer should not get escalations, got %v", got)
+	}
+	if got := drainEventKinds(other); len(got) != 0 {
+		t.Fatalf("other tenant should not get escalations, got %v", got)
+	}
+	if got := drainEventKinds(admin); len(got) != 2 || got[0] != "approval_escalated" {
+		t.Fatalf("admin subscriber should get the escalation, got %v", got)
+	}
+	if evs := eventsOfKind(cp, sessionID, "approval_needed"); evs[0].EscalatedAtMS != 121_000 {
+		t.Fatalf("escalation not recorded on the prompt event: %#v", evs[0])
+	}
+}
+
+func TestCheckApprovals_DeadlineRejects(t *testing.T) {
+	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, "Continue? [y/N]")
+	if _, err := cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", ApprovalDeadlineSec: 300}); err != nil {
+		t.Fatalf("set settings: %v", err)
+	}
+
+	cp.checkApprovals(time.UnixMilli(301_000))
+	if got := lastPTYInput(t, conn); got != "n\n" {
+		t.Fatalf("deadline should reject, sent %q", got)
+	}
+	if sessionByID(t, cp, sessionID).AwaitingApproval {
+		t.Fatal("approval should be resolved after the deadline")
+	}
+	timeouts := eventsOfKind(cp, sessionID, "approval_timeout")
+	if len(timeouts) != 1 || timeouts[0].RefEventID != eventID {
+		t.Fatalf("expected one timeout event, got %#v", timeouts)
+	}
+	if prompt := eventsOfKind(cp, sessionID, "approval_needed")[0]; prompt.Actor != approvalDeadlineActor {
+		t.Fatalf("prompt resolved by %q", prompt.Actor)
+	}
+}
+
+func TestCheckApprovals_DeadlineKeepsPromptWhenAgentOffline(t *testing.T) {
+	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, "Continue? [y/N]")
+	if _, err := cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", ApprovalDeadlineSec: 300}); err != nil {
+		t.Fatalf("set settings: %v", err)
+	}
+	cp.mu.Lock()
+	cp.agentConns = map[serverKey]AgentSender{}
+	cp.mu.Unlock()
+
+	cp.checkApprovals(time.UnixMilli(301_000))
+	got := sessionByID(t, cp, sessionID)
+	if !got.AwaitingApproval || got.PendingEventID != eventID {
+		t.Fatalf("undelivered deadline action should leave the approval pending: %#v", got)
+	}
+	if prompt := eventsOfKind(cp, sessionID, "approval_needed")[0]; prompt.Resolved || prompt.Actor == approvalDeadlineActor {
+		t.Fatalf("prompt should still be open: %#v", prompt)
+	}
+	if pending := cp.GetPendingApprovalEvents("t1", nil); len(pending) != 1 || pending[0].EventID != eventID {
+		t.Fatalf("prompt should still be listed as pending: %#v", pending)
+	}
+
+	cp.mu.Lock()
+	cp.agentConns[serverKey{"t1", "srv"}] = conn
+	cp.mu.Unlock()
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "approve", EventID: eventID}); err != nil {
+		t.Fatalf("a human should still be able to answer: %v", err)
+	}
+	if got := lastPTYInput(t, conn); got != "y\n" {
+		t.Fatalf("approve sent %q", got)
+	}
+}
+
+func TestCheckApprovals_DeadlineStopsSession(t *testing.T) {
+	cp, conn, sessionID, _ := setupActionTestControlPlane(t, "Continue? [y/N]")
+	if _, err := cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", ApprovalDeadlineSec: 60, ApprovalDeadlineAction: "stop"}); err != nil {
+		t.Fatalf("set settings: %v", err)
+	}
+
+	cp.checkApprovals(time.UnixMilli(61_000))
+	if len(conn.msgs) == 0 || conn.msgs[len(conn.msgs)-1].Type != "stop_session" {
+		t.Fatalf("expected stop_session, got %#v", conn.msgs)
+	}
+	got := sessionByID(t, cp, sessionID)
+	if got.AwaitingApproval || got.Status != SessionStopping {
+		t.Fatalf("unexpected session after deadline stop: %#v", got)
+	}
+}
+
+func TestSetTenantSettings_ValidatesApprovalSettings(t *testing.T) {
+	cp, _, _, _ := setupActionTestControlPlane(t, "")
+	if _, err := cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", ApprovalEscalateRole: "root"}); err == nil {
+		t.Fatal("expected invalid role error")
+	}
+	if _, err := cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", ApprovalDeadlineSec: 10, ApprovalDeadlineAction: "ignore"}); err == nil {
+		t.Fatal("expected invalid deadline action error")
+	}
+	got, err := cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", ApprovalEscalateAfterSec: 30, ApprovalDeadlineSec: 60})
+	if err != nil {
+		t.Fatalf("set settings: %v", err)
+	}
+	if got.ApprovalEscalateRole != string(auth.RoleOwner) || got.ApprovalDeadlineAction != "reject" {
+		t.Fatalf("defaults not applied: %#v", got)
+	}
+}
@@ -1,53 +1,516 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"cc-control/internal/auth"
+)
+
+const (
+	auditCheckpointKind          = "audit_checkpoint"
+	defaultAuditCheckpointPeriod = time.Hour
+	auditRotatedTimeLayout       = "20060102T150405.000"
 )
 
+// auditRotatedName matches files rotated away from the active log, e.g.
+// audit-20260101T000000.000.jsonl or the same with .gz.
+var auditRotatedName = regexp.MustCompile(`-\d{8}T\d{6}\.\d{3}\.[^.]+(\.gz)?$`)
+
+// AuditEvent is one line of the audit log. TenantID is empty for events
+// that concern the whole control plane. Seq and PrevHash chain records
+// together; each line additionally ends with its own "hash", see
+// AuditLogger.appendLocked.
 type AuditEvent struct {
 	TsMS      int64          `json:"ts_ms"`
+	TenantID  string         `json:"tenant_id,omitempty"`
 	Actor     string         `json:"actor"`
 	ServerID  string         `json:"server_id,omitempty"`
 	SessionID string         `json:"session_id,omitempty"`
 	Kind      string         `json:"kind"`
 	Meta      map[string]any `json:"meta,omitempty"`
+	Seq       uint64         `json:"seq,omitempty"`
+	PrevHash  string         `json:"prev_hash,omitempty"`
+}
+
+// AuditOptions configure rotation and integrity checkpoints of the audit
+// log. The zero value keeps a single, never rotated file.
+type AuditOptions struct {
+	// RotateBytes rotates the active file before it would grow past this
+	// size; RotateInterval rotates files older than this. 0 disables either.
+	RotateBytes    int64
+	RotateInterval time.Duration
+	// Compress gzips rotated files.
+	Compress bool
+	// SigningKey signs a checkpoint of the chain head every
+	// CheckpointInterval (default 1h), on rotation and on close. Nil
+	// disables checkpoints; the hash chain is written regardless.
+	SigningKey         ed25519.PrivateKey
+	CheckpointInterval time.Duration
 }
 
 type AuditLogger struct {
 	mu   sync.Mutex
+	path string
+	opts AuditOptions
 	file *os.File
+
+	size     int64
+	openedAt time.Time
+	seq      uint64
+	lastHash string
+	// unsigned counts records since the last checkpoint.
+	unsigned       int
+	lastCheckpoint time.Time
+
+	// indexCh feeds written records to the audit index, see attachIndex.
+	indexCh   chan AuditEvent
+	indexDone chan struct{}
+	// indexGap is the lowest seq that missed the index, 0 for none. The
+	// indexer reads it without a.mu, which Close holds while it drains.
+	indexGap atomic.Uint64
 }
 
-func NewAuditLogger(path string) (*AuditLogger, error) {
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
-	if err != nil {
+func NewAuditLogger(path string, opts AuditOptions) (*AuditLogger, error) {
+	if opts.CheckpointInterval <= 0 {
+		opts.CheckpointInterval = defaultAuditCheckpointPeriod
+	}
+	a := &AuditLogger{path: path, opts: opts, lastCheckpoint: time.Now()}
+	if err := a.resumeChain(); err != nil {
+		return nil, err
+	}
+	if err := a.openActive(); err != nil {
 		return nil, err
 	}
-	return &AuditLogger{file: f}, nil
+	return a, nil
 }
 
 func (a *AuditLogger) Close() error {
 	if a == nil || a.file == nil {
 		return nil
 	}
-	return a.file.Close()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checkpointLocked(time.Now())
+	err := a.file.Close()
+	a.file = nil
+	if a.indexCh != nil {
+		close(a.indexCh)
+		<-a.indexDone
+		a.indexCh = nil
+	}
+	return err
 }
 
 func (a *AuditLogger) Log(event AuditEvent) {
-	if a == nil || a.file == nil {
+	if a == nil {
 		return
 	}
+	now := time.Now()
 	if event.TsMS == 0 {
-		event.TsMS = time.Now().UnixMilli()
+		event.TsMS = now.UnixMilli()
 	}
-	line, err := json.Marshal(event)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if a.shouldRotateLocked(now) {
+		if err := a.rotateLocked(now); err != nil {
+			slog.Error("rotate audit log failed", "path", a.path, "err", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+	if err := a.appendLocked(event); err != nil {
+		return
+	}
+	a.unsigned++
+	if now.Sub(a.lastCheckpoint) >= a.opts.CheckpointInterval {
+		a.checkpointLocked(now)
+	}
+}
+
+// LogAuthEvent implements auth.AuditSink, so token events are chained
+// together with session events.
+func (a *AuditLogger) LogAuthEvent(kind string, actor auth.Actor, tenantID string, meta map[string]any) {
+	merged := actor.AuditMeta()
+	for k, v := range meta {
+		merged[k] = v
+	}
+	a.Log(AuditEvent{TenantID: tenantID, Actor: actor.String(), Kind: kind, Meta: merged})
+}
+
+// appendLocked chains event to the previous record and writes it. The line
+// is the JSON of the event followed by "hash", the hex SHA-256 of that JSON
+// without the hash field, so verification works on the raw bytes.
+func (a *AuditLogger) appendLocked(event AuditEvent) error {
+	event.Seq = a.seq + 1
+	event.PrevHash = a.lastHash
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	line := make([]byte, 0, len(body)+len(hash)+12)
+	line = append(line, body[:len(body)-1]...)
+	line = append(line, `,"hash":"`...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+	n, err := a.file.Write(line)
+	a.size += int64(n)
 	if err != nil {
+		return err
+	}
+	a.seq = event.Seq
+	a.lastHash = hash
+	a.enqueueIndexLocked(event)
+	return nil
+}
+
+// checkpointLocked signs the current chain head. The checkpoint is itself a
+// chained record, so removing it breaks the chain too.
+func (a *AuditLogger) checkpointLocked(now time.Time) {
+	if a.opts.SigningKey == nil || a.unsigned == 0 || a.file == nil {
 		return
 	}
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	_, _ = a.file.Write(append(line, '\n'))
+	sig := ed25519.Sign(a.opts.SigningKey, auditCheckpointMessage(a.seq, a.lastHash))
+	pub := a.opts.SigningKey.Public().(ed25519.PublicKey)
+	err := a.appendLocked(AuditEvent{
+		TsMS:  now.UnixMilli(),
+		Actor: "system",
+		Kind:  auditCheckpointKind,
+		Meta: map[string]any{
+			"covers_seq":  a.seq,
+			"covers_hash": a.lastHash,
+			"key_id":      auditKeyID(pub),
+			"sig":         base64.StdEncoding.EncodeToString(sig),
+		},
+	})
+	if err != nil {
+		slog.Error("write audit checkpoint failed", "path", a.path, "err", err)
+		return
+	}
+	a.unsigned = 0
+	a.lastCheckpoint = now
+}
+
+func (a *AuditLogger) shouldRotateLocked(now time.Time) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.opts.RotateBytes > 0 && a.size >= a.opts.RotateBytes {
+		return true
+	}
+	return a.opts.RotateInterval > 0 && now.Sub(a.openedAt) >= a.opts.RotateInterval
+}
+
+// rotateLocked checkpoints and closes the active file, moves it aside under
+// a timestamped name (gzipped if configured) and starts a new one. The chain
+// continues across files.
+func (a *AuditLogger) rotateLocked(now time.Time) error {
+	a.checkpointLocked(now)
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	a.file = nil
+	rotated := a.rotatedName(now)
+	if err := os.Rename(a.path, rotated); err != nil {
+		_ = a.openActive()
+		return err
+	}
+	if err := a.openActive(); err != nil {
+		return err
+	}
+	if a.opts.Compress {
+		if err := gzipFile(rotated); err != nil {
+			slog.Error("compress rotated audit log failed", "path", rotated, "err", err)
+		}
+	}
+	return nil
+}
+
+// rotatedName timestamps the file being rotated away. Names must sort in
+// rotation order and never replace an earlier file, so a taken millisecond
+// moves on to the next one.
+func (a *AuditLogger) rotatedName(now time.Time) string {
+	ext := filepath.Ext(a.path)
+	stem := strings.TrimSuffix(a.path, ext)
+	for ts := now.UTC(); ; ts = ts.Add(time.Millisecond) {
+		name := stem + "-" + ts.Format(auditRotatedTimeLayout) + ext
+		if !fileExists(name) && !fileExists(name+".gz") {
+			return name
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (a *AuditLogger) openActive() error {
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	if a.size == 0 || a.openedAt.IsZero() {
+		a.openedAt = time.Now()
+	}
+	return nil
+}
+
+// resumeChain picks up seq and hash from the newest chained record, in the
+// active file or else the most recent rotated one, and the age of the active
+// file from its first record.
+func (a *AuditLogger) resumeChain() error {
+	files, err := auditFiles(filepath.Dir(a.path), filepath.Base(a.path))
+	if err != nil {
+		return err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		first, last, err := scanAuditFile(files[i])
+		if err != nil {
+			return err
+		}
+		if filepath.Base(files[i]) == filepath.Base(a.path) && first != nil {
+			a.openedAt = time.UnixMilli(first.TsMS)
+		}
+		if last != nil {
+			a.seq = last.Seq
+			a.lastHash = last.hash
+			return nil
+		}
+	}
+	return nil
+}
+
+type auditRecord struct {
+	AuditEvent
+	hash string
+}
+
+// scanAuditFile returns the first record and the last chained record of a
+// (possibly gzipped) audit file.
+func scanAuditFile(path string) (first, last *auditRecord, err error) {
+	err = readAuditLines(path, func(_ int, line []byte) error {
+		rec, ok := parseAuditLine(line)
+		if first == nil {
+			first = &rec
+		}
+		if ok {
+			last = &rec
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return first, last, err
+}
+
+// parseAuditLine decodes a record and reports whether it carries a hash.
+// The hash itself is not checked here.
+func parseAuditLine(line []byte) (auditRecord, bool) {
+	var rec auditRecord
+	_ = json.Unmarshal(line, &rec.AuditEvent)
+	_, hash, ok := splitAuditHash(line)
+	if !ok {
+		return rec, false
+	}
+	rec.hash = hash
+	return rec, true
+}
+
+// splitAuditHash splits a line into the hashed JSON body and its hash.
+func splitAuditHash(line []byte) (body []byte, hash string, ok bool) {
+	const marker = `,"hash":"`
+	i := bytes.LastIndex(line, []byte(marker))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", false
+	}
+	hash = string(line[i+len(marker) : len(line)-2])
+	if len(hash) != sha256.Size*2 {
+		return nil, "", false
+	}
+	body = append(append([]byte{}, line[:i]...), '}')
+	return body, hash, true
+}
+
+func readAuditLines(path string, fn func(lineNo int, line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if ferr := fn(n, line); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// auditFiles lists the audit files of one log in chain order: rotated files
+// oldest first, then the active file. An empty base accepts every log file
+// in dir, which assumes the directory holds a single audit log.
+func auditFiles(dir, base string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	var rotated, active []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			continue
+		}
+		switch {
+		case auditRotatedName.MatchString(name):
+			if base == "" || strings.HasPrefix(name, stem+"-") {
+				rotated = append(rotated, filepath.Join(dir, name))
+			}
+		case base == "" && strings.HasSuffix(name, ".jsonl"), name == base:
+			active = append(active, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(rotated)
+	sort.Strings(active)
+	return append(rotated, active...), nil
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func auditCheckpointMessage(seq uint64, hash string) []byte {
+	return []byte(fmt.Sprintf("cc-audit-checkpoint\n%d\n%s", seq, hash))
+}
+
+func auditKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// LoadAuditSigningKey reads a PEM PKCS#8 Ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`.
+func LoadAuditSigningKey(path string) (ed25519.PrivateKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("audit signing key must be a PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("audit signing key is not ed25519")
+	}
+	return priv, nil
+}
+
+// LoadAuditPublicKey reads the PEM key checkpoints are verified with. A
+// private key is accepted too and its public half used.
+func LoadAuditPublicKey(path string) (ed25519.PublicKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("audit public key must be PEM")
+	}
+	if block.Type == "PRIVATE KEY" {
+		priv, err := LoadAuditSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return priv.Public().(ed25519.PublicKey), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("audit public key is not ed25519")
+	}
+	return pub, nil
 }
@@ -0,0 +1,319 @@
+package core
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+	auditIndexQueueSize  = 4096
+	auditIndexBatchSize  = 500
+)
+
+// AuditQuery filters audit records. An empty TenantID matches every tenant
+// and is reserved for admins. Results are newest first; Before is the cursor
+// of the previous page and only returns records with a lower seq.
+type AuditQuery struct {
+	TenantID  string
+	Actor     string
+	Kind      string
+	ServerID  string
+	SessionID string
+	SinceMS   int64
+	UntilMS   int64
+	Before    uint64
+	Limit     int
+}
+
+type AuditPage struct {
+	Events     []AuditEvent `json:"events"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// AuditIndex stores chained audit records for queries. Records are keyed by
+// seq, so indexing the same record twice is harmless. LastAuditSeq is the
+// highest seq below which nothing is missing.
+type AuditIndex interface {
+	IndexAuditEvents(events []AuditEvent) error
+	LastAuditSeq() (uint64, error)
+	QueryAudit(q AuditQuery) ([]AuditEvent, error)
+}
+
+func (q AuditQuery) matches(ev AuditEvent) bool {
+	switch {
+	case ev.Seq == 0:
+		return false
+	case q.TenantID != "" && ev.TenantID != q.TenantID,
+		q.Actor != "" && ev.Actor != q.Actor,
+		q.Kind != "" && ev.Kind != q.Kind,
+		q.ServerID != "" && ev.ServerID != q.ServerID,
+		q.SessionID != "" && ev.SessionID != q.SessionID:
+		return false
+	case q.SinceMS > 0 && ev.TsMS < q.SinceMS,
+		q.UntilMS > 0 && ev.TsMS >= q.UntilMS,
+		q.Before > 0 && ev.Seq >= q.Before:
+		return false
+	}
+	return true
+}
+
+// ParseAuditCursor decodes the next_cursor of an AuditPage.
+func ParseAuditCursor(cursor string) (uint64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil || seq == 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return seq, nil
+}
+
+// QueryAudit returns one page of audit records. It reads the SQLite index
+// when state persistence is enabled and scans the log files otherwise.
+// Records written before hash chaining have no seq and are not returned.
+func (cp *ControlPlane) QueryAudit(q AuditQuery) (AuditPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultAuditPageSize
+	}
+	if q.Limit > maxAuditPageSize {
+		q.Limit = maxAuditPageSize
+	}
+	var events []AuditEvent
+	var err error
+	if ix, ok := cp.state.(AuditIndex); ok {
+		events, err = ix.QueryAudit(q)
+	} else {
+		events, err = cp.audit.scan(q)
+	}
+	if err != nil {
+		return AuditPage{}, err
+	}
+	page := AuditPage{Events: events}
+	if page.Events == nil {
+		page.Events = []AuditEvent{}
+	}
+	if len(events) == q.Limit {
+		page.NextCursor = strconv.FormatUint(events[len(events)-1].Seq, 10)
+	}
+	return page, nil
+}
+
+// ExportAudit calls fn for every record matching q, newest first, ignoring
+// q.Limit. The index is read page by page; without one each log file is
+// read once, newest first, holding only that file's matches in memory.
+func (cp *ControlPlane) ExportAudit(q AuditQuery, fn func(AuditEvent) error) error {
+	if _, ok := cp.state.(AuditIndex); !ok {
+		return cp.audit.export(q, fn)
+	}
+	q.Limit = maxAuditPageSize
+	for {
+		page, err := cp.QueryAudit(q)
+		if err != nil {
+			return err
+		}
+		for _, ev := range page.Events {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		if q.Before, err = ParseAuditCursor(page.NextCursor); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *AuditLogger) export(q AuditQuery, fn func(AuditEvent) error) error {
+	if a == nil {
+		return nil
+	}
+	files, err := auditFiles(filepath.Dir(a.path), filepath.Base(a.path))
+	if err != nil {
+		return err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		var out []AuditEvent
+		err := readAuditLines(files[i], func(_ int, line []byte) error {
+			if rec, ok := parseAuditLine(line); ok && q.matches(rec.AuditEvent) {
+				out = append(out, rec.AuditEvent)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Seq > out[j].Seq })
+		for _, ev := range out {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan filters the audit files directly, for deployments without an index.
+func (a *AuditLogger) scan(q AuditQuery) ([]AuditEvent, error) {
+	if a == nil {
+		return nil, nil
+	}
+	files, err := auditFiles(filepath.Dir(a.path), filepath.Base(a.path))
+	if err != nil {
+		return nil, err
+	}
+	var out []AuditEvent
+	for _, path := range files {
+		err := readAuditLines(path, func(_ int, line []byte) error {
+			if rec, ok := parseAuditLine(line); ok && q.matches(rec.AuditEvent) {
+				out = append(out, rec.AuditEvent)
+			}
+			return nil
+		})
+		// A file may be rotated away between listing and reading.
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq > out[j].Seq })
+	if len(out) > q.Limit {
+		out = out[:q.Limit]
+	}
+	return out, nil
+}
+
+// attachIndex feeds new records to ix from now on, after indexing whatever
+// the log files hold beyond the index's last seq, e.g. records written while
+// the index was unavailable.
+func (a *AuditLogger) attachIndex(ix AuditIndex) error {
+	last, err := ix.LastAuditSeq()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	head := a.seq
+	a.mu.Unlock()
+	if last > head {
+		slog.Warn("audit index is ahead of the audit log; was the log replaced?", "index_seq", last, "log_seq", head)
+	}
+	if err := a.backfillIndex(ix, last); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.indexCh = make(chan AuditEvent, auditIndexQueueSize)
+	a.indexDone = make(chan struct{})
+	go a.runIndexer(ix, a.indexCh, a.indexDone)
+	a.mu.Unlock()
+	return nil
+}
+
+// backfillIndex indexes every record in the log files with a seq above
+// after. Records already in the index are ignored by it.
+func (a *AuditLogger) backfillIndex(ix AuditIndex, after uint64) error {
+	files, err := auditFiles(filepath.Dir(a.path), filepath.Base(a.path))
+	if err != nil {
+		return err
+	}
+	var batch []AuditEvent
+	for _, path := range files {
+		err := readAuditLines(path, func(_ int, line []byte) error {
+			rec, ok := parseAuditLine(line)
+			if !ok || rec.Seq <= after {
+				return nil
+			}
+			batch = append(batch, rec.AuditEvent)
+			if len(batch) < auditIndexBatchSize {
+				return nil
+			}
+			err := ix.IndexAuditEvents(batch)
+			batch = batch[:0]
+			return err
+		})
+		// A file may be rotated away between listing and reading.
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if len(batch) > 0 {
+		return ix.IndexAuditEvents(batch)
+	}
+	return nil
+}
+
+// markIndexGap remembers that seq did not reach the index, keeping the
+// lowest such seq until the indexer re-reads the log from it.
+func (a *AuditLogger) markIndexGap(seq uint64) {
+	for {
+		cur := a.indexGap.Load()
+		if cur != 0 && cur <= seq {
+			return
+		}
+		if a.indexGap.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
+
+// fillIndexGap re-reads the log from the lowest record that missed the
+// index, if any. Whatever it still misses is found by LastAuditSeq on the
+// next startup.
+func (a *AuditLogger) fillIndexGap(ix AuditIndex) {
+	from := a.indexGap.Swap(0)
+	if from == 0 {
+		return
+	}
+	if err := a.backfillIndex(ix, from-1); err != nil {
+		slog.Error("audit index backfill failed", "from_seq", from, "err", err)
+		a.markIndexGap(from)
+	}
+}
+
+// runIndexer writes queued records in batches until the queue is closed.
+// Records dropped on a full queue or lost to a failed write are re-read from
+// the log files once the queue has room again.
+func (a *AuditLogger) runIndexer(ix AuditIndex, queue <-chan AuditEvent, done chan<- struct{}) {
+	defer close(done)
+	for ev := range queue {
+		batch := []AuditEvent{ev}
+	drain:
+		for len(batch) < auditIndexBatchSize {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		if err := ix.IndexAuditEvents(batch); err != nil {
+			slog.Error("index audit events failed", "count", len(batch), "err", err)
+			a.markIndexGap(batch[0].Seq)
+			continue
+		}
+		a.fillIndexGap(ix)
+	}
+	a.fillIndexGap(ix)
+}
+
+// enqueueIndexLocked hands a written record to the indexer without blocking.
+func (a *AuditLogger) enqueueIndexLocked(ev AuditEvent) {
+	if a.indexCh == nil {
+		return
+	}
+	select {
+	case a.indexCh <- ev:
+	default:
+		a.markIndexGap(ev.Seq)
+	}
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func logAuditFixture(t *testing.T, cfg Config) {
+	t.Helper()
+	cp, err := NewControlPlane(cfg)
+	if err != nil {
+		t.Fatalf("new control plane: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		cp.audit.Log(AuditEvent{TsMS: int64(1000 + i), TenantID: "t1", Actor: "ui:alice", SessionID: "s1", Kind: "action_approve"})
+	}
+	cp.audit.Log(AuditEvent{TsMS: 2000, TenantID: "t1", Actor: "ui:bob", SessionID: "s2", Kind: "action_reject"})
+	cp.audit.Log(AuditEvent{TsMS: 3000, TenantID: "t2", Actor: "ui:carol", SessionID: "s3", Kind: "action_approve"})
+	cp.audit.Log(AuditEvent{TsMS: 4000, Actor: "system", Kind: "detection_profiles_reloaded"})
+	if err := cp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestQueryAudit_FiltersAndPages(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		stateDB bool
+	}{{"index", true}, {"scan", false}} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := Config{AuditPath: filepath.Join(dir, "audit.jsonl")}
+			if tc.stateDB {
+				cfg.StateDBPath = filepath.Join(dir, "state.db")
+			}
+			logAuditFixture(t, cfg)
+			cp, err := NewControlPlane(cfg)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer cp.Close()
+
+			page, err := cp.QueryAudit(AuditQuery{TenantID: "t1", Kind: "action_approve", Limit: 3})
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			if len(page.Events) != 3 || page.Events[0].TsMS != 1004 || page.NextCursor == "" {
+				t.Fatalf("unexpected first page %#v", page)
+			}
+			before, err := ParseAuditCursor(page.NextCursor)
+			if err != nil {
+				t.Fatalf("cursor: %v", err)
+			}
+			page, _ = cp.QueryAudit(AuditQuery{TenantID: "t1", Kind: "action_approve", Limit: 3, Before: before})
+			if len(page.Events) != 2 || page.Events[1].TsMS != 1000 || page.NextCursor != "" {
+				t.Fatalf("unexpected last page %#v", page)
+			}
+
+			page, _ = cp.QueryAudit(AuditQuery{TenantID: "t1", SinceMS: 1500, UntilMS: 5000})
+			if len(page.Events) != 1 || page.Events[0].Actor != "ui:bob" {
+				t.Fatalf("time range should only match bob, got %#v", page.Events)
+			}
+			for _, ev := range mustQueryAll(t, cp, AuditQuery{TenantID: "t2"}) {
+				if ev.TenantID != "t2" {
+					t.Fatalf("tenant query leaked %#v", ev)
+				}
+			}
+			if all := mustQueryAll(t, cp, AuditQuery{}); len(all) != 8 {
+				t.Fatalf("admin query should see every record, got %d", len(all))
+			}
+		})
+	}
+}
+
+func mustQueryAll(t *testing.T, cp *ControlPlane, q AuditQuery) []AuditEvent {
+	t.Helper()
+	page, err := cp.QueryAudit(q)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	return page.Events
+}
+
+func TestAuditIndex_BackfillsFromLogFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{AuditPath: filepath.Join(dir, "audit.jsonl")}
+	logAuditFixture(t, cfg)
+
+	cfg.StateDBPath = filepath.Join(dir, "state.db")
+	cp, err := NewControlPlane(cfg)
+	if err != nil {
+		t.Fatalf("open with index: %v", err)
+	}
+	defer cp.Close()
+	last, err := cp.state.(AuditIndex).LastAuditSeq()
+	if err != nil || last != 8 {
+		t.Fatalf("expected the index to be backfilled to seq 8, got %d %v", last, err)
+	}
+	if got := mustQueryAll(t, cp, AuditQuery{TenantID: "t1", Actor: "ui:bob"}); len(got) != 1 || got[0].SessionID != "s2" {
+		t.Fatalf("unexpected backfilled records %#v", got)
+	}
+}
+
+func TestAuditIndex_RecoversRecordsDroppedFromFullQueue(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{AuditPath: filepath.Join(dir, "audit.jsonl"), StateDBPath: filepath.Join(dir, "state.db")}
+	cp := newTestControlPlane(t, cfg)
+	ix := cp.state.(AuditIndex)
+
+	// Nothing receives on an unbuffered channel, so it is always full.
+	cp.audit.mu.Lock()
+	queue := cp.audit.indexCh
+	cp.audit.indexCh = make(chan AuditEvent)
+	cp.audit.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		cp.audit.Log(AuditEvent{TenantID: "t1", Actor: "ui:alice", Kind: "action_approve"})
+	}
+	cp.audit.mu.Lock()
+	cp.audit.indexCh = queue
+	cp.audit.mu.Unlock()
+	cp.audit.Log(AuditEvent{TenantID: "t1", Actor: "ui:bob", Kind: "action_reject"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		last, err := ix.LastAuditSeq()
+		if err == nil && last == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dropped records were not re-indexed, last seq %d %v", last, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := mustQueryAll(t, cp, AuditQuery{Actor: "ui:alice"}); len(got) != 3 {
+		t.Fatalf("expected 3 re-indexed records, got %d", len(got))
+	}
+
+	// A record missing from the index is filled in on the next startup.
+	if _, err := cp.state.(*SQLiteStateStore).db.Exec(`DELETE FROM cp_audit WHERE seq = 2`); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	cp = newTestControlPlane(t, cfg)
+	if last, err := cp.state.(AuditIndex).LastAuditSeq(); err != nil || last != 4 {
+		t.Fatalf("expected the gap to be filled up to seq 4, got %d %v", last, err)
+	}
+}
+
+func TestExportAudit_NewestFirstAcrossRotatedFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		stateDB bool
+	}{{"index", true}, {"scan", false}} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := Config{AuditPath: filepath.Join(dir, "audit.jsonl"), Audit: AuditOptions{RotateBytes: 600, Compress: true}}
+			if tc.stateDB {
+				cfg.StateDBPath = filepath.Join(dir, "state.db")
+			}
+			cp, err := NewControlPlane(cfg)
+			if err != nil {
+				t.Fatalf("new control plane: %v", err)
+			}
+			for i := 0; i < 30; i++ {
+				tenant := "t1"
+				if i%3 == 0 {
+					tenant = "t2"
+				}
+				cp.audit.Log(AuditEvent{TsMS: int64(1000 + i), TenantID: tenant, Actor: "ui:alice", Kind: "action_approve"})
+			}
+			// Closing drains the indexer.
+			if err := cp.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if cp, err = NewControlPlane(cfg); err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer cp.Close()
+			if files, _ := auditFiles(dir, "audit.jsonl"); len(files) < 3 {
+				t.Fatalf("fixture should span several files, got %v", files)
+			}
+
+			var got []AuditEvent
+			if err := cp.ExportAudit(AuditQuery{TenantID: "t1", Limit: 1}, func(ev AuditEvent) error {
+				got = append(got, ev)
+				return nil
+			}); err != nil {
+				t.Fatalf("export: %v", err)
+			}
+			if len(got) != 20 {
+				t.Fatalf("export should ignore the page limit, got %d records", len(got))
+			}
+			for i, ev := range got {
+				if ev.TenantID != "t1" || (i > 0 && ev.Seq >= got[i-1].Seq) {
+					t.Fatalf("export should be t1 only, newest first: %#v", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cc-control/internal/auth"
+)
+
+func newTestAuditLogger(t *testing.T, path string, opts AuditOptions) *AuditLogger {
+	t.Helper()
+	a, err := NewAuditLogger(path, opts)
+	if err != nil {
+		t.Fatalf("new audit logger: %v", err)
+	}
+	return a
+}
+
+func verifyAudit(t *testing.T, dir string, pub ed25519.PublicKey) AuditVerifyReport {
+	t.Helper()
+	rep, err := VerifyAuditDir(dir, pub)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	return rep
+}
+
+func TestAuditLogger_ChainsAcrossRotationAndRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	opts := AuditOptions{RotateBytes: 600, Compress: true, SigningKey: priv}
+
+	a := newTestAuditLogger(t, path, opts)
+	for i := 0; i < 10; i++ {
+		a.Log(AuditEvent{Actor: "ui:t", SessionID: "s1", Kind: "action_approve"})
+	}
+	_ = a.Close()
+	a = newTestAuditLogger(t, path, opts)
+	a.Log(AuditEvent{Actor: "ui:t", SessionID: "s1", Kind: "action_reject"})
+	_ = a.Close()
+
+	gz, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl.gz"))
+	if len(gz) == 0 {
+		t.Fatal("expected gzipped rotated files")
+	}
+	rep := verifyAudit(t, dir, pub)
+	if len(rep.Problems) != 0 {
+		t.Fatalf("intact log reported problems: %v", rep.Problems)
+	}
+	if rep.Files != len(gz)+1 || rep.Checkpoints == 0 || rep.VerifiedCheckpoints != rep.Checkpoints || rep.Unsigned != 0 {
+		t.Fatalf("unexpected report %#v", rep)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if rep := verifyAudit(t, dir, other); len(rep.Problems) == 0 {
+		t.Fatal("checkpoints must not verify with another key")
+	}
+}
+
+func TestAuditVerify_DetectsEditsAndGaps(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	a := newTestAuditLogger(t, path, AuditOptions{})
+	for _, actor := range []string{"ui:alice", "ui:bob", "ui:carol", "ui:dave"} {
+		a.Log(AuditEvent{Actor: actor, Kind: "action_approve"})
+	}
+	_ = a.Close()
+	original, _ := os.ReadFile(path)
+
+	edited := bytes.Replace(original, []byte("ui:bob"), []byte("ui:eve"), 1)
+	_ = os.WriteFile(path, edited, 0o600)
+	if rep := verifyAudit(t, dir, nil); len(rep.Problems) != 1 || !strings.Contains(rep.Problems[0], "modified") {
+		t.Fatalf("expected the edit to be detected, got %v", rep.Problems)
+	}
+
+	lines := strings.SplitAfter(string(original), "\n")
+	_ = os.WriteFile(path, []byte(lines[0]+lines[2]+lines[3]), 0o600)
+	if rep := verifyAudit(t, dir, nil); len(rep.Problems) != 1 || !strings.Contains(rep.Problems[0], "expected seq 2") {
+		t.Fatalf("expected the deleted record to be detected, got %v", rep.Problems)
+	}
+
+	_ = os.WriteFile(path, []byte(lines[2]+lines[3]), 0o600)
+	if rep := verifyAudit(t, dir, nil); len(rep.Problems) != 1 || !strings.Contains(rep.Problems[0], "earlier records are missing") {
+		t.Fatalf("expected the missing head to be detected, got %v", rep.Problems)
+	}
+}
+
+func TestAuditVerify_AcceptsLegacyPrefix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	_ = os.WriteFile(path, []byte(`{"ts_ms":1,"actor":"ui:old","kind":"action_approve"}`+"\n"), 0o600)
+	a := newTestAuditLogger(t, path, AuditOptions{})
+	a.Log(AuditEvent{Actor: "ui:new", Kind: "action_approve"})
+	_ = a.Close()
+
+	rep := verifyAudit(t, dir, nil)
+	if len(rep.Problems) != 0 || rep.Legacy != 1 || rep.LastSeq != 1 {
+		t.Fatalf("unexpected report %#v", rep)
+	}
+}
+
+func TestAuditLogger_RecordsTokenEvents(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestAuditLogger(t, filepath.Join(dir, "audit.jsonl"), AuditOptions{})
+	store := auth.NewStore()
+	store.SetAuditSink(a)
+	admin := auth.Actor{TokenID: "adm1", Type: auth.TokenTypeAdmin, RemoteAddr: "10.0.0.9:5123", UserAgent: "curl/8"}
+
+	_, rec, err := store.CreateToken(admin, auth.TokenTypeUI, auth.RoleOwner, "t1", "alice", auth.TokenOptions{})
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	store.RevokeToken(admin, rec.TokenID)
+	store.RevokeTokensByTenant(admin, "t1", auth.TokenTypeUI)
+	_ = a.Close()
+
+	var events []AuditEvent
+	_ = readAuditLines(filepath.Join(dir, "audit.jsonl"), func(_ int, line []byte) error {
+		if r, ok := parseAuditLine(line); ok && r.Kind != auditCheckpointKind {
+			events = append(events, r.AuditEvent)
+		}
+		return nil
+	})
+	if len(events) != 3 || events[0].Kind != "token_created" || events[1].Kind != "token_revoked" || events[2].Kind != "tenant_tokens_revoked" {
+		t.Fatalf("unexpected token events %#v", events)
+	}
+	created := events[0]
+	if created.Actor != "admin:adm1" || created.TenantID != "t1" || created.Meta["token_id"] != rec.TokenID ||
+		created.Meta["remote_addr"] != "10.0.0.9:5123" || created.Meta["user_agent"] != "curl/8" {
+		t.Fatalf("token_created is missing caller details: %#v", created)
+	}
+}
+
+func TestSetTenantSettingsAs_RecordsCallerDetails(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	admin := auth.Actor{TokenID: "adm1", Type: auth.TokenTypeAdmin, RemoteAddr: "10.0.0.9", UserAgent: "curl/8"}
+	if _, err := cp.SetTenantSettingsAs(admin, TenantSettings{TenantID: "t1", Recording: true}); err != nil {
+		t.Fatalf("set settings: %v", err)
+	}
+
+	got := mustQueryAll(t, cp, AuditQuery{Kind: "tenant_settings_updated"})
+	if len(got) != 1 || got[0].Actor != "admin:adm1" || got[0].Meta["remote_addr"] != "10.0.0.9" ||
+		got[0].Meta["actor_token_id"] != "adm1" || got[0].Meta["recording"] != true {
+		t.Fatalf("tenant_settings_updated is missing caller details: %#v", got)
+	}
+}
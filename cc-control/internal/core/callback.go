@@ -0,0 +1,177 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultCallbackTokenTTL = 15 * time.Minute
+
+// CallbackAction is a pre-authorized action on one approval event, handed
+// out in notifications and redeemed at POST /api/callbacks/approval.
+type CallbackAction struct {
+	Kind        string `json:"kind"`
+	Choice      int    `json:"choice,omitempty"`
+	Label       string `json:"label,omitempty"`
+	Token       string `json:"token"`
+	ExpiresAtMS int64  `json:"expires_at_ms"`
+}
+
+// CallbackResult describes a redeemed callback token.
+type CallbackResult struct {
+	TenantID  string `json:"tenant_id"`
+	SessionID string `json:"session_id"`
+	EventID   string `json:"event_id"`
+	Kind      string `json:"kind"`
+	Choice    int    `json:"choice,omitempty"`
+}
+
+// callbackClaims is the signed part of a callback token.
+type callbackClaims struct {
+	ID        string `json:"jti"`
+	TenantID  string `json:"tid"`
+	SessionID string `json:"sid"`
+	EventID   string `json:"eid"`
+	Kind      string `json:"act"`
+	Choice    int    `json:"ch,omitempty"`
+	// Channel names who the token was handed to, e.g. "webhook:<id>"; it
+	// becomes the actor of the redemption.
+	Channel   string `json:"chn,omitempty"`
+	ExpiresMS int64  `json:"exp"`
+}
+
+func newCallbackKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}
+
+func (cp *ControlPlane) signCallback(c callbackClaims) string {
+	raw, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	mac := hmac.New(sha256.New, cp.callbackKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (cp *ControlPlane) parseCallback(token string) (callbackClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return callbackClaims{}, errors.New("invalid callback token")
+	}
+	want, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return callbackClaims{}, errors.New("invalid callback token")
+	}
+	mac := hmac.New(sha256.New, cp.callbackKey)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return callbackClaims{}, errors.New("invalid callback token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return callbackClaims{}, errors.New("invalid callback token")
+	}
+	var c callbackClaims
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return callbackClaims{}, errors.New("invalid callback token")
+	}
+	return c, nil
+}
+
+// MintCallbackActions signs one token per action available on an approval
+// event: approve, reject and choose for each parsed option. channel is
+// signed into the tokens and recorded as "callback:<channel>" on redemption.
+func (cp *ControlPlane) MintCallbackActions(ev SessionEvent, channel string) []CallbackAction {
+	expires := time.Now().Add(cp.cfg.CallbackTokenTTL).UnixMilli()
+	mint := func(kind string, opt ApprovalOption) CallbackAction {
+		token := cp.signCallback(callbackClaims{
+			ID:        uuid.NewString(),
+			TenantID:  ev.TenantID,
+			SessionID: ev.SessionID,
+			EventID:   ev.EventID,
+			Kind:      kind,
+			Choice:    opt.Index,
+			Channel:   channel,
+			ExpiresMS: expires,
+		})
+		return CallbackAction{Kind: kind, Choice: opt.Index, Label: opt.Label, Token: token, ExpiresAtMS: expires}
+	}
+	out := []CallbackAction{mint("approve", ApprovalOption{}), mint("reject", ApprovalOption{})}
+	for _, opt := range ev.Options {
+		out = append(out, mint("choose", opt))
+	}
+	return out
+}
+
+// RedeemCallback performs the action of a callback token. Tokens are single
+// use and only act on the event they were minted for while it is pending.
+func (cp *ControlPlane) RedeemCallback(token string) (CallbackResult, error) {
+	c, err := cp.parseCallback(token)
+	if err != nil {
+		return CallbackResult{}, err
+	}
+	now := time.Now().UnixMilli()
+	if now > c.ExpiresMS {
+		return CallbackResult{}, errors.New("callback token expired")
+	}
+	channel := c.Channel
+	if channel == "" {
+		channel = "api"
+	}
+	result := CallbackResult{TenantID: c.TenantID, SessionID: c.SessionID, EventID: c.EventID, Kind: c.Kind, Choice: c.Choice}
+
+	cp.mu.Lock()
+	for id, exp := range cp.usedCallbacks {
+		if now > exp {
+			delete(cp.usedCallbacks, id)
+		}
+	}
+	if _, used := cp.usedCallbacks[c.ID]; used {
+		cp.mu.Unlock()
+		return CallbackResult{}, errors.New("callback token already used")
+	}
+	sess, ok := cp.sessions[c.SessionID]
+	if !ok || sess.TenantID != c.TenantID || !sess.AwaitingApproval || sess.PendingEventID != c.EventID {
+		cp.mu.Unlock()
+		return CallbackResult{}, errors.New("approval no longer pending")
+	}
+	cp.mu.Unlock()
+
+	// The token is spent only once the keys reached the agent, so a failed
+	// delivery can be retried with the same button. HandleClientAction lets
+	// only one of two concurrent redemptions through.
+	err = cp.HandleClientAction("callback:"+channel, c.TenantID, nil, c.SessionID, ActionRequest{Kind: c.Kind, EventID: c.EventID, Choice: c.Choice, exactEvent: true})
+	cp.audit.Log(AuditEvent{
+		TenantID:  c.TenantID,
+		Actor:     "callback:" + channel,
+		SessionID: c.SessionID,
+		Kind:      "callback_redeemed",
+		Meta: map[string]any{
+			"event_id": c.EventID,
+			"action":   c.Kind,
+			"choice":   c.Choice,
+			"token_id": c.ID,
+			"channel":  channel,
+			"applied":  err == nil,
+		},
+	})
+	if err != nil {
+		return CallbackResult{}, err
+	}
+	cp.mu.Lock()
+	cp.usedCallbacks[c.ID] = c.ExpiresMS
+	cp.mu.Unlock()
+	return result, nil
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pendingEvent(t *testing.T, cp *ControlPlane, sessionID string) SessionEvent {
+	t.Helper()
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	pending := cp.sessions[sessionID].PendingEventID
+	for _, ev := range cp.sessionEvents[sessionID] {
+		if ev.EventID == pending {
+			return ev
+		}
+	}
+	t.Fatalf("no pending event for %s", sessionID)
+	return SessionEvent{}
+}
+
+func callbackToken(t *testing.T, actions []CallbackAction, kind string, choice int) string {
+	t.Helper()
+	for _, a := range actions {
+		if a.Kind == kind && a.Choice == choice {
+			return a.Token
+		}
+	}
+	t.Fatalf("no %s/%d action in %#v", kind, choice, actions)
+	return ""
+}
+
+func TestRedeemCallback_ApproveOnce(t *testing.T) {
+	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	token := callbackToken(t, cp.MintCallbackActions(pendingEvent(t, cp, sessionID), "slack"), "approve", 0)
+
+	got, err := cp.RedeemCallback(token)
+	if err != nil {
+		t.Fatalf("redeem: %v", err)
+	}
+	if got.EventID != eventID || got.Kind != "approve" {
+		t.Fatalf("unexpected result %#v", got)
+	}
+	if in := lastPTYInput(t, conn); in != "y\n" {
+		t.Fatalf("approve should send y\\n, got %q", in)
+	}
+	if ev := eventsOfKind(cp, sessionID, "approval_needed")[0]; !ev.Resolved || ev.Actor != "callback:slack" {
+		t.Fatalf("event not resolved by callback: %#v", ev)
+	}
+	if _, err := cp.RedeemCallback(token); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("second redemption should fail as used, got %v", err)
+	}
+}
+
+func TestRedeemCallback_FailedDeliveryKeepsTokenAndPrompt(t *testing.T) {
+	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	token := callbackToken(t, cp.MintCallbackActions(pendingEvent(t, cp, sessionID), "slack"), "approve", 0)
+
+	conn.err = errors.New("send queue full")
+	if _, err := cp.RedeemCallback(token); err == nil {
+		t.Fatal("redeem should fail while the agent cannot be reached")
+	}
+	if ev := pendingEvent(t, cp, sessionID); ev.EventID != eventID || ev.Resolved {
+		t.Fatalf("prompt should stay pending: %#v", ev)
+	}
+
+	conn.err = nil
+	if _, err := cp.RedeemCallback(token); err != nil {
+		t.Fatalf("token should still work after a failed delivery: %v", err)
+	}
+	if in := lastPTYInput(t, conn); in != "y\n" {
+		t.Fatalf("approve should send y\\n, got %q", in)
+	}
+	if _, err := cp.RedeemCallback(token); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("token should be spent after it applied, got %v", err)
+	}
+}
+
+func TestRedeemCallback_ChooseOption(t *testing.T) {
+	prompt := "Do you want to proceed?\n❯ 1. Yes\n  2. Yes, and don't ask again for this project\n  3. No"
+	cp, conn, sessionID, _ := setupActionTestControlPlane(t, prompt)
+	token := callbackToken(t, cp.MintCallbackActions(pendingEvent(t, cp, sessionID), ""), "choose", 2)
+
+	if _, err := cp.RedeemCallback(token); err != nil {
+		t.Fatalf("redeem: %v", err)
+	}
+	if in := lastPTYInput(t, conn); in != "2" {
+		t.Fatalf("choose 2 should send 2, got %q", in)
+	}
+}
+
+func TestRedeemCallback_RejectsInvalidTokens(t *testing.T) {
+	cp, conn, sessionID, _ := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	ev := pendingEvent(t, cp, sessionID)
+	token := callbackToken(t, cp.MintCallbackActions(ev, ""), "reject", 0)
+
+	payload, sig, _ := strings.Cut(token, ".")
+	if _, err := cp.RedeemCallback(payload + "x." + sig); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Fatalf("tampered token should be invalid, got %v", err)
+	}
+	other, _, _, _ := setupActionTestControlPlane(t, "Continue? [y/N]")
+	if _, err := other.RedeemCallback(token); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Fatalf("token from another key should be invalid, got %v", err)
+	}
+
+	cp.cfg.CallbackTokenTTL = -time.Second
+	expired := callbackToken(t, cp.MintCallbackActions(ev, ""), "approve", 0)
+	if _, err := cp.RedeemCallback(expired); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expired token should fail, got %v", err)
+	}
+
+	cp.mu.Lock()
+	cp.sessions[sessionID].PendingEventID = "e2"
+	cp.mu.Unlock()
+	if _, err := cp.RedeemCallback(token); err == nil || !strings.Contains(err.Error(), "no longer pending") {
+		t.Fatalf("token for a superseded event should fail, got %v", err)
+	}
+	if len(conn.msgs) != 0 {
+		t.Fatalf("rejected callbacks must not send input, got %#v", conn.msgs)
+	}
+}
+
+func TestRedeemCallback_RefusesEventThatChangedBeforeApply(t *testing.T) {
+	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+
+	// A new approval replaced the one the token was minted for after
+	// RedeemCallback checked it; the apply step must notice.
+	cp.mu.Lock()
+	cp.sessions[sessionID].PendingEventID = "e2"
+	cp.mu.Unlock()
+	err := cp.HandleClientAction("callback:api", "t1", nil, sessionID, ActionRequest{Kind: "approve", EventID: eventID, exactEvent: true})
+	if err == nil || !strings.Contains(err.Error(), "no longer pending") {
+		t.Fatalf("action on a superseded event should fail, got %v", err)
+	}
+	if len(conn.msgs) != 0 {
+		t.Fatalf("superseded event must not send input, got %#v", conn.msgs)
+	}
+	cp.mu.RLock()
+	pending := cp.sessions[sessionID].AwaitingApproval
+	cp.mu.RUnlock()
+	if !pending {
+		t.Fatal("the new approval must stay pending")
+	}
+}
+
+func TestRedeemCallback_ActorComesFromToken(t *testing.T) {
+	cp, _, sessionID, _ := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	token := callbackToken(t, cp.MintCallbackActions(pendingEvent(t, cp, sessionID), "webhook:w1"), "reject", 0)
+
+	if _, err := cp.RedeemCallback(token); err != nil {
+		t.Fatalf("redeem: %v", err)
+	}
+	if ev := eventsOfKind(cp, sessionID, "approval_needed")[0]; ev.Actor != "callback:webhook:w1" {
+		t.Fatalf("actor should be the channel signed into the token, got %q", ev.Actor)
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"log/slog"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"cc-control/internal/auth"
 	"github.com/google/uuid"
 )
 
@@ -32,6 +34,31 @@ type Config struct {
 	// emit "approval_needed" session events. Disabled by default because it's
 	// heuristic and may miss prompts depending on the AI CLI/terminal formatting.
 	EnablePromptDetection bool
+	// StateDBPath enables SQLite persistence of servers, sessions and session
+	// events so they survive restarts. Empty keeps state in memory only.
+	StateDBPath string
+	// RecordingDir enables asciicast session recordings under
+	// <dir>/<tenant>/<session>.cast. RecordSessions is the default for tenants
+	// without explicit settings; RecordingRetention (0 = forever) is how long
+	// finished recordings are kept unless a tenant overrides it.
+	RecordingDir       string
+	RecordSessions     bool
+	RecordingRetention time.Duration
+	// DetectionProfilesPath is a JSON file of prompt detection profiles (see
+	// DetectionProfile); ReloadDetectionProfiles re-reads it.
+	DetectionProfilesPath string
+	// CallbackSecret signs callback action tokens; empty uses a random key,
+	// which invalidates outstanding tokens on restart. CallbackTokenTTL
+	// defaults to 15 minutes.
+	CallbackSecret   string
+	CallbackTokenTTL time.Duration
+	// WebhookAllowPrivate lets webhooks reach loopback, private and
+	// link-local addresses. Off by default so tenants cannot probe the
+	// control plane's network.
+	WebhookAllowPrivate bool
+	// Audit configures rotation, compression and signed checkpoints of the
+	// audit log at AuditPath.
+	Audit AuditOptions
 }
 
 type Subscriber struct {
@@ -40,11 +67,20 @@ type Subscriber struct {
 	Send            chan Envelope
 	AttachedSession string
 	TenantID        string
+	// TokenScope is the scope of the subscriber's token; it hides servers
+	// and sessions outside it.
+	TokenScope *auth.Scope
+	// Scope and ScopeServerID filter tenant-wide fanout; see SetSubscription.
+	Scope         SubscriptionScope
+	ScopeServerID string
+	// Role decides which approval escalations the subscriber receives.
+	Role auth.TokenRole
 }
 
 type SessionHub struct {
 	ring        *RingBuffer
 	subscribers map[*Subscriber]struct{}
+	rec         *castRecorder
 }
 
 func newSessionHub(ringBytes int) *SessionHub {
@@ -59,17 +95,37 @@ type ControlPlane struct {
 
 	cfg Config
 
-	servers       map[string]*Server
+	servers       map[serverKey]*Server
 	sessions      map[string]*Session
 	sessionEvents map[string][]SessionEvent
 	sessionHubs   map[string]*SessionHub
-	agentConns    map[string]AgentSender
+	agentConns    map[serverKey]AgentSender
 	subscribers   map[*Subscriber]struct{}
+	// serverStats holds recent heartbeat telemetry per server.
+	serverStats map[serverKey][]ServerStats
+
+	tenantSettings map[string]TenantSettings
+	policies       map[string]ApprovalPolicy
+	webhooks       map[string]Webhook
+	hooks          *webhookDispatcher
+	callbackKey    []byte
+	// usedCallbacks maps redeemed callback token ids to their expiry.
+	usedCallbacks map[string]int64
+	// pasteDelay is the wait before the message of a reject_with_message
+	// is pasted; zero pastes right away.
+	pasteDelay time.Duration
 
 	detector       *PromptDetector
 	resumeDetector *ResumeDetector
 	audit          *AuditLogger
 	limiter        *RateLimiter
+	metrics        *metrics
+
+	state     StateStore
+	persistMu sync.Mutex
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewControlPlane(cfg Config) (*ControlPlane, error) {
@@ -94,52 +150,126 @@ func NewControlPlane(cfg Config) (*ControlPlane, error) {
 	if cfg.ApprovalBroadcast == "" {
 		cfg.ApprovalBroadcast = "all"
 	}
+	if cfg.CallbackTokenTTL <= 0 {
+		cfg.CallbackTokenTTL = defaultCallbackTokenTTL
+	}
 
-	audit, err := NewAuditLogger(cfg.AuditPath)
+	audit, err := NewAuditLogger(cfg.AuditPath, cfg.Audit)
 	if err != nil {
 		return nil, err
 	}
-	var detector *PromptDetector
-	if cfg.EnablePromptDetection {
-		detector = NewPromptDetector()
+	detector := NewPromptDetector()
+	if cfg.DetectionProfilesPath != "" {
+		profiles, err := LoadDetectionProfiles(cfg.DetectionProfilesPath)
+		if err == nil {
+			err = detector.SetProfiles(profiles)
+		}
+		if err != nil {
+			_ = audit.Close()
+			return nil, err
+		}
 	}
 	cp := &ControlPlane{
 		cfg:            cfg,
-		servers:        make(map[string]*Server),
+		servers:        make(map[serverKey]*Server),
 		sessions:       make(map[string]*Session),
 		sessionEvents:  make(map[string][]SessionEvent),
 		sessionHubs:    make(map[string]*SessionHub),
-		agentConns:     make(map[string]AgentSender),
+		agentConns:     make(map[serverKey]AgentSender),
 		subscribers:    make(map[*Subscriber]struct{}),
+		serverStats:    make(map[serverKey][]ServerStats),
+		tenantSettings: make(map[string]TenantSettings),
+		policies:       make(map[string]ApprovalPolicy),
+		webhooks:       make(map[string]Webhook),
+		hooks:          newWebhookDispatcher(cfg.WebhookAllowPrivate),
+		callbackKey:    newCallbackKey(cfg.CallbackSecret),
+		usedCallbacks:  make(map[string]int64),
+		pasteDelay:     defaultFeedbackPasteDelay,
 		detector:       detector,
 		resumeDetector: NewResumeDetector(),
 		audit:          audit,
 		limiter:        NewRateLimiter(cfg.RateLimitPerMin, cfg.RateWindow),
+		metrics:        newMetrics(),
+		stop:           make(chan struct{}),
+	}
+	if cfg.StateDBPath != "" {
+		state, err := NewSQLiteStateStore(cfg.StateDBPath)
+		if err != nil {
+			_ = audit.Close()
+			return nil, err
+		}
+		cp.state = state
+		if err := cp.restoreState(); err != nil {
+			_ = state.Close()
+			_ = audit.Close()
+			return nil, err
+		}
+		if err := audit.attachIndex(state); err != nil {
+			_ = audit.Close()
+			_ = state.Close()
+			return nil, err
+		}
+	}
+	if cfg.RecordingDir != "" {
+		go cp.runRecordingRetention()
+	}
+	go cp.runApprovalScheduler()
+	for i := 0; i < webhookWorkers; i++ {
+		go cp.runWebhookWorker()
 	}
 	return cp, nil
 }
 
+// AuditSink is the audit log, for components outside core such as the
+// token store.
+func (cp *ControlPlane) AuditSink() auth.AuditSink {
+	return cp.audit
+}
+
 func (cp *ControlPlane) Close() error {
+	cp.closeOnce.Do(func() { close(cp.stop) })
+	cp.mu.Lock()
+	var recs []*castRecorder
+	for id := range cp.sessionHubs {
+		if rec := cp.detachRecorderLocked(id); rec != nil {
+			recs = append(recs, rec)
+		}
+	}
+	cp.mu.Unlock()
+	for _, rec := range recs {
+		rec.close()
+	}
+	// The audit logger goes first: its indexer writes to the state store.
+	var err error
 	if cp.audit != nil {
-		return cp.audit.Close()
+		err = cp.audit.Close()
 	}
-	return nil
+	if cp.state != nil {
+		if err := cp.state.Close(); err != nil {
+			slog.Error("close state store failed", "err", err)
+		}
+	}
+	return err
 }
 
 func (cp *ControlPlane) RateAllow(token string) bool {
-	return cp.limiter.Allow(token)
+	if !cp.limiter.Allow(token) {
+		cp.metrics.rateLimited.Add(1)
+		return false
+	}
+	return true
 }
 
 func (cp *ControlPlane) RegisterOrUpdateServer(tenantID string, reg AgentRegister, conn AgentSender) error {
 	now := time.Now().UnixMilli()
+	key := serverKey{tenantID, reg.ServerID}
 	cp.mu.Lock()
-	defer cp.mu.Unlock()
-
-	if existing, ok := cp.agentConns[reg.ServerID]; ok && existing != nil {
+	if existing, ok := cp.agentConns[key]; ok && existing != nil {
+		cp.mu.Unlock()
 		return errors.New("duplicate server_id \"" + reg.ServerID + "\": already connected; rename via -server-id")
 	}
 
-	cp.servers[reg.ServerID] = &Server{
+	cp.servers[key] = &Server{
 		TenantID:     tenantID,
 		ServerID:     reg.ServerID,
 		Hostname:     reg.Hostname,
@@ -151,20 +281,38 @@ func (cp *ControlPlane) RegisterOrUpdateServer(tenantID string, reg AgentRegiste
 		Status:       ServerOnline,
 		AllowRoots:   append([]string(nil), reg.AllowRoots...),
 		ClaudePath:   reg.ClaudePath,
+		Runtimes:     append([]RuntimeInfo(nil), reg.Runtimes...),
 	}
-	cp.agentConns[reg.ServerID] = conn
+	cp.agentConns[key] = conn
 	cp.audit.Log(AuditEvent{
+		TenantID: tenantID,
 		Actor:    "agent:" + reg.ServerID,
 		ServerID: reg.ServerID,
 		Kind:     "register",
 	})
+	var changed []string
+	var resolved map[string]string
+	if reg.Sessions != nil {
+		changed, resolved = cp.reconcileSessionsLocked(tenantID, reg.ServerID, reg.Sessions)
+	}
+	cp.mu.Unlock()
+
+	cp.persistServer(tenantID, reg.ServerID)
+	cp.emitServerWebhook(tenantID, reg.ServerID)
+	for _, sessionID := range changed {
+		if eventID, ok := resolved[sessionID]; ok {
+			cp.persistSessionEvent(sessionID, eventID)
+		}
+		cp.persistSession(sessionID)
+		cp.broadcastSessionUpdate(sessionID)
+	}
 	return nil
 }
 
-func (cp *ControlPlane) TouchServer(serverID string) {
+func (cp *ControlPlane) TouchServer(tenantID, serverID string) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
-	s, ok := cp.servers[serverID]
+	s, ok := cp.servers[serverKey{tenantID, serverID}]
 	if !ok {
 		return
 	}
@@ -172,21 +320,38 @@ func (cp *ControlPlane) TouchServer(serverID string) {
 	s.Status = ServerOnline
 }
 
-func (cp *ControlPlane) RemoveAgentConnection(serverID string) {
+func (cp *ControlPlane) RemoveAgentConnection(tenantID, serverID string) {
+	key := serverKey{tenantID, serverID}
 	cp.mu.Lock()
-	defer cp.mu.Unlock()
-	delete(cp.agentConns, serverID)
-	if s, ok := cp.servers[serverID]; ok {
+	delete(cp.agentConns, key)
+	if s, ok := cp.servers[key]; ok {
 		s.Status = ServerOffline
 	}
+	var orphaned []string
+	for id, sess := range cp.sessions {
+		if sess.ServerID != serverID || sess.TenantID != tenantID || !isActiveStatus(sess.Status) || sess.AwaitingReconcile {
+			continue
+		}
+		sess.AwaitingReconcile = true
+		orphaned = append(orphaned, id)
+	}
 	cp.audit.Log(AuditEvent{
+		TenantID: tenantID,
 		Actor:    "agent:" + serverID,
 		ServerID: serverID,
 		Kind:     "agent_disconnected",
 	})
+	cp.mu.Unlock()
+
+	cp.persistServer(tenantID, serverID)
+	cp.emitServerWebhook(tenantID, serverID)
+	for _, sessionID := range orphaned {
+		cp.persistSession(sessionID)
+		cp.broadcastSessionUpdate(sessionID)
+	}
 }
 
-func (cp *ControlPlane) GetServers(tenantID string) []Server {
+func (cp *ControlPlane) GetServers(tenantID string, scope *auth.Scope) []Server {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 	now := time.Now()
@@ -195,6 +360,9 @@ func (cp *ControlPlane) GetServers(tenantID string) []Server {
 		if tenantID != "" && s.TenantID != tenantID {
 			continue
 		}
+		if !scope.AllowsServer(s.ServerID, s.Tags) {
+			continue
+		}
 		if now.Sub(time.UnixMilli(s.LastSeenMS)) > cp.cfg.OfflineAfter {
 			s.Status = ServerOffline
 		}
@@ -204,12 +372,12 @@ func (cp *ControlPlane) GetServers(tenantID string) []Server {
 	return items
 }
 
-func (cp *ControlPlane) GetSessions(tenantID, serverID string) []Session {
+func (cp *ControlPlane) GetSessions(tenantID string, scope *auth.Scope, serverID string) []Session {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
 	items := make([]Session, 0, len(cp.sessions))
 	for _, s := range cp.sessions {
-		if tenantID != "" && s.TenantID != tenantID {
+		if !cp.sessionVisibleLocked(s, tenantID, scope) {
 			continue
 		}
 		if serverID != "" && s.ServerID != serverID {
@@ -221,12 +389,12 @@ func (cp *ControlPlane) GetSessions(tenantID, serverID string) []Session {
 	return items
 }
 
-func (cp *ControlPlane) GetSessionEvents(tenantID, sessionID string) []SessionEvent {
+func (cp *ControlPlane) GetSessionEvents(tenantID string, scope *auth.Scope, sessionID string) []SessionEvent {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
-	if tenantID != "" {
+	if tenantID != "" || scope != nil {
 		sess, ok := cp.sessions[sessionID]
-		if !ok || sess.TenantID != tenantID {
+		if !ok || !cp.sessionVisibleLocked(sess, tenantID, scope) {
 			return nil
 		}
 	}
@@ -237,7 +405,7 @@ func (cp *ControlPlane) GetSessionEvents(tenantID, sessionID string) []SessionEv
 }
 
 // GetPendingApprovalEvents returns unresolved approval events across all sessions.
-func (cp *ControlPlane) GetPendingApprovalEvents(tenantID string) []SessionEvent {
+func (cp *ControlPlane) GetPendingApprovalEvents(tenantID string, scope *auth.Scope) []SessionEvent {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
 
@@ -250,6 +418,9 @@ func (cp *ControlPlane) GetPendingApprovalEvents(tenantID string) []SessionEvent
 			if tenantID != "" && ev.TenantID != tenantID {
 				continue
 			}
+			if sess := cp.sessions[ev.SessionID]; scope != nil && (sess == nil || !cp.sessionVisibleLocked(sess, tenantID, scope)) {
+				continue
+			}
 			out = append(out, ev)
 		}
 	}
@@ -279,15 +450,31 @@ func (cp *ControlPlane) UnregisterSubscriber(sub *Subscriber) {
 	}
 }
 
-func (cp *ControlPlane) AttachSubscriber(sub *Subscriber, sessionID string) ([]byte, uint64, error) {
+// AttachReplay is the output a subscriber must be sent to catch up after
+// attaching to a session.
+type AttachReplay struct {
+	Data      []byte
+	LatestSeq uint64
+	// Full is set when Data is the whole buffered scrollback rather than the
+	// delta after the requested seq.
+	Full bool
+	// Resync is set when the requested seq is no longer buffered; the client
+	// should reset its terminal before writing Data.
+	Resync bool
+}
+
+// AttachSubscriber attaches sub to a session and returns the output written
+// after sinceSeq, or the full scrollback when sinceSeq is 0 or has already
+// been evicted.
+func (cp *ControlPlane) AttachSubscriber(sub *Subscriber, sessionID string, sinceSeq uint64) (AttachReplay, error) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 	sess, ok := cp.sessions[sessionID]
 	if !ok {
-		return nil, 0, errors.New("session not found")
+		return AttachReplay{}, errors.New("session not found")
 	}
-	if sub.TenantID != "" && sess.TenantID != sub.TenantID {
-		return nil, 0, errors.New("session not found")
+	if !cp.sessionVisibleLocked(sess, sub.TenantID, sub.TokenScope) {
+		return AttachReplay{}, errors.New("session not found")
 	}
 	if sub.AttachedSession != "" {
 		if oldHub, ok := cp.sessionHubs[sub.AttachedSession]; ok {
@@ -301,33 +488,53 @@ func (cp *ControlPlane) AttachSubscriber(sub *Subscriber, sessionID string) ([]b
 	}
 	hub.subscribers[sub] = struct{}{}
 	sub.AttachedSession = sessionID
-	return hub.ring.Snapshot(), sess.LatestAgentOutSeq, nil
+
+	replay := AttachReplay{LatestSeq: sess.LatestAgentOutSeq}
+	if sinceSeq > 0 {
+		if data, ok := hub.ring.Since(sinceSeq); ok {
+			replay.Data = data
+			return replay, nil
+		}
+		replay.Resync = true
+	}
+	replay.Data = hub.ring.Snapshot()
+	replay.Full = true
+	return replay, nil
 }
 
-func (cp *ControlPlane) CreateSession(actor string, tenantID string, req StartSessionRequest) (*Session, error) {
+func (cp *ControlPlane) CreateSession(actor string, tenantID string, scope *auth.Scope, req StartSessionRequest) (*Session, error) {
 	if req.ServerID == "" || req.Cwd == "" {
 		return nil, errors.New("server_id and cwd are required")
 	}
 	cp.mu.Lock()
-	server, ok := cp.servers[req.ServerID]
-	conn := cp.agentConns[req.ServerID]
+	server, ok := cp.serverLocked(tenantID, req.ServerID)
+	var conn AgentSender
+	if ok {
+		conn = cp.agentConns[serverKey{server.TenantID, server.ServerID}]
+	}
 	if !ok || conn == nil || server.Status != ServerOnline {
 		cp.mu.Unlock()
 		return nil, errors.New("server offline")
 	}
-	if tenantID != "" && server.TenantID != tenantID {
+	if !scope.AllowsServer(server.ServerID, server.Tags) {
 		cp.mu.Unlock()
-		return nil, errors.New("server not in tenant")
+		return nil, errors.New("server not allowed by token scope")
+	}
+	if !scope.AllowsCwd(req.Cwd) {
+		cp.mu.Unlock()
+		return nil, errors.New("cwd not allowed by token scope")
 	}
 	sessionID := uuid.NewString()
 	resumeID := strings.TrimSpace(req.ResumeID)
-	cmdPath := strings.TrimSpace(server.ClaudePath)
-	if cmdPath == "" {
-		cmdPath = "claude-code"
+	rt, err := resolveRuntime(server, req.Runtime)
+	if err != nil {
+		cp.mu.Unlock()
+		return nil, err
 	}
-	cmd := []string{cmdPath}
-	if resumeID != "" {
-		cmd = append(cmd, "--resume", resumeID)
+	cmd, err := rt.commandLine(resumeID, req.Args)
+	if err != nil {
+		cp.mu.Unlock()
+		return nil, err
 	}
 	envKeys := make([]string, 0, len(req.Env))
 	for k := range req.Env {
@@ -338,8 +545,10 @@ func (cp *ControlPlane) CreateSession(actor string, tenantID string, req StartSe
 		TenantID:         tenantID,
 		SessionID:        sessionID,
 		ServerID:         req.ServerID,
+		Runtime:          rt.Name,
 		Cwd:              req.Cwd,
 		Cmd:              append([]string(nil), cmd...),
+		Args:             append([]string(nil), req.Args...),
 		ResumeID:         resumeID,
 		EnvKeys:          envKeys,
 		Status:           SessionStarting,
@@ -347,8 +556,10 @@ func (cp *ControlPlane) CreateSession(actor string, tenantID string, req StartSe
 		CreatedAtMS:      time.Now().UnixMilli(),
 		AwaitingApproval: false,
 	}
+	hub := newSessionHub(cp.cfg.RingBufferBytes)
 	cp.sessions[sessionID] = sess
-	cp.sessionHubs[sessionID] = newSessionHub(cp.cfg.RingBufferBytes)
+	cp.sessionHubs[sessionID] = hub
+	cp.startRecordingLocked(sess, hub, req.Cols, req.Rows)
 	cp.mu.Unlock()
 
 	payload := map[string]any{
@@ -361,6 +572,12 @@ func (cp *ControlPlane) CreateSession(actor string, tenantID string, req StartSe
 	if resumeID != "" {
 		payload["resume_id"] = resumeID
 	}
+	if rt.Name != "" {
+		payload["runtime"] = rt.Name
+	}
+	if len(req.Args) > 0 {
+		payload["args"] = req.Args
+	}
 	data, _ := json.Marshal(payload)
 	msg := NewEnvelope("start_session", req.ServerID, sessionID)
 	msg.Data = data
@@ -369,9 +586,12 @@ func (cp *ControlPlane) CreateSession(actor string, tenantID string, req StartSe
 		sess.Status = SessionError
 		sess.ExitReason = "start_session_send_failed"
 		cp.mu.Unlock()
+		cp.persistSession(sessionID)
 		return nil, err
 	}
+	cp.persistSession(sessionID)
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     actor,
 		ServerID:  req.ServerID,
 		SessionID: sessionID,
@@ -379,29 +599,42 @@ func (cp *ControlPlane) CreateSession(actor string, tenantID string, req StartSe
 		Meta: map[string]any{
 			"cwd":       req.Cwd,
 			"resume_id": resumeID,
+			"runtime":   rt.Name,
+			"args":      req.Args,
 		},
 	})
 	return sess, nil
 }
 
 func (cp *ControlPlane) StopSession(actor, tenantID, sessionID string, graceMS, killAfterMS int) error {
+	return cp.stopSession(actor, nil, tenantID, nil, sessionID, graceMS, killAfterMS)
+}
+
+// StopSessionAs stops a session on behalf of an API caller, recording the
+// caller's token and address with the audit event.
+func (cp *ControlPlane) StopSessionAs(actor auth.Actor, tenantID string, scope *auth.Scope, sessionID string, graceMS, killAfterMS int) error {
+	return cp.stopSession(actor.String(), actor.AuditMeta(), tenantID, scope, sessionID, graceMS, killAfterMS)
+}
+
+func (cp *ControlPlane) stopSession(actor string, meta map[string]any, tenantID string, scope *auth.Scope, sessionID string, graceMS, killAfterMS int) error {
 	cp.mu.Lock()
 	sess, ok := cp.sessions[sessionID]
 	if !ok {
 		cp.mu.Unlock()
 		return errors.New("session not found")
 	}
-	if tenantID != "" && sess.TenantID != tenantID {
+	if !cp.sessionVisibleLocked(sess, tenantID, scope) {
 		cp.mu.Unlock()
 		return errors.New("session not found")
 	}
-	conn := cp.agentConns[sess.ServerID]
+	conn := cp.agentConns[sess.serverKey()]
 	if conn == nil {
 		cp.mu.Unlock()
 		return errors.New("server offline")
 	}
 	sess.Status = SessionStopping
 	cp.mu.Unlock()
+	cp.persistSession(sessionID)
 
 	if graceMS <= 0 {
 		graceMS = cp.cfg.DefaultGraceMS
@@ -419,38 +652,43 @@ func (cp *ControlPlane) StopSession(actor, tenantID, sessionID string, graceMS,
 	if err := conn.Send(msg); err != nil {
 		return err
 	}
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	meta["grace_ms"] = graceMS
+	meta["kill_after_ms"] = killAfterMS
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     actor,
 		ServerID:  sess.ServerID,
 		SessionID: sessionID,
 		Kind:      "stop_session",
-		Meta: map[string]any{
-			"grace_ms":      graceMS,
-			"kill_after_ms": killAfterMS,
-		},
+		Meta:      meta,
 	})
 	cp.broadcastSessionUpdate(sessionID)
 	return nil
 }
 
-func (cp *ControlPlane) DeleteSession(actor, tenantID, sessionID string) error {
+func (cp *ControlPlane) DeleteSession(actor, tenantID string, scope *auth.Scope, sessionID string) error {
 	cp.mu.Lock()
 	sess, ok := cp.sessions[sessionID]
 	if !ok {
 		cp.mu.Unlock()
 		return errors.New("session not found")
 	}
-	if tenantID != "" && sess.TenantID != tenantID {
+	if !cp.sessionVisibleLocked(sess, tenantID, scope) {
 		cp.mu.Unlock()
 		return errors.New("session not found")
 	}
-	if sess.Status == SessionStarting || sess.Status == SessionRunning || sess.Status == SessionStopping {
+	if isActiveStatus(sess.Status) {
 		cp.mu.Unlock()
 		return errors.New("session still active; stop first")
 	}
+	rec := cp.detachRecorderLocked(sessionID)
 	delete(cp.sessions, sessionID)
 	delete(cp.sessionEvents, sessionID)
 	delete(cp.sessionHubs, sessionID)
+	cp.forgetSessionWebhook(sessionID)
 	for sub := range cp.subscribers {
 		if sub.AttachedSession == sessionID {
 			sub.AttachedSession = ""
@@ -458,11 +696,14 @@ func (cp *ControlPlane) DeleteSession(actor, tenantID, sessionID string) error {
 	}
 	cp.mu.Unlock()
 
-	if cp.detector != nil {
-		cp.detector.Clear(sessionID)
+	if rec != nil {
+		rec.close()
 	}
+	cp.forgetSession(sessionID)
+	cp.detector.Clear(sessionID)
 	cp.resumeDetector.Clear(sessionID)
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     actor,
 		ServerID:  sess.ServerID,
 		SessionID: sessionID,
@@ -471,23 +712,25 @@ func (cp *ControlPlane) DeleteSession(actor, tenantID, sessionID string) error {
 	return nil
 }
 
-func (cp *ControlPlane) StopAndDeleteSession(actor, tenantID, sessionID string, graceMS, killAfterMS int) error {
+func (cp *ControlPlane) StopAndDeleteSession(actor, tenantID string, scope *auth.Scope, sessionID string, graceMS, killAfterMS int) error {
 	cp.mu.RLock()
 	sess, ok := cp.sessions[sessionID]
 	if !ok {
 		cp.mu.RUnlock()
 		return errors.New("session not found")
 	}
-	if tenantID != "" && sess.TenantID != tenantID {
+	if !cp.sessionVisibleLocked(sess, tenantID, scope) {
 		cp.mu.RUnlock()
 		return errors.New("session not found")
 	}
 	serverID := sess.ServerID
 	status := sess.Status
-	conn := cp.agentConns[serverID]
+	awaitingReconcile := sess.AwaitingReconcile
+	conn := cp.agentConns[sess.serverKey()]
 	cp.mu.RUnlock()
 
-	if status == SessionStarting || status == SessionRunning || status == SessionStopping {
+	stopRequested := isActiveStatus(status) && !(conn == nil && awaitingReconcile)
+	if stopRequested {
 		if conn == nil {
 			return errors.New("server offline")
 		}
@@ -508,6 +751,7 @@ func (cp *ControlPlane) StopAndDeleteSession(actor, tenantID, sessionID string,
 			return err
 		}
 		cp.audit.Log(AuditEvent{
+			TenantID:  sess.TenantID,
 			Actor:     actor,
 			ServerID:  serverID,
 			SessionID: sessionID,
@@ -525,13 +769,15 @@ func (cp *ControlPlane) StopAndDeleteSession(actor, tenantID, sessionID string,
 		cp.mu.Unlock()
 		return errors.New("session not found")
 	}
-	if tenantID != "" && sess.TenantID != tenantID {
+	if !cp.sessionVisibleLocked(sess, tenantID, scope) {
 		cp.mu.Unlock()
 		return errors.New("session not found")
 	}
+	rec := cp.detachRecorderLocked(sessionID)
 	delete(cp.sessions, sessionID)
 	delete(cp.sessionEvents, sessionID)
 	delete(cp.sessionHubs, sessionID)
+	cp.forgetSessionWebhook(sessionID)
 	for sub := range cp.subscribers {
 		if sub.AttachedSession == sessionID {
 			sub.AttachedSession = ""
@@ -539,32 +785,37 @@ func (cp *ControlPlane) StopAndDeleteSession(actor, tenantID, sessionID string,
 	}
 	cp.mu.Unlock()
 
-	if cp.detector != nil {
-		cp.detector.Clear(sessionID)
+	if rec != nil {
+		rec.close()
 	}
+	cp.forgetSession(sessionID)
+	cp.detector.Clear(sessionID)
 	cp.resumeDetector.Clear(sessionID)
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     actor,
 		ServerID:  sess.ServerID,
 		SessionID: sessionID,
 		Kind:      "delete_session",
 		Meta: map[string]any{
-			"stop_requested": status == SessionStarting || status == SessionRunning || status == SessionStopping,
+			"stop_requested": stopRequested,
 		},
 	})
 	return nil
 }
 
-func (cp *ControlPlane) HandlePTYOut(serverID, sessionID string, seq uint64, dataB64 string) {
+func (cp *ControlPlane) HandlePTYOut(tenantID, serverID, sessionID string, seq uint64, dataB64 string) {
 	raw, err := base64.StdEncoding.DecodeString(dataB64)
 	if err != nil {
 		return
 	}
+	cp.metrics.ptyOutMessages.Add(1)
+	cp.metrics.ptyOutBytes.Add(uint64(len(raw)))
 	var becameRunning bool
 	var resumeUpdated bool
 	cp.mu.Lock()
 	sess, ok := cp.sessions[sessionID]
-	if !ok {
+	if !ok || !sess.ownedBy(tenantID, serverID) {
 		cp.mu.Unlock()
 		return
 	}
@@ -579,16 +830,30 @@ func (cp *ControlPlane) HandlePTYOut(serverID, sessionID string, seq uint64, dat
 		sess.Status = SessionRunning
 		becameRunning = true
 	}
+	if sess.AwaitingReconcile {
+		// Output proves the agent still owns this session.
+		sess.AwaitingReconcile = false
+		becameRunning = true
+	}
+	var rec *castRecorder
 	if hub, ok := cp.sessionHubs[sessionID]; ok {
-		hub.ring.Write(raw)
+		hub.ring.Write(seq, raw)
+		rec = hub.rec
 	}
 	if resumeID, ok := cp.resumeDetector.Feed(sessionID, raw); ok && resumeID != sess.ResumeID {
 		sess.ResumeID = resumeID
 		resumeUpdated = true
 	}
 	awaiting := sess.AwaitingApproval
+	runtime := sess.Runtime
 	cp.mu.Unlock()
 
+	if rec != nil {
+		rec.output(raw)
+	}
+	if becameRunning || resumeUpdated {
+		cp.persistSession(sessionID)
+	}
 	out := NewEnvelope("term_out", serverID, sessionID)
 	out.Seq = seq
 	out.DataB64 = dataB64
@@ -597,17 +862,17 @@ func (cp *ControlPlane) HandlePTYOut(serverID, sessionID string, seq uint64, dat
 	if becameRunning || resumeUpdated {
 		cp.broadcastSessionUpdate(sessionID)
 	}
-	if awaiting || cp.detector == nil {
+	if awaiting || !cp.cfg.EnablePromptDetection {
 		return
 	}
-	matched, excerpt := cp.detector.Feed(sessionID, raw)
-	if !matched {
+	match := cp.detector.Match(sessionID, runtime, raw)
+	if !match.Matched {
 		return
 	}
-	cp.createApprovalEvent(sessionID, serverID, excerpt)
+	cp.createApprovalEvent(sessionID, serverID, match.Excerpt, match.Profile)
 }
 
-func (cp *ControlPlane) createApprovalEvent(sessionID, serverID, excerpt string) {
+func (cp *ControlPlane) createApprovalEvent(sessionID, serverID, excerpt, profile string) {
 	cp.mu.Lock()
 	sess, ok := cp.sessions[sessionID]
 	if !ok || sess.AwaitingApproval {
@@ -617,6 +882,12 @@ func (cp *ControlPlane) createApprovalEvent(sessionID, serverID, excerpt string)
 	eventID := uuid.NewString()
 	sess.AwaitingApproval = true
 	sess.PendingEventID = eventID
+	createdBy := sess.CreatedBy
+	in := PolicyInput{Prompt: excerpt, ServerID: serverID, Cwd: sess.Cwd, Runtime: sess.Runtime}
+	if srv, ok := cp.servers[sess.serverKey()]; ok {
+		in.ServerTags = srv.Tags
+	}
+	decision := cp.evaluatePoliciesLocked(sess.TenantID, in)
 	ev := SessionEvent{
 		EventID:    eventID,
 		SessionID:  sessionID,
@@ -624,27 +895,21 @@ func (cp *ControlPlane) createApprovalEvent(sessionID, serverID, excerpt string)
 		TenantID:   sess.TenantID,
 		Kind:       "approval_needed",
 		PromptText: excerpt,
+		Profile:    profile,
+		Options:    parseApprovalOptions(excerpt),
 		TsMS:       time.Now().UnixMilli(),
 	}
 	cp.sessionEvents[sessionID] = append(cp.sessionEvents[sessionID], ev)
 	cp.mu.Unlock()
+	cp.persistSessionEvent(sessionID, eventID)
+	cp.persistSession(sessionID)
 
 	// Clear the detector buffer so the same prompt text sitting in the ring
 	// buffer won't re-trigger a new approval on the next pty_out chunk.
-	if cp.detector != nil {
-		cp.detector.Clear(sessionID)
-	}
+	cp.detector.Clear(sessionID)
 
-	body, _ := json.Marshal(ev)
-	msg := NewEnvelope("event", serverID, sessionID)
-	msg.Data = body
-	if cp.cfg.ApprovalBroadcast == "attached" {
-		cp.broadcastToAttached(sessionID, msg)
-	} else {
-		cp.broadcastToAll(msg)
-	}
-	cp.broadcastSessionUpdate(sessionID)
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     "system",
 		ServerID:  serverID,
 		SessionID: sessionID,
@@ -653,12 +918,60 @@ func (cp *ControlPlane) createApprovalEvent(sessionID, serverID, excerpt string)
 			"event_id": eventID,
 		},
 	})
+	// Policy decisions resolve the prompt before anyone is notified.
+	if cp.applyPolicy(sessionID, eventID, decision) {
+		return
+	}
+
+	cp.broadcastApprovalEvent(ev, createdBy)
+	// Each webhook gets its own tokens, so a redemption names the webhook
+	// that delivered it.
+	cp.emitWebhookFor(ev.TenantID, WebhookApprovalNeeded, func(h Webhook) any {
+		return approvalWebhookData{SessionEvent: ev, Actions: cp.MintCallbackActions(ev, "webhook:"+h.WebhookID)}
+	})
+	cp.broadcastSessionUpdate(sessionID)
 }
 
-func (cp *ControlPlane) HandlePTYExit(serverID, sessionID string, exit PTYExit) {
+// HandleSessionStarted records the argv and pid the agent actually started,
+// which is authoritative over the command line built in CreateSession.
+func (cp *ControlPlane) HandleSessionStarted(tenantID, serverID, sessionID string, started SessionStarted) {
 	cp.mu.Lock()
 	sess, ok := cp.sessions[sessionID]
-	if !ok {
+	if !ok || !sess.ownedBy(tenantID, serverID) {
+		cp.mu.Unlock()
+		return
+	}
+	if len(started.Argv) > 0 {
+		sess.Cmd = append([]string(nil), started.Argv...)
+	}
+	sess.Pid = started.Pid
+	if sess.Status == SessionStarting {
+		sess.Status = SessionRunning
+	}
+	args := sess.Args
+	cp.mu.Unlock()
+
+	cp.persistSession(sessionID)
+	cp.broadcastSessionUpdate(sessionID)
+	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
+		Actor:     "agent:" + serverID,
+		ServerID:  serverID,
+		SessionID: sessionID,
+		Kind:      "session_started",
+		Meta: map[string]any{
+			"runtime": started.Runtime,
+			"argv":    started.Argv,
+			"args":    args,
+			"pid":     started.Pid,
+		},
+	})
+}
+
+func (cp *ControlPlane) HandlePTYExit(tenantID, serverID, sessionID string, exit PTYExit) {
+	cp.mu.Lock()
+	sess, ok := cp.sessions[sessionID]
+	if !ok || !sess.ownedBy(tenantID, serverID) {
 		cp.mu.Unlock()
 		return
 	}
@@ -667,14 +980,16 @@ func (cp *ControlPlane) HandlePTYExit(serverID, sessionID string, exit PTYExit)
 	sess.ExitReason = exit.Reason
 	sess.AwaitingApproval = false
 	sess.PendingEventID = ""
+	sess.AwaitingReconcile = false
 	cp.mu.Unlock()
 
-	if cp.detector != nil {
-		cp.detector.Clear(sessionID)
-	}
+	cp.stopRecording(sessionID)
+	cp.persistSession(sessionID)
+	cp.detector.Clear(sessionID)
 	cp.resumeDetector.Clear(sessionID)
 	cp.broadcastSessionUpdate(sessionID)
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     "agent:" + serverID,
 		ServerID:  serverID,
 		SessionID: sessionID,
@@ -687,7 +1002,7 @@ func (cp *ControlPlane) HandlePTYExit(serverID, sessionID string, exit PTYExit)
 	})
 }
 
-func (cp *ControlPlane) HandleAgentError(serverID, sessionID, message string) {
+func (cp *ControlPlane) HandleAgentError(tenantID, serverID, sessionID, message string) {
 	if sessionID == "" {
 		return
 	}
@@ -708,7 +1023,7 @@ func (cp *ControlPlane) HandleAgentError(serverID, sessionID, message string) {
 
 	cp.mu.Lock()
 	sess, ok := cp.sessions[sessionID]
-	if !ok {
+	if !ok || !sess.ownedBy(tenantID, serverID) {
 		cp.mu.Unlock()
 		return
 	}
@@ -733,24 +1048,28 @@ func (cp *ControlPlane) HandleAgentError(serverID, sessionID, message string) {
 	}
 	sess.AwaitingApproval = false
 	sess.PendingEventID = ""
+	// The note gets a seq of its own, so clients resuming from the last
+	// output still receive it.
+	sess.LatestAgentOutSeq++
 	latest = sess.LatestAgentOutSeq
 	hub = cp.sessionHubs[sessionID]
 	cp.mu.Unlock()
+	cp.persistSession(sessionID)
 
 	if hub != nil {
-		hub.ring.Write([]byte(note))
+		hub.ring.Write(latest, []byte(note))
 	}
+	cp.stopRecording(sessionID)
 	out := NewEnvelope("term_out", serverID, sessionID)
 	out.Seq = latest
 	out.DataB64 = base64.StdEncoding.EncodeToString([]byte(note))
 	cp.broadcastToAttached(sessionID, out)
 
-	if cp.detector != nil {
-		cp.detector.Clear(sessionID)
-	}
+	cp.detector.Clear(sessionID)
 	cp.resumeDetector.Clear(sessionID)
 	cp.broadcastSessionUpdate(sessionID)
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     "agent:" + serverID,
 		ServerID:  serverID,
 		SessionID: sessionID,
@@ -761,18 +1080,18 @@ func (cp *ControlPlane) HandleAgentError(serverID, sessionID, message string) {
 	})
 }
 
-func (cp *ControlPlane) HandleClientTermIn(actor, tenantID, sessionID, dataB64 string) error {
+func (cp *ControlPlane) HandleClientTermIn(actor, tenantID string, scope *auth.Scope, sessionID, dataB64 string) error {
 	cp.mu.RLock()
 	sess, ok := cp.sessions[sessionID]
 	if !ok {
 		cp.mu.RUnlock()
 		return errors.New("session not found")
 	}
-	if tenantID != "" && sess.TenantID != tenantID {
+	if !cp.sessionVisibleLocked(sess, tenantID, scope) {
 		cp.mu.RUnlock()
 		return errors.New("session not found")
 	}
-	conn := cp.agentConns[sess.ServerID]
+	conn := cp.agentConns[sess.serverKey()]
 	cp.mu.RUnlock()
 	if conn == nil {
 		return errors.New("server offline")
@@ -783,8 +1102,12 @@ func (cp *ControlPlane) HandleClientTermIn(actor, tenantID, sessionID, dataB64 s
 		return err
 	}
 	raw, _ := base64.StdEncoding.DecodeString(dataB64)
+	if rec := cp.sessionRecorder(sessionID); rec != nil {
+		rec.inputEvent(raw)
+	}
 	sum := sha256.Sum256(raw)
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     actor,
 		ServerID:  sess.ServerID,
 		SessionID: sessionID,
@@ -797,16 +1120,25 @@ func (cp *ControlPlane) HandleClientTermIn(actor, tenantID, sessionID, dataB64 s
 	return nil
 }
 
-func (cp *ControlPlane) HandleClientAction(actor, tenantID, sessionID string, req ActionRequest) error {
+func (cp *ControlPlane) HandleClientAction(actor, tenantID string, scope *auth.Scope, sessionID string, req ActionRequest) error {
 	switch req.Kind {
-	case "approve", "reject":
+	case "approve", "reject", "choose", "reject_with_message":
+		message := sanitizePasteText(req.Message)
+		if req.Kind == "reject_with_message" {
+			if strings.TrimSpace(message) == "" {
+				return errors.New("message is required")
+			}
+			if len(message) > maxFeedbackMessageBytes {
+				return errors.New("message too long")
+			}
+		}
 		cp.mu.Lock()
 		sess, ok := cp.sessions[sessionID]
 		if !ok {
 			cp.mu.Unlock()
 			return errors.New("session not found")
 		}
-		if tenantID != "" && sess.TenantID != tenantID {
+		if !cp.sessionVisibleLocked(sess, tenantID, scope) {
 			cp.mu.Unlock()
 			return errors.New("session not found")
 		}
@@ -814,57 +1146,146 @@ func (cp *ControlPlane) HandleClientAction(actor, tenantID, sessionID string, re
 			cp.mu.Unlock()
 			return errors.New("no pending approval")
 		}
+		if req.exactEvent && req.EventID != sess.PendingEventID {
+			cp.mu.Unlock()
+			return errors.New("approval no longer pending")
+		}
 		// Clients may submit a stale event_id after reconnect; always execute
 		// against the session's current pending event for robustness.
 		requestedEventID := req.EventID
 		eventID := sess.PendingEventID
-		var promptExcerpt string
-		sess.AwaitingApproval = false
-		sess.PendingEventID = ""
+		var ev *SessionEvent
 		for i := len(cp.sessionEvents[sessionID]) - 1; i >= 0; i-- {
 			if cp.sessionEvents[sessionID][i].EventID == eventID {
-				promptExcerpt = cp.sessionEvents[sessionID][i].PromptText
-				cp.sessionEvents[sessionID][i].Resolved = true
-				cp.sessionEvents[sessionID][i].Actor = actor
+				ev = &cp.sessionEvents[sessionID][i]
 				break
 			}
 		}
+		var promptExcerpt, profile string
+		var options []ApprovalOption
+		if ev != nil {
+			promptExcerpt = ev.PromptText
+			profile = ev.Profile
+			options = ev.Options
+		}
+		var option ApprovalOption
+		if req.Kind == "choose" {
+			opt, err := selectApprovalOption(options, req)
+			if err != nil {
+				cp.mu.Unlock()
+				return err
+			}
+			option = opt
+		}
+		runtime := sess.Runtime
+		// Claim the prompt so a concurrent answer cannot send keys too. The
+		// claim is only persisted once the keys reached the agent; until then
+		// releaseApproval can hand the prompt back.
+		sess.AwaitingApproval = false
+		sess.PendingEventID = ""
+		var promptTsMS int64
+		var promptActor string
+		if ev != nil {
+			promptActor = ev.Actor
+			ev.Resolved = true
+			ev.Actor = actor
+			promptTsMS = ev.TsMS
+		}
 		cp.mu.Unlock()
 
-		input := "y\n"
-		if req.Kind == "reject" {
-			input = "n\n"
-		}
-		// Claude Code / Cursor-style approval menus are not y/n; approving is Enter (default "Yes"),
-		// rejecting is Esc (cancel).
-		if looksLikeApprovalMenuPrompt(promptExcerpt) {
-			if req.Kind == "approve" {
-				input = "\r"
-			} else {
-				input = "\u001b"
+		// The detection profile decides the keys, e.g. Enter/Esc for Claude
+		// Code style menus instead of y/n.
+		var input string
+		switch req.Kind {
+		case "choose":
+			input = cp.detector.ChoiceKeys(profile, runtime, promptExcerpt, option.Index)
+		case "reject_with_message":
+			input = cp.detector.FeedbackKeys(profile, runtime, promptExcerpt, options)
+		default:
+			approveInput, rejectInput := cp.detector.ApprovalKeys(profile, runtime, promptExcerpt)
+			input = approveInput
+			if req.Kind == "reject" {
+				input = rejectInput
 			}
 		}
-		if err := cp.HandleClientTermIn(actor, tenantID, sessionID, base64.StdEncoding.EncodeToString([]byte(input))); err != nil {
+		if err := cp.HandleClientTermIn(actor, tenantID, scope, sessionID, base64.StdEncoding.EncodeToString([]byte(input))); err != nil {
+			cp.releaseApproval(sessionID, eventID, actor, promptActor)
 			return err
 		}
+		if promptTsMS != 0 {
+			cp.metrics.observeApproval(req.Kind, time.Since(time.UnixMilli(promptTsMS)))
+		}
+		cp.persistSessionEvent(sessionID, eventID)
+		cp.persistSession(sessionID)
+		if req.Kind == "reject_with_message" {
+			// Give the CLI time to open its feedback input, then paste the
+			// message in one piece and submit it. The wait runs on a timer so
+			// the caller's connection keeps being served meanwhile.
+			paste := base64.StdEncoding.EncodeToString([]byte("\x1b[200~" + message + "\x1b[201~\r"))
+			send := func() error {
+				return cp.HandleClientTermIn(actor, tenantID, scope, sessionID, paste)
+			}
+			if cp.pasteDelay <= 0 {
+				if err := send(); err != nil {
+					return err
+				}
+			} else {
+				time.AfterFunc(cp.pasteDelay, func() {
+					if err := send(); err != nil {
+						slog.Warn("paste feedback message failed", "session_id", sessionID, "err", err)
+					}
+				})
+			}
+		}
 		cp.broadcastSessionUpdate(sessionID)
+		meta := map[string]any{
+			"event_id":           eventID,
+			"requested_event_id": requestedEventID,
+		}
+		switch req.Kind {
+		case "choose":
+			meta["choice"] = option.Index
+			meta["label"] = option.Label
+		case "reject_with_message":
+			meta["message"] = message
+		}
 		cp.audit.Log(AuditEvent{
+			TenantID:  sess.TenantID,
 			Actor:     actor,
 			SessionID: sessionID,
 			Kind:      "action_" + req.Kind,
-			Meta: map[string]any{
-				"event_id":           eventID,
-				"requested_event_id": requestedEventID,
-			},
+			Meta:      meta,
 		})
 		return nil
 	case "stop":
-		return cp.StopSession(actor, tenantID, sessionID, cp.cfg.DefaultGraceMS, cp.cfg.DefaultKillMS)
+		return cp.stopSession(actor, nil, tenantID, scope, sessionID, cp.cfg.DefaultGraceMS, cp.cfg.DefaultKillMS)
 	default:
 		return errors.New("invalid action")
 	}
 }
 
+// releaseApproval hands a prompt claimed by actor back when its keys could
+// not be delivered, e.g. the agent is offline, so it can still be answered.
+// prevActor is the event's actor before the claim.
+func (cp *ControlPlane) releaseApproval(sessionID, eventID, actor, prevActor string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	sess, ok := cp.sessions[sessionID]
+	if !ok || sess.AwaitingApproval || !isActiveStatus(sess.Status) {
+		return
+	}
+	sess.AwaitingApproval = true
+	sess.PendingEventID = eventID
+	events := cp.sessionEvents[sessionID]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].EventID == eventID && events[i].Actor == actor {
+			events[i].Resolved = false
+			events[i].Actor = prevActor
+			break
+		}
+	}
+}
+
 func looksLikeApprovalMenuPrompt(prompt string) bool {
 	p := normalizePromptForMenuMatch(prompt)
 	if p == "" {
@@ -897,18 +1318,18 @@ func normalizePromptForMenuMatch(prompt string) string {
 	return strings.Join(strings.Fields(strings.ToLower(prompt)), " ")
 }
 
-func (cp *ControlPlane) HandleClientResize(actor, tenantID, sessionID string, cols, rows uint16) error {
+func (cp *ControlPlane) HandleClientResize(actor, tenantID string, scope *auth.Scope, sessionID string, cols, rows uint16) error {
 	cp.mu.RLock()
 	sess, ok := cp.sessions[sessionID]
 	if !ok {
 		cp.mu.RUnlock()
 		return errors.New("session not found")
 	}
-	if tenantID != "" && sess.TenantID != tenantID {
+	if !cp.sessionVisibleLocked(sess, tenantID, scope) {
 		cp.mu.RUnlock()
 		return errors.New("session not found")
 	}
-	conn := cp.agentConns[sess.ServerID]
+	conn := cp.agentConns[sess.serverKey()]
 	cp.mu.RUnlock()
 	if conn == nil {
 		return errors.New("server offline")
@@ -919,7 +1340,11 @@ func (cp *ControlPlane) HandleClientResize(actor, tenantID, sessionID string, co
 	if err := conn.Send(msg); err != nil {
 		return err
 	}
+	if rec := cp.sessionRecorder(sessionID); rec != nil {
+		rec.resize(cols, rows)
+	}
 	cp.audit.Log(AuditEvent{
+		TenantID:  sess.TenantID,
 		Actor:     actor,
 		ServerID:  sess.ServerID,
 		SessionID: sessionID,
@@ -948,21 +1373,7 @@ func (cp *ControlPlane) broadcastToAttached(sessionID string, msg Envelope) {
 		select {
 		case sub.Send <- msg:
 		default:
-		}
-	}
-}
-
-func (cp *ControlPlane) broadcastToAll(msg Envelope) {
-	cp.mu.RLock()
-	subs := make([]*Subscriber, 0, len(cp.subscribers))
-	for s := range cp.subscribers {
-		subs = append(subs, s)
-	}
-	cp.mu.RUnlock()
-	for _, sub := range subs {
-		select {
-		case sub.Send <- msg:
-		default:
+			cp.metrics.dropMessage("session")
 		}
 	}
 }
@@ -974,19 +1385,22 @@ func (cp *ControlPlane) broadcastSessionUpdate(sessionID string) {
 		cp.mu.RUnlock()
 		return
 	}
-	serverID := sess.ServerID
+	tenantID, serverID, createdBy := sess.TenantID, sess.ServerID, sess.CreatedBy
+	snap := *sess
 	body, _ := json.Marshal(map[string]any{
-		"session_id":        sess.SessionID,
-		"status":            sess.Status,
-		"exit_code":         sess.ExitCode,
-		"exit_reason":       sess.ExitReason,
-		"resume_id":         sess.ResumeID,
-		"awaiting_approval": sess.AwaitingApproval,
-		"pending_event_id":  sess.PendingEventID,
+		"session_id":         sess.SessionID,
+		"status":             sess.Status,
+		"exit_code":          sess.ExitCode,
+		"exit_reason":        sess.ExitReason,
+		"resume_id":          sess.ResumeID,
+		"awaiting_approval":  sess.AwaitingApproval,
+		"pending_event_id":   sess.PendingEventID,
+		"awaiting_reconcile": sess.AwaitingReconcile,
 	})
 	cp.mu.RUnlock()
 
 	msg := NewEnvelope("session_update", serverID, sessionID)
 	msg.Data = body
-	cp.broadcastToAll(msg)
+	cp.broadcastToTenant(tenantID, serverID, createdBy, msg)
+	cp.emitSessionWebhook(snap)
 }
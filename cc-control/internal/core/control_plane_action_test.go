@@ -4,33 +4,92 @@ import (
 	"encoding/base64"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 type fakeAgentConn struct {
 	msgs []Envelope
+	// err, when set, fails every Send like a full or closed agent queue.
+	err error
 }
 
 func (f *fakeAgentConn) Send(msg Envelope) error {
+	if f.err != nil {
+		return f.err
+	}
 	f.msgs = append(f.msgs, msg)
 	return nil
 }
 
-func setupActionTestControlPlane(t *testing.T, prompt string) (*ControlPlane, *fakeAgentConn, string, string) {
+func TestHandleAgentError_NoteGetsItsOwnSeq(t *testing.T) {
+	cp, _, sessionID, _ := setupActionTestControlPlane(t, "")
+	cp.mu.Lock()
+	cp.sessionHubs[sessionID] = newSessionHub(1024)
+	cp.mu.Unlock()
+	cp.HandlePTYOut("t1", "srv", sessionID, 1, base64.StdEncoding.EncodeToString([]byte("hello")))
+	cp.HandleAgentError("t1", "srv", sessionID, "boom")
+
+	if got := sessionByID(t, cp, sessionID); got.Status != SessionError || got.LatestAgentOutSeq != 2 {
+		t.Fatalf("expected an errored session at seq 2, got %#v", got)
+	}
+	cp.mu.RLock()
+	hub := cp.sessionHubs[sessionID]
+	cp.mu.RUnlock()
+	if data, ok := hub.ring.Since(1); !ok || string(data) != "\r\n[agent error] boom\r\n" {
+		t.Fatalf("a client holding seq 1 should get only the note, got %q %v", data, ok)
+	}
+}
+
+// newTestControlPlane starts a control plane that is closed when the test
+// ends. The audit log goes to a temp dir unless cfg names one.
+func newTestControlPlane(t *testing.T, cfg Config) *ControlPlane {
 	t.Helper()
-	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
-	cp, err := NewControlPlane(Config{AuditPath: auditPath})
+	if cfg.AuditPath == "" {
+		cfg.AuditPath = filepath.Join(t.TempDir(), "audit.jsonl")
+	}
+	cp, err := NewControlPlane(cfg)
 	if err != nil {
 		t.Fatalf("new control plane: %v", err)
 	}
 	t.Cleanup(func() { _ = cp.Close() })
+	return cp
+}
+
+// addTestServer registers a server the way a connecting agent does and
+// returns its connection with the registration traffic cleared.
+func addTestServer(t *testing.T, cp *ControlPlane, tenantID string, reg AgentRegister) *fakeAgentConn {
+	t.Helper()
+	conn := &fakeAgentConn{}
+	if err := cp.RegisterOrUpdateServer(tenantID, reg, conn); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	conn.msgs = nil
+	return conn
+}
+
+// addTestSession adds sess, running unless it says otherwise, with an
+// output hub.
+func addTestSession(cp *ControlPlane, sess Session) {
+	if sess.Status == "" {
+		sess.Status = SessionRunning
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.sessions[sess.SessionID] = &sess
+	cp.sessionHubs[sess.SessionID] = newSessionHub(1024)
+}
+
+func setupActionTestControlPlane(t *testing.T, prompt string) (*ControlPlane, *fakeAgentConn, string, string) {
+	t.Helper()
+	cp := newTestControlPlane(t, Config{})
 
 	conn := &fakeAgentConn{}
 	sessionID := "s1"
 	eventID := "e1"
 	tenantID := "t1"
 	cp.mu.Lock()
-	cp.servers["srv"] = &Server{TenantID: tenantID, ServerID: "srv", Status: ServerOnline}
-	cp.agentConns["srv"] = conn
+	cp.servers[serverKey{tenantID, "srv"}] = &Server{TenantID: tenantID, ServerID: "srv", Status: ServerOnline}
+	cp.agentConns[serverKey{tenantID, "srv"}] = conn
 	cp.sessions[sessionID] = &Session{
 		TenantID:         tenantID,
 		SessionID:        sessionID,
@@ -47,6 +106,7 @@ func setupActionTestControlPlane(t *testing.T, prompt string) (*ControlPlane, *f
 			TenantID:   tenantID,
 			Kind:       "approval_needed",
 			PromptText: prompt,
+			Options:    parseApprovalOptions(prompt),
 			TsMS:       1,
 		},
 	}
@@ -74,7 +134,7 @@ func TestHandleClientAction_ApproveMenuUsesEnter(t *testing.T) {
 	prompt := "Do you want to create abc?\n1. Yes\n2. Yes, allow all edits during this session (shift+tab)\n3. No\nEsc to cancel · Tab to amend"
 	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, prompt)
 
-	if err := cp.HandleClientAction("ui:test", "t1", sessionID, ActionRequest{Kind: "approve", EventID: eventID}); err != nil {
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "approve", EventID: eventID}); err != nil {
 		t.Fatalf("approve action failed: %v", err)
 	}
 	if got := lastPTYInput(t, conn); got != "\r" {
@@ -86,7 +146,7 @@ func TestHandleClientAction_RejectMenuUsesEscape(t *testing.T) {
 	prompt := "Do you want to create abc?\n1. Yes\n2. Yes, allow all edits during this session (shift+tab)\n3. No\nEsc to cancel · Tab to amend"
 	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, prompt)
 
-	if err := cp.HandleClientAction("ui:test", "t1", sessionID, ActionRequest{Kind: "reject", EventID: eventID}); err != nil {
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "reject", EventID: eventID}); err != nil {
 		t.Fatalf("reject action failed: %v", err)
 	}
 	if got := lastPTYInput(t, conn); got != "\u001b" {
@@ -97,7 +157,7 @@ func TestHandleClientAction_RejectMenuUsesEscape(t *testing.T) {
 func TestHandleClientAction_PlainPromptUsesYN(t *testing.T) {
 	prompt := "Do you want to continue? [y/N]"
 	cp1, conn1, sessionID1, eventID1 := setupActionTestControlPlane(t, prompt)
-	if err := cp1.HandleClientAction("ui:test", "t1", sessionID1, ActionRequest{Kind: "approve", EventID: eventID1}); err != nil {
+	if err := cp1.HandleClientAction("ui:test", "t1", nil, sessionID1, ActionRequest{Kind: "approve", EventID: eventID1}); err != nil {
 		t.Fatalf("approve action failed: %v", err)
 	}
 	if got := lastPTYInput(t, conn1); got != "y\n" {
@@ -105,7 +165,7 @@ func TestHandleClientAction_PlainPromptUsesYN(t *testing.T) {
 	}
 
 	cp2, conn2, sessionID2, eventID2 := setupActionTestControlPlane(t, prompt)
-	if err := cp2.HandleClientAction("ui:test", "t1", sessionID2, ActionRequest{Kind: "reject", EventID: eventID2}); err != nil {
+	if err := cp2.HandleClientAction("ui:test", "t1", nil, sessionID2, ActionRequest{Kind: "reject", EventID: eventID2}); err != nil {
 		t.Fatalf("reject action failed: %v", err)
 	}
 	if got := lastPTYInput(t, conn2); got != "n\n" {
@@ -117,7 +177,7 @@ func TestHandleClientAction_StaleEventIDStillExecutesCurrentPending(t *testing.T
 	prompt := "Do you want to create abc?\n1. Yes\n2. Yes, allow all edits during this session (shift+tab)\n3. No\nEsc to cancel · Tab to amend"
 	cp, conn, sessionID, _ := setupActionTestControlPlane(t, prompt)
 
-	if err := cp.HandleClientAction("ui:test", "t1", sessionID, ActionRequest{Kind: "approve", EventID: "stale-event-id"}); err != nil {
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "approve", EventID: "stale-event-id"}); err != nil {
 		t.Fatalf("approve with stale event_id should still succeed, got: %v", err)
 	}
 	if got := lastPTYInput(t, conn); got != "\r" {
@@ -125,6 +185,141 @@ func TestHandleClientAction_StaleEventIDStillExecutesCurrentPending(t *testing.T
 	}
 }
 
+func TestParseApprovalOptions_ClaudeCodeMenu(t *testing.T) {
+	prompt := "Do you want to proceed?\n│ ❯ 1. Yes                                          │\n│   2. Yes, and don't ask again for this project   │\n│   3. No, and tell Claude what to do differently (esc) │"
+	got := parseApprovalOptions(prompt)
+	want := []string{"Yes", "Yes, and don't ask again for this project", "No, and tell Claude what to do differently (esc)"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d options, got %#v", len(want), got)
+	}
+	for i, opt := range got {
+		if opt.Index != i+1 || opt.Label != want[i] {
+			t.Fatalf("option %d = %#v, want %q", i+1, opt, want[i])
+		}
+	}
+	if opts := parseApprovalOptions("Do you want to continue? [y/N]"); len(opts) != 0 {
+		t.Fatalf("plain prompt should have no options, got %#v", opts)
+	}
+	if opts := parseApprovalOptions("1. only one entry\n3. not a sequence"); len(opts) != 0 {
+		t.Fatalf("broken numbering should have no options, got %#v", opts)
+	}
+}
+
+func TestHandleClientAction_ChooseSendsOptionNumber(t *testing.T) {
+	prompt := "Do you want to proceed?\n❯ 1. Yes\n  2. Yes, and don't ask again for this project\n  3. No, and tell Claude what to do differently"
+	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, prompt)
+
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "choose", Label: "yes, and don't"}); err != nil {
+		t.Fatalf("choose action failed: %v", err)
+	}
+	if got := lastPTYInput(t, conn); got != "2" {
+		t.Fatalf("choose should type the option number, got %q", got)
+	}
+	if sessionByID(t, cp, sessionID).AwaitingApproval {
+		t.Fatal("choose should resolve the approval")
+	}
+
+	cp2, conn2, sessionID2, _ := setupActionTestControlPlane(t, prompt)
+	if err := cp2.HandleClientAction("ui:test", "t1", nil, sessionID2, ActionRequest{Kind: "choose", Choice: 3, EventID: eventID}); err != nil {
+		t.Fatalf("choose by index failed: %v", err)
+	}
+	if got := lastPTYInput(t, conn2); got != "3" {
+		t.Fatalf("choose 3 should send 3, got %q", got)
+	}
+}
+
+func TestHandleClientAction_ChooseRejectsUnknownOption(t *testing.T) {
+	prompt := "Do you want to proceed?\n❯ 1. Yes\n  2. Yes, and don't ask again for this project\n  3. No"
+	cp, conn, sessionID, _ := setupActionTestControlPlane(t, prompt)
+
+	for _, req := range []ActionRequest{
+		{Kind: "choose", Choice: 4},
+		{Kind: "choose", Label: "y"},
+		{Kind: "choose"},
+	} {
+		if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, req); err == nil {
+			t.Fatalf("expected error for %#v", req)
+		}
+	}
+	if len(conn.msgs) != 0 {
+		t.Fatalf("invalid choices must not send input, got %#v", conn.msgs)
+	}
+	if !sessionByID(t, cp, sessionID).AwaitingApproval {
+		t.Fatal("invalid choice should leave the approval pending")
+	}
+
+	cp2, _, sessionID2, _ := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	if err := cp2.HandleClientAction("ui:test", "t1", nil, sessionID2, ActionRequest{Kind: "choose", Choice: 1}); err == nil {
+		t.Fatal("choose on a prompt without options should fail")
+	}
+}
+
+func ptyInputs(t *testing.T, conn *fakeAgentConn) []string {
+	t.Helper()
+	var out []string
+	for _, msg := range conn.msgs {
+		if msg.Type != "pty_in" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(msg.DataB64)
+		if err != nil {
+			t.Fatalf("decode pty input: %v", err)
+		}
+		out = append(out, string(raw))
+	}
+	return out
+}
+
+func TestHandleClientAction_RejectWithMessagePicksFeedbackOption(t *testing.T) {
+	prompt := "Do you want to proceed?\n❯ 1. Yes\n  2. Yes, and don't ask again for this project\n  3. No, and tell Claude what to do differently (esc)"
+	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, prompt)
+	cp.pasteDelay = 0
+
+	req := ActionRequest{Kind: "reject_with_message", EventID: eventID, Message: "use the staging db\x1b[201~ instead"}
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, req); err != nil {
+		t.Fatalf("reject_with_message failed: %v", err)
+	}
+	got := ptyInputs(t, conn)
+	want := []string{"3", "\x1b[200~use the staging db[201~ instead\x1b[201~\r"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("unexpected input sequence %q, want %q", got, want)
+	}
+	if sessionByID(t, cp, sessionID).AwaitingApproval {
+		t.Fatal("reject_with_message should resolve the approval")
+	}
+}
+
+func TestHandleClientAction_RejectWithMessageFallsBackToReject(t *testing.T) {
+	cp, conn, sessionID, _ := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	cp.pasteDelay = 0
+
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "reject_with_message", Message: "   "}); err == nil {
+		t.Fatal("empty message should be rejected")
+	}
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "reject_with_message", Message: "not now"}); err != nil {
+		t.Fatalf("reject_with_message failed: %v", err)
+	}
+	if got := ptyInputs(t, conn); len(got) != 2 || got[0] != "n\n" {
+		t.Fatalf("plain prompt should reject with n\\n first, got %q", got)
+	}
+}
+
+func TestHandleClientAction_RejectWithMessageDoesNotBlockCaller(t *testing.T) {
+	cp, conn, sessionID, _ := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	cp.pasteDelay = time.Hour
+
+	start := time.Now()
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "reject_with_message", Message: "not now"}); err != nil {
+		t.Fatalf("reject_with_message failed: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("the paste delay must not block the caller")
+	}
+	if got := ptyInputs(t, conn); len(got) != 1 || got[0] != "n\n" {
+		t.Fatalf("only the reject keys should be sent before the delay, got %q", got)
+	}
+}
+
 func TestDeleteSession_RemovesExitedSessionData(t *testing.T) {
 	cp, _, sessionID, _ := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
 	cp.mu.Lock()
@@ -132,7 +327,7 @@ func TestDeleteSession_RemovesExitedSessionData(t *testing.T) {
 	cp.sessionHubs[sessionID] = newSessionHub(1024)
 	cp.mu.Unlock()
 
-	if err := cp.DeleteSession("ui:test", "t1", sessionID); err != nil {
+	if err := cp.DeleteSession("ui:test", "t1", nil, sessionID); err != nil {
 		t.Fatalf("delete session failed: %v", err)
 	}
 
@@ -152,7 +347,7 @@ func TestDeleteSession_RejectsActiveSession(t *testing.T) {
 	cp.sessions[sessionID].Status = SessionRunning
 	cp.mu.Unlock()
 
-	if err := cp.DeleteSession("ui:test", "t1", sessionID); err == nil {
+	if err := cp.DeleteSession("ui:test", "t1", nil, sessionID); err == nil {
 		t.Fatal("expected delete active session to fail")
 	}
 }
@@ -164,7 +359,7 @@ func TestStopAndDeleteSession_RunningSendsStopAndRemoves(t *testing.T) {
 	cp.sessionHubs[sessionID] = newSessionHub(1024)
 	cp.mu.Unlock()
 
-	if err := cp.StopAndDeleteSession("ui:test", "t1", sessionID, 0, 0); err != nil {
+	if err := cp.StopAndDeleteSession("ui:test", "t1", nil, sessionID, 0, 0); err != nil {
 		t.Fatalf("stop and delete failed: %v", err)
 	}
 	if len(conn.msgs) == 0 || conn.msgs[len(conn.msgs)-1].Type != "stop_session" {
@@ -188,7 +383,7 @@ func TestStopAndDeleteSession_ExitedDeletesDirectly(t *testing.T) {
 	cp.sessionHubs[sessionID] = newSessionHub(1024)
 	cp.mu.Unlock()
 
-	if err := cp.StopAndDeleteSession("ui:test", "t1", sessionID, 0, 0); err != nil {
+	if err := cp.StopAndDeleteSession("ui:test", "t1", nil, sessionID, 0, 0); err != nil {
 		t.Fatalf("stop and delete failed: %v", err)
 	}
 	if len(conn.msgs) != 0 {
@@ -0,0 +1,278 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDetectionProfile = "default"
+	defaultExcerptLines     = 12
+	defaultDetectBufferSize = 4096
+)
+
+// DetectionProfile describes how approval prompts of one CLI family look and
+// which keys answer them. Profiles are loaded from a JSON file; a profile
+// named "default" replaces the built-in one.
+type DetectionProfile struct {
+	Name string `json:"name"`
+	// Runtimes lists the session runtimes the profile applies to. A profile
+	// without runtimes is the fallback for runtimes no other profile claims.
+	Runtimes []string `json:"runtimes,omitempty"`
+	// Triggers are regexps matched against the recent, escape-stripped output.
+	Triggers []string `json:"triggers"`
+	// ExcerptLines is how many trailing lines become the event excerpt.
+	ExcerptLines int `json:"excerpt_lines,omitempty"`
+	// BufferBytes bounds the per-session output window triggers see.
+	BufferBytes int `json:"buffer_bytes,omitempty"`
+	// Keys are tried in order against the excerpt; the first whose Match is
+	// empty or matches decides what approve and reject send.
+	Keys []DetectionKeys `json:"keys,omitempty"`
+}
+
+type DetectionKeys struct {
+	Match   string `json:"match,omitempty"`
+	Approve string `json:"approve"`
+	Reject  string `json:"reject"`
+	// Choose is sent to pick a numbered menu option; "{n}" is replaced by
+	// the option number. Empty types the number, which is how Claude Code
+	// menus select an entry.
+	Choose string `json:"choose,omitempty"`
+	// Feedback opens the CLI's input for reject_with_message, e.g. "\t" for
+	// "Tab to amend". Empty picks a "No, and tell ..." menu option when the
+	// prompt has one and sends the reject keys otherwise.
+	Feedback string `json:"feedback,omitempty"`
+}
+
+type detectionProfilesFile struct {
+	Profiles []DetectionProfile `json:"profiles"`
+}
+
+type detectionProfile struct {
+	name         string
+	runtimes     []string
+	triggers     []*regexp.Regexp
+	excerptLines int
+	bufferBytes  int
+	keys         []detectionKeys
+}
+
+type detectionKeys struct {
+	match    func(excerpt string) bool
+	approve  string
+	reject   string
+	choose   string
+	feedback string
+}
+
+// builtinDetectionProfile covers y/n prompts and the Claude Code / Cursor
+// approval menus, which are answered with Enter (default "Yes") and Esc.
+func builtinDetectionProfile() *detectionProfile {
+	rawPatterns := []string{
+		`(?i)(approve|reject)`,
+		`(?i)\(y/n\)`,
+		`(?i)\[y/N\]`,
+		`(?i)\bconfirm\b`,
+		`(?i)continue\?`,
+		// Claude Code / Cursor-style approval menu prompt (examples):
+		// - "Do you want to proceed?" / "Do you want to create <file>?"
+		// - "1. Yes" ... "3. No"
+		// - "Esc to cancel · Tab to amend"
+		`(?is)\bdo\s+you\s+want\s+to\b.{0,800}1[.)]\s*[Yy]es\b`,
+		`(?is)\besc\s+to\s+cancel\b.{0,300}\btab\s+to\s+amend\b`,
+		// Standalone "Do you want to <verb>?" as a single-line trigger
+		`(?i)\bdo\s+you\s+want\s+to\s+\w+.*\?`,
+	}
+	triggers := make([]*regexp.Regexp, 0, len(rawPatterns))
+	for _, p := range rawPatterns {
+		triggers = append(triggers, regexp.MustCompile(p))
+	}
+	return &detectionProfile{
+		name:         defaultDetectionProfile,
+		triggers:     triggers,
+		excerptLines: defaultExcerptLines,
+		bufferBytes:  defaultDetectBufferSize,
+		keys: []detectionKeys{
+			{match: looksLikeApprovalMenuPrompt, approve: "\r", reject: "\u001b"},
+			{approve: "y\n", reject: "n\n"},
+		},
+	}
+}
+
+// LoadDetectionProfiles reads and validates a detection profiles file.
+func LoadDetectionProfiles(path string) ([]DetectionProfile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f detectionProfilesFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if _, err := compileDetectionProfiles(f.Profiles); err != nil {
+		return nil, err
+	}
+	return f.Profiles, nil
+}
+
+// compileDetectionProfiles validates profiles and appends the built-in
+// default unless one of them overrides it.
+func compileDetectionProfiles(profiles []DetectionProfile) ([]*detectionProfile, error) {
+	out := make([]*detectionProfile, 0, len(profiles)+1)
+	seen := make(map[string]struct{}, len(profiles))
+	for _, p := range profiles {
+		name := strings.TrimSpace(p.Name)
+		if name == "" {
+			return nil, errors.New("detection profile name is required")
+		}
+		if _, dup := seen[name]; dup {
+			return nil, fmt.Errorf("duplicate detection profile %q", name)
+		}
+		seen[name] = struct{}{}
+		if len(p.Triggers) == 0 {
+			return nil, fmt.Errorf("detection profile %q: at least one trigger is required", name)
+		}
+		c := &detectionProfile{
+			name:         name,
+			runtimes:     append([]string(nil), p.Runtimes...),
+			excerptLines: p.ExcerptLines,
+			bufferBytes:  p.BufferBytes,
+		}
+		if c.excerptLines <= 0 {
+			c.excerptLines = defaultExcerptLines
+		}
+		if c.bufferBytes <= 0 {
+			c.bufferBytes = defaultDetectBufferSize
+		}
+		for _, t := range p.Triggers {
+			re, err := regexp.Compile(t)
+			if err != nil {
+				return nil, fmt.Errorf("detection profile %q: trigger %q: %w", name, t, err)
+			}
+			c.triggers = append(c.triggers, re)
+		}
+		for _, k := range p.Keys {
+			if k.Approve == "" || k.Reject == "" {
+				return nil, fmt.Errorf("detection profile %q: keys need approve and reject", name)
+			}
+			keys := detectionKeys{approve: k.Approve, reject: k.Reject, choose: k.Choose, feedback: k.Feedback}
+			if k.Match != "" {
+				re, err := regexp.Compile(k.Match)
+				if err != nil {
+					return nil, fmt.Errorf("detection profile %q: keys match %q: %w", name, k.Match, err)
+				}
+				keys.match = re.MatchString
+			}
+			c.keys = append(c.keys, keys)
+		}
+		out = append(out, c)
+	}
+	if _, ok := seen[defaultDetectionProfile]; !ok {
+		out = append(out, builtinDetectionProfile())
+	}
+	return out, nil
+}
+
+// keysFor returns what approve and reject send for a prompt excerpt.
+func (p *detectionProfile) keysFor(excerpt string) (approve, reject string) {
+	for _, k := range p.keys {
+		if k.match == nil || k.match(excerpt) {
+			return k.approve, k.reject
+		}
+	}
+	return "y\n", "n\n"
+}
+
+// choiceFor returns what picks menu option n for a prompt excerpt.
+func (p *detectionProfile) choiceFor(excerpt string, n int) string {
+	tmpl := "{n}"
+	for _, k := range p.keys {
+		if k.match == nil || k.match(excerpt) {
+			if k.choose != "" {
+				tmpl = k.choose
+			}
+			break
+		}
+	}
+	return strings.ReplaceAll(tmpl, "{n}", strconv.Itoa(n))
+}
+
+// feedbackFor returns what opens the feedback input of a prompt before a
+// reject message is pasted.
+func (p *detectionProfile) feedbackFor(excerpt string, options []ApprovalOption) string {
+	for _, k := range p.keys {
+		if k.match == nil || k.match(excerpt) {
+			if k.feedback != "" {
+				return k.feedback
+			}
+			break
+		}
+	}
+	if opt, ok := feedbackOption(options); ok {
+		return p.choiceFor(excerpt, opt.Index)
+	}
+	_, reject := p.keysFor(excerpt)
+	return reject
+}
+
+func (p *detectionProfile) appliesTo(runtime string) bool {
+	for _, rt := range p.runtimes {
+		if rt == runtime {
+			return true
+		}
+	}
+	return false
+}
+
+// selectProfile picks the profile claiming runtime, then the first fallback
+// without runtimes, then the default.
+func selectProfile(profiles []*detectionProfile, runtime string) *detectionProfile {
+	var fallback, def *detectionProfile
+	for _, p := range profiles {
+		if runtime != "" && p.appliesTo(runtime) {
+			return p
+		}
+		if len(p.runtimes) == 0 && fallback == nil {
+			fallback = p
+		}
+		if p.name == defaultDetectionProfile {
+			def = p
+		}
+	}
+	if fallback != nil {
+		return fallback
+	}
+	if def != nil {
+		return def
+	}
+	return builtinDetectionProfile()
+}
+
+// ReloadDetectionProfiles re-reads Config.DetectionProfilesPath. A file that
+// fails to load leaves the current profiles in place.
+func (cp *ControlPlane) ReloadDetectionProfiles() error {
+	if cp.cfg.DetectionProfilesPath == "" {
+		return errors.New("detection profiles file not configured")
+	}
+	profiles, err := LoadDetectionProfiles(cp.cfg.DetectionProfilesPath)
+	if err == nil {
+		err = cp.detector.SetProfiles(profiles)
+	}
+	if err != nil {
+		return err
+	}
+	cp.audit.Log(AuditEvent{
+		Actor: "system",
+		Kind:  "detection_profiles_reloaded",
+		Meta: map[string]any{
+			"path":     cp.cfg.DetectionProfilesPath,
+			"profiles": cp.detector.ProfileNames(),
+		},
+	})
+	return nil
+}
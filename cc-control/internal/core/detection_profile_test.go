@@ -0,0 +1,119 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDetectionProfiles = `{
+  "profiles": [
+    {
+      "name": "codex",
+      "runtimes": ["codex"],
+      "triggers": ["(?i)allow command\\?"],
+      "excerpt_lines": 2,
+      "keys": [{"match": "(?i)\\[a\\]lways", "approve": "a", "reject": "\u001b"}, {"approve": "y", "reject": "n"}]
+    }
+  ]
+}`
+
+func writeDetectionProfiles(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPromptDetector_SelectsProfileByRuntime(t *testing.T) {
+	profiles, err := LoadDetectionProfiles(writeDetectionProfiles(t, testDetectionProfiles))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	d := NewPromptDetector()
+	if err := d.SetProfiles(profiles); err != nil {
+		t.Fatalf("set profiles: %v", err)
+	}
+
+	m := d.Match("s1", "codex", []byte("line one\nline two\nAllow command? [a]lways / [y]es / [n]o"))
+	if !m.Matched || m.Profile != "codex" || m.Excerpt != "line two\nAllow command? [a]lways / [y]es / [n]o" {
+		t.Fatalf("codex prompt not matched by its profile: %#v", m)
+	}
+	if m := d.Match("s2", "codex", []byte("Continue? (y/n)")); m.Matched {
+		t.Fatalf("codex profile must not use the default triggers: %#v", m)
+	}
+	if m := d.Match("s3", "claude", []byte("Continue? (y/n)")); !m.Matched || m.Profile != defaultDetectionProfile {
+		t.Fatalf("other runtimes should fall back to the built-in default: %#v", m)
+	}
+
+	if approve, reject := d.ApprovalKeys("codex", "codex", "Allow command? [a]lways"); approve != "a" || reject != "\u001b" {
+		t.Fatalf("unexpected keys for always menu: %q %q", approve, reject)
+	}
+	if approve, reject := d.ApprovalKeys("codex", "codex", "Allow command?"); approve != "y" || reject != "n" {
+		t.Fatalf("unexpected fallback keys: %q %q", approve, reject)
+	}
+}
+
+func TestLoadDetectionProfiles_RejectsInvalidFiles(t *testing.T) {
+	cases := map[string]string{
+		"no name":     `{"profiles":[{"triggers":["x"]}]}`,
+		"no triggers": `{"profiles":[{"name":"a"}]}`,
+		"bad regexp":  `{"profiles":[{"name":"a","triggers":["("]}]}`,
+		"empty keys":  `{"profiles":[{"name":"a","triggers":["x"],"keys":[{"approve":"y"}]}]}`,
+		"duplicate":   `{"profiles":[{"name":"a","triggers":["x"]},{"name":"a","triggers":["y"]}]}`,
+	}
+	for name, body := range cases {
+		if _, err := LoadDetectionProfiles(writeDetectionProfiles(t, body)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestReloadDetectionProfiles_KeepsProfilesOnError(t *testing.T) {
+	path := writeDetectionProfiles(t, testDetectionProfiles)
+	cp := newTestControlPlane(t, Config{DetectionProfilesPath: path})
+
+	if err := os.WriteFile(path, []byte(`{"profiles":[{"name":"broken","triggers":["("]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.ReloadDetectionProfiles(); err == nil {
+		t.Fatal("expected reload of an invalid file to fail")
+	}
+	if names := cp.detector.ProfileNames(); len(names) != 2 || names[0] != "codex" {
+		t.Fatalf("failed reload must keep previous profiles, got %v", names)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"profiles":[{"name":"gemini","runtimes":["gemini"],"triggers":["Allow execution"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.ReloadDetectionProfiles(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if names := cp.detector.ProfileNames(); len(names) != 2 || names[0] != "gemini" {
+		t.Fatalf("reload should swap profiles, got %v", names)
+	}
+}
+
+func TestHandleClientAction_UsesEventProfileKeys(t *testing.T) {
+	cp, conn, sessionID, eventID := setupActionTestControlPlane(t, "Allow command? [a]lways")
+	profiles, err := LoadDetectionProfiles(writeDetectionProfiles(t, testDetectionProfiles))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := cp.detector.SetProfiles(profiles); err != nil {
+		t.Fatalf("set profiles: %v", err)
+	}
+	cp.mu.Lock()
+	cp.sessions[sessionID].Runtime = "codex"
+	cp.sessionEvents[sessionID][0].Profile = "codex"
+	cp.mu.Unlock()
+
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "approve", EventID: eventID}); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if got := lastPTYInput(t, conn); got != "a" {
+		t.Fatalf("approve should send the profile's key, got %q", got)
+	}
+}
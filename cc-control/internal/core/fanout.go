@@ -0,0 +1,113 @@
+package core
+
+import (
+	"errors"
+
+	"cc-control/internal/auth"
+)
+
+// SubscriptionScope narrows which session_update and approval events a UI
+// subscriber receives. Every scope is additionally limited to the
+// subscriber's own tenant.
+type SubscriptionScope string
+
+const (
+	// ScopeTenant delivers events for every session in the tenant (default).
+	ScopeTenant SubscriptionScope = "tenant"
+	// ScopeServer delivers events for sessions on a single server.
+	ScopeServer SubscriptionScope = "server"
+	// ScopeOwn delivers events for sessions created by the subscriber's token.
+	ScopeOwn SubscriptionScope = "own"
+)
+
+// SetSubscription changes the topic filter of sub. serverID is required for
+// ScopeServer and must belong to the subscriber's tenant.
+func (cp *ControlPlane) SetSubscription(sub *Subscriber, scope SubscriptionScope, serverID string) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	switch scope {
+	case ScopeTenant, ScopeOwn:
+		serverID = ""
+	case ScopeServer:
+		if serverID == "" {
+			return errors.New("server_id is required for server scope")
+		}
+		srv, ok := cp.serverLocked(sub.TenantID, serverID)
+		if !ok || !sub.TokenScope.AllowsServer(srv.ServerID, srv.Tags) {
+			return errors.New("server not found")
+		}
+	default:
+		return errors.New("unknown subscription scope")
+	}
+	sub.Scope = scope
+	sub.ScopeServerID = serverID
+	return nil
+}
+
+// wants reports whether sub should receive events about a session. Callers
+// must hold cp.mu.
+func (sub *Subscriber) wants(tenantID, serverID, createdBy string) bool {
+	if sub.TenantID != "" && sub.TenantID != tenantID {
+		return false
+	}
+	switch sub.Scope {
+	case ScopeServer:
+		return sub.ScopeServerID == serverID
+	case ScopeOwn:
+		return sub.Actor != "" && sub.Actor == createdBy
+	default:
+		return true
+	}
+}
+
+// inTokenScopeLocked reports whether the session msg is about lies within
+// the subscriber's token scope. Callers must hold cp.mu.
+func (cp *ControlPlane) inTokenScopeLocked(sub *Subscriber, msg Envelope) bool {
+	if sub.TokenScope == nil {
+		return true
+	}
+	sess, ok := cp.sessions[msg.SessionID]
+	return ok && cp.sessionVisibleLocked(sess, "", sub.TokenScope)
+}
+
+// broadcastToTenant fans msg out to the subscribers allowed to see the given
+// session: the same tenant (or tenant-less admin subscribers), a matching
+// topic and a token scope covering the session.
+func (cp *ControlPlane) broadcastToTenant(tenantID, serverID, createdBy string, msg Envelope) {
+	cp.mu.RLock()
+	subs := make([]*Subscriber, 0, len(cp.subscribers))
+	for s := range cp.subscribers {
+		if s.wants(tenantID, serverID, createdBy) && cp.inTokenScopeLocked(s, msg) {
+			subs = append(subs, s)
+		}
+	}
+	cp.mu.RUnlock()
+	for _, sub := range subs {
+		select {
+		case sub.Send <- msg:
+		default:
+			cp.metrics.dropMessage("tenant")
+		}
+	}
+}
+
+// broadcastToRole reaches every tenant (or tenant-less admin) subscriber
+// holding at least role, regardless of subscription scope but within token
+// scope; used for approval escalations.
+func (cp *ControlPlane) broadcastToRole(tenantID string, role auth.TokenRole, msg Envelope) {
+	cp.mu.RLock()
+	subs := make([]*Subscriber, 0, len(cp.subscribers))
+	for s := range cp.subscribers {
+		if (s.TenantID == "" || s.TenantID == tenantID) && auth.RoleAtLeast(s.Role, role) && cp.inTokenScopeLocked(s, msg) {
+			subs = append(subs, s)
+		}
+	}
+	cp.mu.RUnlock()
+	for _, sub := range subs {
+		select {
+		case sub.Send <- msg:
+		default:
+			cp.metrics.dropMessage("role")
+		}
+	}
+}
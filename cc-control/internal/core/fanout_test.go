@@ -0,0 +1,94 @@
+package core
+
+import "testing"
+
+func newTestSubscriber(cp *ControlPlane, actor, tenantID string) *Subscriber {
+	sub := &Subscriber{ID: actor, Actor: actor, TenantID: tenantID, Send: make(chan Envelope, 64)}
+	cp.RegisterSubscriber(sub)
+	return sub
+}
+
+func drainSessionIDs(sub *Subscriber) []string {
+	var ids []string
+	for {
+		select {
+		case msg := <-sub.Send:
+			ids = append(ids, msg.Type+":"+msg.SessionID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestFanout_SessionUpdatesAndApprovalsStayInTenant(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "ta", AgentRegister{ServerID: "srv-a"})
+	addTestServer(t, cp, "tb", AgentRegister{ServerID: "srv-b"})
+	addTestSession(cp, Session{TenantID: "ta", SessionID: "sa", ServerID: "srv-a"})
+	addTestSession(cp, Session{TenantID: "tb", SessionID: "sb", ServerID: "srv-b"})
+	alice := newTestSubscriber(cp, "ui:alice", "ta")
+	bob := newTestSubscriber(cp, "ui:bob", "tb")
+
+	cp.broadcastSessionUpdate("sa")
+	cp.createApprovalEvent("sa", "srv-a", "Allow? (y/n)", defaultDetectionProfile)
+
+	if got := drainSessionIDs(bob); len(got) != 0 {
+		t.Fatalf("tenant tb must not see tenant ta traffic, got %v", got)
+	}
+	got := drainSessionIDs(alice)
+	want := []string{"session_update:sa", "event:sa", "session_update:sa"}
+	if len(got) != len(want) {
+		t.Fatalf("tenant ta should get its own updates, got %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("message %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	cp.broadcastSessionUpdate("sb")
+	if got := drainSessionIDs(alice); len(got) != 0 {
+		t.Fatalf("tenant ta must not see tenant tb traffic, got %v", got)
+	}
+	if got := drainSessionIDs(bob); len(got) != 1 {
+		t.Fatalf("tenant tb should get its own update, got %v", got)
+	}
+}
+
+func TestFanout_ServerAndOwnScopes(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "ta", AgentRegister{ServerID: "srv-a"})
+	addTestServer(t, cp, "ta", AgentRegister{ServerID: "srv-a2"})
+	addTestSession(cp, Session{TenantID: "ta", SessionID: "sa", ServerID: "srv-a", CreatedBy: "ui:alice"})
+	addTestSession(cp, Session{TenantID: "ta", SessionID: "sa2", ServerID: "srv-a2", CreatedBy: "ui:carol"})
+	byServer := newTestSubscriber(cp, "ui:dave", "ta")
+	own := newTestSubscriber(cp, "ui:alice", "ta")
+	if err := cp.SetSubscription(byServer, ScopeServer, "srv-a2"); err != nil {
+		t.Fatalf("server scope: %v", err)
+	}
+	if err := cp.SetSubscription(own, ScopeOwn, ""); err != nil {
+		t.Fatalf("own scope: %v", err)
+	}
+
+	cp.broadcastSessionUpdate("sa")
+	cp.broadcastSessionUpdate("sa2")
+
+	if got := drainSessionIDs(byServer); len(got) != 1 || got[0] != "session_update:sa2" {
+		t.Fatalf("server scope should only see srv-a2 sessions, got %v", got)
+	}
+	if got := drainSessionIDs(own); len(got) != 1 || got[0] != "session_update:sa" {
+		t.Fatalf("own scope should only see sessions it created, got %v", got)
+	}
+}
+
+func TestFanout_SetSubscriptionRejectsForeignServer(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "tb", AgentRegister{ServerID: "srv-b"})
+	sub := newTestSubscriber(cp, "ui:alice", "ta")
+	if err := cp.SetSubscription(sub, ScopeServer, "srv-b"); err == nil {
+		t.Fatal("subscribing to another tenant's server must fail")
+	}
+	if err := cp.SetSubscription(sub, "everything", ""); err == nil {
+		t.Fatal("unknown scope must fail")
+	}
+}
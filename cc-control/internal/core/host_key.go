@@ -0,0 +1,41 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// hostKeySkew bounds how far the time an agent signed its register may be
+// from ours. It also limits how long a captured register stays replayable.
+const hostKeySkew = 5 * time.Minute
+
+// HostKeyMessage is what an agent signs with its host key when registering.
+func HostKeyMessage(serverID string, tsMS int64) []byte {
+	return []byte("cc-agent-register\n" + serverID + "\n" + strconv.FormatInt(tsMS, 10))
+}
+
+// VerifyHostKey checks the host key proof in reg and returns the key in
+// canonical base64, or "" when the agent sent none.
+func VerifyHostKey(reg AgentRegister, now time.Time) (string, error) {
+	if reg.HostKey == "" {
+		return "", nil
+	}
+	pub, err := base64.StdEncoding.DecodeString(reg.HostKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return "", errors.New("invalid host key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(reg.HostKeySig)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return "", errors.New("invalid host key signature")
+	}
+	if d := now.Sub(time.UnixMilli(reg.HostKeyTsMS)); d > hostKeySkew || d < -hostKeySkew {
+		return "", errors.New("host key signature expired; check the agent clock")
+	}
+	if !ed25519.Verify(pub, HostKeyMessage(reg.ServerID, reg.HostKeyTsMS), sig) {
+		return "", errors.New("invalid host key signature")
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
@@ -0,0 +1,33 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestVerifyHostKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	now := time.Now()
+	reg := AgentRegister{ServerID: "build", HostKey: base64.StdEncoding.EncodeToString(pub), HostKeyTsMS: now.UnixMilli()}
+	reg.HostKeySig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, HostKeyMessage(reg.ServerID, reg.HostKeyTsMS)))
+
+	if key, err := VerifyHostKey(reg, now); err != nil || key != reg.HostKey {
+		t.Fatalf("valid proof rejected: key=%q err=%v", key, err)
+	}
+	if _, err := VerifyHostKey(reg, now.Add(10*time.Minute)); err == nil {
+		t.Fatal("an old signature should be rejected")
+	}
+	forged := reg
+	forged.ServerID = "other"
+	if _, err := VerifyHostKey(forged, now); err == nil {
+		t.Fatal("a signature for another server_id should be rejected")
+	}
+	if key, err := VerifyHostKey(AgentRegister{ServerID: "build"}, now); err != nil || key != "" {
+		t.Fatalf("agents without a key should pass through: key=%q err=%v", key, err)
+	}
+}
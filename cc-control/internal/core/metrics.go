@@ -0,0 +1,165 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// approvalLatencyBuckets are the upper bounds, in seconds, of the approval
+// latency histogram.
+var approvalLatencyBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// metrics holds the counters behind /metrics. Gauges are computed from the
+// control plane state at scrape time instead.
+type metrics struct {
+	ptyOutBytes    atomic.Uint64
+	ptyOutMessages atomic.Uint64
+	rateLimited    atomic.Uint64
+
+	mu sync.Mutex
+	// dropped counts fanout messages discarded because a subscriber's send
+	// buffer was full, by fanout path.
+	dropped     map[string]uint64
+	wsWriteErrs map[string]uint64
+	latency     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last entry is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		dropped:     make(map[string]uint64),
+		wsWriteErrs: make(map[string]uint64),
+		latency:     make(map[string]*histogram),
+	}
+}
+
+func (m *metrics) dropMessage(path string) {
+	m.mu.Lock()
+	m.dropped[path]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeApproval(action string, d time.Duration) {
+	secs := d.Seconds()
+	if secs < 0 {
+		secs = 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.latency[action]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(approvalLatencyBuckets)+1)}
+		m.latency[action] = h
+	}
+	i := sort.SearchFloat64s(approvalLatencyBuckets, secs)
+	h.counts[i]++
+	h.sum += secs
+	h.count++
+}
+
+// RecordWSWriteError counts a failed websocket write; peer is "agent" or
+// "client".
+func (cp *ControlPlane) RecordWSWriteError(peer string) {
+	cp.metrics.mu.Lock()
+	cp.metrics.wsWriteErrs[peer]++
+	cp.metrics.mu.Unlock()
+}
+
+// WriteMetrics writes all metrics in the Prometheus text exposition format.
+func (cp *ControlPlane) WriteMetrics(w io.Writer) error {
+	agents := make(map[string]int)
+	servers := make(map[ServerStatus]int)
+	sessions := make(map[SessionStatus]int)
+	cp.mu.RLock()
+	for key := range cp.agentConns {
+		agents[key.tenantID]++
+	}
+	for _, srv := range cp.servers {
+		servers[srv.Status]++
+	}
+	for _, sess := range cp.sessions {
+		sessions[sess.Status]++
+	}
+	cp.mu.RUnlock()
+
+	var b strings.Builder
+	header := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("cc_agents_connected", "gauge", "Agents with an open websocket, by tenant.")
+	for _, tenantID := range sortedKeys(agents) {
+		fmt.Fprintf(&b, "cc_agents_connected{tenant_id=%s} %d\n", labelValue(tenantID), agents[tenantID])
+	}
+	header("cc_servers", "gauge", "Registered servers by status.")
+	for _, status := range []ServerStatus{ServerOnline, ServerOffline} {
+		fmt.Fprintf(&b, "cc_servers{status=%s} %d\n", labelValue(string(status)), servers[status])
+	}
+	header("cc_sessions", "gauge", "Sessions by status.")
+	for _, status := range []SessionStatus{SessionStarting, SessionRunning, SessionStopping, SessionExited, SessionError, SessionLost} {
+		fmt.Fprintf(&b, "cc_sessions{status=%s} %d\n", labelValue(string(status)), sessions[status])
+	}
+
+	header("cc_pty_out_bytes_total", "counter", "PTY output bytes received from agents.")
+	fmt.Fprintf(&b, "cc_pty_out_bytes_total %d\n", cp.metrics.ptyOutBytes.Load())
+	header("cc_pty_out_messages_total", "counter", "PTY output messages received from agents.")
+	fmt.Fprintf(&b, "cc_pty_out_messages_total %d\n", cp.metrics.ptyOutMessages.Load())
+	header("cc_rate_limited_total", "counter", "Requests rejected by the rate limiter.")
+	fmt.Fprintf(&b, "cc_rate_limited_total %d\n", cp.metrics.rateLimited.Load())
+
+	m := cp.metrics
+	m.mu.Lock()
+	header("cc_subscriber_dropped_messages_total", "counter", "Messages dropped because a subscriber's send buffer was full, by fanout path.")
+	for _, path := range sortedKeys(m.dropped) {
+		fmt.Fprintf(&b, "cc_subscriber_dropped_messages_total{fanout=%s} %d\n", labelValue(path), m.dropped[path])
+	}
+	header("cc_ws_write_errors_total", "counter", "Failed websocket writes, by peer.")
+	for _, peer := range sortedKeys(m.wsWriteErrs) {
+		fmt.Fprintf(&b, "cc_ws_write_errors_total{peer=%s} %d\n", labelValue(peer), m.wsWriteErrs[peer])
+	}
+	header("cc_approval_latency_seconds", "histogram", "Time from approval_needed to resolution, by action.")
+	for _, action := range sortedKeys(m.latency) {
+		h := m.latency[action]
+		var cum uint64
+		for i, le := range approvalLatencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(&b, "cc_approval_latency_seconds_bucket{action=%s,le=%s} %d\n", labelValue(action), labelValue(strconv.FormatFloat(le, 'g', -1, 64)), cum)
+		}
+		fmt.Fprintf(&b, "cc_approval_latency_seconds_bucket{action=%s,le=\"+Inf\"} %d\n", labelValue(action), h.count)
+		fmt.Fprintf(&b, "cc_approval_latency_seconds_sum{action=%s} %s\n", labelValue(action), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "cc_approval_latency_seconds_count{action=%s} %d\n", labelValue(action), h.count)
+	}
+	m.mu.Unlock()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labelEscaper escapes a label value the way the Prometheus text format
+// expects; Go's %q escapes more than it accepts.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes v as a label value.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
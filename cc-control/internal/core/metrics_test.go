@@ -0,0 +1,73 @@
+package core
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func scrapeMetrics(t *testing.T, cp *ControlPlane) string {
+	t.Helper()
+	var b strings.Builder
+	if err := cp.WriteMetrics(&b); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	return b.String()
+}
+
+func TestMetrics_CountsAndGauges(t *testing.T) {
+	cp, _, sessionID, _ := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	cp.limiter = NewRateLimiter(1, cp.cfg.RateWindow)
+
+	cp.HandlePTYOut("t1", "srv", sessionID, 10, base64.StdEncoding.EncodeToString([]byte("hello")))
+	cp.RateAllow("ui:x")
+	cp.RateAllow("ui:x")
+	cp.RecordWSWriteError("client")
+	if err := cp.HandleClientAction("ui:test", "t1", nil, sessionID, ActionRequest{Kind: "approve"}); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+
+	out := scrapeMetrics(t, cp)
+	for _, want := range []string{
+		`cc_agents_connected{tenant_id="t1"} 1`,
+		`cc_servers{status="online"} 1`,
+		`cc_pty_out_bytes_total 5`,
+		`cc_pty_out_messages_total 1`,
+		`cc_rate_limited_total 1`,
+		`cc_ws_write_errors_total{peer="client"} 1`,
+		`cc_approval_latency_seconds_bucket{action="approve",le="+Inf"} 1`,
+		`cc_approval_latency_seconds_count{action="approve"} 1`,
+		"# TYPE cc_approval_latency_seconds histogram",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetrics_EscapesLabelValues(t *testing.T) {
+	cp, conn, _, _ := setupActionTestControlPlane(t, "")
+	cp.mu.Lock()
+	cp.agentConns[serverKey{"ténant\t\"a\\b\"\n", "srv"}] = conn
+	cp.mu.Unlock()
+
+	want := "cc_agents_connected{tenant_id=\"ténant\t\\\"a\\\\b\\\"\\n\"} 1\n"
+	if out := scrapeMetrics(t, cp); !strings.Contains(out, want) {
+		t.Fatalf("metrics missing %q:\n%s", want, out)
+	}
+}
+
+func TestMetrics_CountsDroppedFanout(t *testing.T) {
+	cp, _, sessionID, _ := setupActionTestControlPlane(t, "Do you want to continue? [y/N]")
+	sub := &Subscriber{ID: "full", TenantID: "t1", Send: make(chan Envelope)}
+	hub := newSessionHub(1024)
+	hub.subscribers[sub] = struct{}{}
+	cp.mu.Lock()
+	cp.sessionHubs[sessionID] = hub
+	cp.mu.Unlock()
+
+	cp.broadcastToAttached(sessionID, NewEnvelope("term_out", "srv", sessionID))
+	if out := scrapeMetrics(t, cp); !strings.Contains(out, `cc_subscriber_dropped_messages_total{fanout="session"} 1`) {
+		t.Fatalf("dropped message not counted:\n%s", out)
+	}
+}
@@ -15,28 +15,52 @@ const (
 	SessionStopping SessionStatus = "stopping"
 	SessionExited   SessionStatus = "exited"
 	SessionError    SessionStatus = "error"
+	// SessionLost marks a session its agent no longer reports after reconnecting.
+	SessionLost SessionStatus = "lost"
 )
 
 type Server struct {
-	TenantID     string       `json:"tenant_id"`
-	ServerID     string       `json:"server_id"`
-	Hostname     string       `json:"hostname"`
-	Tags         []string     `json:"tags"`
-	OS           string       `json:"os"`
-	Arch         string       `json:"arch"`
-	AgentVersion string       `json:"agent_version"`
-	LastSeenMS   int64        `json:"last_seen_ms"`
-	Status       ServerStatus `json:"status"`
-	AllowRoots   []string     `json:"allow_roots,omitempty"`
-	ClaudePath   string       `json:"claude_path,omitempty"`
+	TenantID     string        `json:"tenant_id"`
+	ServerID     string        `json:"server_id"`
+	Hostname     string        `json:"hostname"`
+	Tags         []string      `json:"tags"`
+	OS           string        `json:"os"`
+	Arch         string        `json:"arch"`
+	AgentVersion string        `json:"agent_version"`
+	LastSeenMS   int64         `json:"last_seen_ms"`
+	Status       ServerStatus  `json:"status"`
+	AllowRoots   []string      `json:"allow_roots,omitempty"`
+	ClaudePath   string        `json:"claude_path,omitempty"`
+	Runtimes     []RuntimeInfo `json:"runtimes,omitempty"`
+}
+
+// RuntimeInfo is a CLI profile advertised by an agent. Env values stay on the
+// agent; only their keys are reported.
+type RuntimeInfo struct {
+	Name       string    `json:"name"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args,omitempty"`
+	ResumeArgs []string  `json:"resume_args,omitempty"`
+	EnvKeys    []string  `json:"env_keys,omitempty"`
+	AllowArgs  []ArgRule `json:"allow_args,omitempty"`
+	Default    bool      `json:"default,omitempty"`
+}
+
+// ArgRule is one entry of a runtime's extra-argument allow-list; the agent
+// enforces it. An empty Flag matches positional arguments.
+type ArgRule struct {
+	Flag  string `json:"flag,omitempty"`
+	Value string `json:"value,omitempty"`
 }
 
 type Session struct {
 	TenantID          string        `json:"tenant_id"`
 	SessionID         string        `json:"session_id"`
 	ServerID          string        `json:"server_id"`
+	Runtime           string        `json:"runtime,omitempty"`
 	Cwd               string        `json:"cwd"`
 	Cmd               []string      `json:"cmd"`
+	Args              []string      `json:"args,omitempty"`
 	ResumeID          string        `json:"resume_id,omitempty"`
 	EnvKeys           []string      `json:"env_keys"`
 	Status            SessionStatus `json:"status"`
@@ -47,6 +71,10 @@ type Session struct {
 	AwaitingApproval  bool          `json:"awaiting_approval"`
 	PendingEventID    string        `json:"pending_event_id,omitempty"`
 	LatestAgentOutSeq uint64        `json:"latest_agent_out_seq"`
+	Pid               int           `json:"pid,omitempty"`
+	// AwaitingReconcile is set for active sessions restored from the state
+	// store, or whose agent disconnected, until the agent confirms them again.
+	AwaitingReconcile bool `json:"awaiting_reconcile,omitempty"`
 }
 
 type SessionEvent struct {
@@ -56,14 +84,52 @@ type SessionEvent struct {
 	TenantID   string `json:"tenant_id"`
 	Kind       string `json:"kind"`
 	PromptText string `json:"prompt_excerpt,omitempty"`
-	Actor      string `json:"actor,omitempty"`
-	TsMS       int64  `json:"ts_ms"`
-	Resolved   bool   `json:"resolved"`
+	// Profile is the detection profile that raised the event; it selects the
+	// keys sent on approve/reject.
+	Profile string `json:"profile,omitempty"`
+	// Options are the numbered menu entries found in the excerpt; they can
+	// be picked with the "choose" action.
+	Options  []ApprovalOption `json:"options,omitempty"`
+	Actor    string           `json:"actor,omitempty"`
+	TsMS     int64            `json:"ts_ms"`
+	Resolved bool             `json:"resolved"`
+	// RefEventID links reminder, escalation and timeout events to the
+	// approval_needed event they are about.
+	RefEventID string `json:"ref_event_id,omitempty"`
+	// RemindedAtMS, EscalatedAtMS and DeadlineAtMS record what the approval
+	// scheduler has already done for a pending approval_needed event.
+	RemindedAtMS  int64 `json:"reminded_at_ms,omitempty"`
+	EscalatedAtMS int64 `json:"escalated_at_ms,omitempty"`
+	DeadlineAtMS  int64 `json:"deadline_at_ms,omitempty"`
+}
+
+// TenantSettings holds per-tenant policy. Tenants without stored settings get
+// the control plane defaults.
+type TenantSettings struct {
+	TenantID    string `json:"tenant_id"`
+	Recording   bool   `json:"recording"`
+	RecordInput bool   `json:"record_input"`
+	// RecordingRetentionDays overrides the global retention; 0 uses it.
+	RecordingRetentionDays int `json:"recording_retention_days,omitempty"`
+	// ApprovalReminderSec re-broadcasts a pending approval this often; 0
+	// disables reminders.
+	ApprovalReminderSec int `json:"approval_reminder_sec,omitempty"`
+	// ApprovalEscalateAfterSec notifies every subscriber holding at least
+	// ApprovalEscalateRole (default owner), whatever their subscription.
+	ApprovalEscalateAfterSec int    `json:"approval_escalate_after_sec,omitempty"`
+	ApprovalEscalateRole     string `json:"approval_escalate_role,omitempty"`
+	// ApprovalDeadlineSec applies ApprovalDeadlineAction ("reject",
+	// "approve" or "stop"; default reject) to approvals still pending.
+	ApprovalDeadlineSec    int    `json:"approval_deadline_sec,omitempty"`
+	ApprovalDeadlineAction string `json:"approval_deadline_action,omitempty"`
+	UpdatedAtMS            int64  `json:"updated_at_ms,omitempty"`
 }
 
 type StartSessionRequest struct {
 	ServerID string            `json:"server_id"`
+	Runtime  string            `json:"runtime,omitempty"`
 	Cwd      string            `json:"cwd"`
+	Args     []string          `json:"args,omitempty"`
 	ResumeID string            `json:"resume_id,omitempty"`
 	Env      map[string]string `json:"env"`
 	Cols     uint16            `json:"cols"`
@@ -75,9 +141,24 @@ type StopSessionRequest struct {
 	KillAfterMS int `json:"kill_after_ms"`
 }
 
+// ApprovalOption is one numbered entry of an approval menu.
+type ApprovalOption struct {
+	Index int    `json:"index"`
+	Label string `json:"label"`
+}
+
 type ActionRequest struct {
 	Kind    string `json:"kind"`
 	EventID string `json:"event_id,omitempty"`
+	// Choice (1-based option index) or Label selects the option of a
+	// "choose" action.
+	Choice int    `json:"choice,omitempty"`
+	Label  string `json:"label,omitempty"`
+	// Message is the guidance typed back by "reject_with_message".
+	Message string `json:"message,omitempty"`
+	// exactEvent refuses the action unless EventID is still the pending
+	// event; callback tokens are only valid for the event they were minted for.
+	exactEvent bool
 }
 
 type AgentRegister struct {
@@ -89,6 +170,41 @@ type AgentRegister struct {
 	AgentVersion string   `json:"agent_version"`
 	AllowRoots   []string `json:"allow_roots"`
 	ClaudePath   string   `json:"claude_path"`
+	// Runtimes lists the CLI profiles the agent can start; empty for agents
+	// that only know ClaudePath.
+	Runtimes []RuntimeInfo `json:"runtimes"`
+	// Sessions is the agent's live PTY inventory. Nil means the agent predates
+	// inventory reporting and no reconciliation is attempted.
+	Sessions []AgentSessionInfo `json:"sessions"`
+	// HostKey is the agent's base64 Ed25519 public key. HostKeySig signs
+	// HostKeyMessage(ServerID, HostKeyTsMS) to prove the agent holds it.
+	HostKey     string `json:"host_key,omitempty"`
+	HostKeySig  string `json:"host_key_sig,omitempty"`
+	HostKeyTsMS int64  `json:"host_key_ts_ms,omitempty"`
+}
+
+type AgentSessionInfo struct {
+	SessionID string `json:"session_id"`
+	Seq       uint64 `json:"seq"`
+	Pid       int    `json:"pid,omitempty"`
+	Cwd       string `json:"cwd"`
+	// Exited marks a session that ended while the agent was disconnected; its
+	// pty_exit is replayed right after register_ok.
+	Exited bool `json:"exited,omitempty"`
+}
+
+// SessionReplayCursor tells a reconnecting agent the last pty_out seq held for
+// a session so it only replays the gap from its spool.
+type SessionReplayCursor struct {
+	SessionID string `json:"session_id"`
+	LatestSeq uint64 `json:"latest_seq"`
+}
+
+// SessionStarted is sent by the agent once the PTY process is running.
+type SessionStarted struct {
+	Runtime string   `json:"runtime"`
+	Argv    []string `json:"argv"`
+	Pid     int      `json:"pid"`
 }
 
 type PTYExit struct {
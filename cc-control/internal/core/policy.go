@@ -0,0 +1,375 @@
+package core
+
+import (
+	"errors"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PolicyDecision string
+
+const (
+	PolicyApprove PolicyDecision = "approve"
+	PolicyReject  PolicyDecision = "reject"
+	// PolicyAsk stops evaluation and leaves the prompt to a human.
+	PolicyAsk PolicyDecision = "ask"
+)
+
+// ApprovalPolicy is a tenant rule applied to approval prompts before anyone
+// is notified. Rules run by ascending Priority; on a tie reject beats ask
+// beats approve, so a broad approve can't shadow a deny.
+type ApprovalPolicy struct {
+	PolicyID    string         `json:"policy_id"`
+	TenantID    string         `json:"tenant_id"`
+	Name        string         `json:"name,omitempty"`
+	Priority    int            `json:"priority"`
+	Enabled     bool           `json:"enabled"`
+	Decision    PolicyDecision `json:"decision"`
+	Match       PolicyMatch    `json:"match"`
+	CreatedBy   string         `json:"created_by,omitempty"`
+	CreatedAtMS int64          `json:"created_at_ms"`
+	UpdatedAtMS int64          `json:"updated_at_ms"`
+}
+
+// PolicyMatch conditions must all hold; empty conditions are ignored.
+type PolicyMatch struct {
+	// Prompt is a regexp matched against the prompt excerpt.
+	Prompt string `json:"prompt,omitempty"`
+	// ServerTags must all be present on the session's server.
+	ServerTags []string `json:"server_tags,omitempty"`
+	// CwdPrefix matches sessions whose cwd is this directory or below it.
+	CwdPrefix string   `json:"cwd_prefix,omitempty"`
+	Runtimes  []string `json:"runtimes,omitempty"`
+	// PathsWithinCwd requires the excerpt to name at least one path and
+	// every path in it to resolve inside the session cwd, e.g. for "read
+	// files in the repo" rules.
+	PathsWithinCwd bool `json:"paths_within_cwd,omitempty"`
+
+	// prompt is Prompt compiled by compile when the policy is stored.
+	prompt *regexp.Regexp
+}
+
+// PolicyInput is what a policy is evaluated against.
+type PolicyInput struct {
+	Prompt     string   `json:"prompt"`
+	ServerID   string   `json:"server_id,omitempty"`
+	ServerTags []string `json:"server_tags,omitempty"`
+	Cwd        string   `json:"cwd,omitempty"`
+	Runtime    string   `json:"runtime,omitempty"`
+}
+
+// PolicyResult is the outcome of an evaluation; Policy is nil when no rule
+// matched, which means a human decides.
+type PolicyResult struct {
+	Decision PolicyDecision  `json:"decision"`
+	Policy   *ApprovalPolicy `json:"policy,omitempty"`
+}
+
+var promptPathPattern = regexp.MustCompile(`(?:^|[\s'"(=:])((?:~|\.{1,2})?/[^\s'"()]+|[\w.-]+(?:/[\w.-]+)+)`)
+
+func decisionRank(d PolicyDecision) int {
+	switch d {
+	case PolicyReject:
+		return 0
+	case PolicyAsk:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// validatePolicy checks p and compiles its prompt pattern.
+func validatePolicy(p *ApprovalPolicy) error {
+	switch p.Decision {
+	case PolicyApprove, PolicyReject, PolicyAsk:
+	default:
+		return errors.New("invalid policy decision")
+	}
+	if err := p.Match.compile(); err != nil {
+		return errors.New("invalid policy prompt pattern: " + err.Error())
+	}
+	if p.Decision == PolicyApprove && p.Match.Prompt == "" {
+		return errors.New("approve policies require a prompt pattern")
+	}
+	if p.Match.CwdPrefix != "" && !strings.HasPrefix(p.Match.CwdPrefix, "/") {
+		return errors.New("policy cwd_prefix must be absolute")
+	}
+	return nil
+}
+
+func (m *PolicyMatch) compile() error {
+	m.prompt = nil
+	if m.Prompt == "" {
+		return nil
+	}
+	re, err := regexp.Compile(m.Prompt)
+	if err != nil {
+		return err
+	}
+	m.prompt = re
+	return nil
+}
+
+func (m PolicyMatch) matches(in PolicyInput) bool {
+	// A pattern that failed to compile matches nothing.
+	if m.Prompt != "" && (m.prompt == nil || !m.prompt.MatchString(in.Prompt)) {
+		return false
+	}
+	for _, tag := range m.ServerTags {
+		found := false
+		for _, have := range in.ServerTags {
+			if have == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if m.CwdPrefix != "" && !pathWithin(in.Cwd, m.CwdPrefix) {
+		return false
+	}
+	if len(m.Runtimes) > 0 {
+		found := false
+		for _, rt := range m.Runtimes {
+			if rt == in.Runtime {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if m.PathsWithinCwd && !promptPathsWithin(in.Prompt, in.Cwd) {
+		return false
+	}
+	return true
+}
+
+// pathWithin reports whether p is dir or below it, after cleaning both.
+func pathWithin(p, dir string) bool {
+	if p == "" || dir == "" {
+		return false
+	}
+	p, dir = path.Clean(p), path.Clean(dir)
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// promptPathsWithin checks every path-like token of the prompt against cwd;
+// home-relative paths are never considered inside. A prompt without any path
+// is not known to stay inside cwd, so it fails too.
+func promptPathsWithin(prompt, cwd string) bool {
+	if cwd == "" {
+		return false
+	}
+	matches := promptPathPattern.FindAllStringSubmatch(prompt, -1)
+	if len(matches) == 0 {
+		return false
+	}
+	for _, m := range matches {
+		p := strings.TrimRight(m[1], ".,;:!?")
+		if strings.HasPrefix(p, "~") {
+			return false
+		}
+		if !strings.HasPrefix(p, "/") {
+			p = path.Join(cwd, p)
+		}
+		if !pathWithin(p, cwd) {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluatePoliciesLocked returns the first enabled tenant policy matching in.
+// Callers must hold cp.mu.
+func (cp *ControlPlane) evaluatePoliciesLocked(tenantID string, in PolicyInput) PolicyResult {
+	for _, p := range cp.sortedPoliciesLocked(tenantID) {
+		if !p.Enabled || !p.Match.matches(in) {
+			continue
+		}
+		policy := p
+		return PolicyResult{Decision: p.Decision, Policy: &policy}
+	}
+	return PolicyResult{Decision: PolicyAsk}
+}
+
+func (cp *ControlPlane) sortedPoliciesLocked(tenantID string) []ApprovalPolicy {
+	out := make([]ApprovalPolicy, 0)
+	for _, p := range cp.policies {
+		if p.TenantID == tenantID {
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority < out[j].Priority
+		}
+		if ri, rj := decisionRank(out[i].Decision), decisionRank(out[j].Decision); ri != rj {
+			return ri < rj
+		}
+		if out[i].CreatedAtMS != out[j].CreatedAtMS {
+			return out[i].CreatedAtMS < out[j].CreatedAtMS
+		}
+		return out[i].PolicyID < out[j].PolicyID
+	})
+	return out
+}
+
+// ListPolicies returns a tenant's policies in evaluation order.
+func (cp *ControlPlane) ListPolicies(tenantID string) []ApprovalPolicy {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	return cp.sortedPoliciesLocked(tenantID)
+}
+
+func (cp *ControlPlane) GetPolicy(tenantID, policyID string) (ApprovalPolicy, error) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	p, ok := cp.policies[policyID]
+	if !ok || p.TenantID != tenantID {
+		return ApprovalPolicy{}, errors.New("policy not found")
+	}
+	return p, nil
+}
+
+func (cp *ControlPlane) CreatePolicy(actor, tenantID string, p ApprovalPolicy) (ApprovalPolicy, error) {
+	if err := validatePolicy(&p); err != nil {
+		return ApprovalPolicy{}, err
+	}
+	now := time.Now().UnixMilli()
+	p.PolicyID = uuid.NewString()
+	p.TenantID = tenantID
+	p.CreatedBy = actor
+	p.CreatedAtMS = now
+	p.UpdatedAtMS = now
+	cp.mu.Lock()
+	cp.policies[p.PolicyID] = p
+	cp.mu.Unlock()
+	cp.persistPolicy(p)
+	cp.auditPolicy(actor, "policy_created", p)
+	return p, nil
+}
+
+// UpdatePolicy replaces a policy's rule; identity and creation fields are
+// kept.
+func (cp *ControlPlane) UpdatePolicy(actor, tenantID, policyID string, p ApprovalPolicy) (ApprovalPolicy, error) {
+	if err := validatePolicy(&p); err != nil {
+		return ApprovalPolicy{}, err
+	}
+	cp.mu.Lock()
+	cur, ok := cp.policies[policyID]
+	if !ok || cur.TenantID != tenantID {
+		cp.mu.Unlock()
+		return ApprovalPolicy{}, errors.New("policy not found")
+	}
+	p.PolicyID = cur.PolicyID
+	p.TenantID = cur.TenantID
+	p.CreatedBy = cur.CreatedBy
+	p.CreatedAtMS = cur.CreatedAtMS
+	p.UpdatedAtMS = time.Now().UnixMilli()
+	cp.policies[policyID] = p
+	cp.mu.Unlock()
+	cp.persistPolicy(p)
+	cp.auditPolicy(actor, "policy_updated", p)
+	return p, nil
+}
+
+func (cp *ControlPlane) DeletePolicy(actor, tenantID, policyID string) error {
+	cp.mu.Lock()
+	cur, ok := cp.policies[policyID]
+	if !ok || cur.TenantID != tenantID {
+		cp.mu.Unlock()
+		return errors.New("policy not found")
+	}
+	delete(cp.policies, policyID)
+	cp.mu.Unlock()
+	if cp.state != nil {
+		cp.persistMu.Lock()
+		if err := cp.state.DeletePolicy(policyID); err != nil {
+			slog.Error("persist policy delete failed", "policy_id", policyID, "err", err)
+		}
+		cp.persistMu.Unlock()
+	}
+	cp.auditPolicy(actor, "policy_deleted", cur)
+	return nil
+}
+
+// EvaluatePolicies is a dry run: it reports what the tenant's policies would
+// decide for in without touching any session. A ServerID fills in the
+// server's tags.
+func (cp *ControlPlane) EvaluatePolicies(tenantID string, in PolicyInput) (PolicyResult, error) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	if in.ServerID != "" {
+		srv, ok := cp.servers[serverKey{tenantID, in.ServerID}]
+		if !ok {
+			return PolicyResult{}, errors.New("server not found")
+		}
+		if len(in.ServerTags) == 0 {
+			in.ServerTags = append([]string(nil), srv.Tags...)
+		}
+	}
+	return cp.evaluatePoliciesLocked(tenantID, in), nil
+}
+
+// applyPolicy resolves a fresh approval event when a policy decides it.
+// It reports whether the event was handled without a human.
+func (cp *ControlPlane) applyPolicy(sessionID, eventID string, result PolicyResult) bool {
+	if result.Policy == nil || result.Decision == PolicyAsk {
+		return false
+	}
+	actor := "policy:" + result.Policy.PolicyID
+	err := cp.HandleClientAction(actor, "", nil, sessionID, ActionRequest{Kind: string(result.Decision), EventID: eventID})
+	cp.audit.Log(AuditEvent{
+		TenantID:  result.Policy.TenantID,
+		Actor:     actor,
+		SessionID: sessionID,
+		Kind:      "policy_decision",
+		Meta: map[string]any{
+			"event_id":  eventID,
+			"policy_id": result.Policy.PolicyID,
+			"decision":  result.Decision,
+			"applied":   err == nil,
+		},
+	})
+	if err != nil {
+		slog.Warn("policy decision not applied", "session_id", sessionID, "policy_id", result.Policy.PolicyID, "err", err)
+		return false
+	}
+	return true
+}
+
+func (cp *ControlPlane) persistPolicy(p ApprovalPolicy) {
+	if cp.state == nil {
+		return
+	}
+	cp.persistMu.Lock()
+	defer cp.persistMu.Unlock()
+	if err := cp.state.SavePolicy(p); err != nil {
+		slog.Error("persist policy failed", "policy_id", p.PolicyID, "err", err)
+	}
+}
+
+func (cp *ControlPlane) auditPolicy(actor, kind string, p ApprovalPolicy) {
+	cp.audit.Log(AuditEvent{
+		TenantID: p.TenantID,
+		Actor:    actor,
+		Kind:     kind,
+		Meta: map[string]any{
+			"policy_id": p.PolicyID,
+			"decision":  p.Decision,
+			"priority":  p.Priority,
+			"enabled":   p.Enabled,
+			"match":     p.Match,
+		},
+	})
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"cc-control/internal/auth"
+)
+
+func mustCreatePolicy(t *testing.T, cp *ControlPlane, tenantID string, p ApprovalPolicy) ApprovalPolicy {
+	t.Helper()
+	p.Enabled = true
+	created, err := cp.CreatePolicy("ui:test", tenantID, p)
+	if err != nil {
+		t.Fatalf("create policy: %v", err)
+	}
+	return created
+}
+
+func TestPolicy_AutoApprovesReadInsideRepo(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	p := mustCreatePolicy(t, cp, "t1", ApprovalPolicy{
+		Decision: PolicyApprove,
+		Match:    PolicyMatch{Prompt: `(?i)read`, ServerTags: []string{"dev"}, PathsWithinCwd: true},
+	})
+
+	cp.createApprovalEvent("s1", "srv", "Do you want to read /repo/src/main.go? (y/n)", defaultDetectionProfile)
+
+	if got := lastPTYInput(t, conn); got != "y\n" {
+		t.Fatalf("policy should approve with y, got %q", got)
+	}
+	sess := sessionByID(t, cp, "s1")
+	if sess.AwaitingApproval {
+		t.Fatal("auto-approved prompt must not stay pending")
+	}
+	ev := cp.GetSessionEvents("t1", nil, "s1")[0]
+	if !ev.Resolved || ev.Actor != "policy:"+p.PolicyID {
+		t.Fatalf("event should be resolved by the policy, got %#v", ev)
+	}
+}
+
+func TestPolicy_UndeliveredDecisionFallsBackToHuman(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	conn.err = errors.New("send queue full")
+	mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Decision: PolicyApprove, Match: PolicyMatch{Prompt: `(?i)read`}})
+	sub := &Subscriber{ID: "ui", TenantID: "t1", Role: auth.RoleOwner, Send: make(chan Envelope, 16)}
+	cp.RegisterSubscriber(sub)
+
+	cp.createApprovalEvent("s1", "srv", "Do you want to read /repo/src/main.go? (y/n)", defaultDetectionProfile)
+
+	sess := sessionByID(t, cp, "s1")
+	ev := cp.GetSessionEvents("t1", nil, "s1")[0]
+	if !sess.AwaitingApproval || sess.PendingEventID != ev.EventID || ev.Resolved || ev.Actor != "" {
+		t.Fatalf("undelivered policy decision should leave the prompt to a human: %#v %#v", sess, ev)
+	}
+	if got := drainEventKinds(sub); len(got) != 1 || got[0] != "approval_needed" {
+		t.Fatalf("humans should be notified of the open prompt, got %v", got)
+	}
+
+	conn.err = nil
+	if err := cp.HandleClientAction("ui:test", "t1", nil, "s1", ActionRequest{Kind: "approve", EventID: ev.EventID}); err != nil {
+		t.Fatalf("the prompt should still be answerable: %v", err)
+	}
+}
+
+func TestPolicy_PathOutsideRepoNeedsHuman(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	mustCreatePolicy(t, cp, "t1", ApprovalPolicy{
+		Decision: PolicyApprove,
+		Match:    PolicyMatch{Prompt: `(?i)read`, PathsWithinCwd: true},
+	})
+
+	cp.createApprovalEvent("s1", "srv", "Do you want to read ../../etc/passwd? (y/n)", defaultDetectionProfile)
+
+	if len(conn.msgs) != 0 {
+		t.Fatalf("no input should be sent, got %d messages", len(conn.msgs))
+	}
+	if !sessionByID(t, cp, "s1").AwaitingApproval {
+		t.Fatal("prompt should wait for a human")
+	}
+}
+
+func TestPolicy_PathsWithinCwdNeedsAPath(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	mustCreatePolicy(t, cp, "t1", ApprovalPolicy{
+		Decision: PolicyApprove,
+		Match:    PolicyMatch{Prompt: `(?i)read`, PathsWithinCwd: true},
+	})
+
+	cp.createApprovalEvent("s1", "srv", "Do you want to read the credentials? [y/N]", defaultDetectionProfile)
+
+	if len(conn.msgs) != 0 || !sessionByID(t, cp, "s1").AwaitingApproval {
+		t.Fatal("a prompt without paths should wait for a human")
+	}
+}
+
+func TestPolicy_RestoredPolicyStillMatches(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	cp := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	p := mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Decision: PolicyApprove, Match: PolicyMatch{Prompt: `(?i)read`}})
+	if err := cp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	cp = newTestControlPlane(t, Config{StateDBPath: dbPath})
+	res, err := cp.EvaluatePolicies("t1", PolicyInput{Prompt: "Read file? (y/n)"})
+	if err != nil || res.Decision != PolicyApprove || res.Policy == nil || res.Policy.PolicyID != p.PolicyID {
+		t.Fatalf("restored policy should still match, got %#v %v", res, err)
+	}
+}
+
+func TestPolicy_RejectWinsOverApproveAtSamePriority(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Decision: PolicyApprove, Match: PolicyMatch{Prompt: `(?i)bash`}})
+	deny := mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Decision: PolicyReject, Match: PolicyMatch{Prompt: `rm\s+-rf|git\s+push\s+(-f|--force)`}})
+
+	cp.createApprovalEvent("s1", "srv", "Bash command: rm -rf build\nContinue? (y/n)", defaultDetectionProfile)
+
+	if got := lastPTYInput(t, conn); got != "n\n" {
+		t.Fatalf("policy should reject with n, got %q", got)
+	}
+	if ev := cp.GetSessionEvents("t1", nil, "s1")[0]; ev.Actor != "policy:"+deny.PolicyID {
+		t.Fatalf("deny rule should decide, got actor %q", ev.Actor)
+	}
+}
+
+func TestPolicy_EvaluateDryRunIsTenantScoped(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	ask := mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Priority: -1, Decision: PolicyAsk, Match: PolicyMatch{CwdPrefix: "/repo/secrets"}})
+	mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Decision: PolicyApprove, Match: PolicyMatch{Prompt: `(?i)read`, ServerTags: []string{"dev"}}})
+	mustCreatePolicy(t, cp, "t2", ApprovalPolicy{Decision: PolicyReject, Match: PolicyMatch{Prompt: `.`}})
+
+	res, err := cp.EvaluatePolicies("t1", PolicyInput{Prompt: "Read file?", ServerID: "srv", Cwd: "/repo"})
+	if err != nil || res.Decision != PolicyApprove {
+		t.Fatalf("expected approve from server tags, got %#v %v", res, err)
+	}
+	res, _ = cp.EvaluatePolicies("t1", PolicyInput{Prompt: "Read file?", ServerID: "srv", Cwd: "/repo/secrets/keys"})
+	if res.Decision != PolicyAsk || res.Policy == nil || res.Policy.PolicyID != ask.PolicyID {
+		t.Fatalf("higher-priority ask rule should stop evaluation, got %#v", res)
+	}
+	if _, err := cp.EvaluatePolicies("t2", PolicyInput{Prompt: "x", ServerID: "srv"}); err == nil {
+		t.Fatal("dry run must not reveal servers of another tenant")
+	}
+	if len(conn.msgs) != 0 {
+		t.Fatal("dry run must not touch sessions")
+	}
+}
+
+func TestPolicy_Validation(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	bad := []ApprovalPolicy{
+		{Decision: "maybe"},
+		{Decision: PolicyApprove},
+		{Decision: PolicyReject, Match: PolicyMatch{Prompt: "("}},
+		{Decision: PolicyAsk, Match: PolicyMatch{CwdPrefix: "repo"}},
+	}
+	for _, p := range bad {
+		if _, err := cp.CreatePolicy("ui:test", "t1", p); err == nil {
+			t.Errorf("expected %#v to be rejected", p)
+		}
+	}
+	p := mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Decision: PolicyReject, Match: PolicyMatch{Prompt: "x"}})
+	if _, err := cp.UpdatePolicy("ui:test", "t2", p.PolicyID, p); err == nil {
+		t.Error("other tenants must not update the policy")
+	}
+	if err := cp.DeletePolicy("ui:test", "t1", p.PolicyID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if len(cp.ListPolicies("t1")) != 0 {
+		t.Fatal("policy should be gone")
+	}
+}
+
+func TestPolicy_PersistsAcrossRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	cp := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	kept := mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Decision: PolicyReject, Match: PolicyMatch{Prompt: "rm -rf"}})
+	gone := mustCreatePolicy(t, cp, "t1", ApprovalPolicy{Decision: PolicyAsk})
+	if err := cp.DeletePolicy("ui:test", "t1", gone.PolicyID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	cp2 := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	policies := cp2.ListPolicies("t1")
+	if len(policies) != 1 || policies[0].PolicyID != kept.PolicyID || policies[0].Match.Prompt != "rm -rf" {
+		t.Fatalf("unexpected policies after restart: %#v", policies)
+	}
+}
@@ -152,61 +152,120 @@ func collapseWhitespace(s string) string {
 }
 
 type PromptDetector struct {
-	mu        sync.Mutex
-	buffers   map[string]string
-	patterns  []*regexp.Regexp
-	maxBuffer int
+	mu       sync.Mutex
+	buffers  map[string]string
+	profiles []*detectionProfile
+}
+
+// DetectionMatch is a detected approval prompt and the profile that saw it.
+type DetectionMatch struct {
+	Matched bool
+	Excerpt string
+	Profile string
 }
 
 func NewPromptDetector() *PromptDetector {
-	rawPatterns := []string{
-		`(?i)(approve|reject)`,
-		`(?i)\(y/n\)`,
-		`(?i)\[y/N\]`,
-		`(?i)\bconfirm\b`,
-		`(?i)continue\?`,
-		// Claude Code / Cursor-style approval menu prompt (examples):
-		// - "Do you want to proceed?" / "Do you want to create <file>?"
-		// - "1. Yes" ... "3. No"
-		// - "Esc to cancel · Tab to amend"
-		`(?is)\bdo\s+you\s+want\s+to\b.{0,800}1[.)]\s*[Yy]es\b`,
-		`(?is)\besc\s+to\s+cancel\b.{0,300}\btab\s+to\s+amend\b`,
-		// Standalone "Do you want to <verb>?" as a single-line trigger
-		`(?i)\bdo\s+you\s+want\s+to\s+\w+.*\?`,
+	return &PromptDetector{
+		buffers:  make(map[string]string),
+		profiles: []*detectionProfile{builtinDetectionProfile()},
 	}
-	patterns := make([]*regexp.Regexp, 0, len(rawPatterns))
-	for _, p := range rawPatterns {
-		patterns = append(patterns, regexp.MustCompile(p))
+}
+
+// SetProfiles replaces the detection profiles. On error the current profiles
+// are kept.
+func (d *PromptDetector) SetProfiles(profiles []DetectionProfile) error {
+	compiled, err := compileDetectionProfiles(profiles)
+	if err != nil {
+		return err
 	}
-	return &PromptDetector{
-		buffers:   make(map[string]string),
-		patterns:  patterns,
-		maxBuffer: 4096,
+	d.mu.Lock()
+	d.profiles = compiled
+	d.mu.Unlock()
+	return nil
+}
+
+// ProfileNames lists the active profiles in selection order.
+func (d *PromptDetector) ProfileNames() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.profiles))
+	for _, p := range d.profiles {
+		names = append(names, p.name)
 	}
+	return names
 }
 
-// Feed returns (matched, excerpt).
+// Feed returns (matched, excerpt) using the profile for sessions without a
+// runtime.
 func (d *PromptDetector) Feed(sessionID string, raw []byte) (bool, string) {
+	m := d.Match(sessionID, "", raw)
+	return m.Matched, m.Excerpt
+}
+
+// Match feeds output of a session running runtime and reports whether its
+// detection profile sees an approval prompt.
+func (d *PromptDetector) Match(sessionID, runtime string, raw []byte) DetectionMatch {
 	clean := collapseWhitespace(stripTermEscapes(raw))
 	if strings.TrimSpace(clean) == "" {
-		return false, ""
+		return DetectionMatch{}
 	}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	profile := selectProfile(d.profiles, runtime)
 	buf := d.buffers[sessionID] + clean
-	if len(buf) > d.maxBuffer {
-		buf = buf[len(buf)-d.maxBuffer:]
+	if len(buf) > profile.bufferBytes {
+		buf = buf[len(buf)-profile.bufferBytes:]
 	}
 	d.buffers[sessionID] = buf
 
-	for _, p := range d.patterns {
+	for _, p := range profile.triggers {
 		if p.MatchString(buf) {
-			return true, lastLines(buf, 12)
+			return DetectionMatch{Matched: true, Excerpt: lastLines(buf, profile.excerptLines), Profile: profile.name}
+		}
+	}
+	return DetectionMatch{}
+}
+
+// ApprovalKeys returns what approve and reject send for an event raised by
+// the named profile. Profiles removed by a reload fall back to the runtime's
+// current profile.
+func (d *PromptDetector) ApprovalKeys(profileName, runtime, excerpt string) (approve, reject string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.profiles {
+		if p.name == profileName {
+			return p.keysFor(excerpt)
+		}
+	}
+	return selectProfile(d.profiles, runtime).keysFor(excerpt)
+}
+
+// ChoiceKeys returns what picks menu option n of an event raised by the
+// named profile.
+func (d *PromptDetector) ChoiceKeys(profileName, runtime, excerpt string, n int) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.profiles {
+		if p.name == profileName {
+			return p.choiceFor(excerpt, n)
+		}
+	}
+	return selectProfile(d.profiles, runtime).choiceFor(excerpt, n)
+}
+
+// FeedbackKeys returns what opens the feedback input of an event raised by
+// the named profile.
+func (d *PromptDetector) FeedbackKeys(profileName, runtime, excerpt string, options []ApprovalOption) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.profiles {
+		if p.name == profileName {
+			return p.feedbackFor(excerpt, options)
 		}
 	}
-	return false, ""
+	return selectProfile(d.profiles, runtime).feedbackFor(excerpt, options)
 }
 
 func (d *PromptDetector) Clear(sessionID string) {
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+// sessionLostActor resolves the pending approval of a session marked lost.
+const sessionLostActor = "system:session_lost"
+
+// reconcileSessionsLocked compares the sessions cc-control believes are running
+// on serverID with the inventory the agent reported on (re)connect. Sessions
+// the agent still has are re-adopted, active sessions it no longer has are
+// marked lost, and live sessions unknown to cc-control are adopted. It returns
+// the IDs of sessions whose state changed and, by session ID, the approval
+// events it resolved for lost sessions. cp.mu must be held.
+func (cp *ControlPlane) reconcileSessionsLocked(tenantID, serverID string, inventory []AgentSessionInfo) (changed []string, resolved map[string]string) {
+	live := make(map[string]AgentSessionInfo, len(inventory))
+	for _, info := range inventory {
+		if info.SessionID != "" {
+			live[info.SessionID] = info
+		}
+	}
+
+	resolved = make(map[string]string)
+	for id, sess := range cp.sessions {
+		if sess.ServerID != serverID || sess.TenantID != tenantID {
+			continue
+		}
+		info, alive := live[id]
+		delete(live, id)
+		switch {
+		case alive:
+			if !isActiveStatus(sess.Status) && sess.Status != SessionLost {
+				// The agent still runs a session we already consider finished
+				// (e.g. an exit raced the disconnect); keep our record.
+				continue
+			}
+			if !info.Exited && (sess.Status == SessionStarting || sess.Status == SessionLost) {
+				sess.Status = SessionRunning
+				sess.ExitReason = ""
+			}
+			sess.AwaitingReconcile = false
+			sess.Pid = info.Pid
+			changed = append(changed, id)
+			cp.audit.Log(AuditEvent{
+				TenantID:  tenantID,
+				Actor:     "agent:" + serverID,
+				ServerID:  serverID,
+				SessionID: id,
+				Kind:      "session_reconciled",
+				Meta: map[string]any{
+					"agent_seq": info.Seq,
+					"pid":       info.Pid,
+				},
+			})
+		case isActiveStatus(sess.Status):
+			sess.Status = SessionLost
+			sess.ExitReason = "agent_lost_session: not reported by agent after reconnect"
+			if sess.PendingEventID != "" {
+				events := cp.sessionEvents[id]
+				for i := len(events) - 1; i >= 0; i-- {
+					if events[i].EventID == sess.PendingEventID {
+						events[i].Resolved = true
+						events[i].Actor = sessionLostActor
+						resolved[id] = sess.PendingEventID
+						break
+					}
+				}
+			}
+			sess.AwaitingApproval = false
+			sess.PendingEventID = ""
+			sess.AwaitingReconcile = false
+			if rec := cp.detachRecorderLocked(id); rec != nil {
+				rec.close()
+			}
+			changed = append(changed, id)
+			cp.audit.Log(AuditEvent{
+				TenantID:  tenantID,
+				Actor:     "agent:" + serverID,
+				ServerID:  serverID,
+				SessionID: id,
+				Kind:      "session_lost",
+			})
+		}
+	}
+
+	// Whatever is left is alive on the agent but unknown here, e.g. because
+	// cc-control restarted without a state store.
+	orphans := make([]string, 0, len(live))
+	for id := range live {
+		orphans = append(orphans, id)
+	}
+	sort.Strings(orphans)
+	now := time.Now().UnixMilli()
+	for _, id := range orphans {
+		info := live[id]
+		if _, taken := cp.sessions[id]; taken || info.Exited {
+			continue
+		}
+		sess := &Session{
+			TenantID:    tenantID,
+			SessionID:   id,
+			ServerID:    serverID,
+			Cwd:         info.Cwd,
+			Status:      SessionRunning,
+			CreatedBy:   "agent:" + serverID,
+			CreatedAtMS: now,
+			Pid:         info.Pid,
+		}
+		cp.sessions[id] = sess
+		hub, ok := cp.sessionHubs[id]
+		if !ok {
+			hub = newSessionHub(cp.cfg.RingBufferBytes)
+			cp.sessionHubs[id] = hub
+		}
+		cp.startRecordingLocked(sess, hub, 0, 0)
+		changed = append(changed, id)
+		cp.audit.Log(AuditEvent{
+			TenantID:  tenantID,
+			Actor:     "agent:" + serverID,
+			ServerID:  serverID,
+			SessionID: id,
+			Kind:      "session_adopted",
+			Meta: map[string]any{
+				"agent_seq": info.Seq,
+				"pid":       info.Pid,
+				"cwd":       info.Cwd,
+			},
+		})
+	}
+	return changed, resolved
+}
+
+// ReplayCursors returns the last pty_out seq held for every session of the
+// given server, sent back to the agent in register_ok.
+func (cp *ControlPlane) ReplayCursors(tenantID, serverID string) []SessionReplayCursor {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	out := make([]SessionReplayCursor, 0)
+	for id, sess := range cp.sessions {
+		if sess.ServerID != serverID || sess.TenantID != tenantID {
+			continue
+		}
+		out = append(out, SessionReplayCursor{SessionID: id, LatestSeq: sess.LatestAgentOutSeq})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SessionID < out[j].SessionID })
+	return out
+}
@@ -0,0 +1,141 @@
+package core
+
+import "testing"
+
+func sessionByID(t *testing.T, cp *ControlPlane, id string) Session {
+	t.Helper()
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	sess, ok := cp.sessions[id]
+	if !ok {
+		t.Fatalf("session %q not found", id)
+	}
+	return *sess
+}
+
+func TestReconcile_DisconnectMarksActiveSessionsAwaitingReconcile(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "alive", ServerID: "srv"})
+	cp.RemoveAgentConnection("t1", "srv")
+
+	if got := sessionByID(t, cp, "alive"); !got.AwaitingReconcile || got.Status != SessionRunning {
+		t.Fatalf("disconnect should flag running session for reconcile, got %#v", got)
+	}
+}
+
+func TestReconcile_ReadoptsLiveMarksMissingLostAndAdoptsUnknown(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "alive", ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "gone", ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t2", SessionID: "other-tenant", ServerID: "srv"})
+	cp.RemoveAgentConnection("t1", "srv")
+
+	err := cp.RegisterOrUpdateServer("t1", AgentRegister{
+		ServerID: "srv",
+		Sessions: []AgentSessionInfo{
+			{SessionID: "alive", Seq: 42, Pid: 1234, Cwd: "/repo"},
+			{SessionID: "unknown", Seq: 7, Pid: 999, Cwd: "/repo/sub"},
+		},
+	}, &fakeAgentConn{})
+	if err != nil {
+		t.Fatalf("re-register: %v", err)
+	}
+
+	alive := sessionByID(t, cp, "alive")
+	if alive.Status != SessionRunning || alive.AwaitingReconcile || alive.Pid != 1234 {
+		t.Fatalf("live session should be re-adopted, got %#v", alive)
+	}
+	gone := sessionByID(t, cp, "gone")
+	if gone.Status != SessionLost || gone.ExitReason == "" {
+		t.Fatalf("missing session should be marked lost with a reason, got %#v", gone)
+	}
+	adopted := sessionByID(t, cp, "unknown")
+	if adopted.TenantID != "t1" || adopted.Status != SessionRunning || adopted.Cwd != "/repo/sub" {
+		t.Fatalf("unknown live session should be adopted, got %#v", adopted)
+	}
+	if other := sessionByID(t, cp, "other-tenant"); other.Status != SessionRunning {
+		t.Fatalf("sessions of another tenant must not be touched, got %#v", other)
+	}
+}
+
+func TestReconcile_LostSessionResolvesPendingApproval(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "alive", ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "gone", ServerID: "srv", AwaitingApproval: true, PendingEventID: "ev1"})
+	cp.mu.Lock()
+	cp.sessionEvents["gone"] = []SessionEvent{{EventID: "ev1", SessionID: "gone", ServerID: "srv", TenantID: "t1", Kind: "approval_needed"}}
+	cp.mu.Unlock()
+	cp.RemoveAgentConnection("t1", "srv")
+
+	err := cp.RegisterOrUpdateServer("t1", AgentRegister{ServerID: "srv", Sessions: []AgentSessionInfo{{SessionID: "alive"}}}, &fakeAgentConn{})
+	if err != nil {
+		t.Fatalf("re-register: %v", err)
+	}
+	if got := sessionByID(t, cp, "gone"); got.Status != SessionLost || got.AwaitingApproval || got.PendingEventID != "" {
+		t.Fatalf("lost session should no longer await approval, got %#v", got)
+	}
+	cp.mu.RLock()
+	ev := cp.sessionEvents["gone"][0]
+	cp.mu.RUnlock()
+	if !ev.Resolved || ev.Actor != sessionLostActor {
+		t.Fatalf("approval of a lost session should be resolved, got %#v", ev)
+	}
+}
+
+func TestReconcile_LegacyAgentWithoutInventoryKeepsSessions(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "gone", ServerID: "srv"})
+	cp.RemoveAgentConnection("t1", "srv")
+
+	if err := cp.RegisterOrUpdateServer("t1", AgentRegister{ServerID: "srv"}, &fakeAgentConn{}); err != nil {
+		t.Fatalf("re-register: %v", err)
+	}
+	if got := sessionByID(t, cp, "gone"); got.Status != SessionRunning {
+		t.Fatalf("nil inventory must not mark sessions lost, got %#v", got)
+	}
+}
+
+func TestReconcile_ExitedWhileDisconnectedIsNotLost(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "alive", ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "gone", ServerID: "srv"})
+	cp.RemoveAgentConnection("t1", "srv")
+
+	err := cp.RegisterOrUpdateServer("t1", AgentRegister{
+		ServerID: "srv",
+		Sessions: []AgentSessionInfo{
+			{SessionID: "alive", Seq: 1},
+			{SessionID: "gone", Exited: true},
+		},
+	}, &fakeAgentConn{})
+	if err != nil {
+		t.Fatalf("re-register: %v", err)
+	}
+	if got := sessionByID(t, cp, "gone"); got.Status != SessionRunning || got.AwaitingReconcile {
+		t.Fatalf("exited-while-disconnected session should wait for replayed pty_exit, got %#v", got)
+	}
+}
+
+func TestReplayCursors_ReportsLatestSeqPerSession(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "alive", ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "gone", ServerID: "srv"})
+	addTestSession(cp, Session{TenantID: "t2", SessionID: "other-tenant", ServerID: "srv"})
+	cp.mu.Lock()
+	cp.sessions["alive"].LatestAgentOutSeq = 17
+	cp.mu.Unlock()
+
+	cursors := cp.ReplayCursors("t1", "srv")
+	if len(cursors) != 2 {
+		t.Fatalf("expected cursors for the tenant's two sessions, got %#v", cursors)
+	}
+	if cursors[0].SessionID != "alive" || cursors[0].LatestSeq != 17 {
+		t.Fatalf("unexpected cursor: %#v", cursors[0])
+	}
+}
@@ -0,0 +1,350 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"cc-control/internal/auth"
+)
+
+const recordingPruneInterval = time.Hour
+
+// castRecorder appends session output, input and resizes to an asciicast v2
+// file (https://docs.asciinema.org/manual/asciicast/v2/).
+type castRecorder struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	start   time.Time
+	input   bool
+	pending []byte // trailing bytes of an incomplete UTF-8 sequence
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// openCastRecorder creates the recording at path, or continues an existing
+// one (e.g. after a control plane restart) keeping its original start time.
+func openCastRecorder(path, title string, cols, rows uint16, recordInput bool) (*castRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if hdr, err := readCastHeader(path); err == nil {
+		start = time.Unix(hdr.Timestamp, 0)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &castRecorder{path: path, file: f, start: start, input: recordInput}
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		if cols == 0 || rows == 0 {
+			cols, rows = 80, 24
+		}
+		line, _ := json.Marshal(castHeader{
+			Version:   2,
+			Width:     int(cols),
+			Height:    int(rows),
+			Timestamp: start.Unix(),
+			Title:     title,
+			Env:       map[string]string{"TERM": "xterm-256color"},
+		})
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func readCastHeader(path string) (castHeader, error) {
+	var hdr castHeader
+	f, err := os.Open(path)
+	if err != nil {
+		return hdr, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return hdr, err
+	}
+	err = json.Unmarshal(line, &hdr)
+	return hdr, err
+}
+
+func (r *castRecorder) output(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// PTY reads can split a multi-byte rune; hold the tail back so the JSON
+	// string stays valid UTF-8.
+	data := append(r.pending, p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte(nil), data[cut:]...)
+	r.writeLocked("o", string(data[:cut]))
+}
+
+func (r *castRecorder) inputEvent(p []byte) {
+	if !r.input {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked("i", string(p))
+}
+
+func (r *castRecorder) resize(cols, rows uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked("r", strconv.Itoa(int(cols))+"x"+strconv.Itoa(int(rows)))
+}
+
+func (r *castRecorder) writeLocked(code, data string) {
+	if r.file == nil || data == "" {
+		return
+	}
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]any{elapsed, code, data})
+	if err != nil {
+		return
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		slog.Error("recording write failed", "path", r.path, "err", err)
+	}
+}
+
+func (r *castRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	if len(r.pending) > 0 {
+		r.writeLocked("o", string(r.pending))
+		r.pending = nil
+	}
+	if err := r.file.Close(); err != nil {
+		slog.Error("recording close failed", "path", r.path, "err", err)
+	}
+	r.file = nil
+}
+
+// safePathElem reports whether id can be used as a single path element.
+func safePathElem(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+func (cp *ControlPlane) recordingPath(tenantID, sessionID string) string {
+	tenantDir := tenantID
+	if tenantDir == "" {
+		tenantDir = "_"
+	}
+	return filepath.Join(cp.cfg.RecordingDir, tenantDir, sessionID+".cast")
+}
+
+// startRecordingLocked attaches a recorder to the session hub when recording
+// is enabled for the session's tenant. Callers must hold cp.mu.
+func (cp *ControlPlane) startRecordingLocked(sess *Session, hub *SessionHub, cols, rows uint16) {
+	if cp.cfg.RecordingDir == "" || hub == nil || hub.rec != nil {
+		return
+	}
+	settings := cp.tenantSettingsLocked(sess.TenantID)
+	if !settings.Recording {
+		return
+	}
+	if !safePathElem(sess.SessionID) || (sess.TenantID != "" && !safePathElem(sess.TenantID)) {
+		slog.Warn("recording skipped: unsafe id", "tenant_id", sess.TenantID, "session_id", sess.SessionID)
+		return
+	}
+	rec, err := openCastRecorder(cp.recordingPath(sess.TenantID, sess.SessionID), sess.SessionID, cols, rows, settings.RecordInput)
+	if err != nil {
+		slog.Error("recording open failed", "session_id", sess.SessionID, "err", err)
+		return
+	}
+	hub.rec = rec
+}
+
+// stopRecording closes the session's recording; the file is kept until the
+// retention policy removes it.
+func (cp *ControlPlane) stopRecording(sessionID string) {
+	cp.mu.Lock()
+	rec := cp.detachRecorderLocked(sessionID)
+	cp.mu.Unlock()
+	if rec != nil {
+		rec.close()
+	}
+}
+
+// detachRecorderLocked removes and returns the session's recorder, if any.
+// Callers must hold cp.mu and close the returned recorder.
+func (cp *ControlPlane) detachRecorderLocked(sessionID string) *castRecorder {
+	hub, ok := cp.sessionHubs[sessionID]
+	if !ok {
+		return nil
+	}
+	rec := hub.rec
+	hub.rec = nil
+	return rec
+}
+
+func (cp *ControlPlane) sessionRecorder(sessionID string) *castRecorder {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	if hub, ok := cp.sessionHubs[sessionID]; ok {
+		return hub.rec
+	}
+	return nil
+}
+
+// RecordingFile returns the path of a session's recording. It is looked up
+// by tenant so recordings remain downloadable after the session is deleted,
+// except for scoped tokens, which need the session to check the scope. The
+// admin view (empty tenantID) takes the tenant from the session, or searches
+// the tenant directories once the session is gone.
+func (cp *ControlPlane) RecordingFile(tenantID string, scope *auth.Scope, sessionID string) (string, error) {
+	if cp.cfg.RecordingDir == "" {
+		return "", errors.New("recording disabled")
+	}
+	if scope != nil {
+		cp.mu.RLock()
+		sess, ok := cp.sessions[sessionID]
+		visible := ok && cp.sessionVisibleLocked(sess, tenantID, scope)
+		cp.mu.RUnlock()
+		if !visible {
+			return "", errors.New("recording not found")
+		}
+	}
+	if !safePathElem(sessionID) || (tenantID != "" && !safePathElem(tenantID)) {
+		return "", errors.New("recording not found")
+	}
+	if tenantID == "" {
+		cp.mu.RLock()
+		sess, ok := cp.sessions[sessionID]
+		cp.mu.RUnlock()
+		if !ok {
+			return cp.findRecording(sessionID)
+		}
+		tenantID = sess.TenantID
+	}
+	path := cp.recordingPath(tenantID, sessionID)
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.New("recording not found")
+	}
+	return path, nil
+}
+
+// findRecording looks for a deleted session's recording in every tenant
+// directory. Session ids are unique across tenants.
+func (cp *ControlPlane) findRecording(sessionID string) (string, error) {
+	tenantDirs, err := os.ReadDir(cp.cfg.RecordingDir)
+	if err != nil {
+		return "", errors.New("recording not found")
+	}
+	for _, d := range tenantDirs {
+		if !d.IsDir() {
+			continue
+		}
+		path := filepath.Join(cp.cfg.RecordingDir, d.Name(), sessionID+".cast")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("recording not found")
+}
+
+func (cp *ControlPlane) runRecordingRetention() {
+	ticker := time.NewTicker(recordingPruneInterval)
+	defer ticker.Stop()
+	cp.pruneRecordings(time.Now())
+	for {
+		select {
+		case <-cp.stop:
+			return
+		case now := <-ticker.C:
+			cp.pruneRecordings(now)
+		}
+	}
+}
+
+// pruneRecordings deletes finished recordings older than the tenant's
+// retention. Recordings still being written are never removed.
+func (cp *ControlPlane) pruneRecordings(now time.Time) {
+	tenantDirs, err := os.ReadDir(cp.cfg.RecordingDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("recording retention: read dir failed", "err", err)
+		}
+		return
+	}
+	cp.mu.RLock()
+	active := make(map[string]struct{})
+	for _, hub := range cp.sessionHubs {
+		if hub.rec != nil {
+			active[hub.rec.path] = struct{}{}
+		}
+	}
+	retention := make(map[string]time.Duration, len(tenantDirs))
+	for _, d := range tenantDirs {
+		tenantID := d.Name()
+		if tenantID == "_" {
+			tenantID = ""
+		}
+		retention[d.Name()] = cp.recordingRetentionLocked(tenantID)
+	}
+	cp.mu.RUnlock()
+
+	for _, d := range tenantDirs {
+		keep := retention[d.Name()]
+		if !d.IsDir() || keep <= 0 {
+			continue
+		}
+		dir := filepath.Join(cp.cfg.RecordingDir, d.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() || !strings.HasSuffix(f.Name(), ".cast") {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			if _, ok := active[path]; ok {
+				continue
+			}
+			info, err := f.Info()
+			if err != nil || now.Sub(info.ModTime()) < keep {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				slog.Error("recording retention: remove failed", "path", path, "err", err)
+				continue
+			}
+			slog.Info("recording pruned", "path", path)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readCastLines(t *testing.T, path string) (castHeader, [][]any) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open recording: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	var hdr castHeader
+	var events [][]any
+	for i := 0; sc.Scan(); i++ {
+		if i == 0 {
+			if err := json.Unmarshal(sc.Bytes(), &hdr); err != nil {
+				t.Fatalf("header: %v", err)
+			}
+			continue
+		}
+		var ev []any
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		events = append(events, ev)
+	}
+	return hdr, events
+}
+
+func TestRecording_WritesAsciicastForEnabledTenant(t *testing.T) {
+	cp := newTestControlPlane(t, Config{RecordingDir: filepath.Join(t.TempDir(), "recordings")})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", Recording: true, RecordInput: true})
+
+	sess, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp", Cols: 120, Rows: 40})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	euro := []byte("€")
+	cp.HandlePTYOut("t1", "srv", sess.SessionID, 1, base64.StdEncoding.EncodeToString(append([]byte("hi "), euro[:1]...)))
+	cp.HandlePTYOut("t1", "srv", sess.SessionID, 2, base64.StdEncoding.EncodeToString(euro[1:]))
+	if err := cp.HandleClientResize("ui:test", "t1", nil, sess.SessionID, 100, 30); err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	if err := cp.HandleClientTermIn("ui:test", "t1", nil, sess.SessionID, base64.StdEncoding.EncodeToString([]byte("y"))); err != nil {
+		t.Fatalf("term in: %v", err)
+	}
+	cp.HandlePTYExit("t1", "srv", sess.SessionID, PTYExit{Reason: "exited"})
+
+	path, err := cp.RecordingFile("t1", nil, sess.SessionID)
+	if err != nil {
+		t.Fatalf("recording file: %v", err)
+	}
+	hdr, events := readCastLines(t, path)
+	if hdr.Version != 2 || hdr.Width != 120 || hdr.Height != 40 {
+		t.Fatalf("unexpected header: %#v", hdr)
+	}
+	want := [][2]string{{"o", "hi "}, {"o", "€"}, {"r", "100x30"}, {"i", "y"}}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %v", len(want), events)
+	}
+	for i, w := range want {
+		if events[i][1] != w[0] || events[i][2] != w[1] {
+			t.Fatalf("event %d = %v, want %v", i, events[i], w)
+		}
+	}
+}
+
+func TestRecording_DisabledTenantAndForeignTenantLookup(t *testing.T) {
+	cp := newTestControlPlane(t, Config{RecordingDir: filepath.Join(t.TempDir(), "recordings")})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	sess, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	cp.HandlePTYOut("t1", "srv", sess.SessionID, 1, base64.StdEncoding.EncodeToString([]byte("x")))
+	if _, err := cp.RecordingFile("t1", nil, sess.SessionID); err == nil {
+		t.Fatal("tenant without recording enabled must not produce a recording")
+	}
+
+	cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", Recording: true})
+	sess, err = cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if _, err := cp.RecordingFile("t2", nil, sess.SessionID); err == nil {
+		t.Fatal("another tenant must not find the recording")
+	}
+	if _, err := cp.RecordingFile("t1", nil, "../"+sess.SessionID); err == nil {
+		t.Fatal("path traversal must be rejected")
+	}
+}
+
+func TestRecording_SurvivesDeleteAndIsPrunedAfterRetention(t *testing.T) {
+	cp := newTestControlPlane(t, Config{RecordingDir: filepath.Join(t.TempDir(), "recordings")})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv"})
+	cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", Recording: true, RecordingRetentionDays: 1})
+	done, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	live, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	cp.HandlePTYExit("t1", "srv", done.SessionID, PTYExit{Reason: "exited"})
+	if err := cp.DeleteSession("ui:test", "t1", nil, done.SessionID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	donePath, err := cp.RecordingFile("t1", nil, done.SessionID)
+	if err != nil {
+		t.Fatalf("recording should outlive the session: %v", err)
+	}
+	if adminPath, err := cp.RecordingFile("", nil, done.SessionID); err != nil || adminPath != donePath {
+		t.Fatalf("admin should find a deleted session's recording, got %q %v", adminPath, err)
+	}
+	if _, err := cp.RecordingFile("", nil, "missing"); err == nil {
+		t.Fatal("admin lookup of an unknown session should fail")
+	}
+	livePath, err := cp.RecordingFile("t1", nil, live.SessionID)
+	if err != nil {
+		t.Fatalf("live recording: %v", err)
+	}
+
+	cp.pruneRecordings(time.Now().Add(48 * time.Hour))
+	if _, err := os.Stat(donePath); !os.IsNotExist(err) {
+		t.Fatalf("expired recording should be pruned, stat err=%v", err)
+	}
+	if _, err := os.Stat(livePath); err != nil {
+		t.Fatalf("active recording must be kept: %v", err)
+	}
+}
+
+func TestTenantSettings_PersistAcrossRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	cp := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	cp.SetTenantSettings("admin", TenantSettings{TenantID: "t1", Recording: true, RecordingRetentionDays: 7})
+	if err := cp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	cp2 := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	got := cp2.GetTenantSettings("t1")
+	if !got.Recording || got.RecordingRetentionDays != 7 {
+		t.Fatalf("tenant settings not restored: %#v", got)
+	}
+}
@@ -2,10 +2,22 @@ package core
 
 import "sync"
 
+type ringChunk struct {
+	seq  uint64
+	data []byte
+}
+
+// RingBuffer keeps the most recent PTY output of a session as seq-tagged
+// chunks, bounded by capacity bytes, so reattaching clients can be sent only
+// what they missed.
 type RingBuffer struct {
 	mu       sync.RWMutex
-	data     []byte
+	chunks   []ringChunk
+	size     int
 	capacity int
+	// dropped is the highest seq whose output is no longer (fully) held,
+	// either because it was evicted or because it never reached us.
+	dropped uint64
 }
 
 func NewRingBuffer(capacity int) *RingBuffer {
@@ -15,24 +27,72 @@ func NewRingBuffer(capacity int) *RingBuffer {
 	return &RingBuffer{capacity: capacity}
 }
 
-func (r *RingBuffer) Write(p []byte) {
+// Write appends output for seq. A jump past latest+1 marks the skipped range
+// as missing.
+func (r *RingBuffer) Write(seq uint64, p []byte) {
 	if len(p) == 0 {
 		return
 	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.data = append(r.data, p...)
-	if len(r.data) > r.capacity {
-		r.data = append([]byte(nil), r.data[len(r.data)-r.capacity:]...)
+	if last := r.latestLocked(); seq > last+1 {
+		r.dropped = seq - 1
+	}
+	r.chunks = append(r.chunks, ringChunk{seq: seq, data: append([]byte(nil), p...)})
+	r.size += len(p)
+
+	drop := 0
+	for r.size > r.capacity && drop < len(r.chunks)-1 {
+		r.size -= len(r.chunks[drop].data)
+		r.dropped = max(r.dropped, r.chunks[drop].seq)
+		drop++
+	}
+	if drop > 0 {
+		r.chunks = append([]ringChunk(nil), r.chunks[drop:]...)
+	}
+	if r.size > r.capacity {
+		// A single chunk larger than the buffer: keep its tail only.
+		last := &r.chunks[len(r.chunks)-1]
+		last.data = append([]byte(nil), last.data[len(last.data)-r.capacity:]...)
+		r.size = len(last.data)
+		r.dropped = max(r.dropped, last.seq)
+	}
+}
+
+func (r *RingBuffer) latestLocked() uint64 {
+	if len(r.chunks) == 0 {
+		return r.dropped
 	}
+	return r.chunks[len(r.chunks)-1].seq
 }
 
 func (r *RingBuffer) Snapshot() []byte {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	if len(r.data) == 0 {
+	if r.size == 0 {
 		return nil
 	}
-	return append([]byte(nil), r.data...)
+	out := make([]byte, 0, r.size)
+	for _, c := range r.chunks {
+		out = append(out, c.data...)
+	}
+	return out
+}
+
+// Since returns the output written after seq. ok is false when part of that
+// range is no longer held (or seq is ahead of the buffer), in which case the
+// caller must fall back to a full Snapshot.
+func (r *RingBuffer) Since(seq uint64) (data []byte, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if seq < r.dropped || seq > r.latestLocked() {
+		return nil, false
+	}
+	for _, c := range r.chunks {
+		if c.seq > seq {
+			data = append(data, c.data...)
+		}
+	}
+	return data, true
 }
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestRingBuffer_SinceReturnsDeltaAfterSeq(t *testing.T) {
+	r := NewRingBuffer(1024)
+	r.Write(1, []byte("a"))
+	r.Write(2, []byte("b"))
+	r.Write(3, []byte("c"))
+
+	data, ok := r.Since(1)
+	if !ok || string(data) != "bc" {
+		t.Fatalf("expected delta %q, got %q ok=%v", "bc", data, ok)
+	}
+	if data, ok := r.Since(3); !ok || len(data) != 0 {
+		t.Fatalf("up-to-date client should get empty delta, got %q ok=%v", data, ok)
+	}
+	if _, ok := r.Since(4); ok {
+		t.Fatal("seq ahead of the buffer must require a resync")
+	}
+}
+
+func TestRingBuffer_EvictedSeqRequiresResync(t *testing.T) {
+	r := NewRingBuffer(4)
+	r.Write(1, []byte("aa"))
+	r.Write(2, []byte("bb"))
+	r.Write(3, []byte("cc"))
+
+	if _, ok := r.Since(0); ok {
+		t.Fatal("seq 1 was evicted, replay from 0 must not be a delta")
+	}
+	if data, ok := r.Since(1); !ok || string(data) != "bbcc" {
+		t.Fatalf("expected delta %q, got %q ok=%v", "bbcc", data, ok)
+	}
+	if got := string(r.Snapshot()); got != "bbcc" {
+		t.Fatalf("snapshot = %q", got)
+	}
+}
+
+func TestRingBuffer_SeqGapRequiresResync(t *testing.T) {
+	r := NewRingBuffer(1024)
+	r.Write(5, []byte("late"))
+
+	if _, ok := r.Since(2); ok {
+		t.Fatal("seqs 3-4 never arrived, replay from 2 must not be a delta")
+	}
+	if data, ok := r.Since(4); !ok || string(data) != "late" {
+		t.Fatalf("expected delta %q, got %q ok=%v", "late", data, ok)
+	}
+}
+
+func TestAttachSubscriber_ReplaysDeltaOrFullWithResync(t *testing.T) {
+	cp, _, sessionID, _ := setupActionTestControlPlane(t, "")
+	sub := &Subscriber{ID: "ui", Send: make(chan Envelope, 16), TenantID: "t1"}
+	if _, err := cp.AttachSubscriber(sub, sessionID, 0); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	for seq, chunk := range []string{"one", "two", "three"} {
+		cp.HandlePTYOut("t1", "srv", sessionID, uint64(seq+1), base64.StdEncoding.EncodeToString([]byte(chunk)))
+	}
+
+	replay, err := cp.AttachSubscriber(sub, sessionID, 2)
+	if err != nil {
+		t.Fatalf("reattach: %v", err)
+	}
+	if replay.Full || replay.Resync || string(replay.Data) != "three" || replay.LatestSeq != 3 {
+		t.Fatalf("expected delta after seq 2, got %#v", replay)
+	}
+
+	replay, err = cp.AttachSubscriber(sub, sessionID, 9)
+	if err != nil {
+		t.Fatalf("reattach: %v", err)
+	}
+	if !replay.Full || !replay.Resync || string(replay.Data) != "onetwothree" {
+		t.Fatalf("unknown seq should fall back to full replay with resync, got %#v", replay)
+	}
+}
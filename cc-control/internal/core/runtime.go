@@ -0,0 +1,53 @@
+package core
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const resumeIDPlaceholder = "{resume_id}"
+
+// resolveRuntime picks the runtime profile for a new session on srv. Agents
+// that predate runtime profiles only offer their ClaudePath.
+func resolveRuntime(srv *Server, name string) (RuntimeInfo, error) {
+	name = strings.TrimSpace(name)
+	if len(srv.Runtimes) == 0 {
+		if name != "" {
+			return RuntimeInfo{}, errors.New("server does not advertise runtimes")
+		}
+		cmdPath := strings.TrimSpace(srv.ClaudePath)
+		if cmdPath == "" {
+			cmdPath = "claude-code"
+		}
+		return RuntimeInfo{Command: cmdPath, ResumeArgs: []string{"--resume", resumeIDPlaceholder}}, nil
+	}
+	for _, rt := range srv.Runtimes {
+		if (name == "" && rt.Default) || (name != "" && rt.Name == name) {
+			return rt, nil
+		}
+	}
+	if name == "" {
+		return srv.Runtimes[0], nil
+	}
+	return RuntimeInfo{}, errors.New("unknown runtime " + strconv.Quote(name))
+}
+
+// commandLine is the argv the agent is expected to run for rt. It is
+// informational: the agent builds the process from its own profile, checks
+// extra args against its allow-list and reports the real argv on start.
+func (rt RuntimeInfo) commandLine(resumeID string, extra []string) ([]string, error) {
+	if len(extra) > 0 && len(rt.AllowArgs) == 0 {
+		return nil, errors.New("runtime " + strconv.Quote(rt.Name) + " does not allow extra args")
+	}
+	cmd := append([]string{rt.Command}, rt.Args...)
+	if resumeID != "" {
+		if len(rt.ResumeArgs) == 0 {
+			return nil, errors.New("runtime " + strconv.Quote(rt.Name) + " does not support resume")
+		}
+		for _, a := range rt.ResumeArgs {
+			cmd = append(cmd, strings.ReplaceAll(a, resumeIDPlaceholder, resumeID))
+		}
+	}
+	return append(cmd, extra...), nil
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func lastStartSession(t *testing.T, conn *fakeAgentConn) map[string]any {
+	t.Helper()
+	for i := len(conn.msgs) - 1; i >= 0; i-- {
+		if conn.msgs[i].Type != "start_session" {
+			continue
+		}
+		var payload map[string]any
+		if err := json.Unmarshal(conn.msgs[i].Data, &payload); err != nil {
+			t.Fatalf("decode start_session: %v", err)
+		}
+		return payload
+	}
+	t.Fatalf("no start_session sent")
+	return nil
+}
+
+func TestCreateSession_SelectsRuntimeProfile(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Runtimes: []RuntimeInfo{
+		{Name: "claude", Command: "claude", ResumeArgs: []string{"--resume", "{resume_id}"}, Default: true},
+		{Name: "codex", Command: "codex", Args: []string{"--full-auto"}, ResumeArgs: []string{"resume", "{resume_id}"}},
+	}})
+
+	sess, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/repo", Runtime: "codex", ResumeID: "abc"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if sess.Runtime != "codex" || !reflect.DeepEqual(sess.Cmd, []string{"codex", "--full-auto", "resume", "abc"}) {
+		t.Fatalf("unexpected session runtime/cmd: %q %#v", sess.Runtime, sess.Cmd)
+	}
+	if got := lastStartSession(t, conn)["runtime"]; got != "codex" {
+		t.Fatalf("start_session should name the runtime, got %#v", got)
+	}
+
+	sess, err = cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/repo"})
+	if err != nil {
+		t.Fatalf("create default session: %v", err)
+	}
+	if sess.Runtime != "claude" {
+		t.Fatalf("empty runtime should use the default profile, got %q", sess.Runtime)
+	}
+}
+
+func TestCreateSession_RejectsUnknownRuntime(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Runtimes: []RuntimeInfo{{Name: "claude", Command: "claude", Default: true}}})
+
+	_, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/repo", Runtime: "aider"})
+	if err == nil || !strings.Contains(err.Error(), "unknown runtime") {
+		t.Fatalf("expected unknown runtime error, got %v", err)
+	}
+	_, err = cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/repo", ResumeID: "abc"})
+	if err == nil || !strings.Contains(err.Error(), "does not support resume") {
+		t.Fatalf("expected resume unsupported error, got %v", err)
+	}
+	if len(conn.msgs) != 0 {
+		t.Fatalf("rejected sessions must not reach the agent, got %d messages", len(conn.msgs))
+	}
+}
+
+func TestCreateSession_LegacyAgentUsesClaudePath(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", ClaudePath: "/usr/bin/claude"})
+
+	sess, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/repo", ResumeID: "abc"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if sess.Runtime != "" || !reflect.DeepEqual(sess.Cmd, []string{"/usr/bin/claude", "--resume", "abc"}) {
+		t.Fatalf("legacy agent should keep claude_path behaviour, got %q %#v", sess.Runtime, sess.Cmd)
+	}
+	if _, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/repo", Runtime: "codex"}); err == nil {
+		t.Fatalf("legacy agent must reject named runtimes")
+	}
+}
+
+func TestCreateSession_ForwardsArgsAndRecordsStartedArgv(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	conn := addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Runtimes: []RuntimeInfo{
+		{Name: "claude", Command: "claude", AllowArgs: []ArgRule{{Flag: "--model", Value: "opus|sonnet"}}, Default: true},
+		{Name: "plain", Command: "sh"},
+	}})
+
+	if _, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/repo", Runtime: "plain", Args: []string{"-x"}}); err == nil {
+		t.Fatal("runtimes without allow_args must reject extra args")
+	}
+	sess, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/repo", Args: []string{"--model", "opus"}})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if !reflect.DeepEqual(sess.Args, []string{"--model", "opus"}) || !reflect.DeepEqual(sess.Cmd, []string{"claude", "--model", "opus"}) {
+		t.Fatalf("unexpected args/cmd: %#v %#v", sess.Args, sess.Cmd)
+	}
+	if got := lastStartSession(t, conn)["args"]; !reflect.DeepEqual(got, []any{"--model", "opus"}) {
+		t.Fatalf("start_session args = %#v", got)
+	}
+
+	cp.HandleSessionStarted("t1", "other", sess.SessionID, SessionStarted{Argv: []string{"evil"}, Pid: 1})
+	cp.HandleSessionStarted("t1", "srv", sess.SessionID, SessionStarted{Runtime: "claude", Argv: []string{"/usr/local/bin/claude", "--model", "opus"}, Pid: 4242})
+	got := sessionByID(t, cp, sess.SessionID)
+	if got.Status != SessionRunning || got.Pid != 4242 || got.Cmd[0] != "/usr/local/bin/claude" {
+		t.Fatalf("session_started not applied (or applied from wrong server): %#v", got)
+	}
+}
@@ -0,0 +1,40 @@
+package core
+
+// serverKey identifies a server within its tenant. Server ids are picked by
+// the agent, so two tenants may register the same one; keying by the pair
+// keeps one tenant from taking over another's server entry and its sessions.
+type serverKey struct {
+	tenantID string
+	serverID string
+}
+
+func (s *Session) serverKey() serverKey {
+	return serverKey{s.TenantID, s.ServerID}
+}
+
+// ownedBy reports whether the agent registered as serverID in tenantID runs
+// this session. Agent messages for other sessions are dropped.
+func (s *Session) ownedBy(tenantID, serverID string) bool {
+	return s.TenantID == tenantID && s.ServerID == serverID
+}
+
+// serverLocked finds serverID in tenantID. An empty tenantID (admin callers)
+// matches the id in any tenant as long as only one tenant uses it. Callers
+// must hold cp.mu.
+func (cp *ControlPlane) serverLocked(tenantID, serverID string) (*Server, bool) {
+	if tenantID != "" {
+		srv, ok := cp.servers[serverKey{tenantID, serverID}]
+		return srv, ok
+	}
+	var found *Server
+	for key, srv := range cp.servers {
+		if key.serverID != serverID {
+			continue
+		}
+		if found != nil {
+			return nil, false
+		}
+		found = srv
+	}
+	return found, found != nil
+}
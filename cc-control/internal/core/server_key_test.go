@@ -0,0 +1,86 @@
+package core
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerID_CannotBeHijackedAcrossTenants(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	cp := newTestControlPlane(t, Config{StateDBPath: dbPath})
+
+	victim := &fakeAgentConn{}
+	if err := cp.RegisterOrUpdateServer("t1", AgentRegister{ServerID: "build", Hostname: "t1-host"}, victim); err != nil {
+		t.Fatalf("register t1: %v", err)
+	}
+	sess, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "build", Cwd: "/tmp"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	cp.RemoveAgentConnection("t1", "build")
+
+	attacker := &fakeAgentConn{}
+	if err := cp.RegisterOrUpdateServer("t2", AgentRegister{ServerID: "build", Hostname: "t2-host"}, attacker); err != nil {
+		t.Fatalf("same id in another tenant should register separately: %v", err)
+	}
+	code := 0
+	cp.HandlePTYExit("t2", "build", sess.SessionID, PTYExit{ExitCode: &code, Reason: "exited"})
+	if got := sessionByID(t, cp, sess.SessionID); got.Status == SessionExited {
+		t.Fatal("an agent in another tenant must not drive the session")
+	}
+	if servers := cp.GetServers("t1", nil); len(servers) != 1 || servers[0].Hostname != "t1-host" || servers[0].Status != ServerOffline {
+		t.Fatalf("t1 server entry should be untouched: %#v", servers)
+	}
+	if _, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "build", Cwd: "/tmp"}); err == nil {
+		t.Fatal("t1 must not reach the t2 agent through the shared id")
+	}
+	if len(attacker.msgs) != 0 {
+		t.Fatalf("t2 agent got %d messages meant for t1", len(attacker.msgs))
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	cp2 := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	if len(cp2.GetServers("t1", nil)) != 1 || len(cp2.GetServers("t2", nil)) != 1 {
+		t.Fatalf("both tenants' servers should persist: %#v", cp2.GetServers("", nil))
+	}
+}
+
+func TestSQLiteStateStore_MigratesServerPrimaryKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = db.Exec(`
+CREATE TABLE cp_servers (
+  server_id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL,
+  data TEXT NOT NULL,
+  updated_at_ms INTEGER NOT NULL
+);
+INSERT INTO cp_servers VALUES ('build', 't1', '{"tenant_id":"t1","server_id":"build"}', 1);
+`)
+	_ = db.Close()
+	if err != nil {
+		t.Fatalf("seed old schema: %v", err)
+	}
+
+	store, err := NewSQLiteStateStore(path)
+	if err != nil {
+		t.Fatalf("open store on old schema: %v", err)
+	}
+	defer store.Close()
+	if err := store.SaveServer(Server{TenantID: "t2", ServerID: "build"}); err != nil {
+		t.Fatalf("save same id in another tenant: %v", err)
+	}
+	st, err := store.LoadState()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(st.Servers) != 2 {
+		t.Fatalf("expected the migrated row plus the new one, got %#v", st.Servers)
+	}
+}
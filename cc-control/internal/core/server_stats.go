@@ -0,0 +1,85 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	"cc-control/internal/auth"
+)
+
+// serverStatsHistory is how many heartbeat samples are kept per server; at
+// the default 5s heartbeat that is the last 10 minutes.
+const serverStatsHistory = 120
+
+// ServerStats is the host telemetry an agent sends with each heartbeat.
+type ServerStats struct {
+	TsMS          int64          `json:"ts_ms"`
+	Load1         float64        `json:"load1"`
+	Load5         float64        `json:"load5"`
+	Load15        float64        `json:"load15"`
+	MemTotalBytes uint64         `json:"mem_total_bytes"`
+	MemAvailBytes uint64         `json:"mem_available_bytes"`
+	Disks         []DiskUsage    `json:"disks,omitempty"`
+	PTYs          int            `json:"ptys"`
+	Sessions      []SessionUsage `json:"sessions,omitempty"`
+}
+
+// DiskUsage is the filesystem space under one of the agent's allow roots.
+type DiskUsage struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+}
+
+// SessionUsage is the summed CPU and memory of a session's process tree.
+type SessionUsage struct {
+	SessionID  string  `json:"session_id"`
+	Pid        int     `json:"pid"`
+	Procs      int     `json:"procs"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+	CPUPercent float64 `json:"cpu_percent"`
+	RSSBytes   uint64  `json:"rss_bytes"`
+}
+
+// RecordServerStats appends a heartbeat sample to the server's rolling
+// history. Samples are kept in memory only.
+func (cp *ControlPlane) RecordServerStats(tenantID, serverID string, stats ServerStats) {
+	if stats.TsMS == 0 {
+		stats.TsMS = time.Now().UnixMilli()
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	key := serverKey{tenantID, serverID}
+	if _, ok := cp.servers[key]; !ok {
+		return
+	}
+	history := append(cp.serverStats[key], stats)
+	if len(history) > serverStatsHistory {
+		history = append([]ServerStats(nil), history[len(history)-serverStatsHistory:]...)
+	}
+	cp.serverStats[key] = history
+}
+
+// GetServerStats returns the server's recent samples, oldest first. Each
+// sample lists only the sessions visible to the caller.
+func (cp *ControlPlane) GetServerStats(tenantID string, scope *auth.Scope, serverID string) ([]ServerStats, error) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	srv, ok := cp.serverLocked(tenantID, serverID)
+	if !ok || !scope.AllowsServer(srv.ServerID, srv.Tags) {
+		return nil, errors.New("server not found")
+	}
+	history := cp.serverStats[serverKey{srv.TenantID, srv.ServerID}]
+	out := make([]ServerStats, 0, len(history))
+	for _, stats := range history {
+		var sessions []SessionUsage
+		for _, u := range stats.Sessions {
+			if sess, ok := cp.sessions[u.SessionID]; ok && cp.sessionVisibleLocked(sess, tenantID, scope) {
+				sessions = append(sessions, u)
+			}
+		}
+		stats.Sessions = sessions
+		out = append(out, stats)
+	}
+	return out, nil
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"testing"
+
+	"cc-control/internal/auth"
+)
+
+func TestServerStats_RollingHistoryPerTenant(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	for i := 1; i <= serverStatsHistory+5; i++ {
+		cp.RecordServerStats("t1", "srv", ServerStats{TsMS: int64(i), PTYs: i})
+	}
+	cp.RecordServerStats("t1", "unknown", ServerStats{PTYs: 1})
+
+	stats, err := cp.GetServerStats("t1", nil, "srv")
+	if err != nil {
+		t.Fatalf("get stats: %v", err)
+	}
+	if len(stats) != serverStatsHistory || stats[0].TsMS != 6 || stats[len(stats)-1].PTYs != serverStatsHistory+5 {
+		t.Fatalf("expected the newest %d samples, got %d from ts %d", serverStatsHistory, len(stats), stats[0].TsMS)
+	}
+	if _, err := cp.GetServerStats("t2", nil, "srv"); err == nil {
+		t.Fatal("stats must not be visible to other tenants")
+	}
+	if _, err := cp.GetServerStats("t1", nil, "unknown"); err == nil {
+		t.Fatal("expected not found for unknown server")
+	}
+}
+
+func TestServerStats_SessionsFilteredByScope(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	cp.mu.Lock()
+	cp.sessions["s2"] = &Session{TenantID: "t1", SessionID: "s2", ServerID: "srv", Cwd: "/other", Status: SessionRunning}
+	cp.mu.Unlock()
+	cp.RecordServerStats("t1", "srv", ServerStats{Sessions: []SessionUsage{{SessionID: "s1"}, {SessionID: "s2"}, {SessionID: "gone"}}})
+
+	stats, err := cp.GetServerStats("t1", &auth.Scope{CwdPrefixes: []string{"/repo"}}, "srv")
+	if err != nil {
+		t.Fatalf("get stats: %v", err)
+	}
+	if got := stats[0].Sessions; len(got) != 1 || got[0].SessionID != "s1" {
+		t.Fatalf("expected only the in-scope session, got %#v", got)
+	}
+	if stats, _ := cp.GetServerStats("t1", nil, "srv"); len(stats[0].Sessions) != 2 {
+		t.Fatalf("an unscoped caller should see every known session, got %#v", stats[0].Sessions)
+	}
+}
@@ -0,0 +1,624 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStateStore keeps control-plane state in a SQLite database. It can
+// share a file with the token store; tables do not overlap.
+type SQLiteStateStore struct {
+	db *sql.DB
+
+	mu         sync.Mutex
+	lastStatus map[string]SessionStatus
+}
+
+func NewSQLiteStateStore(path string) (*SQLiteStateStore, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, errors.New("sqlite path required")
+	}
+	db, err := openStateDB(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureStateSchema(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &SQLiteStateStore{
+		db:         db,
+		lastStatus: make(map[string]SessionStatus),
+	}, nil
+}
+
+func openStateDB(path string) (*sql.DB, error) {
+	if path != ":memory:" {
+		dir := filepath.Dir(path)
+		if dir != "." && dir != "" {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, err
+			}
+		}
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if path == ":memory:" {
+		// Every pooled connection would otherwise see its own empty database.
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	_, _ = db.Exec(`PRAGMA journal_mode = WAL;`)
+	_, _ = db.Exec(`PRAGMA synchronous = NORMAL;`)
+	_, _ = db.Exec(`PRAGMA busy_timeout = 5000;`)
+	return db, nil
+}
+
+func ensureStateSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS cp_servers (
+  tenant_id TEXT NOT NULL,
+  server_id TEXT NOT NULL,
+  data TEXT NOT NULL,
+  updated_at_ms INTEGER NOT NULL,
+  PRIMARY KEY (tenant_id, server_id)
+);
+CREATE TABLE IF NOT EXISTS cp_sessions (
+  session_id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL,
+  server_id TEXT NOT NULL,
+  status TEXT NOT NULL,
+  exit_code INTEGER,
+  resume_id TEXT NOT NULL,
+  created_at_ms INTEGER NOT NULL,
+  data TEXT NOT NULL,
+  updated_at_ms INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cp_sessions_tenant ON cp_sessions(tenant_id);
+CREATE TABLE IF NOT EXISTS cp_session_transitions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  session_id TEXT NOT NULL,
+  status TEXT NOT NULL,
+  exit_code INTEGER,
+  reason TEXT NOT NULL,
+  ts_ms INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cp_transitions_session ON cp_session_transitions(session_id);
+CREATE TABLE IF NOT EXISTS cp_session_events (
+  event_id TEXT PRIMARY KEY,
+  session_id TEXT NOT NULL,
+  tenant_id TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  resolved INTEGER NOT NULL,
+  ts_ms INTEGER NOT NULL,
+  data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cp_events_session ON cp_session_events(session_id);
+CREATE TABLE IF NOT EXISTS cp_tenant_settings (
+  tenant_id TEXT PRIMARY KEY,
+  data TEXT NOT NULL,
+  updated_at_ms INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS cp_policies (
+  policy_id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL,
+  data TEXT NOT NULL,
+  updated_at_ms INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cp_policies_tenant ON cp_policies(tenant_id);
+CREATE TABLE IF NOT EXISTS cp_webhooks (
+  webhook_id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL,
+  data TEXT NOT NULL,
+  updated_at_ms INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS cp_webhook_deliveries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  webhook_id TEXT NOT NULL,
+  ts_ms INTEGER NOT NULL,
+  data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cp_webhook_deliveries_webhook ON cp_webhook_deliveries(webhook_id, id);
+CREATE TABLE IF NOT EXISTS cp_audit (
+  seq INTEGER PRIMARY KEY,
+  ts_ms INTEGER NOT NULL,
+  tenant_id TEXT NOT NULL,
+  actor TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  server_id TEXT NOT NULL,
+  session_id TEXT NOT NULL,
+  data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cp_audit_tenant ON cp_audit(tenant_id, seq);
+CREATE INDEX IF NOT EXISTS idx_cp_audit_session ON cp_audit(session_id, seq);
+CREATE INDEX IF NOT EXISTS idx_cp_audit_ts ON cp_audit(ts_ms);
+`)
+	if err != nil {
+		return err
+	}
+	return migrateServerKey(db)
+}
+
+// migrateServerKey rebuilds a cp_servers table created when servers were
+// keyed by server_id alone, so the same id can exist in several tenants.
+func migrateServerKey(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(cp_servers)`)
+	if err != nil {
+		return err
+	}
+	keyCols := 0
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if pk > 0 {
+			keyCols++
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if keyCols != 1 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, stmt := range []string{
+		`ALTER TABLE cp_servers RENAME TO cp_servers_old`,
+		`CREATE TABLE cp_servers (
+  tenant_id TEXT NOT NULL,
+  server_id TEXT NOT NULL,
+  data TEXT NOT NULL,
+  updated_at_ms INTEGER NOT NULL,
+  PRIMARY KEY (tenant_id, server_id)
+)`,
+		`INSERT INTO cp_servers (tenant_id, server_id, data, updated_at_ms) SELECT tenant_id, server_id, data, updated_at_ms FROM cp_servers_old`,
+		`DROP TABLE cp_servers_old`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStateStore) Close() error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *SQLiteStateStore) LoadState() (*PersistedState, error) {
+	st := &PersistedState{}
+	if err := loadJSONRows(s.db, `SELECT data FROM cp_servers`, func(raw []byte) error {
+		var srv Server
+		if err := json.Unmarshal(raw, &srv); err != nil {
+			return err
+		}
+		st.Servers = append(st.Servers, srv)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := loadJSONRows(s.db, `SELECT data FROM cp_sessions ORDER BY created_at_ms`, func(raw []byte) error {
+		var sess Session
+		if err := json.Unmarshal(raw, &sess); err != nil {
+			return err
+		}
+		st.Sessions = append(st.Sessions, sess)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := loadJSONRows(s.db, `SELECT data FROM cp_session_events ORDER BY ts_ms`, func(raw []byte) error {
+		var ev SessionEvent
+		if err := json.Unmarshal(raw, &ev); err != nil {
+			return err
+		}
+		st.Events = append(st.Events, ev)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := loadJSONRows(s.db, `SELECT data FROM cp_tenant_settings`, func(raw []byte) error {
+		var settings TenantSettings
+		if err := json.Unmarshal(raw, &settings); err != nil {
+			return err
+		}
+		st.TenantSettings = append(st.TenantSettings, settings)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := loadJSONRows(s.db, `SELECT data FROM cp_policies`, func(raw []byte) error {
+		var p ApprovalPolicy
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return err
+		}
+		st.Policies = append(st.Policies, p)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := loadJSONRows(s.db, `SELECT data FROM cp_webhooks`, func(raw []byte) error {
+		var h Webhook
+		if err := json.Unmarshal(raw, &h); err != nil {
+			return err
+		}
+		st.Webhooks = append(st.Webhooks, h)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := loadJSONRows(s.db, `SELECT data FROM cp_webhook_deliveries ORDER BY id`, func(raw []byte) error {
+		var d WebhookDelivery
+		if err := json.Unmarshal(raw, &d); err != nil {
+			return err
+		}
+		st.WebhookDeliveries = append(st.WebhookDeliveries, d)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	for _, sess := range st.Sessions {
+		s.lastStatus[sess.SessionID] = sess.Status
+	}
+	s.mu.Unlock()
+	return st, nil
+}
+
+func loadJSONRows(db *sql.DB, query string, fn func(raw []byte) error) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return err
+		}
+		if err := fn([]byte(raw)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStateStore) SaveServer(srv Server) error {
+	data, err := json.Marshal(srv)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+INSERT INTO cp_servers (server_id, tenant_id, data, updated_at_ms) VALUES (?, ?, ?, ?)
+ON CONFLICT(tenant_id, server_id) DO UPDATE SET data = excluded.data, updated_at_ms = excluded.updated_at_ms`,
+		srv.ServerID, srv.TenantID, string(data), time.Now().UnixMilli(),
+	)
+	return err
+}
+
+func (s *SQLiteStateStore) SaveSession(sess Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	var exitCode any
+	if sess.ExitCode != nil {
+		exitCode = *sess.ExitCode
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`
+INSERT INTO cp_sessions (session_id, tenant_id, server_id, status, exit_code, resume_id, created_at_ms, data, updated_at_ms)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(session_id) DO UPDATE SET
+  status = excluded.status,
+  exit_code = excluded.exit_code,
+  resume_id = excluded.resume_id,
+  data = excluded.data,
+  updated_at_ms = excluded.updated_at_ms`,
+		sess.SessionID, sess.TenantID, sess.ServerID, string(sess.Status), exitCode, sess.ResumeID, sess.CreatedAtMS, string(data), now,
+	); err != nil {
+		return err
+	}
+	if prev, ok := s.lastStatus[sess.SessionID]; !ok || prev != sess.Status {
+		if _, err := tx.Exec(
+			`INSERT INTO cp_session_transitions (session_id, status, exit_code, reason, ts_ms) VALUES (?, ?, ?, ?, ?)`,
+			sess.SessionID, string(sess.Status), exitCode, sess.ExitReason, now,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.lastStatus[sess.SessionID] = sess.Status
+	return nil
+}
+
+func (s *SQLiteStateStore) DeleteSession(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, q := range []string{
+		`DELETE FROM cp_sessions WHERE session_id = ?`,
+		`DELETE FROM cp_session_events WHERE session_id = ?`,
+		`DELETE FROM cp_session_transitions WHERE session_id = ?`,
+	} {
+		if _, err := tx.Exec(q, sessionID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	delete(s.lastStatus, sessionID)
+	return nil
+}
+
+func (s *SQLiteStateStore) SaveSessionEvent(ev SessionEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resolved := 0
+	if ev.Resolved {
+		resolved = 1
+	}
+	_, err = s.db.Exec(`
+INSERT INTO cp_session_events (event_id, session_id, tenant_id, kind, resolved, ts_ms, data)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(event_id) DO UPDATE SET resolved = excluded.resolved, data = excluded.data`,
+		ev.EventID, ev.SessionID, ev.TenantID, ev.Kind, resolved, ev.TsMS, string(data),
+	)
+	return err
+}
+
+func (s *SQLiteStateStore) SaveTenantSettings(settings TenantSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+INSERT INTO cp_tenant_settings (tenant_id, data, updated_at_ms) VALUES (?, ?, ?)
+ON CONFLICT(tenant_id) DO UPDATE SET data = excluded.data, updated_at_ms = excluded.updated_at_ms`,
+		settings.TenantID, string(data), time.Now().UnixMilli(),
+	)
+	return err
+}
+
+func (s *SQLiteStateStore) SavePolicy(p ApprovalPolicy) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+INSERT INTO cp_policies (policy_id, tenant_id, data, updated_at_ms) VALUES (?, ?, ?, ?)
+ON CONFLICT(policy_id) DO UPDATE SET data = excluded.data, updated_at_ms = excluded.updated_at_ms`,
+		p.PolicyID, p.TenantID, string(data), p.UpdatedAtMS,
+	)
+	return err
+}
+
+func (s *SQLiteStateStore) DeletePolicy(policyID string) error {
+	_, err := s.db.Exec(`DELETE FROM cp_policies WHERE policy_id = ?`, policyID)
+	return err
+}
+
+func (s *SQLiteStateStore) SaveWebhook(h Webhook) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+INSERT INTO cp_webhooks (webhook_id, tenant_id, data, updated_at_ms) VALUES (?, ?, ?, ?)
+ON CONFLICT(webhook_id) DO UPDATE SET data = excluded.data, updated_at_ms = excluded.updated_at_ms`,
+		h.WebhookID, h.TenantID, string(data), h.UpdatedAtMS,
+	)
+	return err
+}
+
+func (s *SQLiteStateStore) DeleteWebhook(webhookID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`DELETE FROM cp_webhooks WHERE webhook_id = ?`, webhookID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM cp_webhook_deliveries WHERE webhook_id = ?`, webhookID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStateStore) SaveWebhookDelivery(d WebhookDelivery, keep int) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(
+		`INSERT INTO cp_webhook_deliveries (webhook_id, ts_ms, data) VALUES (?, ?, ?)`,
+		d.WebhookID, d.TsMS, string(data),
+	); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+DELETE FROM cp_webhook_deliveries WHERE webhook_id = ? AND id NOT IN (
+  SELECT id FROM cp_webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?
+)`, d.WebhookID, d.WebhookID, keep)
+	return err
+}
+
+// SessionTransition is one recorded status change of a session.
+type SessionTransition struct {
+	Status   SessionStatus `json:"status"`
+	ExitCode *int          `json:"exit_code,omitempty"`
+	Reason   string        `json:"reason,omitempty"`
+	TsMS     int64         `json:"ts_ms"`
+}
+
+func (s *SQLiteStateStore) SessionTransitions(sessionID string) ([]SessionTransition, error) {
+	rows, err := s.db.Query(
+		`SELECT status, exit_code, reason, ts_ms FROM cp_session_transitions WHERE session_id = ? ORDER BY id`,
+		sessionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SessionTransition
+	for rows.Next() {
+		var (
+			t        SessionTransition
+			status   string
+			exitCode sql.NullInt64
+		)
+		if err := rows.Scan(&status, &exitCode, &t.Reason, &t.TsMS); err != nil {
+			return nil, err
+		}
+		t.Status = SessionStatus(status)
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			t.ExitCode = &code
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// IndexAuditEvents implements AuditIndex.
+func (s *SQLiteStateStore) IndexAuditEvents(events []AuditEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	stmt, err := tx.Prepare(`
+INSERT OR IGNORE INTO cp_audit (seq, ts_ms, tenant_id, actor, kind, server_id, session_id, data)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(int64(ev.Seq), ev.TsMS, ev.TenantID, ev.Actor, ev.Kind, ev.ServerID, ev.SessionID, string(data)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LastAuditSeq implements AuditIndex. It returns the end of the run of seqs
+// starting at 1, so a record that never made it into the index is indexed
+// again on the next startup.
+func (s *SQLiteStateStore) LastAuditSeq() (uint64, error) {
+	var seq sql.NullInt64
+	err := s.db.QueryRow(`SELECT CASE WHEN MIN(seq) > 1 THEN 0 ELSE (
+  SELECT MIN(seq) FROM cp_audit a
+  WHERE NOT EXISTS (SELECT 1 FROM cp_audit b WHERE b.seq = a.seq + 1)
+) END FROM cp_audit`).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(seq.Int64), nil
+}
+
+// QueryAudit implements AuditIndex.
+func (s *SQLiteStateStore) QueryAudit(q AuditQuery) ([]AuditEvent, error) {
+	var where []string
+	var args []any
+	for _, f := range []struct {
+		column, value string
+	}{
+		{"tenant_id", q.TenantID},
+		{"actor", q.Actor},
+		{"kind", q.Kind},
+		{"server_id", q.ServerID},
+		{"session_id", q.SessionID},
+	} {
+		if f.value != "" {
+			where = append(where, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	if q.SinceMS > 0 {
+		where = append(where, "ts_ms >= ?")
+		args = append(args, q.SinceMS)
+	}
+	if q.UntilMS > 0 {
+		where = append(where, "ts_ms < ?")
+		args = append(args, q.UntilMS)
+	}
+	if q.Before > 0 {
+		where = append(where, "seq < ?")
+		args = append(args, int64(q.Before))
+	}
+	query := `SELECT data FROM cp_audit`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY seq DESC LIMIT ?`
+	args = append(args, q.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []AuditEvent
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var ev AuditEvent
+		if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"log/slog"
+	"sort"
+)
+
+// StateStore persists servers, sessions and session events so the control
+// plane can rebuild its view after a restart. Implementations must be safe
+// for use from multiple goroutines.
+type StateStore interface {
+	LoadState() (*PersistedState, error)
+	SaveServer(srv Server) error
+	SaveSession(sess Session) error
+	DeleteSession(sessionID string) error
+	SaveSessionEvent(ev SessionEvent) error
+	SaveTenantSettings(settings TenantSettings) error
+	SavePolicy(p ApprovalPolicy) error
+	DeletePolicy(policyID string) error
+	SaveWebhook(h Webhook) error
+	DeleteWebhook(webhookID string) error
+	// SaveWebhookDelivery appends to a webhook's delivery log, keeping the
+	// newest keep entries.
+	SaveWebhookDelivery(d WebhookDelivery, keep int) error
+	Close() error
+}
+
+type PersistedState struct {
+	Servers        []Server
+	Sessions       []Session
+	Events         []SessionEvent
+	TenantSettings []TenantSettings
+	Policies       []ApprovalPolicy
+	Webhooks       []Webhook
+	// WebhookDeliveries are ordered oldest first.
+	WebhookDeliveries []WebhookDelivery
+}
+
+func isActiveStatus(status SessionStatus) bool {
+	return status == SessionStarting || status == SessionRunning || status == SessionStopping
+}
+
+// restoreState loads persisted state into the in-memory maps. Servers come
+// back offline until their agent reconnects, and sessions that were still
+// active are flagged as awaiting reconciliation with the agent.
+func (cp *ControlPlane) restoreState() error {
+	if cp.state == nil {
+		return nil
+	}
+	st, err := cp.state.LoadState()
+	if err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, settings := range st.TenantSettings {
+		cp.tenantSettings[settings.TenantID] = settings
+	}
+	for _, p := range st.Policies {
+		if err := p.Match.compile(); err != nil {
+			slog.Error("load policy failed", "policy_id", p.PolicyID, "err", err)
+		}
+		cp.policies[p.PolicyID] = p
+	}
+	for _, h := range st.Webhooks {
+		cp.webhooks[h.WebhookID] = h
+	}
+	for _, d := range st.WebhookDeliveries {
+		cp.hooks.deliveries[d.WebhookID] = append(cp.hooks.deliveries[d.WebhookID], d)
+	}
+	for i := range st.Servers {
+		srv := st.Servers[i]
+		srv.Status = ServerOffline
+		cp.servers[serverKey{srv.TenantID, srv.ServerID}] = &srv
+	}
+	for i := range st.Sessions {
+		sess := st.Sessions[i]
+		if isActiveStatus(sess.Status) {
+			sess.AwaitingReconcile = true
+		}
+		// Output buffers are not persisted; starting from zero lets the agent
+		// replay its spool to refill the scrollback.
+		sess.LatestAgentOutSeq = 0
+		hub := newSessionHub(cp.cfg.RingBufferBytes)
+		cp.sessions[sess.SessionID] = &sess
+		cp.sessionHubs[sess.SessionID] = hub
+		cp.hooks.lastStatus[sess.SessionID] = sess.Status
+		if isActiveStatus(sess.Status) {
+			cp.startRecordingLocked(&sess, hub, 0, 0)
+		}
+	}
+	for _, ev := range st.Events {
+		if _, ok := cp.sessions[ev.SessionID]; !ok {
+			continue
+		}
+		cp.sessionEvents[ev.SessionID] = append(cp.sessionEvents[ev.SessionID], ev)
+	}
+	for sessionID := range cp.sessionEvents {
+		events := cp.sessionEvents[sessionID]
+		sort.SliceStable(events, func(i, j int) bool { return events[i].TsMS < events[j].TsMS })
+	}
+	slog.Info("control plane state restored",
+		"servers", len(st.Servers),
+		"sessions", len(st.Sessions),
+		"events", len(st.Events),
+	)
+	return nil
+}
+
+func (cp *ControlPlane) persistServer(tenantID, serverID string) {
+	if cp.state == nil {
+		return
+	}
+	cp.persistMu.Lock()
+	defer cp.persistMu.Unlock()
+	cp.mu.RLock()
+	srv, ok := cp.servers[serverKey{tenantID, serverID}]
+	var snap Server
+	if ok {
+		snap = *srv
+	}
+	cp.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if err := cp.state.SaveServer(snap); err != nil {
+		slog.Error("persist server failed", "server_id", serverID, "err", err)
+	}
+}
+
+func (cp *ControlPlane) persistSession(sessionID string) {
+	if cp.state == nil {
+		return
+	}
+	cp.persistMu.Lock()
+	defer cp.persistMu.Unlock()
+	cp.mu.RLock()
+	sess, ok := cp.sessions[sessionID]
+	var snap Session
+	if ok {
+		snap = *sess
+	}
+	cp.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if err := cp.state.SaveSession(snap); err != nil {
+		slog.Error("persist session failed", "session_id", sessionID, "err", err)
+	}
+}
+
+func (cp *ControlPlane) persistSessionEvent(sessionID, eventID string) {
+	if cp.state == nil {
+		return
+	}
+	cp.persistMu.Lock()
+	defer cp.persistMu.Unlock()
+	cp.mu.RLock()
+	var (
+		snap  SessionEvent
+		found bool
+	)
+	events := cp.sessionEvents[sessionID]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].EventID == eventID {
+			snap = events[i]
+			found = true
+			break
+		}
+	}
+	cp.mu.RUnlock()
+	if !found {
+		return
+	}
+	if err := cp.state.SaveSessionEvent(snap); err != nil {
+		slog.Error("persist session event failed", "session_id", sessionID, "event_id", eventID, "err", err)
+	}
+}
+
+func (cp *ControlPlane) persistTenantSettings(settings TenantSettings) {
+	if cp.state == nil {
+		return
+	}
+	cp.persistMu.Lock()
+	defer cp.persistMu.Unlock()
+	if err := cp.state.SaveTenantSettings(settings); err != nil {
+		slog.Error("persist tenant settings failed", "tenant_id", settings.TenantID, "err", err)
+	}
+}
+
+func (cp *ControlPlane) forgetSession(sessionID string) {
+	if cp.state == nil {
+		return
+	}
+	cp.persistMu.Lock()
+	defer cp.persistMu.Unlock()
+	if err := cp.state.DeleteSession(sessionID); err != nil {
+		slog.Error("persist session delete failed", "session_id", sessionID, "err", err)
+	}
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateStore_RestoresSessionsAndEventsAfterRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	cp := newTestControlPlane(t, Config{StateDBPath: dbPath})
+
+	conn := &fakeAgentConn{}
+	if err := cp.RegisterOrUpdateServer("t1", AgentRegister{ServerID: "srv", Hostname: "host"}, conn); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	running, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp", ResumeID: "r1"})
+	if err != nil {
+		t.Fatalf("create running session: %v", err)
+	}
+	cp.HandlePTYOut("t1", "srv", running.SessionID, 1, base64.StdEncoding.EncodeToString([]byte("hello")))
+	cp.createApprovalEvent(running.SessionID, "srv", "Do you want to continue? [y/N]", defaultDetectionProfile)
+
+	exited, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp"})
+	if err != nil {
+		t.Fatalf("create exited session: %v", err)
+	}
+	code := 3
+	cp.HandlePTYExit("t1", "srv", exited.SessionID, PTYExit{ExitCode: &code, Reason: "exited"})
+	if err := cp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	cp2 := newTestControlPlane(t, Config{StateDBPath: dbPath})
+
+	servers := cp2.GetServers("t1", nil)
+	if len(servers) != 1 || servers[0].Status != ServerOffline {
+		t.Fatalf("expected one offline server after restart, got %#v", servers)
+	}
+	byID := make(map[string]Session)
+	for _, s := range cp2.GetSessions("t1", nil, "") {
+		byID[s.SessionID] = s
+	}
+	gotRunning, ok := byID[running.SessionID]
+	if !ok {
+		t.Fatal("running session missing after restart")
+	}
+	if gotRunning.Status != SessionRunning || !gotRunning.AwaitingReconcile {
+		t.Fatalf("running session should be restored awaiting reconcile, got %#v", gotRunning)
+	}
+	if gotRunning.ResumeID != "r1" || !gotRunning.AwaitingApproval {
+		t.Fatalf("resume id / approval state not restored: %#v", gotRunning)
+	}
+	gotExited, ok := byID[exited.SessionID]
+	if !ok {
+		t.Fatal("exited session missing after restart")
+	}
+	if gotExited.Status != SessionExited || gotExited.ExitCode == nil || *gotExited.ExitCode != 3 || gotExited.AwaitingReconcile {
+		t.Fatalf("exited session not restored correctly: %#v", gotExited)
+	}
+
+	pending := cp2.GetPendingApprovalEvents("t1", nil)
+	if len(pending) != 1 || pending[0].SessionID != running.SessionID {
+		t.Fatalf("expected pending approval to survive restart, got %#v", pending)
+	}
+
+	transitions, err := cp2.state.(*SQLiteStateStore).SessionTransitions(exited.SessionID)
+	if err != nil {
+		t.Fatalf("load transitions: %v", err)
+	}
+	if len(transitions) != 2 || transitions[0].Status != SessionStarting || transitions[1].Status != SessionExited {
+		t.Fatalf("unexpected transitions: %#v", transitions)
+	}
+}
+
+func TestStateStore_DeleteSessionRemovesRows(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	cp := newTestControlPlane(t, Config{StateDBPath: dbPath})
+
+	conn := &fakeAgentConn{}
+	if err := cp.RegisterOrUpdateServer("t1", AgentRegister{ServerID: "srv"}, conn); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	sess, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	cp.HandlePTYExit("t1", "srv", sess.SessionID, PTYExit{Reason: "exited"})
+	if err := cp.DeleteSession("ui:test", "t1", nil, sess.SessionID); err != nil {
+		t.Fatalf("delete session: %v", err)
+	}
+	_ = cp.Close()
+
+	cp2 := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	if got := cp2.GetSessions("t1", nil, ""); len(got) != 0 {
+		t.Fatalf("deleted session should not be restored, got %#v", got)
+	}
+}
+
+func TestStopAndDeleteSession_RestoredSessionWithoutAgent(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	cp := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	conn := &fakeAgentConn{}
+	if err := cp.RegisterOrUpdateServer("t1", AgentRegister{ServerID: "srv"}, conn); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	sess, err := cp.CreateSession("ui:test", "t1", nil, StartSessionRequest{ServerID: "srv", Cwd: "/tmp"})
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	_ = cp.Close()
+
+	cp2 := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	if err := cp2.StopAndDeleteSession("ui:test", "t1", nil, sess.SessionID, 0, 0); err != nil {
+		t.Fatalf("restored session with offline agent should be deletable: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"cc-control/internal/auth"
+)
+
+// tenantSettingsLocked returns the stored settings of a tenant or the control
+// plane defaults. Callers must hold cp.mu.
+func (cp *ControlPlane) tenantSettingsLocked(tenantID string) TenantSettings {
+	if settings, ok := cp.tenantSettings[tenantID]; ok {
+		return settings
+	}
+	return TenantSettings{
+		TenantID:  tenantID,
+		Recording: cp.cfg.RecordSessions,
+	}
+}
+
+func (cp *ControlPlane) recordingRetentionLocked(tenantID string) time.Duration {
+	if days := cp.tenantSettingsLocked(tenantID).RecordingRetentionDays; days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return cp.cfg.RecordingRetention
+}
+
+func (cp *ControlPlane) GetTenantSettings(tenantID string) TenantSettings {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	return cp.tenantSettingsLocked(tenantID)
+}
+
+// ListTenantSettings returns the explicitly stored settings, sorted by tenant.
+func (cp *ControlPlane) ListTenantSettings() []TenantSettings {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	out := make([]TenantSettings, 0, len(cp.tenantSettings))
+	for _, settings := range cp.tenantSettings {
+		out = append(out, settings)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].TenantID < out[j].TenantID })
+	return out
+}
+
+// SetTenantSettings replaces a tenant's settings. Recording changes apply to
+// sessions started afterwards.
+func (cp *ControlPlane) SetTenantSettings(actor string, settings TenantSettings) (TenantSettings, error) {
+	return cp.setTenantSettings(actor, nil, settings)
+}
+
+// SetTenantSettingsAs replaces a tenant's settings on behalf of an API
+// caller, recording the caller's token and address with the audit event.
+func (cp *ControlPlane) SetTenantSettingsAs(actor auth.Actor, settings TenantSettings) (TenantSettings, error) {
+	return cp.setTenantSettings(actor.String(), actor.AuditMeta(), settings)
+}
+
+func (cp *ControlPlane) setTenantSettings(actor string, meta map[string]any, settings TenantSettings) (TenantSettings, error) {
+	if settings.RecordingRetentionDays < 0 {
+		settings.RecordingRetentionDays = 0
+	}
+	if err := normalizeApprovalSettings(&settings); err != nil {
+		return TenantSettings{}, err
+	}
+	settings.UpdatedAtMS = time.Now().UnixMilli()
+	cp.mu.Lock()
+	cp.tenantSettings[settings.TenantID] = settings
+	cp.mu.Unlock()
+	cp.persistTenantSettings(settings)
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	meta["recording"] = settings.Recording
+	meta["record_input"] = settings.RecordInput
+	meta["recording_retention_days"] = settings.RecordingRetentionDays
+	meta["approval_reminder_sec"] = settings.ApprovalReminderSec
+	meta["approval_escalate_after"] = settings.ApprovalEscalateAfterSec
+	meta["approval_escalate_role"] = settings.ApprovalEscalateRole
+	meta["approval_deadline_sec"] = settings.ApprovalDeadlineSec
+	meta["approval_deadline_action"] = settings.ApprovalDeadlineAction
+	cp.audit.Log(AuditEvent{
+		TenantID: settings.TenantID,
+		Actor:    actor,
+		Kind:     "tenant_settings_updated",
+		Meta:     meta,
+	})
+	return settings, nil
+}
+
+// normalizeApprovalSettings validates the approval timers and fills in the
+// escalation role and deadline action defaults.
+func normalizeApprovalSettings(s *TenantSettings) error {
+	for _, v := range []*int{&s.ApprovalReminderSec, &s.ApprovalEscalateAfterSec, &s.ApprovalDeadlineSec} {
+		if *v < 0 {
+			*v = 0
+		}
+	}
+	if s.ApprovalEscalateRole == "" && s.ApprovalEscalateAfterSec > 0 {
+		s.ApprovalEscalateRole = string(auth.RoleOwner)
+	}
+	if s.ApprovalEscalateRole != "" {
+		if _, ok := auth.ParseRole(s.ApprovalEscalateRole); !ok {
+			return errors.New("invalid approval_escalate_role")
+		}
+	}
+	switch s.ApprovalDeadlineAction {
+	case "":
+		if s.ApprovalDeadlineSec > 0 {
+			s.ApprovalDeadlineAction = "reject"
+		}
+	case "reject", "approve", "stop":
+	default:
+		return errors.New("invalid approval_deadline_action")
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package core
+
+import "cc-control/internal/auth"
+
+// serverInScopeLocked reports whether scope admits the tenant's serverID,
+// judged by the tags the server last registered with. Callers must hold cp.mu.
+func (cp *ControlPlane) serverInScopeLocked(scope *auth.Scope, tenantID, serverID string) bool {
+	if scope == nil {
+		return true
+	}
+	var tags []string
+	if srv := cp.servers[serverKey{tenantID, serverID}]; srv != nil {
+		tags = srv.Tags
+	}
+	return scope.AllowsServer(serverID, tags)
+}
+
+// sessionVisibleLocked reports whether a caller limited to tenantID (empty
+// for admins) and scope may see or drive sess. Callers must hold cp.mu.
+func (cp *ControlPlane) sessionVisibleLocked(sess *Session, tenantID string, scope *auth.Scope) bool {
+	if tenantID != "" && sess.TenantID != tenantID {
+		return false
+	}
+	return cp.serverInScopeLocked(scope, sess.TenantID, sess.ServerID) && scope.AllowsCwd(sess.Cwd)
+}
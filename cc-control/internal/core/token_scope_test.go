@@ -0,0 +1,67 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"cc-control/internal/auth"
+)
+
+func TestTokenScope_LimitsServersSessionsAndFanout(t *testing.T) {
+	cp, _, _, _ := setupActionTestControlPlane(t, "Do you want to proceed?")
+	cp.mu.Lock()
+	cp.servers[serverKey{"t1", "sbx"}] = &Server{TenantID: "t1", ServerID: "sbx", Tags: []string{"linux", "sandbox"}, Status: ServerOnline, LastSeenMS: time.Now().UnixMilli()}
+	cp.agentConns[serverKey{"t1", "sbx"}] = &fakeAgentConn{}
+	cp.sessions["s2"] = &Session{TenantID: "t1", SessionID: "s2", ServerID: "sbx", Cwd: "/work/app", Status: SessionRunning}
+	cp.sessions["s3"] = &Session{TenantID: "t1", SessionID: "s3", ServerID: "sbx", Cwd: "/etc", Status: SessionRunning}
+	cp.mu.Unlock()
+	scope := &auth.Scope{ServerTags: []string{"sandbox"}, CwdPrefixes: []string{"/work"}}
+
+	if servers := cp.GetServers("t1", scope); len(servers) != 1 || servers[0].ServerID != "sbx" {
+		t.Fatalf("scoped token should only see the sandbox server, got %#v", servers)
+	}
+	if sessions := cp.GetSessions("t1", scope, ""); len(sessions) != 1 || sessions[0].SessionID != "s2" {
+		t.Fatalf("scoped token should only see sessions under /work on sandbox hosts, got %#v", sessions)
+	}
+	if pending := cp.GetPendingApprovalEvents("t1", scope); len(pending) != 0 {
+		t.Fatalf("approval on an out-of-scope server leaked: %#v", pending)
+	}
+	if err := cp.HandleClientAction("ui:contractor", "t1", scope, "s1", ActionRequest{Kind: "approve"}); err == nil {
+		t.Fatal("action on an out-of-scope session should fail")
+	}
+	if err := cp.HandleClientTermIn("ui:contractor", "t1", scope, "s3", "eQ=="); err == nil {
+		t.Fatal("input to a session outside the cwd prefixes should fail")
+	}
+
+	if _, err := cp.CreateSession("ui:contractor", "t1", scope, StartSessionRequest{ServerID: "srv", Cwd: "/work"}); err == nil {
+		t.Fatal("creating a session on an untagged server should fail")
+	}
+	if _, err := cp.CreateSession("ui:contractor", "t1", scope, StartSessionRequest{ServerID: "sbx", Cwd: "/workspace"}); err == nil {
+		t.Fatal("a cwd sharing only a string prefix should not match")
+	}
+	if _, err := cp.CreateSession("ui:contractor", "t1", scope, StartSessionRequest{ServerID: "sbx", Cwd: "/work/app/sub"}); err != nil {
+		t.Fatalf("create in scope: %v", err)
+	}
+
+	sub := &Subscriber{ID: "c", Actor: "ui:contractor", Send: make(chan Envelope, 8), TenantID: "t1", TokenScope: scope, Role: auth.RoleOperator}
+	cp.RegisterSubscriber(sub)
+	if _, err := cp.AttachSubscriber(sub, "s1", 0); err == nil {
+		t.Fatal("attach to an out-of-scope session should fail")
+	}
+	if err := cp.SetSubscription(sub, ScopeServer, "srv"); err == nil {
+		t.Fatal("subscribing to an out-of-scope server should fail")
+	}
+	cp.broadcastSessionUpdate("s1")
+	cp.broadcastSessionUpdate("s2")
+	select {
+	case msg := <-sub.Send:
+		if msg.SessionID != "s2" {
+			t.Fatalf("scoped subscriber got an update for %s", msg.SessionID)
+		}
+	default:
+		t.Fatal("scoped subscriber should get updates for in-scope sessions")
+	}
+	if len(sub.Send) != 0 {
+		t.Fatalf("unexpected extra fanout: %#v", <-sub.Send)
+	}
+}
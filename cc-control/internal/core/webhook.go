@@ -0,0 +1,545 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook event types.
+const (
+	WebhookApprovalNeeded = "approval_needed"
+	WebhookSessionUpdate  = "session_update"
+	WebhookServer         = "server"
+)
+
+const (
+	webhookWorkers          = 4
+	webhookQueueSize        = 1024
+	webhookTimeout          = 10 * time.Second
+	maxDeliveriesPerWebhook = 100
+)
+
+// Webhook is a tenant endpoint that receives event notifications as signed
+// JSON POSTs.
+type Webhook struct {
+	WebhookID string `json:"webhook_id"`
+	TenantID  string `json:"tenant_id"`
+	URL       string `json:"url"`
+	// Secret is the HMAC-SHA256 key of the X-CC-Signature header. It is
+	// generated when left empty and only returned on creation.
+	Secret string `json:"secret,omitempty"`
+	// Events lists the event types to deliver; empty means all of them.
+	Events      []string `json:"events,omitempty"`
+	Enabled     bool     `json:"enabled"`
+	CreatedBy   string   `json:"created_by,omitempty"`
+	CreatedAtMS int64    `json:"created_at_ms"`
+	UpdatedAtMS int64    `json:"updated_at_ms"`
+}
+
+// WebhookPayload is the body of every delivery.
+type WebhookPayload struct {
+	DeliveryID string `json:"delivery_id"`
+	Event      string `json:"event"`
+	TenantID   string `json:"tenant_id"`
+	TsMS       int64  `json:"ts_ms"`
+	Data       any    `json:"data"`
+}
+
+// WebhookDelivery records one delivery attempt. Retries of the same event
+// share the DeliveryID.
+type WebhookDelivery struct {
+	DeliveryID string `json:"delivery_id"`
+	WebhookID  string `json:"webhook_id"`
+	TenantID   string `json:"tenant_id"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Success    bool   `json:"success"`
+	DurationMS int64  `json:"duration_ms"`
+	TsMS       int64  `json:"ts_ms"`
+}
+
+// approvalWebhookData is the approval_needed payload: the event plus signed
+// callback actions for one-click answers.
+type approvalWebhookData struct {
+	SessionEvent
+	Actions []CallbackAction `json:"actions"`
+}
+
+type webhookJob struct {
+	hook       Webhook
+	deliveryID string
+	event      string
+	body       []byte
+	attempt    int
+}
+
+// webhookDispatcher queues deliveries for a small worker pool and keeps the
+// recent delivery log of each webhook.
+type webhookDispatcher struct {
+	client *http.Client
+	// backoff is the wait before each retry; a delivery is tried
+	// len(backoff)+1 times.
+	backoff []time.Duration
+	queue   chan webhookJob
+	// allowPrivate lets deliveries reach loopback and private addresses.
+	allowPrivate bool
+
+	mu         sync.Mutex
+	deliveries map[string][]WebhookDelivery
+	// lastStatus remembers the session status last sent, so only status
+	// changes become session_update deliveries.
+	lastStatus map[string]SessionStatus
+}
+
+func newWebhookDispatcher(allowPrivate bool) *webhookDispatcher {
+	d := &webhookDispatcher{
+		backoff:      []time.Duration{time.Second, 5 * time.Second, 30 * time.Second, 2 * time.Minute},
+		queue:        make(chan webhookJob, webhookQueueSize),
+		allowPrivate: allowPrivate,
+		deliveries:   make(map[string][]WebhookDelivery),
+		lastStatus:   make(map[string]SessionStatus),
+	}
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: d.dialControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client = &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: transport,
+		// A redirect could bounce a public url to an internal one.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// dialControl runs on the resolved address of every connection, so tenant
+// webhooks cannot reach cc-control's own network through a DNS name.
+func (d *webhookDispatcher) dialControl(_, address string, _ syscall.RawConn) error {
+	if d.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("webhook address %s is not allowed", host)
+	}
+	return nil
+}
+
+// SignWebhook returns the X-CC-Signature value of a delivery: the hex
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret.
+func SignWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validateWebhook(h Webhook) error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook url must be an absolute http(s) url")
+	}
+	for _, ev := range h.Events {
+		switch ev {
+		case WebhookApprovalNeeded, WebhookSessionUpdate, WebhookServer:
+		default:
+			return fmt.Errorf("unknown webhook event %q", ev)
+		}
+	}
+	return nil
+}
+
+func (h Webhook) wants(event string) bool {
+	if !h.Enabled {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, ev := range h.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (h Webhook) redacted() Webhook {
+	h.Secret = ""
+	return h
+}
+
+func newWebhookSecret() string {
+	buf := make([]byte, 32)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (cp *ControlPlane) ListWebhooks(tenantID string) []Webhook {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	out := make([]Webhook, 0)
+	for _, h := range cp.webhooks {
+		if h.TenantID == tenantID {
+			out = append(out, h.redacted())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CreatedAtMS != out[j].CreatedAtMS {
+			return out[i].CreatedAtMS < out[j].CreatedAtMS
+		}
+		return out[i].WebhookID < out[j].WebhookID
+	})
+	return out
+}
+
+func (cp *ControlPlane) GetWebhook(tenantID, webhookID string) (Webhook, error) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	h, ok := cp.webhooks[webhookID]
+	if !ok || h.TenantID != tenantID {
+		return Webhook{}, errors.New("webhook not found")
+	}
+	return h.redacted(), nil
+}
+
+// CreateWebhook registers an endpoint. The returned webhook carries the
+// secret; later reads do not.
+func (cp *ControlPlane) CreateWebhook(actor, tenantID string, h Webhook) (Webhook, error) {
+	if err := validateWebhook(h); err != nil {
+		return Webhook{}, err
+	}
+	now := time.Now().UnixMilli()
+	h.WebhookID = uuid.NewString()
+	h.TenantID = tenantID
+	if h.Secret == "" {
+		h.Secret = newWebhookSecret()
+	}
+	h.CreatedBy = actor
+	h.CreatedAtMS = now
+	h.UpdatedAtMS = now
+	cp.mu.Lock()
+	cp.webhooks[h.WebhookID] = h
+	cp.mu.Unlock()
+	cp.persistWebhook(h)
+	cp.auditWebhook(actor, "webhook_created", h)
+	return h, nil
+}
+
+// UpdateWebhook replaces url, events and enabled; an empty secret keeps the
+// current one.
+func (cp *ControlPlane) UpdateWebhook(actor, tenantID, webhookID string, h Webhook) (Webhook, error) {
+	if err := validateWebhook(h); err != nil {
+		return Webhook{}, err
+	}
+	cp.mu.Lock()
+	cur, ok := cp.webhooks[webhookID]
+	if !ok || cur.TenantID != tenantID {
+		cp.mu.Unlock()
+		return Webhook{}, errors.New("webhook not found")
+	}
+	h.WebhookID = cur.WebhookID
+	h.TenantID = cur.TenantID
+	if h.Secret == "" {
+		h.Secret = cur.Secret
+	}
+	h.CreatedBy = cur.CreatedBy
+	h.CreatedAtMS = cur.CreatedAtMS
+	h.UpdatedAtMS = time.Now().UnixMilli()
+	cp.webhooks[webhookID] = h
+	cp.mu.Unlock()
+	cp.persistWebhook(h)
+	cp.auditWebhook(actor, "webhook_updated", h)
+	return h.redacted(), nil
+}
+
+func (cp *ControlPlane) DeleteWebhook(actor, tenantID, webhookID string) error {
+	cp.mu.Lock()
+	cur, ok := cp.webhooks[webhookID]
+	if !ok || cur.TenantID != tenantID {
+		cp.mu.Unlock()
+		return errors.New("webhook not found")
+	}
+	delete(cp.webhooks, webhookID)
+	cp.mu.Unlock()
+	cp.hooks.mu.Lock()
+	delete(cp.hooks.deliveries, webhookID)
+	cp.hooks.mu.Unlock()
+	if cp.state != nil {
+		cp.persistMu.Lock()
+		if err := cp.state.DeleteWebhook(webhookID); err != nil {
+			slog.Error("persist webhook delete failed", "webhook_id", webhookID, "err", err)
+		}
+		cp.persistMu.Unlock()
+	}
+	cp.auditWebhook(actor, "webhook_deleted", cur)
+	return nil
+}
+
+// ListWebhookDeliveries returns the recent delivery attempts of a webhook,
+// newest first.
+func (cp *ControlPlane) ListWebhookDeliveries(tenantID, webhookID string) ([]WebhookDelivery, error) {
+	if _, err := cp.GetWebhook(tenantID, webhookID); err != nil {
+		return nil, err
+	}
+	cp.hooks.mu.Lock()
+	defer cp.hooks.mu.Unlock()
+	entries := cp.hooks.deliveries[webhookID]
+	out := make([]WebhookDelivery, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		out = append(out, entries[i])
+	}
+	return out, nil
+}
+
+// emitWebhook queues event for every enabled tenant webhook subscribed to
+// it. A full queue drops the delivery and logs it as failed.
+func (cp *ControlPlane) emitWebhook(tenantID, event string, data any) {
+	cp.emitWebhookFor(tenantID, event, func(Webhook) any { return data })
+}
+
+// emitWebhookFor is emitWebhook with a payload built per webhook.
+func (cp *ControlPlane) emitWebhookFor(tenantID, event string, dataFor func(Webhook) any) {
+	cp.mu.RLock()
+	var hooks []Webhook
+	for _, h := range cp.webhooks {
+		if h.TenantID == tenantID && h.wants(event) {
+			hooks = append(hooks, h)
+		}
+	}
+	cp.mu.RUnlock()
+	now := time.Now().UnixMilli()
+	for _, h := range hooks {
+		job := webhookJob{hook: h, deliveryID: uuid.NewString(), event: event, attempt: 1}
+		body, err := json.Marshal(WebhookPayload{
+			DeliveryID: job.deliveryID,
+			Event:      event,
+			TenantID:   tenantID,
+			TsMS:       now,
+			Data:       dataFor(h),
+		})
+		if err != nil {
+			slog.Error("marshal webhook payload failed", "event", event, "err", err)
+			continue
+		}
+		job.body = body
+		cp.enqueueWebhook(job)
+	}
+}
+
+func (cp *ControlPlane) enqueueWebhook(job webhookJob) {
+	select {
+	case cp.hooks.queue <- job:
+	default:
+		cp.recordDelivery(WebhookDelivery{
+			DeliveryID: job.deliveryID,
+			WebhookID:  job.hook.WebhookID,
+			TenantID:   job.hook.TenantID,
+			Event:      job.event,
+			Attempt:    job.attempt,
+			Error:      "delivery queue full",
+			TsMS:       time.Now().UnixMilli(),
+		})
+	}
+}
+
+// emitSessionWebhook sends session_update when a session reaches running,
+// exited or error for the first time.
+func (cp *ControlPlane) emitSessionWebhook(sess Session) {
+	switch sess.Status {
+	case SessionRunning, SessionExited, SessionError:
+	default:
+		return
+	}
+	cp.hooks.mu.Lock()
+	if cp.hooks.lastStatus[sess.SessionID] == sess.Status {
+		cp.hooks.mu.Unlock()
+		return
+	}
+	cp.hooks.lastStatus[sess.SessionID] = sess.Status
+	cp.hooks.mu.Unlock()
+	cp.emitWebhook(sess.TenantID, WebhookSessionUpdate, map[string]any{
+		"session_id":  sess.SessionID,
+		"server_id":   sess.ServerID,
+		"runtime":     sess.Runtime,
+		"cwd":         sess.Cwd,
+		"status":      sess.Status,
+		"exit_code":   sess.ExitCode,
+		"exit_reason": sess.ExitReason,
+		"created_by":  sess.CreatedBy,
+	})
+}
+
+func (cp *ControlPlane) emitServerWebhook(tenantID, serverID string) {
+	cp.mu.RLock()
+	srv, ok := cp.servers[serverKey{tenantID, serverID}]
+	if !ok {
+		cp.mu.RUnlock()
+		return
+	}
+	data := map[string]any{
+		"server_id": srv.ServerID,
+		"hostname":  srv.Hostname,
+		"status":    srv.Status,
+		"tags":      srv.Tags,
+	}
+	cp.mu.RUnlock()
+	cp.emitWebhook(tenantID, WebhookServer, data)
+}
+
+func (cp *ControlPlane) forgetSessionWebhook(sessionID string) {
+	cp.hooks.mu.Lock()
+	delete(cp.hooks.lastStatus, sessionID)
+	cp.hooks.mu.Unlock()
+}
+
+func (cp *ControlPlane) runWebhookWorker() {
+	for {
+		select {
+		case <-cp.stop:
+			return
+		case job := <-cp.hooks.queue:
+			cp.deliverWebhook(job)
+		}
+	}
+}
+
+// deliverWebhook makes one attempt of a job. Network errors, 5xx, 408 and
+// 429 re-queue it after the backoff from a timer, so a dead endpoint never
+// holds a worker. Retries stop once the webhook is deleted or disabled.
+func (cp *ControlPlane) deliverWebhook(job webhookJob) {
+	if job.attempt > 1 {
+		cp.mu.RLock()
+		h, ok := cp.webhooks[job.hook.WebhookID]
+		cp.mu.RUnlock()
+		if !ok || !h.Enabled {
+			return
+		}
+		job.hook = h
+	}
+	d := cp.postWebhook(job, job.attempt)
+	cp.recordDelivery(d)
+	retryable := d.StatusCode == 0 || d.StatusCode >= 500 || d.StatusCode == http.StatusRequestTimeout || d.StatusCode == http.StatusTooManyRequests
+	if d.Success || !retryable || job.attempt > len(cp.hooks.backoff) {
+		return
+	}
+	wait := cp.hooks.backoff[job.attempt-1]
+	job.attempt++
+	time.AfterFunc(wait, func() {
+		select {
+		case <-cp.stop:
+		default:
+			cp.enqueueWebhook(job)
+		}
+	})
+}
+
+func (cp *ControlPlane) postWebhook(job webhookJob, attempt int) WebhookDelivery {
+	start := time.Now()
+	d := WebhookDelivery{
+		DeliveryID: job.deliveryID,
+		WebhookID:  job.hook.WebhookID,
+		TenantID:   job.hook.TenantID,
+		Event:      job.event,
+		Attempt:    attempt,
+		TsMS:       start.UnixMilli(),
+	}
+	req, err := http.NewRequest(http.MethodPost, job.hook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	ts := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cc-control-webhook")
+	req.Header.Set("X-CC-Event", job.event)
+	req.Header.Set("X-CC-Delivery", job.deliveryID)
+	req.Header.Set("X-CC-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-CC-Signature", SignWebhook(job.hook.Secret, ts, job.body))
+	resp, err := cp.hooks.client.Do(req)
+	d.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	_ = resp.Body.Close()
+	d.StatusCode = resp.StatusCode
+	d.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !d.Success {
+		d.Error = resp.Status
+	}
+	return d
+}
+
+func (cp *ControlPlane) recordDelivery(d WebhookDelivery) {
+	cp.hooks.mu.Lock()
+	entries := append(cp.hooks.deliveries[d.WebhookID], d)
+	if len(entries) > maxDeliveriesPerWebhook {
+		entries = entries[len(entries)-maxDeliveriesPerWebhook:]
+	}
+	cp.hooks.deliveries[d.WebhookID] = entries
+	cp.hooks.mu.Unlock()
+	if !d.Success {
+		slog.Warn("webhook delivery failed", "webhook_id", d.WebhookID, "event", d.Event, "attempt", d.Attempt, "err", d.Error)
+	}
+	if cp.state == nil {
+		return
+	}
+	cp.persistMu.Lock()
+	defer cp.persistMu.Unlock()
+	if err := cp.state.SaveWebhookDelivery(d, maxDeliveriesPerWebhook); err != nil {
+		slog.Error("persist webhook delivery failed", "webhook_id", d.WebhookID, "err", err)
+	}
+}
+
+func (cp *ControlPlane) persistWebhook(h Webhook) {
+	if cp.state == nil {
+		return
+	}
+	cp.persistMu.Lock()
+	defer cp.persistMu.Unlock()
+	if err := cp.state.SaveWebhook(h); err != nil {
+		slog.Error("persist webhook failed", "webhook_id", h.WebhookID, "err", err)
+	}
+}
+
+func (cp *ControlPlane) auditWebhook(actor, kind string, h Webhook) {
+	cp.audit.Log(AuditEvent{
+		TenantID: h.TenantID,
+		Actor:    actor,
+		Kind:     kind,
+		Meta: map[string]any{
+			"webhook_id": h.WebhookID,
+			"url":        h.URL,
+			"events":     h.Events,
+			"enabled":    h.Enabled,
+		},
+	})
+}
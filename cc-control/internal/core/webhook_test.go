@@ -0,0 +1,294 @@
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver answers with statuses in order, then 200. It listens on
+// loopback, so cp is allowed to deliver there.
+func webhookReceiver(t *testing.T, cp *ControlPlane, statuses ...int) (*httptest.Server, chan webhookRequest) {
+	t.Helper()
+	cp.hooks.allowPrivate = true
+	got := make(chan webhookRequest, 16)
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- webhookRequest{header: r.Header.Clone(), body: body}
+		n := int(atomic.AddInt32(&calls, 1))
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func nextWebhook(t *testing.T, got chan webhookRequest) webhookRequest {
+	t.Helper()
+	select {
+	case req := <-got:
+		return req
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for webhook delivery")
+		return webhookRequest{}
+	}
+}
+
+func waitForDeliveries(t *testing.T, cp *ControlPlane, webhookID string, n int) []WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		deliveries, err := cp.ListWebhookDeliveries("t1", webhookID)
+		if err != nil {
+			t.Fatalf("list deliveries: %v", err)
+		}
+		if len(deliveries) >= n {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d deliveries, got %#v", n, deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhook_ApprovalNeededIsSigned(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	srv, got := webhookReceiver(t, cp)
+	hook, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: srv.URL, Events: []string{WebhookApprovalNeeded}, Enabled: true})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	if hook.Secret == "" {
+		t.Fatal("create should return a generated secret")
+	}
+
+	cp.createApprovalEvent("s1", "srv", "Do you want to continue? [y/N]", defaultDetectionProfile)
+	req := nextWebhook(t, got)
+	ts, _ := strconv.ParseInt(req.header.Get("X-CC-Timestamp"), 10, 64)
+	if sig := req.header.Get("X-CC-Signature"); sig != SignWebhook(hook.Secret, ts, req.body) {
+		t.Fatalf("bad signature %q", sig)
+	}
+	var payload struct {
+		Event    string              `json:"event"`
+		TenantID string              `json:"tenant_id"`
+		Data     approvalWebhookData `json:"data"`
+	}
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if payload.Event != WebhookApprovalNeeded || payload.TenantID != "t1" || payload.Data.SessionID != "s1" {
+		t.Fatalf("unexpected payload: %s", req.body)
+	}
+	if len(payload.Data.Actions) != 2 || payload.Data.Actions[0].Kind != "approve" || payload.Data.Actions[0].Token == "" {
+		t.Fatalf("approval payload should carry callback actions: %s", req.body)
+	}
+	deliveries := waitForDeliveries(t, cp, hook.WebhookID, 1)
+	if !deliveries[0].Success || deliveries[0].StatusCode != http.StatusOK {
+		t.Fatalf("delivery not logged as success: %#v", deliveries[0])
+	}
+	if listed := cp.ListWebhooks("t1"); len(listed) != 1 || listed[0].Secret != "" {
+		t.Fatalf("list should redact secrets: %#v", listed)
+	}
+}
+
+func TestWebhook_RetriesServerErrors(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	cp.hooks.backoff = []time.Duration{time.Millisecond, time.Millisecond}
+	srv, got := webhookReceiver(t, cp, http.StatusBadGateway, http.StatusServiceUnavailable)
+	hook, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: srv.URL, Enabled: true})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	cp.emitServerWebhook("t1", "srv")
+	first := nextWebhook(t, got)
+	nextWebhook(t, got)
+	last := nextWebhook(t, got)
+	if first.header.Get("X-CC-Delivery") != last.header.Get("X-CC-Delivery") {
+		t.Fatal("retries should keep the delivery id")
+	}
+	deliveries := waitForDeliveries(t, cp, hook.WebhookID, 3)
+	if !deliveries[0].Success || deliveries[0].Attempt != 3 || deliveries[2].StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected delivery log: %#v", deliveries)
+	}
+}
+
+func TestWebhook_DoesNotRetryClientErrors(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	cp.hooks.backoff = []time.Duration{time.Millisecond}
+	srv, got := webhookReceiver(t, cp, http.StatusGone)
+	hook, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: srv.URL, Enabled: true})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	cp.emitServerWebhook("t1", "srv")
+	nextWebhook(t, got)
+	deliveries := waitForDeliveries(t, cp, hook.WebhookID, 1)
+	time.Sleep(50 * time.Millisecond)
+	if deliveries, _ = cp.ListWebhookDeliveries("t1", hook.WebhookID); len(deliveries) != 1 || deliveries[0].Success {
+		t.Fatalf("410 should not be retried: %#v", deliveries)
+	}
+}
+
+func TestWebhook_SessionUpdateOnlyOnStatusChange(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	addTestSession(cp, Session{TenantID: "t1", SessionID: "s1", ServerID: "srv", Cwd: "/repo", Runtime: "claude"})
+	srv, got := webhookReceiver(t, cp)
+	if _, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: srv.URL, Events: []string{WebhookSessionUpdate}, Enabled: true}); err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	cp.broadcastSessionUpdate("s1")
+	cp.broadcastSessionUpdate("s1")
+	cp.emitServerWebhook("t1", "srv")
+	code := 0
+	cp.HandlePTYExit("t1", "srv", "s1", PTYExit{ExitCode: &code, Reason: "exited"})
+
+	var statuses []SessionStatus
+	for i := 0; i < 2; i++ {
+		var payload struct {
+			Data struct {
+				Status SessionStatus `json:"status"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(nextWebhook(t, got).body, &payload); err != nil {
+			t.Fatalf("decode payload: %v", err)
+		}
+		statuses = append(statuses, payload.Data.Status)
+	}
+	if statuses[0] != SessionRunning || statuses[1] != SessionExited {
+		t.Fatalf("unexpected statuses %v", statuses)
+	}
+	select {
+	case extra := <-got:
+		t.Fatalf("unexpected extra delivery: %s", extra.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhook_ValidatesAndPersists(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	cp := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	if _, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: "ftp://example.com"}); err == nil {
+		t.Fatal("expected url validation error")
+	}
+	if _, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: "https://example.com/hook", Events: []string{"everything"}}); err == nil {
+		t.Fatal("expected event validation error")
+	}
+	hook, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: "https://example.com/hook", Secret: "s3cret", Enabled: true})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	cp.recordDelivery(WebhookDelivery{DeliveryID: "d1", WebhookID: hook.WebhookID, TenantID: "t1", Event: WebhookServer, Attempt: 1, Success: true})
+	_ = cp.Close()
+
+	cp2 := newTestControlPlane(t, Config{StateDBPath: dbPath})
+	if _, err := cp2.GetWebhook("t2", hook.WebhookID); err == nil {
+		t.Fatal("webhook must not be visible to other tenants")
+	}
+	cp2.mu.RLock()
+	restored := cp2.webhooks[hook.WebhookID]
+	cp2.mu.RUnlock()
+	if restored.Secret != "s3cret" || restored.URL != "https://example.com/hook" {
+		t.Fatalf("webhook not restored: %#v", restored)
+	}
+	if deliveries, _ := cp2.ListWebhookDeliveries("t1", hook.WebhookID); len(deliveries) != 1 || deliveries[0].DeliveryID != "d1" {
+		t.Fatalf("delivery log not restored: %#v", deliveries)
+	}
+}
+
+func TestWebhook_RefusesInternalAddresses(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	srv, got := webhookReceiver(t, cp)
+	cp.hooks.allowPrivate = false
+	hook, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: srv.URL, Enabled: true})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	cp.emitServerWebhook("t1", "srv")
+	deliveries := waitForDeliveries(t, cp, hook.WebhookID, 1)
+	if deliveries[0].Success || !strings.Contains(deliveries[0].Error, "not allowed") {
+		t.Fatalf("loopback delivery should be refused: %#v", deliveries[0])
+	}
+	select {
+	case <-got:
+		t.Fatal("receiver on loopback must not be reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhook_DoesNotFollowRedirects(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	addTestServer(t, cp, "t1", AgentRegister{ServerID: "srv", Tags: []string{"dev"}})
+	target, got := webhookReceiver(t, cp)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+	hook, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: redirect.URL, Enabled: true})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	cp.emitServerWebhook("t1", "srv")
+	deliveries := waitForDeliveries(t, cp, hook.WebhookID, 1)
+	if deliveries[0].Success || deliveries[0].StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("redirect should be reported, not followed: %#v", deliveries[0])
+	}
+	select {
+	case <-got:
+		t.Fatal("redirect target must not be reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhook_RetryBackoffDoesNotHoldWorkers(t *testing.T) {
+	cp := newTestControlPlane(t, Config{})
+	cp.hooks.backoff = []time.Duration{time.Hour}
+	statuses := make([]int, 2*webhookWorkers)
+	for i := range statuses {
+		statuses[i] = http.StatusBadGateway
+	}
+	dead, deadGot := webhookReceiver(t, cp, statuses...)
+	live, liveGot := webhookReceiver(t, cp)
+	if _, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: dead.URL, Events: []string{WebhookServer}, Enabled: true}); err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	if _, err := cp.CreateWebhook("ui:test", "t1", Webhook{URL: live.URL, Events: []string{WebhookSessionUpdate}, Enabled: true}); err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	for i := 0; i < webhookWorkers+1; i++ {
+		cp.emitWebhook("t1", WebhookServer, map[string]any{"n": i})
+	}
+	for i := 0; i < webhookWorkers+1; i++ {
+		nextWebhook(t, deadGot)
+	}
+	cp.emitWebhook("t1", WebhookSessionUpdate, map[string]any{"status": "running"})
+	nextWebhook(t, liveGot)
+}
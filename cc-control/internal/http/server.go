@@ -1,11 +1,18 @@
 package httpapi
 
 import (
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"io"
+	"log/slog"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"cc-control/internal/auth"
 	"cc-control/internal/core"
@@ -19,6 +26,17 @@ type Server struct {
 	Tokens      *auth.Store
 	UIDir       string
 	CheckOrigin bool
+	// MetricsToken enables /metrics on the main listener, guarded by this
+	// bearer token. A dedicated listener uses MetricsHandler instead.
+	MetricsToken string
+	// TokenRotateOverlap is how long a rotated token keeps working when the
+	// rotate request does not say.
+	TokenRotateOverlap time.Duration
+	// DeniedCerts lists revoked agent client certificates (optional).
+	DeniedCerts *auth.CertDenyList
+	// TrustedProxies may set X-Forwarded-For / X-Real-IP; their requests
+	// are attributed to the forwarded client in audit, usage and rate limits.
+	TrustedProxies auth.TrustedProxies
 }
 
 func (s *Server) Router() http.Handler {
@@ -35,9 +53,10 @@ func (s *Server) Router() http.Handler {
 	}
 
 	mux.Handle("/ws/agent", &wshandler.AgentHandler{
-		CP:       s.CP,
-		Upgrader: upgrader,
-		Tokens:   s.Tokens,
+		CP:          s.CP,
+		Upgrader:    upgrader,
+		Tokens:      s.Tokens,
+		DeniedCerts: s.DeniedCerts,
 	})
 	mux.Handle("/ws/client", &wshandler.ClientHandler{
 		CP:       s.CP,
@@ -46,19 +65,39 @@ func (s *Server) Router() http.Handler {
 	})
 
 	mux.HandleFunc("/api/servers", s.withUIAuth(s.handleServers))
+	mux.HandleFunc("/api/servers/", s.withUIAuth(s.handleServerSubroutes))
 	mux.HandleFunc("/api/sessions", s.withUIAuth(s.handleSessions))
 	mux.HandleFunc("/api/sessions/", s.withUIAuth(s.handleSessionSubroutes))
+	mux.HandleFunc("/api/policies", s.withUIAuth(s.handlePolicies))
+	mux.HandleFunc("/api/policies/", s.withUIAuth(s.handlePolicySubroutes))
+	mux.HandleFunc("/api/webhooks", s.withUIAuth(s.handleWebhooks))
+	mux.HandleFunc("/api/webhooks/", s.withUIAuth(s.handleWebhookSubroutes))
+	mux.HandleFunc("/api/audit", s.withUIAuth(s.handleAudit))
+	mux.HandleFunc("/api/join-codes", s.withUIAuth(s.handleJoinCodes))
+	// Callback tokens carry their own signature, so no bearer token here.
+	mux.HandleFunc("/api/callbacks/approval", s.handleApprovalCallback)
+	// The join code in the body is the credential.
+	mux.HandleFunc("/api/enroll", s.handleEnroll)
 	mux.HandleFunc("/admin/verify", s.withAdminAuth(s.handleAdminVerify))
 	mux.HandleFunc("/admin/tokens", s.withAdminAuth(s.handleAdminTokens))
 	mux.HandleFunc("/admin/tokens/", s.withAdminAuth(s.handleAdminTokenSubroutes))
 	mux.HandleFunc("/admin/servers", s.withAdminAuth(s.handleAdminServers))
 	mux.HandleFunc("/admin/sessions", s.withAdminAuth(s.handleAdminSessions))
 	mux.HandleFunc("/admin/sessions/", s.withAdminAuth(s.handleAdminSessionSubroutes))
+	mux.HandleFunc("/admin/tenants", s.withAdminAuth(s.handleAdminTenants))
+	mux.HandleFunc("/admin/audit", s.withAdminAuth(s.handleAdminAudit))
+	mux.HandleFunc("/admin/tenants/", s.withAdminAuth(s.handleAdminTenantSubroutes))
 	mux.HandleFunc("/tenant/verify", s.withTenantAuth(s.handleTenantVerify))
 	mux.HandleFunc("/tenant/tokens", s.withTenantAuth(s.handleTenantTokens))
+	mux.HandleFunc("/tenant/tokens/", s.withTenantAuth(s.handleTenantTokenSubroutes))
+	mux.HandleFunc("/tenant/settings", s.withTenantAuth(s.handleTenantSettings))
+	mux.HandleFunc("/tenant/join-codes", s.withTenantAuth(s.handleJoinCodes))
 	mux.HandleFunc("/api/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 	})
+	if s.MetricsToken != "" {
+		mux.Handle("/metrics", s.MetricsHandler())
+	}
 
 	uiDir := s.UIDir
 	if uiDir == "" {
@@ -84,7 +123,19 @@ func (s *Server) Router() http.Handler {
 		}
 		fileServer.ServeHTTP(w, r)
 	})
-	return mux
+	if len(s.TrustedProxies) == 0 {
+		return mux
+	}
+	return s.withClientIP(mux)
+}
+
+// withClientIP replaces RemoteAddr with the forwarded client address for
+// requests that come through a trusted proxy.
+func (s *Server) withClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = s.TrustedProxies.ClientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-IP"))
+		next.ServeHTTP(w, r)
+	})
 }
 
 type authedHandler func(http.ResponseWriter, *http.Request, *auth.TokenRecord)
@@ -97,10 +148,11 @@ func (s *Server) withUIAuth(next authedHandler) http.HandlerFunc {
 			return
 		}
 		rec, ok := s.Tokens.Lookup(token)
-		if !ok || rec.Revoked || rec.Type != auth.TokenTypeUI || !s.CP.RateAllow("ui:"+rec.TokenID) {
+		if !ok || rec.Revoked || rec.Expired(time.Now()) || rec.Type != auth.TokenTypeUI || !s.CP.RateAllow("ui:"+rec.TokenID) {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		s.Tokens.MarkUsed(rec.TokenID, auth.RemoteIP(r.RemoteAddr))
 		next(w, r, rec)
 	}
 }
@@ -113,10 +165,11 @@ func (s *Server) withAdminAuth(next authedHandler) http.HandlerFunc {
 			return
 		}
 		rec, ok := s.Tokens.Lookup(token)
-		if !ok || rec.Revoked || rec.Type != auth.TokenTypeAdmin {
+		if !ok || rec.Revoked || rec.Expired(time.Now()) || rec.Type != auth.TokenTypeAdmin {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		s.Tokens.MarkUsed(rec.TokenID, auth.RemoteIP(r.RemoteAddr))
 		next(w, r, rec)
 	}
 }
@@ -129,10 +182,11 @@ func (s *Server) withTenantAuth(next authedHandler) http.HandlerFunc {
 			return
 		}
 		rec, ok := s.Tokens.Lookup(token)
-		if !ok || rec.Revoked || rec.Type != auth.TokenTypeTenant || !s.CP.RateAllow("tenant:"+rec.TokenID) {
+		if !ok || rec.Revoked || rec.Expired(time.Now()) || rec.Type != auth.TokenTypeTenant || !s.CP.RateAllow("tenant:"+rec.TokenID) {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		s.Tokens.MarkUsed(rec.TokenID, auth.RemoteIP(r.RemoteAddr))
 		next(w, r, rec)
 	}
 }
@@ -146,7 +200,30 @@ func (s *Server) handleServers(w http.ResponseWriter, r *http.Request, rec *auth
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"servers": s.CP.GetServers(rec.TenantID)})
+	writeJSON(w, http.StatusOK, map[string]any{"servers": s.CP.GetServers(rec.TenantID, rec.Scope)})
+}
+
+func (s *Server) handleServerSubroutes(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	if !auth.RoleAtLeast(rec.Role, auth.RoleViewer) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/servers/"), "/")
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "stats" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := s.CP.GetServerStats(rec.TenantID, rec.Scope, parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"server_id": parts[0], "stats": stats})
 }
 
 func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
@@ -157,7 +234,7 @@ func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request, rec *aut
 			return
 		}
 		serverID := r.URL.Query().Get("server_id")
-		writeJSON(w, http.StatusOK, map[string]any{"sessions": s.CP.GetSessions(rec.TenantID, serverID)})
+		writeJSON(w, http.StatusOK, map[string]any{"sessions": s.CP.GetSessions(rec.TenantID, rec.Scope, serverID)})
 	case http.MethodPost:
 		if !auth.RoleAtLeast(rec.Role, auth.RoleOperator) {
 			http.Error(w, "forbidden", http.StatusForbidden)
@@ -169,12 +246,18 @@ func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request, rec *aut
 			return
 		}
 		actor := "ui:" + rec.TokenID
-		sess, err := s.CP.CreateSession(actor, rec.TenantID, req)
+		sess, err := s.CP.CreateSession(actor, rec.TenantID, rec.Scope, req)
 		if err != nil {
 			code := http.StatusInternalServerError
 			if strings.Contains(err.Error(), "offline") {
 				code = http.StatusServiceUnavailable
 			}
+			if strings.Contains(err.Error(), "runtime") {
+				code = http.StatusBadRequest
+			}
+			if strings.Contains(err.Error(), "token scope") {
+				code = http.StatusForbidden
+			}
 			http.Error(w, err.Error(), code)
 			return
 		}
@@ -205,8 +288,7 @@ func (s *Server) handleSessionSubroutes(w http.ResponseWriter, r *http.Request,
 		}
 		var req core.StopSessionRequest
 		_ = json.NewDecoder(r.Body).Decode(&req)
-		actor := "ui:" + rec.TokenID
-		if err := s.CP.StopSession(actor, rec.TenantID, sessionID, req.GraceMS, req.KillAfterMS); err != nil {
+		if err := s.CP.StopSessionAs(requestActor(r, rec), rec.TenantID, rec.Scope, sessionID, req.GraceMS, req.KillAfterMS); err != nil {
 			code := http.StatusInternalServerError
 			if strings.Contains(err.Error(), "not found") {
 				code = http.StatusNotFound
@@ -226,7 +308,7 @@ func (s *Server) handleSessionSubroutes(w http.ResponseWriter, r *http.Request,
 		var req core.StopSessionRequest
 		_ = json.NewDecoder(r.Body).Decode(&req)
 		actor := "ui:" + rec.TokenID
-		if err := s.CP.StopAndDeleteSession(actor, rec.TenantID, sessionID, req.GraceMS, req.KillAfterMS); err != nil {
+		if err := s.CP.StopAndDeleteSession(actor, rec.TenantID, rec.Scope, sessionID, req.GraceMS, req.KillAfterMS); err != nil {
 			code := http.StatusInternalServerError
 			if strings.Contains(err.Error(), "not found") {
 				code = http.StatusNotFound
@@ -243,24 +325,276 @@ func (s *Server) handleSessionSubroutes(w http.ResponseWriter, r *http.Request,
 			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
-		events := s.CP.GetSessionEvents(rec.TenantID, sessionID)
+		events := s.CP.GetSessionEvents(rec.TenantID, rec.Scope, sessionID)
 		writeJSON(w, http.StatusOK, map[string]any{"events": events})
+	case r.Method == http.MethodGet && action == "recording":
+		if !auth.RoleAtLeast(rec.Role, auth.RoleViewer) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		s.serveRecording(w, r, rec.TenantID, rec.Scope, sessionID)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) handlePolicies(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	switch r.Method {
+	case http.MethodGet:
+		// Policies match on tags and paths across the whole tenant, so a
+		// scoped token could map servers outside its scope through them.
+		if !auth.RoleAtLeast(rec.Role, auth.RoleViewer) || rec.Scope != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"policies": s.CP.ListPolicies(rec.TenantID)})
+	case http.MethodPost:
+		if !canManageTenant(rec) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var req core.ApprovalPolicy
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		p, err := s.CP.CreatePolicy("ui:"+rec.TokenID, rec.TenantID, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, p)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handlePolicySubroutes(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	policyID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/policies/"), "/")
+	if policyID == "" || strings.Contains(policyID, "/") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	actor := "ui:" + rec.TokenID
+	switch {
+	case policyID == "evaluate" && r.Method == http.MethodPost:
+		if !auth.RoleAtLeast(rec.Role, auth.RoleViewer) || rec.Scope != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var req core.PolicyInput
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		result, err := s.CP.EvaluatePolicies(rec.TenantID, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	case r.Method == http.MethodGet:
+		if !auth.RoleAtLeast(rec.Role, auth.RoleViewer) || rec.Scope != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		p, err := s.CP.GetPolicy(rec.TenantID, policyID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case r.Method == http.MethodPut:
+		if !canManageTenant(rec) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var req core.ApprovalPolicy
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		p, err := s.CP.UpdatePolicy(actor, rec.TenantID, policyID, req)
+		if err != nil {
+			code := http.StatusBadRequest
+			if strings.Contains(err.Error(), "not found") {
+				code = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case r.Method == http.MethodDelete:
+		if !canManageTenant(rec) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if err := s.CP.DeletePolicy(actor, rec.TenantID, policyID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookRequest tells an omitted "enabled" apart from false.
+type webhookRequest struct {
+	core.Webhook
+	Enabled *bool `json:"enabled"`
+}
+
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	// Webhook urls often embed credentials, so every route needs owner.
+	if !canManageTenant(rec) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"webhooks": s.CP.ListWebhooks(rec.TenantID)})
+	case http.MethodPost:
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		// A new webhook is enabled unless the body says otherwise.
+		req.Webhook.Enabled = req.Enabled == nil || *req.Enabled
+		h, err := s.CP.CreateWebhook("ui:"+rec.TokenID, rec.TenantID, req.Webhook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, h)
 	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleWebhookSubroutes(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	if !canManageTenant(rec) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/webhooks/"), "/")
+	parts := strings.Split(rest, "/")
+	webhookID := parts[0]
+	if webhookID == "" || len(parts) > 2 {
 		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	actor := "ui:" + rec.TokenID
+	switch {
+	case action == "deliveries" && r.Method == http.MethodGet:
+		deliveries, err := s.CP.ListWebhookDeliveries(rec.TenantID, webhookID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"deliveries": deliveries})
+	case action != "":
+		http.Error(w, "not found", http.StatusNotFound)
+	case r.Method == http.MethodGet:
+		h, err := s.CP.GetWebhook(rec.TenantID, webhookID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, h)
+	case r.Method == http.MethodPut:
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.Enabled != nil {
+			req.Webhook.Enabled = *req.Enabled
+		} else if cur, err := s.CP.GetWebhook(rec.TenantID, webhookID); err == nil {
+			req.Webhook.Enabled = cur.Enabled
+		}
+		h, err := s.CP.UpdateWebhook(actor, rec.TenantID, webhookID, req.Webhook)
+		if err != nil {
+			code := http.StatusBadRequest
+			if strings.Contains(err.Error(), "not found") {
+				code = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeJSON(w, http.StatusOK, h)
+	case r.Method == http.MethodDelete:
+		if err := s.CP.DeleteWebhook(actor, rec.TenantID, webhookID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (s *Server) handleAdminTokens(w http.ResponseWriter, r *http.Request, _ *auth.TokenRecord) {
+func (s *Server) handleApprovalCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.CP.RateAllow("callback:" + auth.RemoteIP(r.RemoteAddr)) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		// Chat buttons and email forms usually post form fields.
+		req.Token = r.FormValue("token")
+	}
+	if req.Token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+	result, err := s.CP.RedeemCallback(req.Token)
+	if err != nil {
+		code := http.StatusBadRequest
+		switch {
+		case strings.Contains(err.Error(), "invalid callback token"), strings.Contains(err.Error(), "expired"):
+			code = http.StatusUnauthorized
+		case strings.Contains(err.Error(), "already used"), strings.Contains(err.Error(), "no longer pending"):
+			code = http.StatusConflict
+		case strings.Contains(err.Error(), "offline"):
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true, "result": result})
+}
+
+func (s *Server) handleAdminTokens(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
 	switch r.Method {
 	case http.MethodGet:
 		tenantID := strings.TrimSpace(r.URL.Query().Get("tenant_id"))
 		writeJSON(w, http.StatusOK, map[string]any{"tokens": s.Tokens.ListTokens(tenantID)})
 	case http.MethodPost:
 		var req struct {
-			Type     string `json:"type"`
-			TenantID string `json:"tenant_id"`
-			Role     string `json:"role"`
-			Name     string `json:"name"`
+			Type        string      `json:"type"`
+			TenantID    string      `json:"tenant_id"`
+			Role        string      `json:"role"`
+			Name        string      `json:"name"`
+			ExpiresAtMS int64       `json:"expires_at_ms"`
+			Scope       *auth.Scope `json:"scope"`
+			Pin         string      `json:"pin"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "bad request", http.StatusBadRequest)
@@ -283,19 +617,13 @@ func (s *Server) handleAdminTokens(w http.ResponseWriter, r *http.Request, _ *au
 				return
 			}
 		}
-		plain, rec, err := s.Tokens.CreateToken(tt, role, req.TenantID, strings.TrimSpace(req.Name))
+		opts := auth.TokenOptions{ExpiresAtMS: req.ExpiresAtMS, Scope: req.Scope, Pin: auth.AgentPin(strings.TrimSpace(req.Pin))}
+		plain, created, err := s.Tokens.CreateToken(requestActor(r, rec), tt, role, req.TenantID, strings.TrimSpace(req.Name), opts)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), tokenErrorStatus(err))
 			return
 		}
-		writeJSON(w, http.StatusOK, map[string]any{
-			"token":         plain,
-			"token_id":      rec.TokenID,
-			"tenant_id":     rec.TenantID,
-			"type":          rec.Type,
-			"role":          rec.Role,
-			"created_at_ms": rec.CreatedAtMS,
-		})
+		writeJSON(w, http.StatusOK, issuedToken(plain, created))
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -358,10 +686,12 @@ func (s *Server) handleTenantTokens(w http.ResponseWriter, r *http.Request, rec
 		return
 	}
 	var req struct {
-		TenantID  string `json:"tenant_id"`
-		Role      string `json:"role"`
-		UIName    string `json:"ui_name"`
-		AgentName string `json:"agent_name"`
+		TenantID    string `json:"tenant_id"`
+		Role        string `json:"role"`
+		UIName      string `json:"ui_name"`
+		AgentName   string `json:"agent_name"`
+		AgentPin    string `json:"agent_pin"`
+		ExpiresAtMS int64  `json:"expires_at_ms"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
 		http.Error(w, "bad request", http.StatusBadRequest)
@@ -375,6 +705,7 @@ func (s *Server) handleTenantTokens(w http.ResponseWriter, r *http.Request, rec
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
+	actor := requestActor(r, rec)
 	role := auth.RoleOwner
 	if strings.TrimSpace(req.Role) != "" {
 		var roleOK bool
@@ -384,35 +715,33 @@ func (s *Server) handleTenantTokens(w http.ResponseWriter, r *http.Request, rec
 			return
 		}
 	}
+	if req.ExpiresAtMS < 0 || (req.ExpiresAtMS > 0 && req.ExpiresAtMS <= time.Now().UnixMilli()) {
+		http.Error(w, "invalid token expiry", http.StatusBadRequest)
+		return
+	}
+	pin, ok := auth.ParsePin(strings.TrimSpace(req.AgentPin))
+	if !ok {
+		http.Error(w, "invalid pin", http.StatusBadRequest)
+		return
+	}
 
-	revoked := s.Tokens.RevokeTokensByTenant(tenantID, auth.TokenTypeUI, auth.TokenTypeAgent)
-	uiPlain, uiRec, err := s.Tokens.CreateToken(auth.TokenTypeUI, role, tenantID, strings.TrimSpace(req.UIName))
+	revoked := s.Tokens.RevokeTokensByTenant(actor, tenantID, auth.TokenTypeUI, auth.TokenTypeAgent)
+	uiPlain, uiRec, err := s.Tokens.CreateToken(actor, auth.TokenTypeUI, role, tenantID, strings.TrimSpace(req.UIName), auth.TokenOptions{ExpiresAtMS: req.ExpiresAtMS})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	agentPlain, agentRec, err := s.Tokens.CreateToken(auth.TokenTypeAgent, "", tenantID, strings.TrimSpace(req.AgentName))
+	agentPlain, agentRec, err := s.Tokens.CreateToken(actor, auth.TokenTypeAgent, "", tenantID, strings.TrimSpace(req.AgentName), auth.TokenOptions{ExpiresAtMS: req.ExpiresAtMS, Pin: pin})
 	if err != nil {
-		_ = s.Tokens.RevokeToken(uiRec.TokenID)
+		_ = s.Tokens.RevokeToken(actor, uiRec.TokenID)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	writeJSON(w, http.StatusOK, map[string]any{
 		"tenant_id":     tenantID,
 		"revoked_count": revoked,
-		"ui": map[string]any{
-			"token":         uiPlain,
-			"token_id":      uiRec.TokenID,
-			"type":          uiRec.Type,
-			"role":          uiRec.Role,
-			"created_at_ms": uiRec.CreatedAtMS,
-		},
-		"agent": map[string]any{
-			"token":         agentPlain,
-			"token_id":      agentRec.TokenID,
-			"type":          agentRec.Type,
-			"created_at_ms": agentRec.CreatedAtMS,
-		},
+		"ui":            issuedToken(uiPlain, uiRec),
+		"agent":         issuedToken(agentPlain, agentRec),
 	})
 }
 
@@ -422,7 +751,7 @@ func (s *Server) handleAdminServers(w http.ResponseWriter, r *http.Request, _ *a
 		return
 	}
 	tenantID := strings.TrimSpace(r.URL.Query().Get("tenant_id"))
-	writeJSON(w, http.StatusOK, map[string]any{"servers": s.CP.GetServers(tenantID)})
+	writeJSON(w, http.StatusOK, map[string]any{"servers": s.CP.GetServers(tenantID, nil)})
 }
 
 func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request, _ *auth.TokenRecord) {
@@ -432,12 +761,161 @@ func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request, _ *
 	}
 	tenantID := strings.TrimSpace(r.URL.Query().Get("tenant_id"))
 	serverID := strings.TrimSpace(r.URL.Query().Get("server_id"))
-	writeJSON(w, http.StatusOK, map[string]any{"sessions": s.CP.GetSessions(tenantID, serverID)})
+	writeJSON(w, http.StatusOK, map[string]any{"sessions": s.CP.GetSessions(tenantID, nil, serverID)})
 }
 
-func (s *Server) handleAdminSessionSubroutes(w http.ResponseWriter, r *http.Request, _ *auth.TokenRecord) {
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request, _ *auth.TokenRecord) {
+	s.serveAudit(w, r, strings.TrimSpace(r.URL.Query().Get("tenant_id")))
+}
+
+// handleAudit is the tenant-scoped audit history, for owners.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	if !canManageTenant(rec) || rec.TenantID == "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	s.serveAudit(w, r, rec.TenantID)
+}
+
+// serveAudit answers one page as JSON, or streams every matching record
+// as CSV or JSONL when format is set.
+func (s *Server) serveAudit(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := auditQueryFromRequest(r, tenantID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		page, err := s.CP.QueryAudit(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	case "csv", "jsonl":
+		s.exportAudit(w, q, format)
+	default:
+		http.Error(w, "invalid format", http.StatusBadRequest)
+	}
+}
+
+func auditQueryFromRequest(r *http.Request, tenantID string) (core.AuditQuery, error) {
+	v := r.URL.Query()
+	q := core.AuditQuery{
+		TenantID:  tenantID,
+		Actor:     strings.TrimSpace(v.Get("actor")),
+		Kind:      strings.TrimSpace(v.Get("kind")),
+		ServerID:  strings.TrimSpace(v.Get("server_id")),
+		SessionID: strings.TrimSpace(v.Get("session_id")),
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"since_ms", &q.SinceMS}, {"until_ms", &q.UntilMS}} {
+		if raw := v.Get(p.name); raw != "" {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || n < 0 {
+				return q, errors.New("invalid " + p.name)
+			}
+			*p.dst = n
+		}
+	}
+	if raw := v.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = n
+	}
+	before, err := core.ParseAuditCursor(v.Get("cursor"))
+	if err != nil {
+		return q, err
+	}
+	q.Before = before
+	return q, nil
+}
+
+func (s *Server) exportAudit(w http.ResponseWriter, q core.AuditQuery, format string) {
+	// Headers go out with the first record, so a failure before that can
+	// still be answered with a 500.
+	var begin func()
+	var writeEvent func(ev core.AuditEvent) error
+	var flush func() error
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		begin = func() {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+			_ = cw.Write([]string{"seq", "ts_ms", "time", "tenant_id", "actor", "kind", "server_id", "session_id", "meta"})
+		}
+		writeEvent = func(ev core.AuditEvent) error {
+			meta := ""
+			if len(ev.Meta) > 0 {
+				raw, _ := json.Marshal(ev.Meta)
+				meta = string(raw)
+			}
+			return cw.Write([]string{
+				strconv.FormatUint(ev.Seq, 10),
+				strconv.FormatInt(ev.TsMS, 10),
+				time.UnixMilli(ev.TsMS).UTC().Format(time.RFC3339Nano),
+				csvText(ev.TenantID), csvText(ev.Actor), csvText(ev.Kind), csvText(ev.ServerID), csvText(ev.SessionID), csvText(meta),
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		enc := json.NewEncoder(w)
+		begin = func() {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		}
+		writeEvent = func(ev core.AuditEvent) error { return enc.Encode(ev) }
+		flush = func() error { return nil }
+	}
+	started := false
+	err := s.CP.ExportAudit(q, func(ev core.AuditEvent) error {
+		if !started {
+			started = true
+			begin()
+		}
+		return writeEvent(ev)
+	})
+	if err != nil && !started {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !started {
+		begin()
+	}
+	if err != nil {
+		slog.Error("audit export failed", "err", err)
+	}
+	_ = flush()
+}
+
+// csvText keeps spreadsheets from evaluating audit fields, which carry
+// user-chosen names and paths, as formulas.
+func csvText(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+func (s *Server) handleAdminSessionSubroutes(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
 	path := strings.TrimPrefix(r.URL.Path, "/admin/sessions/")
 	parts := strings.Split(path, "/")
+	if len(parts) == 2 && parts[0] != "" && parts[1] == "recording" && r.Method == http.MethodGet {
+		s.serveRecording(w, r, "", nil, parts[0])
+		return
+	}
 	if len(parts) < 2 || parts[0] == "" || parts[1] != "stop" {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -449,7 +927,7 @@ func (s *Server) handleAdminSessionSubroutes(w http.ResponseWriter, r *http.Requ
 	sessionID := parts[0]
 	var req core.StopSessionRequest
 	_ = json.NewDecoder(r.Body).Decode(&req)
-	if err := s.CP.StopSession("admin", "", sessionID, req.GraceMS, req.KillAfterMS); err != nil {
+	if err := s.CP.StopSessionAs(requestActor(r, rec), "", nil, sessionID, req.GraceMS, req.KillAfterMS); err != nil {
 		code := http.StatusInternalServerError
 		if strings.Contains(err.Error(), "not found") {
 			code = http.StatusNotFound
@@ -463,10 +941,83 @@ func (s *Server) handleAdminSessionSubroutes(w http.ResponseWriter, r *http.Requ
 	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 }
 
-func (s *Server) handleAdminTokenSubroutes(w http.ResponseWriter, r *http.Request, _ *auth.TokenRecord) {
+// serveRecording streams a session's asciicast file. tenantID and scope
+// limit the lookup; empty (admin) resolves the tenant from the session or,
+// once it is deleted, from the recording directory.
+func (s *Server) serveRecording(w http.ResponseWriter, r *http.Request, tenantID string, scope *auth.Scope, sessionID string) {
+	path, err := s.CP.RecordingFile(tenantID, scope, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+sessionID+`.cast"`)
+	http.ServeContent(w, r, sessionID+".cast", info.ModTime(), f)
+}
+
+func (s *Server) handleAdminTenants(w http.ResponseWriter, r *http.Request, _ *auth.TokenRecord) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tenants": s.CP.ListTenantSettings()})
+}
+
+func (s *Server) handleAdminTenantSubroutes(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/tenants/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] != "settings" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.tenantSettings(w, r, requestActor(r, rec), parts[0])
+}
+
+func (s *Server) handleTenantSettings(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	if rec.TenantID == "" {
+		http.Error(w, "tenant token missing tenant_id", http.StatusBadRequest)
+		return
+	}
+	s.tenantSettings(w, r, requestActor(r, rec), rec.TenantID)
+}
+
+func (s *Server) tenantSettings(w http.ResponseWriter, r *http.Request, actor auth.Actor, tenantID string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.CP.GetTenantSettings(tenantID))
+	case http.MethodPut:
+		var req core.TenantSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		req.TenantID = tenantID
+		settings, err := s.CP.SetTenantSettingsAs(actor, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, settings)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleAdminTokenSubroutes(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
 	path := strings.TrimPrefix(r.URL.Path, "/admin/tokens/")
 	parts := strings.Split(path, "/")
-	if len(parts) < 2 || parts[0] == "" || parts[1] != "revoke" {
+	if len(parts) < 2 || parts[0] == "" || (parts[1] != "revoke" && parts[1] != "rotate") {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
@@ -475,13 +1026,216 @@ func (s *Server) handleAdminTokenSubroutes(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	tokenID := parts[0]
-	if ok := s.Tokens.RevokeToken(tokenID); !ok {
+	if parts[1] == "rotate" {
+		s.rotateToken(w, r, rec, tokenID)
+		return
+	}
+	if ok := s.Tokens.RevokeToken(requestActor(r, rec), tokenID); !ok {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 }
 
+// handleTenantTokenSubroutes rotates tokens of the caller's tenant.
+func (s *Server) handleTenantTokenSubroutes(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	path := strings.TrimPrefix(r.URL.Path, "/tenant/tokens/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] != "rotate" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if target, ok := s.Tokens.GetToken(parts[0]); !ok || rec.TenantID == "" || target.TenantID != rec.TenantID {
+		http.Error(w, "token not found", http.StatusNotFound)
+		return
+	}
+	s.rotateToken(w, r, rec, parts[0])
+}
+
+// rotateToken issues a successor for tokenID. The old token keeps working
+// for overlap_sec, or TokenRotateOverlap when the body leaves it out.
+func (s *Server) rotateToken(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord, tokenID string) {
+	var req struct {
+		OverlapSec *int `json:"overlap_sec"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	overlap := s.TokenRotateOverlap
+	if req.OverlapSec != nil {
+		overlap = time.Duration(*req.OverlapSec) * time.Second
+	}
+	plain, next, err := s.Tokens.RotateToken(requestActor(r, rec), tokenID, overlap)
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	old, _ := s.Tokens.GetToken(tokenID)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"token":                  issuedToken(plain, next),
+		"previous_token_id":      tokenID,
+		"previous_expires_at_ms": old.ExpiresAtMS,
+	})
+}
+
+// issuedToken is the response body for a newly issued token; the plain
+// token is only ever returned here.
+func issuedToken(plain string, rec auth.TokenRecord) map[string]any {
+	out := map[string]any{
+		"token":         plain,
+		"token_id":      rec.TokenID,
+		"tenant_id":     rec.TenantID,
+		"type":          rec.Type,
+		"created_at_ms": rec.CreatedAtMS,
+	}
+	if rec.Role != "" {
+		out["role"] = rec.Role
+	}
+	if rec.ExpiresAtMS > 0 {
+		out["expires_at_ms"] = rec.ExpiresAtMS
+	}
+	if rec.Scope != nil {
+		out["scope"] = rec.Scope
+	}
+	if rec.Pin != auth.PinNone {
+		out["pin"] = rec.Pin
+		if rec.PinnedServerID != "" {
+			out["pinned_server_id"] = rec.PinnedServerID
+		}
+	}
+	return out
+}
+
+func tokenErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	case strings.Contains(err.Error(), "revoked"), strings.Contains(err.Error(), "expired"), strings.Contains(err.Error(), "already rotated"):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// MetricsHandler serves Prometheus metrics. It requires MetricsToken when one
+// is set, so it can also be mounted on a private bind address without one.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.MetricsToken != "" && subtle.ConstantTimeCompare([]byte(extractToken(r)), []byte(s.MetricsToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = s.CP.WriteMetrics(w)
+	})
+}
+
+// handleJoinCodes lists and issues join codes for the caller's tenant. It
+// serves both tenant tokens and owner UI tokens.
+func (s *Server) handleJoinCodes(w http.ResponseWriter, r *http.Request, rec *auth.TokenRecord) {
+	if rec.TenantID == "" || (rec.Type == auth.TokenTypeUI && !canManageTenant(rec)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"join_codes": s.Tokens.ListJoinCodes(rec.TenantID)})
+	case http.MethodPost:
+		var req struct {
+			Name   string `json:"name"`
+			TTLSec int    `json:"ttl_sec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code, jc, err := s.Tokens.CreateJoinCode(requestActor(r, rec), rec.TenantID, req.Name, time.Duration(req.TTLSec)*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), tokenErrorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{
+			"code":          code,
+			"code_id":       jc.CodeID,
+			"tenant_id":     jc.TenantID,
+			"name":          jc.Name,
+			"expires_at_ms": jc.ExpiresAtMS,
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEnroll exchanges a join code for an agent token bound to the
+// enrolling host. The host key proof is the same one sent on register.
+func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.CP.RateAllow("enroll:" + auth.RemoteIP(r.RemoteAddr)) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	var req struct {
+		Code        string `json:"code"`
+		ServerID    string `json:"server_id"`
+		HostKey     string `json:"host_key"`
+		HostKeySig  string `json:"host_key_sig"`
+		HostKeyTsMS int64  `json:"host_key_ts_ms"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	hostKey, err := core.VerifyHostKey(core.AgentRegister{
+		ServerID:    req.ServerID,
+		HostKey:     req.HostKey,
+		HostKeySig:  req.HostKeySig,
+		HostKeyTsMS: req.HostKeyTsMS,
+	}, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plain, created, err := s.Tokens.RedeemJoinCode(req.Code, req.ServerID, hostKey, r.RemoteAddr)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case err.Error() == "invalid join code":
+			status = http.StatusForbidden
+		case strings.Contains(err.Error(), "required"):
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusOK, issuedToken(plain, created))
+}
+
+// canManageTenant reports whether rec may see or change tenant-wide state
+// such as policies, webhooks and the audit log. Scoped tokens may not: those
+// reach servers outside the scope.
+func canManageTenant(rec *auth.TokenRecord) bool {
+	return auth.RoleAtLeast(rec.Role, auth.RoleOwner) && rec.Scope == nil
+}
+
+// requestActor identifies the caller for audit events.
+func requestActor(r *http.Request, rec *auth.TokenRecord) auth.Actor {
+	return auth.ActorFor(rec, r.RemoteAddr, r.UserAgent())
+}
+
 func extractToken(r *http.Request) string {
 	auth := strings.TrimSpace(r.Header.Get("Authorization"))
 	if strings.HasPrefix(strings.ToLower(auth), "bearer ") {
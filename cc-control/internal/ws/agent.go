@@ -2,6 +2,7 @@ package ws
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"sync"
@@ -13,14 +14,16 @@ import (
 )
 
 type AgentConn struct {
+	cp     *core.ControlPlane
 	conn   *websocket.Conn
 	send   chan core.Envelope
 	closed chan struct{}
 	once   sync.Once
 }
 
-func NewAgentConn(conn *websocket.Conn) *AgentConn {
+func NewAgentConn(cp *core.ControlPlane, conn *websocket.Conn) *AgentConn {
 	return &AgentConn{
+		cp:     cp,
 		conn:   conn,
 		send:   make(chan core.Envelope, 128),
 		closed: make(chan struct{}),
@@ -51,6 +54,7 @@ func (a *AgentConn) writeLoop() {
 		case msg := <-a.send:
 			_ = a.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := a.conn.WriteJSON(msg); err != nil {
+				a.cp.RecordWSWriteError("agent")
 				a.Close()
 				return
 			}
@@ -62,16 +66,69 @@ type AgentHandler struct {
 	CP       *core.ControlPlane
 	Upgrader websocket.Upgrader
 	Tokens   *auth.Store
+	// DeniedCerts revokes client certificates that still chain to the CA.
+	DeniedCerts *auth.CertDenyList
 }
 
-func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// agentIdentity is who an agent connection authenticated as: an agent token,
+// or a client certificate that also fixes the server id.
+type agentIdentity struct {
+	tenantID        string
+	tokenID         string
+	serverID        string
+	certFingerprint string
+}
+
+func (h *AgentHandler) authenticate(r *http.Request) (agentIdentity, bool) {
+	// VerifiedChains is only set when cc-control terminates TLS itself with
+	// -tls-client-ca and the certificate checked out.
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		tenantID, serverID, err := auth.AgentCertIdentity(cert)
+		if err == nil && h.DeniedCerts.Revoked(auth.CertFingerprint(cert)) {
+			err = errors.New("client certificate revoked")
+		}
+		if err != nil {
+			slog.Warn("agent client certificate rejected", "remote", r.RemoteAddr, "err", err)
+			return agentIdentity{}, false
+		}
+		if !h.CP.RateAllow("agent-cert:" + tenantID + "/" + serverID) {
+			return agentIdentity{}, false
+		}
+		return agentIdentity{tenantID: tenantID, serverID: serverID, certFingerprint: auth.CertFingerprint(cert)}, true
+	}
 	token := extractToken(r)
 	if token == "" || h.Tokens == nil {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
+		return agentIdentity{}, false
 	}
 	rec, ok := h.Tokens.Lookup(token)
-	if !ok || rec.Revoked || rec.Type != auth.TokenTypeAgent || !h.CP.RateAllow("agent:"+rec.TokenID) {
+	if !ok || rec.Revoked || rec.Expired(time.Now()) || rec.Type != auth.TokenTypeAgent || !h.CP.RateAllow("agent:"+rec.TokenID) {
+		return agentIdentity{}, false
+	}
+	h.Tokens.MarkUsed(rec.TokenID, auth.RemoteIP(r.RemoteAddr))
+	return agentIdentity{tenantID: rec.TenantID, tokenID: rec.TokenID}, true
+}
+
+// revokedReason says why the connection's credential stopped working, or ""
+// while it is still usable: a token is checked against the store, a client
+// certificate against the deny list.
+func (h *AgentHandler) revokedReason(id agentIdentity) string {
+	if id.certFingerprint != "" {
+		if h.DeniedCerts.Revoked(id.certFingerprint) {
+			return "client certificate revoked"
+		}
+		return ""
+	}
+	cur, ok := h.Tokens.GetToken(id.tokenID)
+	if !ok || cur.Revoked || cur.Expired(time.Now()) {
+		return "token revoked or expired"
+	}
+	return ""
+}
+
+func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.authenticate(r)
+	if !ok {
 		slog.Warn("agent ws unauthorized", "remote", r.RemoteAddr)
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
@@ -102,8 +159,20 @@ func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	agentConn := NewAgentConn(conn)
-	if err := h.CP.RegisterOrUpdateServer(rec.TenantID, reg, agentConn); err != nil {
+	// A pinned token only registers as the identity it was first used with,
+	// so a leaked token cannot be replayed as another server.
+	hostKey, err := core.VerifyHostKey(reg, time.Now())
+	if err == nil && id.serverID != "" && reg.ServerID != id.serverID {
+		err = errors.New("client certificate is for server_id " + id.serverID)
+	}
+	if err == nil && id.tokenID != "" {
+		err = h.Tokens.BindAgent(id.tokenID, reg.ServerID, hostKey, r.RemoteAddr)
+	}
+	agentConn := NewAgentConn(h.CP, conn)
+	if err == nil {
+		err = h.CP.RegisterOrUpdateServer(id.tenantID, reg, agentConn)
+	}
+	if err != nil {
 		_ = conn.WriteControl(
 			websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
@@ -114,7 +183,7 @@ func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	go agentConn.writeLoop()
 	defer agentConn.Close()
-	defer h.CP.RemoveAgentConnection(reg.ServerID)
+	defer h.CP.RemoveAgentConnection(id.tenantID, reg.ServerID)
 	slog.Info("agent registered",
 		"server_id", reg.ServerID,
 		"hostname", reg.Hostname,
@@ -126,6 +195,7 @@ func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ack.Data, _ = json.Marshal(map[string]any{
 		"heartbeat_interval_ms": 5000,
 		"server_time_ms":        time.Now().UnixMilli(),
+		"sessions":              h.CP.ReplayCursors(id.tenantID, reg.ServerID),
 	})
 	_ = agentConn.Send(ack)
 	slog.Info("agent register_ok sent", "server_id", reg.ServerID)
@@ -139,13 +209,35 @@ func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		switch msg.Type {
 		case "heartbeat":
-			h.CP.TouchServer(reg.ServerID)
+			// Revoking an enrolled host's token or certificate should cut it
+			// off, not just keep it from reconnecting.
+			if reason := h.revokedReason(id); reason != "" {
+				_ = conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+					time.Now().Add(2*time.Second),
+				)
+				slog.Warn("agent credential no longer valid", "server_id", reg.ServerID, "remote", r.RemoteAddr, "reason", reason)
+				return
+			}
+			h.CP.TouchServer(id.tenantID, reg.ServerID)
+			if len(msg.Data) > 0 {
+				var stats core.ServerStats
+				if err := json.Unmarshal(msg.Data, &stats); err == nil {
+					h.CP.RecordServerStats(id.tenantID, reg.ServerID, stats)
+				}
+			}
 		case "pty_out":
-			h.CP.HandlePTYOut(reg.ServerID, msg.SessionID, msg.Seq, msg.DataB64)
+			h.CP.HandlePTYOut(id.tenantID, reg.ServerID, msg.SessionID, msg.Seq, msg.DataB64)
+		case "session_started":
+			var started core.SessionStarted
+			if err := json.Unmarshal(msg.Data, &started); err == nil {
+				h.CP.HandleSessionStarted(id.tenantID, reg.ServerID, msg.SessionID, started)
+			}
 		case "pty_exit":
 			var exit core.PTYExit
 			_ = json.Unmarshal(msg.Data, &exit)
-			h.CP.HandlePTYExit(reg.ServerID, msg.SessionID, exit)
+			h.CP.HandlePTYExit(id.tenantID, reg.ServerID, msg.SessionID, exit)
 		case "error":
 			var payload struct {
 				Message string `json:"message"`
@@ -155,7 +247,7 @@ func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if message == "" {
 				message = string(msg.Data)
 			}
-			h.CP.HandleAgentError(reg.ServerID, msg.SessionID, message)
+			h.CP.HandleAgentError(id.tenantID, reg.ServerID, msg.SessionID, message)
 			slog.Warn("agent error", "server_id", reg.ServerID, "session_id", msg.SessionID, "message", message)
 		default:
 		}
@@ -0,0 +1,237 @@
+package ws
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cc-control/internal/auth"
+	"cc-control/internal/core"
+	"github.com/gorilla/websocket"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "agent ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func agentCert(t *testing.T, ca *testCA, uri string) tls.Certificate {
+	t.Helper()
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.issue(t, &x509.Certificate{URIs: []*url.URL{u}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+}
+
+// startCertAgentServer serves an AgentHandler over TLS that accepts client
+// certificates from ca, like cc-control with -tls-client-ca.
+func startCertAgentServer(t *testing.T, ca *testCA, denied *auth.CertDenyList) (*core.ControlPlane, string) {
+	t.Helper()
+	cp, err := core.NewControlPlane(core.Config{AuditPath: filepath.Join(t.TempDir(), "audit.jsonl")})
+	if err != nil {
+		t.Fatalf("new control plane: %v", err)
+	}
+	t.Cleanup(func() { _ = cp.Close() })
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(&AgentHandler{CP: cp, Tokens: auth.NewStore(), DeniedCerts: denied})
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, &x509.Certificate{
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})},
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return cp, "wss" + strings.TrimPrefix(srv.URL, "https")
+}
+
+func dialAgent(t *testing.T, ca *testCA, wsURL string, cert tls.Certificate) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	d := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}}
+	return d.Dial(wsURL, nil)
+}
+
+func register(t *testing.T, conn *websocket.Conn, serverID string) core.Envelope {
+	t.Helper()
+	msg := core.NewEnvelope("register", serverID, "")
+	msg.Data, _ = json.Marshal(core.AgentRegister{ServerID: serverID, Hostname: serverID})
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatalf("write register: %v", err)
+	}
+	var reply core.Envelope
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("read after register: %v", err)
+	}
+	return reply
+}
+
+func expectPolicyClose(t *testing.T, conn *websocket.Conn, text string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg core.Envelope
+	err := conn.ReadJSON(&msg)
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation || !strings.Contains(ce.Text, text) {
+		t.Fatalf("want 1008 close containing %q, got %v", text, err)
+	}
+}
+
+func TestAgentHandler_ClientCertificateMapsToTenantAndServer(t *testing.T) {
+	ca := newTestCA(t)
+	cp, wsURL := startCertAgentServer(t, ca, nil)
+	cert := agentCert(t, ca, "cc-agent://t1/build-7")
+
+	conn, _, err := dialAgent(t, ca, wsURL, cert)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if reply := register(t, conn, "build-7"); reply.Type != "register_ok" {
+		t.Fatalf("register reply %q", reply.Type)
+	}
+	servers := cp.GetServers("t1", nil)
+	if len(servers) != 1 || servers[0].ServerID != "build-7" {
+		t.Fatalf("servers in t1: %+v", servers)
+	}
+	if other := cp.GetServers("t2", nil); len(other) != 0 {
+		t.Fatalf("certificate leaked into t2: %+v", other)
+	}
+
+	// The certificate fixes the server id; registering as another is refused.
+	conn2, _, err := dialAgent(t, ca, wsURL, cert)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn2.Close()
+	msg := core.NewEnvelope("register", "build-8", "")
+	msg.Data, _ = json.Marshal(core.AgentRegister{ServerID: "build-8"})
+	if err := conn2.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	expectPolicyClose(t, conn2, "client certificate is for server_id build-7")
+	if servers := cp.GetServers("t1", nil); len(servers) != 1 {
+		t.Fatalf("mismatched register should not add a server: %+v", servers)
+	}
+}
+
+func TestAgentHandler_RefusesCertificateWithoutAgentURI(t *testing.T) {
+	ca := newTestCA(t)
+	_, wsURL := startCertAgentServer(t, ca, nil)
+	cert := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"t1"}, CommonName: "build-7"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	conn, resp, err := dialAgent(t, ca, wsURL, cert)
+	if err == nil {
+		conn.Close()
+		t.Fatal("certificate without a cc-agent uri should be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("want 401, got %v", err)
+	}
+}
+
+func TestAgentHandler_DenyListRevokesCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	listPath := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(listPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	denied, err := auth.NewCertDenyList(listPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wsURL := startCertAgentServer(t, ca, denied)
+	cert := agentCert(t, ca, "cc-agent://t1/build-7")
+
+	conn, _, err := dialAgent(t, ca, wsURL, cert)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if reply := register(t, conn, "build-7"); reply.Type != "register_ok" {
+		t.Fatalf("register reply %q", reply.Type)
+	}
+
+	if err := os.WriteFile(listPath, []byte(auth.CertFingerprint(cert.Leaf)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := denied.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	// A connected agent is cut off at its next heartbeat.
+	if err := conn.WriteJSON(core.NewEnvelope("heartbeat", "build-7", "")); err != nil {
+		t.Fatal(err)
+	}
+	expectPolicyClose(t, conn, "client certificate revoked")
+
+	// And cannot reconnect.
+	if c, resp, err := dialAgent(t, ca, wsURL, cert); err == nil {
+		c.Close()
+		t.Fatal("revoked certificate should not reconnect")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("want 401, got %v", err)
+	}
+}
@@ -20,6 +20,28 @@ type ClientHandler struct {
 	Tokens   *auth.Store
 }
 
+// uiTokenRecheck is how often an idle UI connection re-checks its token, so
+// a viewer that only receives output is still cut off after a revoke.
+const uiTokenRecheck = 15 * time.Second
+
+// tokenValid reports whether the connection's UI token is still usable.
+func (h *ClientHandler) tokenValid(tokenID string) bool {
+	cur, ok := h.Tokens.GetToken(tokenID)
+	return ok && !cur.Revoked && !cur.Expired(time.Now())
+}
+
+// closeRevoked tells the browser why the connection ends, then drops it so
+// the read loop unblocks.
+func closeRevoked(conn *websocket.Conn, remote string) {
+	_ = conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token revoked or expired"),
+		time.Now().Add(2*time.Second),
+	)
+	_ = conn.Close()
+	slog.Warn("ui token no longer valid", "remote", remote)
+}
+
 func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	remote := r.RemoteAddr
 	token := extractToken(r)
@@ -28,10 +50,11 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	rec, ok := h.Tokens.Lookup(token)
-	if !ok || rec.Revoked || rec.Type != auth.TokenTypeUI || !auth.RoleAtLeast(rec.Role, auth.RoleViewer) || !h.CP.RateAllow("ui:"+rec.TokenID) {
+	if !ok || rec.Revoked || rec.Expired(time.Now()) || rec.Type != auth.TokenTypeUI || !auth.RoleAtLeast(rec.Role, auth.RoleViewer) || !h.CP.RateAllow("ui:"+rec.TokenID) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	h.Tokens.MarkUsed(rec.TokenID, auth.RemoteIP(remote))
 	conn, err := h.Upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
@@ -40,10 +63,12 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	slog.Info("ui ws connected", "remote", remote)
 
 	sub := &core.Subscriber{
-		ID:       uuid.NewString(),
-		Actor:    "ui:" + rec.TokenID,
-		Send:     make(chan core.Envelope, 256),
-		TenantID: rec.TenantID,
+		ID:         uuid.NewString(),
+		Actor:      "ui:" + rec.TokenID,
+		Send:       make(chan core.Envelope, 256),
+		TenantID:   rec.TenantID,
+		TokenScope: rec.Scope,
+		Role:       rec.Role,
 	}
 	h.CP.RegisterSubscriber(sub)
 	stopWriter := make(chan struct{})
@@ -59,16 +84,24 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	doneWriter := make(chan struct{})
 	go func() {
 		defer close(doneWriter)
+		recheck := time.NewTicker(uiTokenRecheck)
+		defer recheck.Stop()
 		for {
 			select {
 			case <-stopWriter:
 				return
+			case <-recheck.C:
+				if !h.tokenValid(rec.TokenID) {
+					closeRevoked(conn, remote)
+					return
+				}
 			case msg := <-sub.Send:
 				if msg.Type != "term_out" {
 					slog.Info("ui ws send", "remote", remote, "type", msg.Type, "session_id", msg.SessionID)
 				}
 				_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 				if err := conn.WriteJSON(msg); err != nil {
+					h.CP.RecordWSWriteError("client")
 					return
 				}
 			}
@@ -86,7 +119,7 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Replay all unresolved approval events on connect so UI has a global
 	// pending-approvals view without requiring per-session attach clicks.
-	pendingEvents := h.CP.GetPendingApprovalEvents(rec.TenantID)
+	pendingEvents := h.CP.GetPendingApprovalEvents(rec.TenantID, rec.Scope)
 	for _, ev := range pendingEvents {
 		evMsg := core.NewEnvelope("event", ev.ServerID, ev.SessionID)
 		evMsg.Data, _ = json.Marshal(ev)
@@ -107,6 +140,12 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			<-doneWriter
 			return
 		}
+		if !h.tokenValid(rec.TokenID) {
+			closeRevoked(conn, remote)
+			cleanup()
+			<-doneWriter
+			return
+		}
 		switch msg.Type {
 		case "attach":
 			var req struct {
@@ -117,26 +156,33 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				_ = conn.WriteJSON(errorEnvelope("bad_attach_payload", msg.SessionID))
 				continue
 			}
-			snapshot, latest, err := h.CP.AttachSubscriber(sub, req.SessionID)
+			replay, err := h.CP.AttachSubscriber(sub, req.SessionID, req.SinceSeq)
 			if err != nil {
 				_ = conn.WriteJSON(errorEnvelope(err.Error(), req.SessionID))
 				continue
 			}
+			mode := "delta"
+			if replay.Full {
+				mode = "full"
+			}
 			ack := core.NewEnvelope("attach_ok", "", req.SessionID)
 			ack.Data, _ = json.Marshal(map[string]any{
 				"session_id": req.SessionID,
-				"latest_seq": latest,
+				"latest_seq": replay.LatestSeq,
+				"since_seq":  req.SinceSeq,
+				"replay":     mode,
+				"resync":     replay.Resync,
 			})
 			sub.Send <- ack
-			if len(snapshot) > 0 {
+			if len(replay.Data) > 0 {
 				out := core.NewEnvelope("term_out", "", req.SessionID)
-				out.Seq = latest
-				out.DataB64 = encodeB64(snapshot)
+				out.Seq = replay.LatestSeq
+				out.DataB64 = encodeB64(replay.Data)
 				sub.Send <- out
 			}
 
 			// Re-send pending approval events for this session to recover from transient drops.
-			events := h.CP.GetSessionEvents(rec.TenantID, req.SessionID)
+			events := h.CP.GetSessionEvents(rec.TenantID, rec.Scope, req.SessionID)
 			pendingApprovals := 0
 			for _, ev := range events {
 				if ev.Kind != "approval_needed" || ev.Resolved {
@@ -150,7 +196,29 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				default:
 				}
 			}
-			slog.Info("ui attach", "remote", remote, "session_id", req.SessionID, "pending_approvals", pendingApprovals, "total_events", len(events))
+			slog.Info("ui attach", "remote", remote, "session_id", req.SessionID, "since_seq", req.SinceSeq, "replay", mode, "resync", replay.Resync, "pending_approvals", pendingApprovals, "total_events", len(events))
+		case "subscribe":
+			var req struct {
+				Scope    core.SubscriptionScope `json:"scope"`
+				ServerID string                 `json:"server_id"`
+			}
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				sub.Send <- errorEnvelope("bad_subscribe_payload", "")
+				continue
+			}
+			if req.Scope == "" {
+				req.Scope = core.ScopeTenant
+			}
+			if err := h.CP.SetSubscription(sub, req.Scope, req.ServerID); err != nil {
+				sub.Send <- errorEnvelope(err.Error(), "")
+				continue
+			}
+			ack := core.NewEnvelope("subscribe_ok", req.ServerID, "")
+			ack.Data, _ = json.Marshal(map[string]any{
+				"scope":     req.Scope,
+				"server_id": req.ServerID,
+			})
+			sub.Send <- ack
 		case "term_in":
 			if !auth.RoleAtLeast(rec.Role, auth.RoleOperator) {
 				sub.Send <- errorEnvelope("forbidden", msg.SessionID)
@@ -164,7 +232,7 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				sub.Send <- errorEnvelope("no_attached_session", "")
 				continue
 			}
-			if err := h.CP.HandleClientTermIn(sub.Actor, rec.TenantID, sessionID, msg.DataB64); err != nil {
+			if err := h.CP.HandleClientTermIn(sub.Actor, rec.TenantID, rec.Scope, sessionID, msg.DataB64); err != nil {
 				sub.Send <- errorEnvelope(err.Error(), sessionID)
 			}
 		case "action":
@@ -185,7 +253,7 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				sub.Send <- errorEnvelope("no_attached_session", "")
 				continue
 			}
-			if err := h.CP.HandleClientAction(sub.Actor, rec.TenantID, sessionID, req); err != nil {
+			if err := h.CP.HandleClientAction(sub.Actor, rec.TenantID, rec.Scope, sessionID, req); err != nil {
 				sub.Send <- errorEnvelope(err.Error(), sessionID)
 			}
 		case "resize":
@@ -209,7 +277,7 @@ func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				sub.Send <- errorEnvelope("no_attached_session", "")
 				continue
 			}
-			if err := h.CP.HandleClientResize(sub.Actor, rec.TenantID, sessionID, req.Cols, req.Rows); err != nil {
+			if err := h.CP.HandleClientResize(sub.Actor, rec.TenantID, rec.Scope, sessionID, req.Cols, req.Rows); err != nil {
 				sub.Send <- errorEnvelope(err.Error(), sessionID)
 			}
 		default:
@@ -49,6 +49,7 @@
     selectedServerID: "",
     selectedSessionID: "",
     pendingFirstOutputSessionID: "",
+    lastSeq: 0,
     ws: null,
     approvals: new Map(),
     sessions: [],
@@ -60,6 +61,7 @@
     adminTokenSecrets: loadAdminTokenCache(),
     adminServers: [],
     adminSessions: [],
+    adminHosts: [],
     adminActiveTab: "overview",
   };
 
@@ -81,6 +83,7 @@
   const adminSessionsSearch = document.getElementById("adminSessionsSearch");
   const adminSessionsStatusFilter = document.getElementById("adminSessionsStatusFilter");
   const adminTokenSearch = document.getElementById("adminTokenSearch");
+  const adminHostsSearch = document.getElementById("adminHostsSearch");
   const tenantTokenInput = document.getElementById("tenantTokenInput");
   const tenantRoleSelect = document.getElementById("tenantRoleSelect");
   const tenantTenantInput = document.getElementById("tenantTenantInput");
@@ -97,8 +100,10 @@
   const approvalList = document.getElementById("approvalList");
   const approvalCount = document.getElementById("approvalCount");
   const approvalDetails = document.getElementById("approvalDetails");
+  const runtimeSelect = document.getElementById("runtimeSelect");
   const cwdInput = document.getElementById("cwdInput");
   const resumeInput = document.getElementById("resumeInput");
+  const argsInput = document.getElementById("argsInput");
   const envInput = document.getElementById("envInput");
   const currentSessionLabel = document.getElementById("currentSessionLabel");
   const sidebarToggleBtn = document.getElementById("sidebarToggleBtn");
@@ -301,6 +306,13 @@
       if (resumeID) {
         body.resume_id = resumeID;
       }
+      if (runtimeSelect.value) {
+        body.runtime = runtimeSelect.value;
+      }
+      const args = parseArgs(argsInput.value);
+      if (args.length) {
+        body.args = args;
+      }
       const resp = await api("/api/sessions", {
         method: "POST",
         body: JSON.stringify(body),
@@ -358,12 +370,15 @@
     if (adminRefreshOverviewBtn) adminRefreshOverviewBtn.addEventListener("click", refreshAdminOverview);
     if (adminRefreshServersBtn) adminRefreshServersBtn.addEventListener("click", fetchAdminServers);
     if (adminRefreshSessionsBtn) adminRefreshSessionsBtn.addEventListener("click", fetchAdminSessions);
+    const adminRefreshHostsBtn = document.getElementById("adminRefreshHostsBtn");
+    if (adminRefreshHostsBtn) adminRefreshHostsBtn.addEventListener("click", fetchAdminHosts);
 
     // Search / filter
     if (adminServersSearch) adminServersSearch.addEventListener("input", debounce(renderAdminServers, 200));
     if (adminSessionsSearch) adminSessionsSearch.addEventListener("input", debounce(renderAdminSessions, 200));
     if (adminSessionsStatusFilter) adminSessionsStatusFilter.addEventListener("change", renderAdminSessions);
     if (adminTokenSearch) adminTokenSearch.addEventListener("input", debounce(renderAdminTenantTokens, 200));
+    if (adminHostsSearch) adminHostsSearch.addEventListener("input", debounce(renderAdminHosts, 200));
   }
 
   if (isTenantPage) {
@@ -454,6 +469,30 @@
     renderServers();
   }
 
+  // renderRuntimeOptions lists the selected server's runtime profiles; agents
+  // that do not advertise any get a single "default" entry.
+  function renderRuntimeOptions() {
+    const server = state.servers.find((s) => s.server_id === state.selectedServerID);
+    const runtimes = (server && server.runtimes) || [];
+    const current = runtimeSelect.value;
+    runtimeSelect.innerHTML = "";
+    if (!runtimes.length) {
+      const opt = document.createElement("option");
+      opt.value = "";
+      opt.textContent = "default";
+      runtimeSelect.appendChild(opt);
+      return;
+    }
+    for (const rt of runtimes) {
+      const opt = document.createElement("option");
+      opt.value = rt.name;
+      opt.textContent = rt.default ? `${rt.name} (default)` : rt.name;
+      runtimeSelect.appendChild(opt);
+    }
+    const keep = runtimes.find((rt) => rt.name === current) || runtimes.find((rt) => rt.default) || runtimes[0];
+    runtimeSelect.value = keep.name;
+  }
+
   async function fetchSessions() {
     const q = state.selectedServerID ? `?server_id=${encodeURIComponent(state.selectedServerID)}` : "";
     const resp = await api(`/api/sessions${q}`);
@@ -474,6 +513,7 @@
 
   function renderServers() {
     serversList.innerHTML = "";
+    renderRuntimeOptions();
     if (!state.servers.length) {
       renderEmptyItem(serversList, "No servers");
       return;
@@ -484,6 +524,7 @@
       if (s.server_id === state.selectedServerID) li.classList.add("selected");
       const statusClass = s.status === "online" ? "badge-online" : "badge-offline";
       const tags = (s.tags || []).map(escapeHtml).join(", ");
+      const runtimes = (s.runtimes || []).map((rt) => escapeHtml(rt.name)).join(", ");
       li.innerHTML = `
         <div class="server-main">
           <strong class="server-id">${escapeHtml(s.server_id)}</strong>
@@ -492,6 +533,7 @@
         <div class="server-sub">
           <span class="server-host">${escapeHtml(s.hostname || "-")}</span>
           ${tags ? `<span class="server-tags">${tags}</span>` : ""}
+          ${runtimes ? `<span class="server-tags">${runtimes}</span>` : ""}
         </div>
       `;
       li.addEventListener("click", async () => {
@@ -525,10 +567,11 @@
             <span class="badge ${approvalClass}">${s.awaiting_approval ? "approval" : "normal"}</span>
           </div>
         </div>
-        <div class="session-sub">${escapeHtml(s.cwd || "-")}</div>
+        <div class="session-sub">${s.runtime ? `${escapeHtml(s.runtime)} · ` : ""}${escapeHtml(s.cwd || "-")}</div>
         ${
-          s.resume_id || s.exit_reason
+          s.resume_id || s.exit_reason || (s.args && s.args.length)
             ? `<div class="session-detail">
+                ${s.args && s.args.length ? `<span>args ${escapeHtml(s.args.join(" "))}</span>` : ""}
                 ${s.resume_id ? `<span>resume ${escapeHtml(s.resume_id)}</span>` : ""}
                 ${s.exit_reason ? `<span>reason ${escapeHtml(s.exit_reason)}</span>` : ""}
               </div>`
@@ -578,6 +621,7 @@
     if (state.selectedSessionID === sessionID) {
       state.selectedSessionID = "";
       state.pendingFirstOutputSessionID = "";
+      state.lastSeq = 0;
       currentSessionLabel.textContent = "Session: (none)";
       term.reset();
       term.scrollToBottom();
@@ -611,6 +655,8 @@
       server_id: serverID,
       cwd,
       resume_id: resumeID,
+      runtime: source.runtime || "",
+      args: source.args || [],
       env: parseEnv(envInput.value),
       cols: term.cols,
       rows: term.rows,
@@ -643,7 +689,7 @@
       pendingCount++;
       const li = document.createElement("li");
       li.innerHTML = `
-        <div><strong>${escapeHtml(ev.session_id.slice(0, 8))}</strong> @ ${escapeHtml(ev.server_id)}</div>
+        <div><strong>${escapeHtml(ev.session_id.slice(0, 8))}</strong> @ ${escapeHtml(ev.server_id)}${ev.escalated_at_ms ? " · escalated" : ""}</div>
       `;
       li.classList.add("approval-item");
       li.tabIndex = 0;
@@ -688,9 +734,11 @@
       console.log("[ws] connected");
       setWSStatus(true);
       if (state.selectedSessionID) {
+        // Ask only for output missed while disconnected; the server falls
+        // back to a full replay (attach_ok.resync) if that is gone.
         sendWS({
           type: "attach",
-          data: { session_id: state.selectedSessionID, since_seq: 0 },
+          data: { session_id: state.selectedSessionID, since_seq: state.lastSeq },
         });
       }
       sendResize();
@@ -726,7 +774,17 @@
   }
 
   function handleWS(msg) {
+    if (msg.type === "attach_ok" && msg.data) {
+      if (msg.session_id === state.selectedSessionID && msg.data.resync) {
+        term.reset();
+        state.lastSeq = 0;
+      }
+      return;
+    }
     if (msg.type === "term_out") {
+      if (msg.session_id === state.selectedSessionID && msg.seq > state.lastSeq) {
+        state.lastSeq = msg.seq;
+      }
       if (msg.session_id === state.selectedSessionID && msg.data_b64) {
         if (state.pendingFirstOutputSessionID === msg.session_id) {
           term.write(b64ToBytes(msg.data_b64), () => {
@@ -773,6 +831,7 @@
     }
     state.pendingFirstOutputSessionID = sessionID;
     state.selectedSessionID = sessionID;
+    state.lastSeq = 0;
     currentSessionLabel.textContent = `Session: ${sessionID} (loading...)`;
     renderSessions();
     term.reset();
@@ -873,6 +932,7 @@
       state.adminTenantTokens = [];
       state.adminServers = [];
       state.adminSessions = [];
+      state.adminHosts = [];
       state.selectedAdminTokenID = "";
       if (adminTenantList) {
         adminTenantList.hidden = true;
@@ -1582,6 +1642,8 @@
       if (!adminTenantList.hidden) {
         listAdminTenantTokens(false);
       }
+    } else if (tabName === "hosts") {
+      fetchAdminHosts();
     }
   }
 
@@ -1595,6 +1657,20 @@
     renderAdminServers();
   }
 
+  // Enrolled hosts are the agent tokens issued by redeeming a join code.
+  async function fetchAdminHosts() {
+    const resp = await adminApi("/admin/tokens");
+    if (!resp.ok) {
+      return;
+    }
+    const body = await resp.json();
+    const tokens = Array.isArray(body.tokens) ? body.tokens : [];
+    const hosts = tokens.filter((rec) => rec.type === "agent" && rec.join_code_id);
+    hosts.sort((a, b) => Number(b.created_at_ms || 0) - Number(a.created_at_ms || 0));
+    state.adminHosts = hosts;
+    renderAdminHosts();
+  }
+
   async function fetchAdminSessions() {
     const resp = await adminApi("/admin/sessions");
     if (!resp.ok) {
@@ -1724,6 +1800,76 @@
     }
   }
 
+  function renderAdminHosts() {
+    const list = document.getElementById("adminHostsList");
+    if (!list) return;
+    list.innerHTML = "";
+    const query = (adminHostsSearch && adminHostsSearch.value || "").toLowerCase().trim();
+    const filtered = state.adminHosts.filter((rec) => {
+      if (!query) return true;
+      return (rec.pinned_server_id || "").toLowerCase().includes(query)
+        || (rec.tenant_id || "").toLowerCase().includes(query)
+        || (rec.token_id || "").toLowerCase().includes(query);
+    });
+    if (!filtered.length) {
+      renderEmptyItem(list, "No enrolled hosts");
+      return;
+    }
+    for (const rec of filtered) {
+      const li = document.createElement("li");
+      li.className = "admin-token-item";
+
+      const head = document.createElement("div");
+      head.className = "admin-token-head";
+      const id = document.createElement("strong");
+      id.textContent = rec.pinned_server_id || "(not registered)";
+      const status = document.createElement("span");
+      status.className = rec.revoked ? "badge badge-offline" : "badge badge-online";
+      status.textContent = rec.revoked ? "revoked" : "enrolled";
+      head.appendChild(id);
+      head.appendChild(status);
+
+      const fields = document.createElement("div");
+      fields.className = "admin-field-list";
+      fields.appendChild(makeAdminFieldRow("tenant", rec.tenant_id, { mono: true }));
+      fields.appendChild(makeAdminFieldRow("token_id", rec.token_id, { mono: true }));
+      fields.appendChild(makeAdminFieldRow("enrolled", formatTime(rec.created_at_ms)));
+      if (rec.last_used_at_ms) {
+        const from = rec.last_used_ip ? ` from ${rec.last_used_ip}` : "";
+        fields.appendChild(makeAdminFieldRow("last seen", `${formatTime(rec.last_used_at_ms)}${from}`));
+      }
+
+      li.appendChild(head);
+      li.appendChild(fields);
+
+      if (!rec.revoked && rec.token_id) {
+        const actions = document.createElement("div");
+        actions.className = "admin-token-actions";
+        const revokeBtn = document.createElement("button");
+        revokeBtn.type = "button";
+        revokeBtn.className = "btn-danger";
+        revokeBtn.textContent = "Revoke";
+        revokeBtn.addEventListener("click", () => revokeAdminHost(rec));
+        actions.appendChild(revokeBtn);
+        li.appendChild(actions);
+      }
+      list.appendChild(li);
+    }
+  }
+
+  async function revokeAdminHost(rec) {
+    const label = rec.pinned_server_id || rec.token_id.slice(0, 8);
+    if (!window.confirm(`Revoke enrolled host ${label}? Its agent will be disconnected.`)) return;
+    const resp = await adminApi(`/admin/tokens/${encodeURIComponent(rec.token_id)}/revoke`, {
+      method: "POST",
+    });
+    if (!resp.ok) {
+      alert(await resp.text());
+      return;
+    }
+    await fetchAdminHosts();
+  }
+
   function renderAdminSessions() {
     const list = document.getElementById("adminSessionsList");
     if (!list) return;
@@ -1815,6 +1961,17 @@
     return env;
   }
 
+  // parseArgs splits on whitespace; double quotes group words into one arg.
+  function parseArgs(input) {
+    const args = [];
+    const re = /"([^"]*)"|(\S+)/g;
+    let m;
+    while ((m = re.exec(input || "")) !== null) {
+      args.push(m[1] !== undefined ? m[1] : m[2]);
+    }
+    return args;
+  }
+
   function escapeHtml(str) {
     return String(str)
       .replaceAll("&", "&amp;")